@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/astaxie/beego"
+
+	"github.com/containerops/wharf/models"
+)
+
+const (
+	DEFAULT_PROVIDER = "local"
+)
+
+// Provider checks the username and password of users, and returns the user saved in the models. Providers with
+// external identities create or update the user at sign in.
+type Provider interface {
+	Name() string
+	Authenticate(username, password string) (*models.User, error)
+}
+
+type ProviderFactory interface {
+	Create(parameters map[string]string) (Provider, error)
+}
+
+var (
+	factories = map[string]ProviderFactory{}
+	Current   Provider
+)
+
+func Register(name string, factory ProviderFactory) {
+	if factory == nil {
+		panic("auth: register provider factory is nil")
+	}
+
+	if _, exist := factories[name]; exist == true {
+		panic(fmt.Sprintf("auth: register provider factory twice: %s", name))
+	}
+
+	factories[name] = factory
+}
+
+func Providers() []string {
+	names := []string{}
+
+	for name := range factories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func Create(name string, parameters map[string]string) (Provider, error) {
+	factory, exist := factories[name]
+	if exist == false {
+		return nil, fmt.Errorf("Unknown auth provider: %s", name)
+	}
+
+	return factory.Create(parameters)
+}
+
+// InitAuth creates the provider named by "auth::Provider" in bucket.conf.
+// The provider parameters are read from the config section with the same name as the provider.
+func InitAuth() {
+	name := beego.AppConfig.DefaultString("auth::Provider", DEFAULT_PROVIDER)
+
+	parameters, err := beego.AppConfig.GetSection(name)
+	if err != nil {
+		parameters = map[string]string{}
+	}
+
+	if Current, err = Create(name, parameters); err != nil {
+		println(err.Error())
+		panic(err)
+	}
+
+	//The web sign in with OpenID Connect is enabled with the issuer
+	if parameters, err := beego.AppConfig.GetSection("oidc"); err == nil && len(parameters["issuer"]) > 0 {
+		if OIDC, err = NewOIDCProvider(parameters); err != nil {
+			println(err.Error())
+			panic(err)
+		}
+	}
+}
+
+// Password checks the username and password with the provider, the local users are checked before the provider
+// is created.
+func Password(username, password string) (*models.User, error) {
+	if Current == nil {
+		return new(localProvider).Authenticate(username, password)
+	}
+
+	return Current.Authenticate(username, password)
+}
+
+// Authenticate checks the basic authorization with a robot account token, a personal access token or the password.
+// The access token is nil when signed in with the password. Users with two-factor authentication must use a token,
+// the password alone isn't enough for them.
+func Authenticate(username, password string) (*models.User, *models.AccessToken, error) {
+	if user, token, err := models.AuthenticateToken(username, password); err != nil {
+		return nil, nil, err
+	} else if token != nil {
+		return user, token, nil
+	}
+
+	user, err := Password(username, password)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if user.TOTPEnabled == true {
+		return nil, nil, fmt.Errorf("Two-factor authentication is enabled, sign in with a personal access token.")
+	}
+
+	return user, nil, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func remove(values []string, value string) []string {
+	result := []string{}
+
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
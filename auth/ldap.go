@@ -0,0 +1,428 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego"
+
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/utils"
+)
+
+const (
+	LDAP_PROVIDER = "ldap"
+
+	LDAP_DEFAULT_TIMEOUT = 10
+)
+
+func init() {
+	Register(LDAP_PROVIDER, &ldapProviderFactory{})
+}
+
+type ldapProviderFactory struct{}
+
+// Create reads the [ldap] section of bucket.conf: Address, TLS, InsecureSkipVerify, BindDN, BindPassword, BaseDN,
+// UserFilter, UsernameAttribute, EmailAttribute, FullnameAttribute, GroupAttribute, GroupBaseDN, GroupFilter,
+// GroupNameAttribute, Organization, Fallback and Timeout (seconds).
+func (f *ldapProviderFactory) Create(parameters map[string]string) (Provider, error) {
+	p := &LDAPProvider{
+		Address:            parameters["address"],
+		BindDN:             parameters["binddn"],
+		BindPassword:       parameters["bindpassword"],
+		BaseDN:             parameters["basedn"],
+		UserFilter:         parameters["userfilter"],
+		UsernameAttribute:  parameters["usernameattribute"],
+		EmailAttribute:     parameters["emailattribute"],
+		FullnameAttribute:  parameters["fullnameattribute"],
+		GroupAttribute:     parameters["groupattribute"],
+		GroupBaseDN:        parameters["groupbasedn"],
+		GroupFilter:        parameters["groupfilter"],
+		GroupNameAttribute: parameters["groupnameattribute"],
+		Organization:       parameters["organization"],
+		Fallback:           true,
+		Timeout:            LDAP_DEFAULT_TIMEOUT * time.Second,
+	}
+
+	if len(p.Address) == 0 || len(p.BaseDN) == 0 {
+		return nil, fmt.Errorf("LDAP provider Address and BaseDN are required")
+	}
+
+	secure, skip := false, false
+
+	for name, value := range map[string]*bool{"tls": &secure, "insecureskipverify": &skip, "fallback": &p.Fallback} {
+		if v, exist := parameters[name]; exist == true {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("LDAP provider %s is invalid: %s", name, v)
+			}
+			*value = b
+		}
+	}
+
+	if value, exist := parameters["timeout"]; exist == true {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("LDAP provider Timeout is invalid: %s", value)
+		}
+		p.Timeout = time.Duration(seconds) * time.Second
+	}
+
+	host, _, err := net.SplitHostPort(p.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Dial = func() (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: p.Timeout}
+
+		if secure == true {
+			return tls.DialWithDialer(dialer, "tcp", p.Address, &tls.Config{ServerName: host, InsecureSkipVerify: skip})
+		}
+
+		return dialer.Dial("tcp", p.Address)
+	}
+
+	p.defaults()
+
+	return p, nil
+}
+
+// LDAPProvider checks the password by binding with the DN of the user found by UserFilter, then creates or updates
+// the user. The groups of the user are read from GroupAttribute like "memberOf" of Active Directory, or searched
+// with GroupFilter under GroupBaseDN, and synced to the teams with the same names in Organization.
+type LDAPProvider struct {
+	Address            string
+	BindDN             string // Searches with the service account, or anonymously when empty
+	BindPassword       string
+	BaseDN             string
+	UserFilter         string // "%s" is the escaped username
+	UsernameAttribute  string
+	EmailAttribute     string
+	FullnameAttribute  string
+	GroupAttribute     string
+	GroupBaseDN        string
+	GroupFilter        string // "%s" is the escaped DN of the user
+	GroupNameAttribute string
+	Organization       string // Teams of the organization are synced with the groups when it isn't empty
+	Fallback           bool   // Users not in LDAP sign in with the local password
+	Timeout            time.Duration
+	Dial               func() (net.Conn, error)
+}
+
+func (p *LDAPProvider) defaults() {
+	if len(p.UserFilter) == 0 {
+		p.UserFilter = "(uid=%s)"
+	}
+
+	if len(p.UsernameAttribute) == 0 {
+		p.UsernameAttribute = "uid"
+	}
+
+	if len(p.EmailAttribute) == 0 {
+		p.EmailAttribute = "mail"
+	}
+
+	if len(p.FullnameAttribute) == 0 {
+		p.FullnameAttribute = "cn"
+	}
+
+	if len(p.GroupFilter) == 0 {
+		p.GroupFilter = "(member=%s)"
+	}
+
+	if len(p.GroupNameAttribute) == 0 {
+		p.GroupNameAttribute = "cn"
+	}
+}
+
+func (p *LDAPProvider) Name() string {
+	return LDAP_PROVIDER
+}
+
+func (p *LDAPProvider) Authenticate(username, password string) (*models.User, error) {
+	//A simple bind with an empty password is an anonymous bind which always succeeds
+	if len(username) == 0 || len(password) == 0 {
+		return nil, fmt.Errorf("User password error.")
+	}
+
+	entry, groups, err := p.lookup(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		if p.Fallback == true {
+			return new(localProvider).Authenticate(username, password)
+		}
+
+		return nil, fmt.Errorf("User is not exist: %s", username)
+	}
+
+	user, err := p.provision(username, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.Organization) > 0 {
+		if err := p.syncTeams(user, groups); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// lookup searches the user and binds with the password, the entry is nil when the user isn't in LDAP.
+func (p *LDAPProvider) lookup(username, password string) (*ldapEntry, []string, error) {
+	conn, err := p.Dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(p.Timeout))
+
+	c := newLDAPConn(conn)
+	defer c.Close()
+
+	if len(p.BindDN) > 0 {
+		if err := c.Bind(p.BindDN, p.BindPassword); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	attributes := []string{p.UsernameAttribute, p.EmailAttribute, p.FullnameAttribute}
+	if len(p.GroupAttribute) > 0 {
+		attributes = append(attributes, p.GroupAttribute)
+	}
+
+	filter := strings.Replace(p.UserFilter, "%s", ldapEscape(username), -1)
+
+	entries, err := c.Search(p.BaseDN, filter, attributes, int64(p.Timeout/time.Second))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, nil, nil
+	} else if len(entries) > 1 {
+		return nil, nil, fmt.Errorf("LDAP user is not unique: %s", username)
+	}
+
+	entry := entries[0]
+
+	if err := c.Bind(entry.DN, password); err != nil {
+		if e, ok := err.(*ldapError); ok == true && e.Code == ldapResultInvalidCredentials {
+			return nil, nil, fmt.Errorf("User password error.")
+		}
+
+		return nil, nil, err
+	}
+
+	groups := []string{}
+
+	if len(p.GroupAttribute) > 0 {
+		for _, dn := range entry.Attributes[strings.ToLower(p.GroupAttribute)] {
+			if name := ldapRDNValue(dn); len(name) > 0 {
+				groups = append(groups, name)
+			}
+		}
+	} else if len(p.GroupBaseDN) > 0 {
+		//Search groups with the service account, the user may not read them
+		if len(p.BindDN) > 0 {
+			if err := c.Bind(p.BindDN, p.BindPassword); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		filter := strings.Replace(p.GroupFilter, "%s", ldapEscape(entry.DN), -1)
+
+		entries, err := c.Search(p.GroupBaseDN, filter, []string{p.GroupNameAttribute}, int64(p.Timeout/time.Second))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, group := range entries {
+			if name := group.Get(p.GroupNameAttribute); len(name) > 0 {
+				groups = append(groups, name)
+			}
+		}
+	}
+
+	return entry, groups, nil
+}
+
+// provision creates the user at the first sign in and updates the email and fullname from LDAP.
+func (p *LDAPProvider) provision(username string, entry *ldapEntry) (*models.User, error) {
+	name := strings.ToLower(entry.Get(p.UsernameAttribute))
+	if len(name) == 0 {
+		name = strings.ToLower(username)
+	}
+
+	if regexp.MustCompile(`^([a-z0-9_]{4,30})$`).MatchString(name) == false {
+		return nil, fmt.Errorf("LDAP username can't be a namespace: %s", name)
+	}
+
+	user := new(models.User)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	has, _, err := user.Has(name)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := has == false
+
+	if has == false {
+		if exist, _, err := new(models.Organization).Has(name); err != nil {
+			return nil, err
+		} else if exist == true {
+			return nil, fmt.Errorf("Namespace is occupation already by organization: %s", name)
+		}
+
+		//The local password is random, LDAP users always sign in with the LDAP password
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+
+		hash, err := utils.HashPassword(hex.EncodeToString(random), 0)
+		if err != nil {
+			return nil, err
+		}
+
+		user.Id = string(utils.GeneralKey(name))
+		user.Username, user.Password, user.PasswordScheme = name, hash, models.PASSWORD_SCHEME_PBKDF2
+		user.Email = fmt.Sprintf("%s@%s", name, beego.AppConfig.String("docker::Endpoints"))
+		user.Gravatar = "/static/images/default-user-icon-profile.png"
+		user.Created = now
+	}
+
+	if email := entry.Get(p.EmailAttribute); len(email) > 0 && email != user.Email {
+		user.Email, changed = email, true
+	}
+
+	if fullname := entry.Get(p.FullnameAttribute); len(fullname) > 0 && fullname != user.Fullname {
+		user.Fullname, changed = fullname, true
+	}
+
+	if changed == true {
+		user.Updated = now
+
+		if err := user.Save(); err != nil {
+			return nil, err
+		}
+	}
+
+	if has == false {
+		user.Log(models.ACTION_SIGNUP, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, user.Id, []byte(entry.DN))
+	}
+
+	return user, nil
+}
+
+// syncTeams adds the user to the teams named as the groups in the organization, and removes the user from the other
+// teams of it. Teams of new groups are created with the read permission.
+func (p *LDAPProvider) syncTeams(user *models.User, groups []string) error {
+	org := new(models.Organization)
+	if has, _, err := org.Has(p.Organization); err != nil {
+		return err
+	} else if has == false {
+		return fmt.Errorf("LDAP organization is not exist: %s", p.Organization)
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	wanted, changed := map[string]bool{}, false
+
+	for _, name := range groups {
+		wanted[name] = true
+
+		team := new(models.Team)
+
+		if has, _, err := team.Has(org.Name, name); err != nil {
+			return err
+		} else if has == false {
+			team = &models.Team{
+				Id:           fmt.Sprintf("%s-%s", org.Name, name),
+				Name:         name,
+				Organization: org.Name,
+				Username:     org.Username,
+				Permission:   models.TEAM_PERMISSION_READ,
+				Users:        []string{},
+				Repositories: []string{},
+				Created:      now,
+			}
+
+			org.Teams, org.Updated = append(org.Teams, team.Id), now
+
+			if err := org.Save(); err != nil {
+				return err
+			}
+		}
+
+		if contains(team.Users, user.Username) == false {
+			team.Users, team.Updated = append(team.Users, user.Username), now
+
+			if err := team.Save(); err != nil {
+				return err
+			}
+		}
+
+		if contains(user.JoinTeams, team.Id) == false {
+			user.JoinTeams, changed = append(user.JoinTeams, team.Id), true
+		}
+	}
+
+	for _, team := range org.GetTeams() {
+		if wanted[team.Name] == true || contains(team.Users, user.Username) == false {
+			continue
+		}
+
+		team.Users, team.Updated = remove(team.Users, user.Username), now
+
+		if err := team.Save(); err != nil {
+			return err
+		}
+
+		user.JoinTeams, changed = remove(remove(user.JoinTeams, team.Id), team.Name), true
+	}
+
+	if len(groups) > 0 && contains(user.JoinOrganizations, org.Name) == false {
+		user.JoinOrganizations, changed = append(user.JoinOrganizations, org.Name), true
+	}
+
+	if changed == true {
+		user.Updated = now
+
+		return user.Save()
+	}
+
+	return nil
+}
+
+// ldapRDNValue returns the value of the first RDN, like "developers" of "cn=developers,ou=groups,dc=example,dc=org".
+func ldapRDNValue(dn string) string {
+	rdn := dn
+
+	for i := 0; i < len(dn); i++ {
+		if dn[i] == '\\' {
+			i++
+		} else if dn[i] == ',' {
+			rdn = dn[:i]
+			break
+		}
+	}
+
+	if i := strings.Index(rdn, "="); i > 0 {
+		return strings.Replace(strings.TrimSpace(rdn[i+1:]), "\\", "", -1)
+	}
+
+	return ""
+}
@@ -0,0 +1,460 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerops/wharf/models"
+)
+
+// fakeLDAP is a directory served over net.Pipe, it answers the binds and searches of ldapConn like a LDAP v3 server.
+type fakeLDAP struct {
+	sync.Mutex
+
+	entries   []*ldapEntry
+	passwords map[string]string // DN to the password
+	requests  []string          // "bind <dn>" and "search <base>" in the order received
+}
+
+func (f *fakeLDAP) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+
+	go f.serve(server)
+
+	return client, nil
+}
+
+func (f *fakeLDAP) Requests() []string {
+	f.Lock()
+	defer f.Unlock()
+
+	return append([]string{}, f.requests...)
+}
+
+func (f *fakeLDAP) record(request string) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.requests = append(f.requests, request)
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		message, err := berRead(reader)
+		if err != nil {
+			return
+		}
+
+		children, err := message.Children()
+		if err != nil || len(children) < 2 {
+			return
+		}
+
+		id, op := children[0].Int(), children[1]
+
+		fields, err := op.Children()
+		if err != nil && op.Tag != ldapUnbindRequest {
+			return
+		}
+
+		reply := func(op []byte) {
+			conn.Write(berConstructed(berSequence, berInt(berInteger, id), op))
+		}
+
+		switch op.Tag {
+		case ldapBindRequest:
+			dn, password := string(fields[1].Content), string(fields[2].Content)
+			f.record("bind " + dn)
+
+			//Clients skip the unsolicited notifications with the message id 0
+			conn.Write(berConstructed(berSequence, berInt(berInteger, 0), berConstructed(0x78, berInt(berEnumerated, 0), berString(berOctetString, ""), berString(berOctetString, "notice"))))
+
+			code, diagnostic := int64(ldapResultSuccess), ""
+			if expected, exist := f.passwords[dn]; exist == false || expected != password {
+				code, diagnostic = ldapResultInvalidCredentials, "invalid credentials"
+			}
+
+			reply(berConstructed(ldapBindResponse, berInt(berEnumerated, code), berString(berOctetString, ""), berString(berOctetString, diagnostic)))
+		case ldapSearchRequest:
+			base := string(fields[0].Content)
+			f.record("search " + base)
+
+			attributes, _ := fields[7].Children()
+
+			reply(berConstructed(ldapSearchReference, berString(berOctetString, "ldap://other.example.org/"+base)))
+
+			for _, entry := range f.entries {
+				if strings.HasSuffix(strings.ToLower(entry.DN), strings.ToLower(base)) == false || ldapMatch(fields[6], entry) == false {
+					continue
+				}
+
+				values := [][]byte{}
+				for _, attribute := range attributes {
+					name := string(attribute.Content)
+
+					set := [][]byte{}
+					for _, value := range entry.Attributes[strings.ToLower(name)] {
+						set = append(set, berString(berOctetString, value))
+					}
+
+					if len(set) > 0 {
+						values = append(values, berConstructed(berSequence, berString(berOctetString, name), berConstructed(berSet, set...)))
+					}
+				}
+
+				reply(berConstructed(ldapSearchEntry, berString(berOctetString, entry.DN), berConstructed(berSequence, values...)))
+			}
+
+			reply(berConstructed(ldapSearchDone, berInt(berEnumerated, ldapResultSuccess), berString(berOctetString, ""), berString(berOctetString, "")))
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+// ldapMatch evaluates the encoded filter with the entry, the values are compared ignoring case.
+func ldapMatch(filter *berValue, entry *ldapEntry) bool {
+	if filter.Tag == ldapFilterPresent {
+		return len(entry.Attributes[strings.ToLower(string(filter.Content))]) > 0
+	}
+
+	children, err := filter.Children()
+	if err != nil {
+		return false
+	}
+
+	switch filter.Tag {
+	case ldapFilterAnd, ldapFilterOr:
+		for _, child := range children {
+			if ldapMatch(child, entry) == (filter.Tag == ldapFilterOr) {
+				return filter.Tag == ldapFilterOr
+			}
+		}
+
+		return filter.Tag == ldapFilterAnd
+	case ldapFilterNot:
+		return ldapMatch(children[0], entry) == false
+	case ldapFilterEqual:
+		for _, value := range entry.Attributes[strings.ToLower(string(children[0].Content))] {
+			if strings.EqualFold(value, string(children[1].Content)) == true {
+				return true
+			}
+		}
+	case ldapFilterSubstrings:
+		substrings, _ := children[1].Children()
+
+		for _, value := range entry.Attributes[strings.ToLower(string(children[0].Content))] {
+			value, matched := strings.ToLower(value), true
+
+			for _, substring := range substrings {
+				part := strings.ToLower(string(substring.Content))
+
+				switch substring.Tag {
+				case 0x80:
+					matched = matched && strings.HasPrefix(value, part)
+				case 0x81:
+					matched = matched && strings.Contains(value, part)
+				case 0x82:
+					matched = matched && strings.HasSuffix(value, part)
+				}
+			}
+
+			if matched == true {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func newFakeLDAP() *fakeLDAP {
+	person := func(uid, cn string, groups ...string) *ldapEntry {
+		return &ldapEntry{
+			DN: fmt.Sprintf("uid=%s,ou=people,dc=example,dc=org", uid),
+			Attributes: map[string][]string{
+				"objectclass": {"person"},
+				"uid":         {uid},
+				"cn":          {cn},
+				"mail":        {uid + "@example.org"},
+				"memberof":    groups,
+			},
+		}
+	}
+
+	group := func(cn string, members ...string) *ldapEntry {
+		dns := []string{}
+		for _, member := range members {
+			dns = append(dns, fmt.Sprintf("uid=%s,ou=people,dc=example,dc=org", member))
+		}
+
+		return &ldapEntry{DN: fmt.Sprintf("cn=%s,ou=groups,dc=example,dc=org", cn), Attributes: map[string][]string{"objectclass": {"groupOfNames"}, "cn": {cn}, "member": dns}}
+	}
+
+	return &fakeLDAP{
+		entries: []*ldapEntry{
+			person("alice", "Alice Liddell", "cn=developers,ou=groups,dc=example,dc=org", "cn=ops,ou=groups,dc=example,dc=org"),
+			person("bobby", "Bobby Tables"),
+			person("twin", "Twin One"),
+			{DN: "uid=twin,ou=contractors,dc=example,dc=org", Attributes: map[string][]string{"objectclass": {"person"}, "uid": {"twin"}}},
+			group("developers", "alice"),
+			group("ops", "alice", "bobby"),
+		},
+		passwords: map[string]string{
+			"cn=admin,dc=example,dc=org":            "admin-secret",
+			"uid=alice,ou=people,dc=example,dc=org": "alice-secret",
+			"uid=bobby,ou=people,dc=example,dc=org": "bobby-secret",
+		},
+	}
+}
+
+func newLDAPProvider(t *testing.T, directory *fakeLDAP, parameters map[string]string) *LDAPProvider {
+	values := map[string]string{"address": "ldap.example.org:389", "basedn": "dc=example,dc=org", "binddn": "cn=admin,dc=example,dc=org", "bindpassword": "admin-secret", "fallback": "false"}
+	for name, value := range parameters {
+		values[name] = value
+	}
+
+	provider, err := Create(LDAP_PROVIDER, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := provider.(*LDAPProvider)
+	p.Dial = directory.Dial
+
+	return p
+}
+
+func TestLDAPConn(t *testing.T) {
+	directory := newFakeLDAP()
+
+	conn, _ := directory.Dial()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := newLDAPConn(conn)
+	defer c.Close()
+
+	if err := c.Bind("cn=admin,dc=example,dc=org", "wrong"); err == nil {
+		t.Errorf("bind with the wrong password succeeds")
+	} else if e, ok := err.(*ldapError); ok == false || e.Code != ldapResultInvalidCredentials {
+		t.Errorf("bind error is %v", err)
+	}
+
+	if err := c.Bind("cn=admin,dc=example,dc=org", "admin-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]string{
+		"(uid=alice)":                        {"uid=alice,ou=people,dc=example,dc=org"},
+		"(&(objectClass=person)(cn=*Tab*))":  {"uid=bobby,ou=people,dc=example,dc=org"},
+		"(|(uid=alice)(uid=bobby))":          {"uid=alice,ou=people,dc=example,dc=org", "uid=bobby,ou=people,dc=example,dc=org"},
+		"(&(objectClass=person)(!(uid=t*)))": {"uid=alice,ou=people,dc=example,dc=org", "uid=bobby,ou=people,dc=example,dc=org"},
+		"(uid=" + ldapEscape("*") + ")":      {},
+	}
+
+	for filter, expected := range tests {
+		entries, err := c.Search("ou=people,dc=example,dc=org", filter, []string{"uid", "mail"}, 5)
+		if err != nil {
+			t.Fatalf("search %s error: %s", filter, err.Error())
+		}
+
+		dns := []string{}
+		for _, entry := range entries {
+			dns = append(dns, entry.DN)
+		}
+
+		if fmt.Sprint(dns) != fmt.Sprint(expected) {
+			t.Errorf("search %s returns %v, want %v", filter, dns, expected)
+		}
+	}
+
+	entries, _ := c.Search("dc=example,dc=org", "(uid=alice)", []string{"UID", "mail"}, 5)
+	if len(entries) != 1 || entries[0].Get("uid") != "alice" || entries[0].Get("Mail") != "alice@example.org" || entries[0].Get("cn") != "" {
+		t.Errorf("attributes of alice are %+v", entries)
+	}
+
+	if _, err := c.Search("dc=example,dc=org", "(uid=alice", nil, 5); err == nil {
+		t.Errorf("search with an invalid filter succeeds")
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	defer setup(t)()
+
+	org := &models.Organization{Id: "org:acme", Name: "acme", Username: "owner", Teams: []string{"acme-legacy"}}
+	if err := org.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	//Members of the teams not in the groups are removed from them
+	legacy := &models.Team{Id: "acme-legacy", Name: "legacy", Organization: "acme", Permission: models.TEAM_PERMISSION_WRITE, Users: []string{"alice"}, Repositories: []string{}}
+	if err := legacy.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	directory := newFakeLDAP()
+	p := newLDAPProvider(t, directory, map[string]string{"groupbasedn": "ou=groups,dc=example,dc=org", "organization": "acme"})
+
+	//The empty password is refused before connecting, or it would be an anonymous bind
+	if _, err := p.Authenticate("alice", ""); err == nil || len(directory.Requests()) != 0 {
+		t.Errorf("authenticate with the empty password is %v, requests %v", err, directory.Requests())
+	}
+
+	for _, test := range []struct{ username, password, err string }{
+		{"alice", "wrong", "User password error."},
+		{"nobody", "secret", "User is not exist: nobody"},
+		{"*", "secret", "User is not exist: *"},
+		{"twin", "secret", "LDAP user is not unique: twin"},
+	} {
+		if _, err := p.Authenticate(test.username, test.password); err == nil || err.Error() != test.err {
+			t.Errorf("authenticate %s with %q error is %v, want %s", test.username, test.password, err, test.err)
+		}
+	}
+
+	directory.Lock()
+	directory.requests = nil
+	directory.Unlock()
+
+	user, err := p.Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"bind cn=admin,dc=example,dc=org",
+		"search dc=example,dc=org",
+		"bind uid=alice,ou=people,dc=example,dc=org",
+		"bind cn=admin,dc=example,dc=org",
+		"search ou=groups,dc=example,dc=org",
+	}
+
+	if fmt.Sprint(directory.Requests()) != fmt.Sprint(expected) {
+		t.Errorf("requests are %v, want %v", directory.Requests(), expected)
+	}
+
+	if user.Username != "alice" || user.Email != "alice@example.org" || user.Fullname != "Alice Liddell" {
+		t.Errorf("provisioned user is %+v", user)
+	}
+
+	if fmt.Sprint(user.JoinTeams) != "[acme-developers acme-ops]" || fmt.Sprint(user.JoinOrganizations) != "[acme]" {
+		t.Errorf("teams of alice are %v, organizations %v", user.JoinTeams, user.JoinOrganizations)
+	}
+
+	team := new(models.Team)
+	if has, _, _ := team.Has("acme", "developers"); has == false || team.Permission != models.TEAM_PERMISSION_READ || fmt.Sprint(team.Users) != "[alice]" {
+		t.Errorf("team of developers is %+v", team)
+	}
+
+	if has, _, _ := legacy.Has("acme", "legacy"); has == false || len(legacy.Users) != 0 {
+		t.Errorf("team of legacy is %+v", legacy)
+	}
+
+	//Leaving a group leaves the team at next sign in, the user is updated instead of created
+	directory.entries[5].Attributes["member"] = []string{"uid=bobby,ou=people,dc=example,dc=org"}
+
+	if user, err = p.Authenticate("alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(user.JoinTeams) != "[acme-developers]" {
+		t.Errorf("teams of alice are %v after leaving ops", user.JoinTeams)
+	}
+
+	if has, _, _ := team.Has("acme", "ops"); has == false || len(team.Users) != 0 {
+		t.Errorf("team of ops is %+v", team)
+	}
+
+	if users := new(models.User).All(); len(users) != 1 {
+		t.Errorf("users are %d", len(users))
+	}
+}
+
+func TestLDAPGroupAttribute(t *testing.T) {
+	defer setup(t)()
+
+	org := &models.Organization{Id: "org:acme", Name: "acme", Username: "owner"}
+	if err := org.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	directory := newFakeLDAP()
+	directory.passwords = map[string]string{"uid=alice,ou=people,dc=example,dc=org": "alice-secret"}
+
+	//Searches anonymously without the service account, groups are read from "memberOf"
+	p := newLDAPProvider(t, directory, map[string]string{"binddn": "", "groupattribute": "memberOf", "organization": "acme"})
+
+	user, err := p.Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(directory.Requests()) != "[search dc=example,dc=org bind uid=alice,ou=people,dc=example,dc=org]" {
+		t.Errorf("requests are %v", directory.Requests())
+	}
+
+	if fmt.Sprint(user.JoinTeams) != "[acme-developers acme-ops]" {
+		t.Errorf("teams of alice are %v", user.JoinTeams)
+	}
+}
+
+func TestLDAPFallback(t *testing.T) {
+	defer setup(t)()
+
+	local := &models.User{Id: "user:local", Username: "local", Password: "Passw0rd!Passw0rd", Email: "local@example.org"}
+	if err := local.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newLDAPProvider(t, newFakeLDAP(), map[string]string{"fallback": "true"})
+
+	if user, err := p.Authenticate("local", "Passw0rd!Passw0rd"); err != nil || user.Username != "local" {
+		t.Errorf("fallback to the local password is %v, %v", user, err)
+	}
+
+	if _, err := p.Authenticate("local", "wrong"); err == nil {
+		t.Errorf("fallback with the wrong password succeeds")
+	}
+
+	//Users in LDAP never sign in with the local password
+	alice := &models.User{Id: "user:alice", Username: "alice", Password: "Passw0rd!Passw0rd", Email: "alice@example.org"}
+	if err := alice.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Authenticate("alice", "Passw0rd!Passw0rd"); err == nil {
+		t.Errorf("user in LDAP signs in with the local password")
+	}
+}
+
+func TestLDAPProviderFactory(t *testing.T) {
+	for _, parameters := range []map[string]string{
+		{"basedn": "dc=example,dc=org"},
+		{"address": "ldap.example.org:389"},
+		{"address": "ldap.example.org", "basedn": "dc=example,dc=org"},
+		{"address": "ldap.example.org:389", "basedn": "dc=example,dc=org", "tls": "sometimes"},
+		{"address": "ldap.example.org:389", "basedn": "dc=example,dc=org", "timeout": "0"},
+	} {
+		if _, err := Create(LDAP_PROVIDER, parameters); err == nil {
+			t.Errorf("create with %v succeeds", parameters)
+		}
+	}
+
+	provider, err := Create(LDAP_PROVIDER, map[string]string{"address": "ldap.example.org:636", "basedn": "dc=example,dc=org", "tls": "true", "timeout": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := provider.(*LDAPProvider)
+	if p.Timeout != 3*time.Second || p.UserFilter != "(uid=%s)" || p.GroupFilter != "(member=%s)" || p.Fallback != true {
+		t.Errorf("provider is %+v", p)
+	}
+}
@@ -0,0 +1,535 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// The BER tags of the LDAP v3 messages in RFC 4511, only the operations used by the provider are here.
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	ldapBindRequest      = 0x60
+	ldapBindResponse     = 0x61
+	ldapUnbindRequest    = 0x42
+	ldapSearchRequest    = 0x63
+	ldapSearchEntry      = 0x64
+	ldapSearchDone       = 0x65
+	ldapSearchReference  = 0x73
+	ldapSimpleAuth       = 0x80
+	ldapFilterAnd        = 0xa0
+	ldapFilterOr         = 0xa1
+	ldapFilterNot        = 0xa2
+	ldapFilterEqual      = 0xa3
+	ldapFilterSubstrings = 0xa4
+	ldapFilterGreater    = 0xa5
+	ldapFilterLess       = 0xa6
+	ldapFilterPresent    = 0x87
+	ldapFilterApprox     = 0xa8
+
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+)
+
+type berValue struct {
+	Tag     byte
+	Content []byte
+}
+
+func berEncode(tag byte, content []byte) []byte {
+	length := len(content)
+
+	if length < 0x80 {
+		return append([]byte{tag, byte(length)}, content...)
+	}
+
+	size := []byte{}
+	for n := length; n > 0; n >>= 8 {
+		size = append([]byte{byte(n)}, size...)
+	}
+
+	return append(append([]byte{tag, 0x80 | byte(len(size))}, size...), content...)
+}
+
+func berInt(tag byte, value int64) []byte {
+	content := []byte{byte(value)}
+
+	for value >>= 8; value != 0 && value != -1; value >>= 8 {
+		content = append([]byte{byte(value)}, content...)
+	}
+
+	//Keep the sign bit right with the two's complement
+	if value == 0 && content[0]&0x80 != 0 {
+		content = append([]byte{0}, content...)
+	} else if value == -1 && content[0]&0x80 == 0 {
+		content = append([]byte{0xff}, content...)
+	}
+
+	return berEncode(tag, content)
+}
+
+func berString(tag byte, value string) []byte {
+	return berEncode(tag, []byte(value))
+}
+
+func berConstructed(tag byte, children ...[]byte) []byte {
+	content := []byte{}
+
+	for _, child := range children {
+		content = append(content, child...)
+	}
+
+	return berEncode(tag, content)
+}
+
+// berParse reads the first value in the data and returns the rest.
+func berParse(data []byte) (*berValue, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, fmt.Errorf("LDAP message is truncated")
+	}
+
+	tag, length, offset := data[0], int(data[1]), 2
+
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 4 || len(data) < 2+size {
+			return nil, nil, fmt.Errorf("LDAP message length is invalid")
+		}
+
+		length = 0
+		for _, b := range data[2 : 2+size] {
+			length = length<<8 | int(b)
+		}
+
+		offset += size
+	}
+
+	if length < 0 || len(data) < offset+length {
+		return nil, nil, fmt.Errorf("LDAP message is truncated")
+	}
+
+	return &berValue{Tag: tag, Content: data[offset : offset+length]}, data[offset+length:], nil
+}
+
+// berRead reads a whole value from the connection.
+func berRead(reader *bufio.Reader) (*berValue, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	length := int(header[1])
+
+	if length&0x80 != 0 {
+		size := make([]byte, length&0x7f)
+		if len(size) == 0 || len(size) > 4 {
+			return nil, fmt.Errorf("LDAP message length is invalid")
+		}
+
+		if _, err := io.ReadFull(reader, size); err != nil {
+			return nil, err
+		}
+
+		length = 0
+		for _, b := range size {
+			length = length<<8 | int(b)
+		}
+	}
+
+	if length < 0 || length > 64*1024*1024 {
+		return nil, fmt.Errorf("LDAP message is too large")
+	}
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(reader, content); err != nil {
+		return nil, err
+	}
+
+	return &berValue{Tag: header[0], Content: content}, nil
+}
+
+func (v *berValue) Children() ([]*berValue, error) {
+	children := []*berValue{}
+
+	for data := v.Content; len(data) > 0; {
+		child, rest, err := berParse(data)
+		if err != nil {
+			return nil, err
+		}
+
+		children = append(children, child)
+		data = rest
+	}
+
+	return children, nil
+}
+
+func (v *berValue) Int() int64 {
+	if len(v.Content) == 0 {
+		return 0
+	}
+
+	value := int64(int8(v.Content[0]))
+	for _, b := range v.Content[1:] {
+		value = value<<8 | int64(b)
+	}
+
+	return value
+}
+
+type ldapEntry struct {
+	DN         string
+	Attributes map[string][]string // The attribute names are lower case
+}
+
+func (e *ldapEntry) Get(name string) string {
+	if values := e.Attributes[strings.ToLower(name)]; len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// ldapConn is a synchronous LDAP v3 client, a request is sent after the response of the last one.
+type ldapConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	id     int64
+}
+
+func newLDAPConn(conn net.Conn) *ldapConn {
+	return &ldapConn{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *ldapConn) send(op []byte) (int64, error) {
+	c.id++
+
+	if _, err := c.conn.Write(berConstructed(berSequence, berInt(berInteger, c.id), op)); err != nil {
+		return 0, err
+	}
+
+	return c.id, nil
+}
+
+func (c *ldapConn) receive(id int64) (*berValue, error) {
+	for {
+		message, err := berRead(c.reader)
+		if err != nil {
+			return nil, err
+		}
+
+		children, err := message.Children()
+		if err != nil {
+			return nil, err
+		}
+
+		if message.Tag != berSequence || len(children) < 2 {
+			return nil, fmt.Errorf("LDAP message is invalid")
+		}
+
+		//Unsolicited notifications have the message id 0
+		if children[0].Int() == id {
+			return children[1], nil
+		}
+	}
+}
+
+// ldapResult returns the error of a LDAPResult.
+func ldapResult(op *berValue) error {
+	children, err := op.Children()
+	if err != nil {
+		return err
+	}
+
+	if len(children) < 3 {
+		return fmt.Errorf("LDAP result is invalid")
+	}
+
+	if code := children[0].Int(); code != ldapResultSuccess {
+		return &ldapError{Code: code, Message: string(children[2].Content)}
+	}
+
+	return nil
+}
+
+type ldapError struct {
+	Code    int64
+	Message string
+}
+
+func (e *ldapError) Error() string {
+	return fmt.Sprintf("LDAP error %d: %s", e.Code, e.Message)
+}
+
+// Bind authenticates the connection with the simple authentication.
+func (c *ldapConn) Bind(dn, password string) error {
+	id, err := c.send(berConstructed(ldapBindRequest, berInt(berInteger, 3), berString(berOctetString, dn), berString(ldapSimpleAuth, password)))
+	if err != nil {
+		return err
+	}
+
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+
+	if op.Tag != ldapBindResponse {
+		return fmt.Errorf("LDAP bind response is invalid")
+	}
+
+	return ldapResult(op)
+}
+
+// Search returns the entries under the base matching the filter in the whole subtree.
+func (c *ldapConn) Search(base, filter string, attributes []string, timeLimit int64) ([]*ldapEntry, error) {
+	encoded, err := ldapFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	names := [][]byte{}
+	for _, attribute := range attributes {
+		names = append(names, berString(berOctetString, attribute))
+	}
+
+	id, err := c.send(berConstructed(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, 2),
+		berInt(berEnumerated, 0),
+		berInt(berInteger, 0),
+		berInt(berInteger, timeLimit),
+		berEncode(berBoolean, []byte{0}),
+		encoded,
+		berConstructed(berSequence, names...)))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*ldapEntry{}
+
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op.Tag {
+		case ldapSearchEntry:
+			entry, err := ldapParseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+
+			entries = append(entries, entry)
+		case ldapSearchReference:
+			//Referrals to other servers aren't followed
+		case ldapSearchDone:
+			if err := ldapResult(op); err != nil {
+				return nil, err
+			}
+
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("LDAP search response is invalid")
+		}
+	}
+}
+
+func (c *ldapConn) Close() error {
+	c.send(berEncode(ldapUnbindRequest, []byte{}))
+
+	return c.conn.Close()
+}
+
+func ldapParseEntry(op *berValue) (*ldapEntry, error) {
+	children, err := op.Children()
+	if err != nil || len(children) < 2 {
+		return nil, fmt.Errorf("LDAP search entry is invalid")
+	}
+
+	entry := &ldapEntry{DN: string(children[0].Content), Attributes: map[string][]string{}}
+
+	attributes, err := children[1].Children()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attribute := range attributes {
+		parts, err := attribute.Children()
+		if err != nil || len(parts) < 2 {
+			return nil, fmt.Errorf("LDAP search entry attribute is invalid")
+		}
+
+		values, err := parts[1].Children()
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.ToLower(string(parts[0].Content))
+		for _, value := range values {
+			entry.Attributes[name] = append(entry.Attributes[name], string(value.Content))
+		}
+	}
+
+	return entry, nil
+}
+
+// ldapEscape escapes the value in a filter of RFC 4515.
+func ldapEscape(value string) string {
+	escaped := ""
+
+	for _, b := range []byte(value) {
+		switch b {
+		case '\\', '*', '(', ')', 0:
+			escaped += fmt.Sprintf("\\%02x", b)
+		default:
+			escaped += string(b)
+		}
+	}
+
+	return escaped
+}
+
+func ldapUnescape(value string) (string, error) {
+	if strings.Contains(value, "\\") == false {
+		return value, nil
+	}
+
+	result := []byte{}
+
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			result = append(result, value[i])
+			continue
+		}
+
+		if i+2 >= len(value) {
+			return "", fmt.Errorf("LDAP filter escape is invalid: %s", value)
+		}
+
+		b, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("LDAP filter escape is invalid: %s", value)
+		}
+
+		result = append(result, b...)
+		i += 2
+	}
+
+	return string(result), nil
+}
+
+// ldapFilter encodes the string filter of RFC 4515, like "(&(objectClass=person)(uid=somebody))".
+func ldapFilter(filter string) ([]byte, error) {
+	encoded, rest, err := ldapParseFilter(strings.TrimSpace(filter))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("LDAP filter is invalid: %s", filter)
+	}
+
+	return encoded, nil
+}
+
+func ldapParseFilter(filter string) ([]byte, string, error) {
+	if len(filter) < 3 || filter[0] != '(' {
+		return nil, "", fmt.Errorf("LDAP filter is invalid: %s", filter)
+	}
+
+	filter = filter[1:]
+
+	switch filter[0] {
+	case '&', '|', '!':
+		tag := map[byte]byte{'&': ldapFilterAnd, '|': ldapFilterOr, '!': ldapFilterNot}[filter[0]]
+		children := [][]byte{}
+
+		for filter = filter[1:]; len(filter) > 0 && filter[0] == '('; {
+			child, rest, err := ldapParseFilter(filter)
+			if err != nil {
+				return nil, "", err
+			}
+
+			children = append(children, child)
+			filter = rest
+		}
+
+		if len(filter) == 0 || filter[0] != ')' || len(children) == 0 || (tag == ldapFilterNot && len(children) != 1) {
+			return nil, "", fmt.Errorf("LDAP filter is invalid")
+		}
+
+		return berConstructed(tag, children...), filter[1:], nil
+	}
+
+	end := strings.Index(filter, ")")
+	if end < 0 {
+		return nil, "", fmt.Errorf("LDAP filter is invalid")
+	}
+
+	item, rest := filter[:end], filter[end+1:]
+
+	i := strings.Index(item, "=")
+	if i <= 0 {
+		return nil, "", fmt.Errorf("LDAP filter item is invalid: %s", item)
+	}
+
+	attribute, value, tag := item[:i], item[i+1:], byte(ldapFilterEqual)
+
+	switch attribute[len(attribute)-1] {
+	case '>':
+		attribute, tag = attribute[:len(attribute)-1], ldapFilterGreater
+	case '<':
+		attribute, tag = attribute[:len(attribute)-1], ldapFilterLess
+	case '~':
+		attribute, tag = attribute[:len(attribute)-1], ldapFilterApprox
+	}
+
+	if tag == ldapFilterEqual && value == "*" {
+		return berString(ldapFilterPresent, attribute), rest, nil
+	}
+
+	if tag == ldapFilterEqual && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		substrings := [][]byte{}
+
+		for k, part := range parts {
+			if len(part) == 0 {
+				continue
+			}
+
+			unescaped, err := ldapUnescape(part)
+			if err != nil {
+				return nil, "", err
+			}
+
+			//Initial, any and final substrings
+			choice := byte(0x81)
+			if k == 0 {
+				choice = 0x80
+			} else if k == len(parts)-1 {
+				choice = 0x82
+			}
+
+			substrings = append(substrings, berString(choice, unescaped))
+		}
+
+		return berConstructed(ldapFilterSubstrings, berString(berOctetString, attribute), berConstructed(berSequence, substrings...)), rest, nil
+	}
+
+	unescaped, err := ldapUnescape(value)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return berConstructed(tag, berString(berOctetString, attribute), berString(berOctetString, unescaped)), rest, nil
+}
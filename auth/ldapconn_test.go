@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestBerInt(t *testing.T) {
+	tests := map[int64]string{
+		0:      "020100",
+		1:      "020101",
+		127:    "02017f",
+		128:    "02020080",
+		256:    "02020100",
+		65535:  "020300ffff",
+		-1:     "0201ff",
+		-128:   "020180",
+		-129:   "0202ff7f",
+		-65536: "0203ff0000",
+	}
+
+	for value, expected := range tests {
+		encoded := berInt(berInteger, value)
+		if hex.EncodeToString(encoded) != expected {
+			t.Errorf("berInt(%d) = %x, want %s", value, encoded, expected)
+		}
+
+		decoded, rest, err := berParse(encoded)
+		if err != nil || len(rest) != 0 || decoded.Int() != value {
+			t.Errorf("berParse(%x) = %v, %x, %v", encoded, decoded, rest, err)
+		}
+	}
+}
+
+func TestBerLength(t *testing.T) {
+	tests := []struct {
+		length int
+		header string
+	}{
+		{0, "0400"},
+		{127, "047f"},
+		{128, "048180"},
+		{255, "0481ff"},
+		{256, "04820100"},
+		{70000, "0483011170"},
+	}
+
+	for _, test := range tests {
+		encoded := berEncode(berOctetString, bytes.Repeat([]byte{'a'}, test.length))
+
+		if header := hex.EncodeToString(encoded[:len(encoded)-test.length]); header != test.header {
+			t.Errorf("header of length %d is %s, want %s", test.length, header, test.header)
+		}
+
+		value, err := berRead(bufio.NewReader(bytes.NewReader(encoded)))
+		if err != nil || value.Tag != berOctetString || len(value.Content) != test.length {
+			t.Errorf("berRead of length %d is %v, %v", test.length, value, err)
+		}
+	}
+}
+
+func TestBerMessage(t *testing.T) {
+	//A simple bind of RFC 4511 with the message id 1
+	bind := berConstructed(berSequence, berInt(berInteger, 1), berConstructed(ldapBindRequest, berInt(berInteger, 3), berString(berOctetString, "cn=admin"), berString(ldapSimpleAuth, "secret")))
+
+	expected := "301a0201016015020103" + "0408" + hex.EncodeToString([]byte("cn=admin")) + "8006" + hex.EncodeToString([]byte("secret"))
+	if hex.EncodeToString(bind) != expected {
+		t.Fatalf("bind request is %x, want %s", bind, expected)
+	}
+
+	message, _, err := berParse(bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	children, err := message.Children()
+	if err != nil || len(children) != 2 || children[0].Int() != 1 || children[1].Tag != ldapBindRequest {
+		t.Fatalf("children of bind request are %v, %v", children, err)
+	}
+
+	fields, err := children[1].Children()
+	if err != nil || len(fields) != 3 || string(fields[1].Content) != "cn=admin" || string(fields[2].Content) != "secret" {
+		t.Errorf("fields of bind request are %v, %v", fields, err)
+	}
+}
+
+func TestBerInvalid(t *testing.T) {
+	for _, data := range []string{"", "04", "0405616263", "0485ffffffffff", "0480", "048401"} {
+		raw, _ := hex.DecodeString(data)
+
+		if _, _, err := berParse(raw); err == nil {
+			t.Errorf("berParse(%s) doesn't fail", data)
+		}
+
+		if _, err := berRead(bufio.NewReader(bytes.NewReader(raw))); err == nil {
+			t.Errorf("berRead(%s) doesn't fail", data)
+		}
+	}
+
+	//A message larger than 64MB is refused before reading it
+	if _, err := berRead(bufio.NewReader(bytes.NewReader([]byte{berSequence, 0x84, 0x7f, 0xff, 0xff, 0xff}))); err == nil || strings.Contains(err.Error(), "too large") == false {
+		t.Errorf("berRead of a huge length is %v", err)
+	}
+
+	//Children must be whole values
+	if _, err := (&berValue{Tag: berSequence, Content: []byte{berInteger, 0x02, 0x01}}).Children(); err == nil {
+		t.Errorf("truncated children don't fail")
+	}
+}
+
+func TestLDAPEscape(t *testing.T) {
+	tests := map[string]string{
+		"somebody":         "somebody",
+		"*":                "\\2a",
+		"admin)(uid=*":     "admin\\29\\28uid=\\2a",
+		"a\\b":             "a\\5cb",
+		"nul\x00":          "nul\\00",
+		"cn=Some Body,o=x": "cn=Some Body,o=x",
+	}
+
+	for value, expected := range tests {
+		escaped := ldapEscape(value)
+		if escaped != expected {
+			t.Errorf("ldapEscape(%q) = %q, want %q", value, escaped, expected)
+		}
+
+		if unescaped, err := ldapUnescape(escaped); err != nil || unescaped != value {
+			t.Errorf("ldapUnescape(%q) = %q, %v", escaped, unescaped, err)
+		}
+	}
+
+	for _, value := range []string{"\\", "a\\2", "\\zz"} {
+		if _, err := ldapUnescape(value); err == nil {
+			t.Errorf("ldapUnescape(%q) doesn't fail", value)
+		}
+	}
+}
+
+func TestLDAPFilter(t *testing.T) {
+	octets := func(value string) string {
+		return hex.EncodeToString(berString(berOctetString, value))
+	}
+
+	tests := map[string]string{
+		"(uid=somebody)":                 "a30f" + octets("uid") + octets("somebody"),
+		"(uid=\\2a)":                     "a308" + octets("uid") + octets("*"),
+		"(mail=*)":                       "8704" + hex.EncodeToString([]byte("mail")),
+		"(age>=21)":                      "a509" + octets("age") + octets("21"),
+		"(age<=21)":                      "a609" + octets("age") + octets("21"),
+		"(cn~=body)":                     "a80a" + octets("cn") + octets("body"),
+		"(cn=ab*cd*ef)":                  "a412" + octets("cn") + "300c" + "8002616281026364" + "82026566",
+		"(cn=*body)":                     "a40c" + octets("cn") + "3006" + "8204626f6479",
+		"(!(uid=a))":                     "a20a" + "a308" + octets("uid") + octets("a"),
+		" (|(a=b)(c=d)) ":                "a110" + "a306" + octets("a") + octets("b") + "a306" + octets("c") + octets("d"),
+		"(&(objectClass=person)(uid=a))": "a021" + "a315" + octets("objectClass") + octets("person") + "a308" + octets("uid") + octets("a"),
+	}
+
+	for filter, expected := range tests {
+		encoded, err := ldapFilter(filter)
+		if err != nil || hex.EncodeToString(encoded) != expected {
+			t.Errorf("ldapFilter(%q) = %x, %v, want %s", filter, encoded, err, expected)
+		}
+	}
+
+	for _, filter := range []string{"", "uid=a", "(uid=a", "(uid=a))", "(=a)", "(uid)", "(&)", "(!(a=b)(c=d))", "(uid=\\zz)", "(&(uid=a)"} {
+		if _, err := ldapFilter(filter); err == nil {
+			t.Errorf("ldapFilter(%q) doesn't fail", filter)
+		}
+	}
+}
+
+func TestLDAPRDNValue(t *testing.T) {
+	tests := map[string]string{
+		"cn=developers,ou=groups,dc=example,dc=org": "developers",
+		"cn=dev\\, ops,ou=groups":                   "dev, ops",
+		"cn = spaced ":                              "spaced",
+		"invalid":                                   "",
+	}
+
+	for dn, expected := range tests {
+		if value := ldapRDNValue(dn); value != expected {
+			t.Errorf("ldapRDNValue(%q) = %q, want %q", dn, value, expected)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"github.com/containerops/wharf/models"
+)
+
+const (
+	LOCAL_PROVIDER = "local"
+)
+
+func init() {
+	Register(LOCAL_PROVIDER, &localProviderFactory{})
+}
+
+type localProviderFactory struct{}
+
+func (f *localProviderFactory) Create(parameters map[string]string) (Provider, error) {
+	return &localProvider{}, nil
+}
+
+// localProvider checks the password hash saved in the user.
+type localProvider struct{}
+
+func (p *localProvider) Name() string {
+	return LOCAL_PROVIDER
+}
+
+func (p *localProvider) Authenticate(username, password string) (*models.User, error) {
+	user := new(models.User)
+
+	if err := user.Get(username, password); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,551 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/utils"
+)
+
+const (
+	OIDC_DEFAULT_SCOPES         = "openid profile email"
+	OIDC_DEFAULT_USERNAME_CLAIM = "preferred_username"
+	OIDC_CLOCK_SKEW             = 60
+)
+
+// OIDC is the OpenID Connect provider of the web sign in, it's nil when the [oidc] section isn't configured.
+var OIDC *OIDCProvider
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// OIDCClaims are the claims of the ID token used to sign in, the audience is a string or an array of strings.
+type OIDCClaims struct {
+	Issuer            string                 `json:"iss"`
+	Subject           string                 `json:"sub"`
+	Audience          interface{}            `json:"aud"`
+	AuthorizedParty   string                 `json:"azp"`
+	Expiration        int64                  `json:"exp"`
+	IssuedAt          int64                  `json:"iat"`
+	Nonce             string                 `json:"nonce"`
+	Email             string                 `json:"email"`
+	EmailVerified     bool                   `json:"email_verified"`
+	Name              string                 `json:"name"`
+	PreferredUsername string                 `json:"preferred_username"`
+	Picture           string                 `json:"picture"`
+	Raw               map[string]interface{} `json:"-"`
+}
+
+// OIDCProvider signs in users with the authorization code flow and PKCE, the ID token from the token endpoint is
+// verified with the keys of the issuer.
+type OIDCProvider struct {
+	Name          string
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string
+	Scopes        string
+	UsernameClaim string
+	Client        *http.Client
+
+	lock      sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+// NewOIDCProvider reads the [oidc] section of bucket.conf: Name, Issuer, ClientID, ClientSecret, RedirectURL, Scopes and
+// UsernameClaim.
+func NewOIDCProvider(parameters map[string]string) (*OIDCProvider, error) {
+	p := &OIDCProvider{
+		Name:          parameters["name"],
+		Issuer:        strings.TrimRight(parameters["issuer"], "/"),
+		ClientID:      parameters["clientid"],
+		ClientSecret:  parameters["clientsecret"],
+		RedirectURL:   parameters["redirecturl"],
+		Scopes:        parameters["scopes"],
+		UsernameClaim: parameters["usernameclaim"],
+		Client:        &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if len(p.Issuer) == 0 || len(p.ClientID) == 0 {
+		return nil, fmt.Errorf("OIDC Issuer and ClientID are required")
+	}
+
+	if _, err := url.Parse(p.Issuer); err != nil {
+		return nil, err
+	}
+
+	if len(p.Name) == 0 {
+		p.Name = "OpenID Connect"
+	}
+
+	if len(p.RedirectURL) == 0 {
+		p.RedirectURL = fmt.Sprintf("https://%s/auth/oidc/callback", beego.AppConfig.String("docker::Endpoints"))
+	}
+
+	if len(p.Scopes) == 0 {
+		p.Scopes = OIDC_DEFAULT_SCOPES
+	}
+
+	if len(p.UsernameClaim) == 0 {
+		p.UsernameClaim = OIDC_DEFAULT_USERNAME_CLAIM
+	}
+
+	return p, nil
+}
+
+// Discover reads the configuration of the issuer at the first call.
+func (p *OIDCProvider) Discover() (*oidcDiscovery, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	discovery := new(oidcDiscovery)
+	if err := p.getJSON(p.Issuer+"/.well-known/openid-configuration", discovery); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimRight(discovery.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("OIDC issuer mismatch: %s", discovery.Issuer)
+	}
+
+	if len(discovery.AuthorizationEndpoint) == 0 || len(discovery.TokenEndpoint) == 0 || len(discovery.JWKSURI) == 0 {
+		return nil, fmt.Errorf("OIDC discovery is incomplete")
+	}
+
+	p.discovery = discovery
+
+	return discovery, nil
+}
+
+// OIDCSecret returns a random value for the state, the nonce and the PKCE code verifier.
+func OIDCSecret() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	return oidcBase64(random), nil
+}
+
+// AuthCodeURL returns the URL of the issuer the browser is redirected to, the PKCE challenge is the S256 of the verifier.
+func (p *OIDCProvider) AuthCodeURL(state, nonce, verifier string) (string, error) {
+	discovery, err := p.Discover()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", p.Scopes)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", oidcBase64(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") == true {
+		separator = "&"
+	}
+
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems the authorization code with the verifier, and returns the claims of the verified ID token.
+func (p *OIDCProvider) Exchange(code, verifier, nonce string) (*OIDCClaims, error) {
+	discovery, err := p.Discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if len(p.ClientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("OIDC token response is invalid: %d", resp.StatusCode)
+	}
+
+	if resp.StatusCode != http.StatusOK || len(result.Error) > 0 {
+		return nil, fmt.Errorf("OIDC token error: %s %s", result.Error, result.Description)
+	}
+
+	if len(result.IDToken) == 0 {
+		return nil, fmt.Errorf("OIDC token response has no id_token")
+	}
+
+	return p.Verify(result.IDToken, nonce)
+}
+
+// Verify checks the signature, the issuer, the audience, the time and the nonce of the ID token.
+func (p *OIDCProvider) Verify(token, nonce string) (*OIDCClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("OIDC ID token format is invalid")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		Kid       string `json:"kid"`
+	}
+
+	if data, err := oidcDecode(parts[0]); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := oidcDecode(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Algorithm != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature) != nil {
+			return nil, fmt.Errorf("OIDC ID token signature is invalid")
+		}
+	case *ecdsa.PublicKey:
+		if header.Algorithm != "ES256" || len(signature) != 64 {
+			return nil, fmt.Errorf("OIDC ID token signature is invalid")
+		}
+
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if ecdsa.Verify(k, hash[:], r, s) == false {
+			return nil, fmt.Errorf("OIDC ID token signature is invalid")
+		}
+	default:
+		return nil, fmt.Errorf("OIDC ID token algorithm is unsupported: %s", header.Algorithm)
+	}
+
+	data, err := oidcDecode(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	claims := new(OIDCClaims)
+	if err := json.Unmarshal(data, claims); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &claims.Raw); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimRight(claims.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("OIDC ID token issuer is invalid")
+	}
+
+	audiences := []string{}
+
+	switch aud := claims.Audience.(type) {
+	case string:
+		audiences = append(audiences, aud)
+	case []interface{}:
+		for _, a := range aud {
+			audiences = append(audiences, fmt.Sprint(a))
+		}
+	}
+
+	//The authorized party must be the client when it's present, and tokens for several audiences must have it
+	if contains(audiences, p.ClientID) == false || (len(claims.AuthorizedParty) > 0 && claims.AuthorizedParty != p.ClientID) || (len(audiences) > 1 && len(claims.AuthorizedParty) == 0) {
+		return nil, fmt.Errorf("OIDC ID token audience is invalid")
+	}
+
+	now := time.Now().Unix()
+	if now > claims.Expiration+OIDC_CLOCK_SKEW || claims.IssuedAt > now+OIDC_CLOCK_SKEW {
+		return nil, fmt.Errorf("OIDC ID token is expired")
+	}
+
+	if len(claims.Subject) == 0 || claims.Nonce != nonce {
+		return nil, fmt.Errorf("OIDC ID token nonce is invalid")
+	}
+
+	return claims, nil
+}
+
+// key returns the public key of the issuer, the keys are reloaded once when the key id is unknown for key rotation.
+func (p *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	discovery, err := p.Discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for reload := p.keys == nil; ; reload = true {
+		if reload == true {
+			keys, err := p.loadKeys(discovery.JWKSURI)
+			if err != nil {
+				return nil, err
+			}
+
+			p.keys = keys
+		}
+
+		if key, exist := p.keys[kid]; exist == true {
+			return key, nil
+		}
+
+		//Issuers with a single key may not set the key id
+		if len(kid) == 0 && len(p.keys) == 1 {
+			for _, key := range p.keys {
+				return key, nil
+			}
+		}
+
+		if reload == true {
+			return nil, fmt.Errorf("OIDC signing key is unknown: %s", kid)
+		}
+	}
+}
+
+func (p *OIDCProvider) loadKeys(uri string) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []oidcKey `json:"keys"`
+	}
+
+	if err := p.getJSON(uri, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+
+	for _, k := range set.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+
+		switch k.Kty {
+		case "RSA":
+			n, err := oidcDecode(k.N)
+			if err != nil {
+				return nil, err
+			}
+
+			e, err := oidcDecode(k.E)
+			if err != nil {
+				return nil, err
+			}
+
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+
+			x, err := oidcDecode(k.X)
+			if err != nil {
+				return nil, err
+			}
+
+			y, err := oidcDecode(k.Y)
+			if err != nil {
+				return nil, err
+			}
+
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	return keys, nil
+}
+
+func (p *OIDCProvider) getJSON(uri string, v interface{}) error {
+	resp, err := p.Client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OIDC request %s error: %d", uri, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Provision returns the user linked with the issuer and the subject, the user is created at the first sign in. The
+// email, the fullname and the gravatar are updated from the claims at each sign in.
+func (p *OIDCProvider) Provision(claims *OIDCClaims) (*models.User, error) {
+	identity := fmt.Sprintf("%s|%s", p.Issuer, claims.Subject)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	user := new(models.User)
+
+	id, err := models.GetByGobalId("identity", identity)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(id) > 0 {
+		if err := user.GetById(string(id)); err != nil {
+			return nil, err
+		}
+	} else {
+		//The local part of the email is the username when the claim is empty
+		name := ""
+		if value, ok := claims.Raw[p.UsernameClaim].(string); ok == true && len(value) > 0 {
+			name = strings.ToLower(value)
+		} else if len(claims.Email) > 0 {
+			name = strings.ToLower(strings.Split(claims.Email, "@")[0])
+		}
+
+		name = regexp.MustCompile(`[^a-z0-9_]`).ReplaceAllString(name, "_")
+
+		if regexp.MustCompile(`^([a-z0-9_]{4,30})$`).MatchString(name) == false {
+			return nil, fmt.Errorf("OIDC username can't be a namespace: %s", name)
+		}
+
+		//An existing account isn't linked automatically, the claims of other issuers could take it over
+		if exist, _, err := new(models.User).Has(name); err != nil {
+			return nil, err
+		} else if exist == true {
+			return nil, fmt.Errorf("User already exist: %s", name)
+		}
+
+		if exist, _, err := new(models.Organization).Has(name); err != nil {
+			return nil, err
+		} else if exist == true {
+			return nil, fmt.Errorf("Namespace is occupation already by organization: %s", name)
+		}
+
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+
+		hash, err := utils.HashPassword(hex.EncodeToString(random), 0)
+		if err != nil {
+			return nil, err
+		}
+
+		user.Id = string(utils.GeneralKey(name))
+		user.Username, user.Password, user.PasswordScheme = name, hash, models.PASSWORD_SCHEME_PBKDF2
+		user.Email = fmt.Sprintf("%s@%s", name, beego.AppConfig.String("docker::Endpoints"))
+		user.Gravatar = "/static/images/default-user-icon-profile.png"
+		user.Created = now
+	}
+
+	if _, exist := claims.Raw["email_verified"]; len(claims.Email) > 0 && (claims.EmailVerified == true || exist == false) {
+		user.Email = claims.Email
+	}
+
+	if len(claims.Name) > 0 {
+		user.Fullname = claims.Name
+	}
+
+	if strings.HasPrefix(claims.Picture, "https://") == true || strings.HasPrefix(claims.Picture, "http://") == true {
+		user.Gravatar = claims.Picture
+	}
+
+	user.Updated = now
+
+	if err := user.Save(); err != nil {
+		return nil, err
+	}
+
+	if len(id) == 0 {
+		if _, err := models.LedisDB.HSet([]byte(models.GLOBAL_IDENTITY_INDEX), []byte(identity), []byte(user.Id)); err != nil {
+			return nil, err
+		}
+
+		user.Log(models.ACTION_SIGNUP, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, user.Id, []byte(identity))
+	}
+
+	return user, nil
+}
+
+func oidcBase64(data []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+}
+
+func oidcDecode(data string) ([]byte, error) {
+	if mod := len(data) % 4; mod != 0 {
+		data += strings.Repeat("=", 4-mod)
+	}
+
+	return base64.URLEncoding.DecodeString(data)
+}
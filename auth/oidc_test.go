@@ -0,0 +1,465 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerops/wharf/models"
+)
+
+// fakeIssuer is an OpenID Connect issuer with the discovery, the key set and the token endpoint.
+type fakeIssuer struct {
+	sync.Mutex
+
+	server    *httptest.Server
+	issuer    string // Issuer in the discovery, the URL of the server when empty
+	published []string
+	keys      map[string]crypto.Signer
+	fetches   int // Requests of the key set
+
+	code, verifier, secret string
+	idToken                string
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	f := &fakeIssuer{keys: map[string]crypto.Signer{}}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.keys["rsa"], f.keys["ec"] = rsaKey, ecKey
+	f.published = []string{"rsa", "ec"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", f.discovery)
+	mux.HandleFunc("/jwks", f.jwks)
+	mux.HandleFunc("/token", f.token)
+
+	f.server = httptest.NewServer(mux)
+
+	return f
+}
+
+func (f *fakeIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := f.server.URL
+	if len(f.issuer) > 0 {
+		issuer = f.issuer
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 issuer,
+		"authorization_endpoint": f.server.URL + "/authorize?tenant=wharf",
+		"token_endpoint":         f.server.URL + "/token",
+		"jwks_uri":               f.server.URL + "/jwks",
+	})
+}
+
+func (f *fakeIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.fetches++
+
+	keys := []map[string]string{{"kid": "encryption", "kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"}}
+
+	for _, kid := range f.published {
+		switch key := f.keys[kid].Public().(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{"kid": kid, "kty": "RSA", "alg": "RS256", "use": "sig", "n": oidcBase64(key.N.Bytes()), "e": oidcBase64(big.NewInt(int64(key.E)).Bytes())})
+		case *ecdsa.PublicKey:
+			keys = append(keys, map[string]string{"kid": kid, "kty": "EC", "alg": "ES256", "crv": "P-256", "x": oidcBase64(pad(key.X.Bytes())), "y": oidcBase64(pad(key.Y.Bytes()))})
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (f *fakeIssuer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	username, password, _ := r.BasicAuth()
+
+	if r.Method != "POST" || r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("code") != f.code || username != "wharf" || password != f.secret {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "code is invalid"})
+		return
+	}
+
+	//PKCE: the verifier must be the one of the challenge
+	if r.PostForm.Get("code_verifier") != f.verifier {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "code verifier is invalid"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": f.idToken})
+}
+
+// sign returns the ID token of the claims signed by the key, alg overrides the algorithm of the key in the header.
+func (f *fakeIssuer) sign(t *testing.T, kid, alg string, claims map[string]interface{}) string {
+	key := f.keys[kid]
+
+	if len(alg) == 0 {
+		alg = map[bool]string{true: "RS256", false: "ES256"}[strings.HasPrefix(kid, "rsa")]
+	}
+
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+
+	input := oidcBase64(header) + "." + oidcBase64(payload)
+	hash := sha256.Sum256([]byte(input))
+
+	var signature []byte
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(pad(r.Bytes()), pad(s.Bytes())...)
+	}
+
+	return input + "." + oidcBase64(signature)
+}
+
+// claims returns valid claims for the client "wharf" with the nonce, changed by the pairs of names and values.
+func (f *fakeIssuer) claims(changes ...interface{}) map[string]interface{} {
+	now := time.Now().Unix()
+
+	claims := map[string]interface{}{
+		"iss":                f.server.URL,
+		"sub":                "248289761001",
+		"aud":                "wharf",
+		"exp":                now + 300,
+		"iat":                now,
+		"nonce":              "n-0S6_WzA2Mj",
+		"email":              "jane@example.org",
+		"email_verified":     true,
+		"name":               "Jane Doe",
+		"preferred_username": "Jane.Doe",
+	}
+
+	for i := 0; i+1 < len(changes); i += 2 {
+		if changes[i+1] == nil {
+			delete(claims, changes[i].(string))
+		} else {
+			claims[changes[i].(string)] = changes[i+1]
+		}
+	}
+
+	return claims
+}
+
+// pad returns the big-endian integer in 32 bytes, the size of P-256 values.
+func pad(b []byte) []byte {
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+func newOIDCProvider(t *testing.T, issuer *fakeIssuer) *OIDCProvider {
+	p, err := NewOIDCProvider(map[string]string{"issuer": issuer.server.URL + "/", "clientid": "wharf", "clientsecret": issuer.secret, "redirecturl": "https://wharf.example.org/auth/oidc/callback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestOIDCDiscover(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.server.Close()
+
+	p := newOIDCProvider(t, issuer)
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+	location, err := p.AuthCodeURL("state", "nonce", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse(location)
+	query := u.Query()
+
+	//The S256 challenge of the verifier in RFC 7636 appendix B
+	for name, expected := range map[string]string{
+		"tenant":                "wharf",
+		"response_type":         "code",
+		"client_id":             "wharf",
+		"redirect_uri":          "https://wharf.example.org/auth/oidc/callback",
+		"scope":                 OIDC_DEFAULT_SCOPES,
+		"state":                 "state",
+		"nonce":                 "nonce",
+		"code_challenge":        "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		"code_challenge_method": "S256",
+	} {
+		if query.Get(name) != expected {
+			t.Errorf("%s of the authorization URL is %q, want %q", name, query.Get(name), expected)
+		}
+	}
+
+	if _, err := NewOIDCProvider(map[string]string{"issuer": issuer.server.URL}); err == nil {
+		t.Errorf("provider without the client id is created")
+	}
+
+	//The issuer of the discovery must be the configured issuer
+	issuer.issuer = "https://evil.example.org"
+
+	if _, err := newOIDCProvider(t, issuer).Discover(); err == nil || strings.Contains(err.Error(), "mismatch") == false {
+		t.Errorf("discovery of another issuer is %v", err)
+	}
+
+	issuer.server.Close()
+
+	if _, err := newOIDCProvider(t, issuer).Discover(); err == nil {
+		t.Errorf("discovery of a stopped issuer succeeds")
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.server.Close()
+
+	p := newOIDCProvider(t, issuer)
+	now := time.Now().Unix()
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	issuer.keys["rsa-unpublished"] = other
+
+	valid := issuer.sign(t, "rsa", "", issuer.claims())
+	parts := strings.Split(valid, ".")
+
+	tampered := parts[0] + "." + oidcBase64([]byte(strings.Replace(string(mustDecode(parts[1])), "248289761001", "000000000001", 1))) + "." + parts[2]
+	none := oidcBase64([]byte(`{"alg":"none","kid":"rsa"}`)) + "." + parts[1] + "."
+
+	tests := []struct {
+		name, token, err string
+	}{
+		{"RS256", valid, ""},
+		{"ES256", issuer.sign(t, "ec", "", issuer.claims()), ""},
+		{"audiences with azp", issuer.sign(t, "rsa", "", issuer.claims("aud", []string{"wharf", "other"}, "azp", "wharf")), ""},
+		{"audiences without azp", issuer.sign(t, "rsa", "", issuer.claims("aud", []string{"wharf", "other"})), "audience"},
+		{"azp of another client", issuer.sign(t, "rsa", "", issuer.claims("azp", "other")), "audience"},
+		{"another audience", issuer.sign(t, "rsa", "", issuer.claims("aud", "other")), "audience"},
+		{"no audience", issuer.sign(t, "rsa", "", issuer.claims("aud", nil)), "audience"},
+		{"another issuer", issuer.sign(t, "rsa", "", issuer.claims("iss", "https://evil.example.org")), "issuer"},
+		{"expired", issuer.sign(t, "rsa", "", issuer.claims("exp", now-OIDC_CLOCK_SKEW-10)), "expired"},
+		{"expired in skew", issuer.sign(t, "rsa", "", issuer.claims("exp", now-10)), ""},
+		{"issued in future", issuer.sign(t, "rsa", "", issuer.claims("iat", now+OIDC_CLOCK_SKEW+10)), "expired"},
+		{"another nonce", issuer.sign(t, "rsa", "", issuer.claims("nonce", "replayed")), "nonce"},
+		{"no nonce", issuer.sign(t, "rsa", "", issuer.claims("nonce", nil)), "nonce"},
+		{"no subject", issuer.sign(t, "rsa", "", issuer.claims("sub", nil)), "nonce"},
+		{"RS256 with EC key", issuer.sign(t, "ec", "RS256", issuer.claims()), "signature"},
+		{"ES256 with RSA key", issuer.sign(t, "rsa", "ES256", issuer.claims()), "signature"},
+		{"HS256", issuer.sign(t, "rsa", "HS256", issuer.claims()), "signature"},
+		{"none", none, "signature"},
+		{"tampered", tampered, "signature"},
+		{"unknown key", issuer.sign(t, "rsa-unpublished", "", issuer.claims()), "unknown"},
+		{"malformed", "header.payload", "format"},
+	}
+
+	for _, test := range tests {
+		claims, err := p.Verify(test.token, "n-0S6_WzA2Mj")
+
+		if len(test.err) == 0 && (err != nil || claims.Subject != "248289761001") {
+			t.Errorf("%s: verify error is %v", test.name, err)
+		} else if len(test.err) > 0 && (err == nil || strings.Contains(err.Error(), test.err) == false) {
+			t.Errorf("%s: verify error is %v, want %s", test.name, err, test.err)
+		}
+	}
+
+	//The key id could be omitted when the issuer has a single key
+	issuer.published = []string{"ec"}
+	p = newOIDCProvider(t, issuer)
+
+	header, _ := json.Marshal(map[string]string{"alg": "ES256"})
+	payload, _ := json.Marshal(issuer.claims())
+	input := oidcBase64(header) + "." + oidcBase64(payload)
+	hash := sha256.Sum256([]byte(input))
+	r, s, _ := ecdsa.Sign(rand.Reader, issuer.keys["ec"].(*ecdsa.PrivateKey), hash[:])
+
+	if _, err := p.Verify(input+"."+oidcBase64(append(pad(r.Bytes()), pad(s.Bytes())...)), "n-0S6_WzA2Mj"); err != nil {
+		t.Errorf("verify without the key id error is %v", err)
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.server.Close()
+
+	p := newOIDCProvider(t, issuer)
+
+	if _, err := p.Verify(issuer.sign(t, "rsa", "", issuer.claims()), "n-0S6_WzA2Mj"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Verify(issuer.sign(t, "ec", "", issuer.claims()), "n-0S6_WzA2Mj"); err != nil || issuer.fetches != 1 {
+		t.Fatalf("verify with the cached keys error is %v, fetches %d", err, issuer.fetches)
+	}
+
+	//The issuer rotates to a new key and stops publishing the old one
+	rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+	issuer.keys["rsa-2"] = rotated
+
+	issuer.Lock()
+	issuer.published = []string{"rsa-2"}
+	issuer.Unlock()
+
+	if _, err := p.Verify(issuer.sign(t, "rsa-2", "", issuer.claims()), "n-0S6_WzA2Mj"); err != nil || issuer.fetches != 2 {
+		t.Errorf("verify with the rotated key error is %v, fetches %d", err, issuer.fetches)
+	}
+
+	if _, err := p.Verify(issuer.sign(t, "rsa", "", issuer.claims()), "n-0S6_WzA2Mj"); err == nil {
+		t.Errorf("verify with the retired key succeeds")
+	}
+
+	if issuer.fetches != 3 {
+		t.Errorf("fetches of the key set are %d, the unknown key reloads once", issuer.fetches)
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.server.Close()
+
+	issuer.code, issuer.verifier, issuer.secret = "SplxlOBeZQQYbYS6WxSbIA", "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk", "s3cr3t"
+	issuer.idToken = issuer.sign(t, "ec", "", issuer.claims())
+
+	p := newOIDCProvider(t, issuer)
+
+	claims, err := p.Exchange(issuer.code, issuer.verifier, "n-0S6_WzA2Mj")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Subject != "248289761001" || claims.Email != "jane@example.org" || claims.Raw["preferred_username"] != "Jane.Doe" {
+		t.Errorf("claims are %+v", claims)
+	}
+
+	if _, err := p.Exchange(issuer.code, "another-verifier", "n-0S6_WzA2Mj"); err == nil || strings.Contains(err.Error(), "invalid_grant") == false {
+		t.Errorf("exchange with another verifier error is %v", err)
+	}
+
+	if _, err := p.Exchange("another-code", issuer.verifier, "n-0S6_WzA2Mj"); err == nil {
+		t.Errorf("exchange with another code succeeds")
+	}
+
+	if _, err := p.Exchange(issuer.code, issuer.verifier, "another-nonce"); err == nil {
+		t.Errorf("exchange with another nonce succeeds")
+	}
+
+	issuer.idToken = ""
+
+	if _, err := p.Exchange(issuer.code, issuer.verifier, "n-0S6_WzA2Mj"); err == nil || strings.Contains(err.Error(), "id_token") == false {
+		t.Errorf("exchange without the ID token error is %v", err)
+	}
+}
+
+func TestOIDCProvision(t *testing.T) {
+	defer setup(t)()
+
+	issuer := newFakeIssuer(t)
+	defer issuer.server.Close()
+
+	p := newOIDCProvider(t, issuer)
+
+	verify := func(claims map[string]interface{}) *OIDCClaims {
+		c, err := p.Verify(issuer.sign(t, "rsa", "", claims), "n-0S6_WzA2Mj")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return c
+	}
+
+	user, err := p.Provision(verify(issuer.claims("picture", "https://example.org/jane.png")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Username != "jane_doe" || user.Email != "jane@example.org" || user.Fullname != "Jane Doe" || user.Gravatar != "https://example.org/jane.png" {
+		t.Errorf("provisioned user is %+v", user)
+	}
+
+	//The same subject signs in to the linked user, and a changed username claim doesn't move it
+	again, err := p.Provision(verify(issuer.claims("preferred_username", "jane", "email", "doe@example.org", "name", "Jane Q. Doe")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.Id != user.Id || again.Username != "jane_doe" || again.Email != "doe@example.org" || again.Fullname != "Jane Q. Doe" {
+		t.Errorf("linked user is %+v", again)
+	}
+
+	//An unverified email isn't saved
+	again, _ = p.Provision(verify(issuer.claims("email", "attacker@example.org", "email_verified", false)))
+	if again.Email != "doe@example.org" {
+		t.Errorf("unverified email is saved: %s", again.Email)
+	}
+
+	//Another subject never takes over an existing user or organization
+	if _, err := p.Provision(verify(issuer.claims("sub", "other", "preferred_username", "jane_doe"))); err == nil || strings.Contains(err.Error(), "already exist") == false {
+		t.Errorf("provision of an existing username error is %v", err)
+	}
+
+	org := &models.Organization{Id: "org:acme", Name: "acme", Username: "jane_doe"}
+	org.Save()
+
+	if _, err := p.Provision(verify(issuer.claims("sub", "other", "preferred_username", "acme"))); err == nil || strings.Contains(err.Error(), "organization") == false {
+		t.Errorf("provision of an organization name error is %v", err)
+	}
+
+	//The local part of the email is the username without the claim
+	user, err = p.Provision(verify(issuer.claims("sub", "email-only", "preferred_username", nil, "email", "john.roe@example.org")))
+	if err != nil || user.Username != "john_roe" {
+		t.Errorf("provisioned user is %+v, %v", user, err)
+	}
+
+	if _, err := p.Provision(verify(issuer.claims("sub", "short", "preferred_username", "jo"))); err == nil {
+		t.Errorf("provision of a short username succeeds")
+	}
+
+	if users := new(models.User).All(); len(users) != 2 {
+		t.Errorf("users are %d", len(users))
+	}
+
+	if has, _, err := new(models.User).Has("jane_doe"); err != nil || has == false {
+		t.Errorf("jane_doe is not saved: %v", err)
+	}
+}
+
+func mustDecode(data string) []byte {
+	decoded, err := oidcDecode(data)
+	if err != nil {
+		panic(fmt.Sprintf("decode %s error: %s", data, err.Error()))
+	}
+
+	return decoded
+}
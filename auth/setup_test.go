@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/siddontang/ledisdb/config"
+	"github.com/siddontang/ledisdb/ledis"
+
+	"github.com/containerops/wharf/models"
+)
+
+// setup opens an empty database for the users and organizations the providers create.
+func setup(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "wharf-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.NewConfigDefault()
+	cfg.DataDir = filepath.Join(dir, "ledis")
+
+	l, err := ledis.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models.LedisDB, _ = l.Select(0)
+
+	return func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
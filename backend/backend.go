@@ -1 +1,98 @@
 package backend
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/astaxie/beego"
+)
+
+const (
+	DEFAULT_DRIVER = "local"
+)
+
+type FileInfo struct {
+	Path     string    `json:"path"`     //
+	Size     int64     `json:"size"`     //
+	Modified time.Time `json:"modified"` //
+	IsDir    bool      `json:"isdir"`    //
+}
+
+// Driver is the storage interface used by the registry API for image layers and blobs.
+// All path parameters are relative to the driver root, for example "images/<image id>/layer".
+type Driver interface {
+	Name() string
+	Reader(path string, offset int64) (io.ReadCloser, error)
+	Writer(path string) (FileWriter, error)
+	Stat(path string) (*FileInfo, error)
+	Delete(path string) error
+	List(path string) ([]string, error)
+	Move(source, dest string) error
+}
+
+// FileWriter writes a file of the driver, Close commits the file to the path and Cancel discards what's written, so
+// the file at the path is left as it was.
+type FileWriter interface {
+	io.WriteCloser
+	Cancel() error
+}
+
+type DriverFactory interface {
+	Create(parameters map[string]string) (Driver, error)
+}
+
+var (
+	factories = map[string]DriverFactory{}
+	Storage   Driver
+)
+
+func Register(name string, factory DriverFactory) {
+	if factory == nil {
+		panic("backend: register driver factory is nil")
+	}
+
+	if _, exist := factories[name]; exist == true {
+		panic(fmt.Sprintf("backend: register driver factory twice: %s", name))
+	}
+
+	factories[name] = factory
+}
+
+func Drivers() []string {
+	names := []string{}
+
+	for name := range factories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func Create(name string, parameters map[string]string) (Driver, error) {
+	factory, exist := factories[name]
+	if exist == false {
+		return nil, fmt.Errorf("Unknown backend driver: %s", name)
+	}
+
+	return factory.Create(parameters)
+}
+
+// InitBackend creates the storage driver named by "backend::Driver" in bucket.conf.
+// The driver parameters are read from the config section with the same name as the driver.
+func InitBackend() {
+	name := beego.AppConfig.DefaultString("backend::Driver", DEFAULT_DRIVER)
+
+	parameters, err := beego.AppConfig.GetSection(name)
+	if err != nil {
+		parameters = map[string]string{}
+	}
+
+	if Storage, err = Create(name, parameters); err != nil {
+		println(err.Error())
+		panic(err)
+	}
+}
@@ -0,0 +1,158 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/astaxie/beego"
+)
+
+const (
+	LOCAL_DRIVER = "local"
+)
+
+func init() {
+	Register(LOCAL_DRIVER, &localDriverFactory{})
+}
+
+type localDriverFactory struct{}
+
+func (f *localDriverFactory) Create(parameters map[string]string) (Driver, error) {
+	root := parameters["path"]
+
+	if len(root) == 0 {
+		root = beego.AppConfig.String("docker::BasePath")
+	}
+
+	if len(root) == 0 {
+		return nil, fmt.Errorf("Local backend path is empty")
+	}
+
+	return &LocalDriver{Root: filepath.Clean(root)}, nil
+}
+
+type LocalDriver struct {
+	Root string
+}
+
+func (d *LocalDriver) Name() string {
+	return LOCAL_DRIVER
+}
+
+// fullPath accepts both relative paths and the absolute paths saved in Image.Path before the backend existed.
+func (d *LocalDriver) fullPath(path string) string {
+	if strings.HasPrefix(path, d.Root+string(os.PathSeparator)) {
+		return filepath.Clean(path)
+	}
+
+	return filepath.Join(d.Root, filepath.Clean(string(os.PathSeparator)+path))
+}
+
+func (d *LocalDriver) Reader(path string, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(d.fullPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		if _, err := file.Seek(offset, os.SEEK_SET); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return file, nil
+}
+
+// Writer writes into a temporary file which replaces the target on Close, so readers never see a partial layer. Cancel
+// removes the temporary file.
+func (d *LocalDriver) Writer(path string) (FileWriter, error) {
+	target := d.fullPath(path)
+
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(target), fmt.Sprintf(".%s.", filepath.Base(target)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &localWriter{File: file, target: target}, nil
+}
+
+func (d *LocalDriver) Stat(path string) (*FileInfo, error) {
+	fi, err := os.Stat(d.fullPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileInfo{Path: path, Size: fi.Size(), Modified: fi.ModTime(), IsDir: fi.IsDir()}, nil
+}
+
+func (d *LocalDriver) Delete(path string) error {
+	return os.RemoveAll(d.fullPath(path))
+}
+
+// List returns the relative paths of all files under path.
+func (d *LocalDriver) List(path string) ([]string, error) {
+	result := []string{}
+
+	err := filepath.Walk(d.fullPath(path), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.Root, p)
+		if err != nil {
+			return err
+		}
+
+		result = append(result, filepath.ToSlash(rel))
+		return nil
+	})
+
+	if err != nil && os.IsNotExist(err) {
+		return result, nil
+	}
+
+	return result, err
+}
+
+func (d *LocalDriver) Move(source, dest string) error {
+	target := d.fullPath(dest)
+
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+
+	return os.Rename(d.fullPath(source), target)
+}
+
+type localWriter struct {
+	*os.File
+	target string
+}
+
+func (w *localWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+
+	return os.Rename(w.File.Name(), w.target)
+}
+
+func (w *localWriter) Cancel() error {
+	w.File.Close()
+
+	return os.Remove(w.File.Name())
+}
@@ -0,0 +1,53 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLocalWriterCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wharf-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &LocalDriver{Root: dir}
+
+	w, err := d.Writer("images/abc/layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("layer"))
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//The canceled writer leaves the existing file and no temporary file
+	w, err = d.Writer("images/abc/layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("partial"))
+
+	if err := w.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := d.Reader("images/abc/layer", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+
+	if string(data) != "layer" {
+		t.Errorf("layer is %q after the canceled write", data)
+	}
+
+	if files, _ := ioutil.ReadDir(dir + "/images/abc"); len(files) != 1 {
+		t.Errorf("%d files are left", len(files))
+	}
+}
@@ -0,0 +1,689 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	S3_DRIVER = "s3"
+
+	S3_DEFAULT_REGION = "us-east-1"
+	S3_MIN_CHUNK_SIZE = 5 << 20
+	S3_MAX_COPY_SIZE  = 5 << 30 // S3 rejects copying larger objects in one request
+	S3_EMPTY_PAYLOAD  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func init() {
+	Register(S3_DRIVER, &s3DriverFactory{})
+}
+
+type s3DriverFactory struct{}
+
+// Create reads the [s3] section of bucket.conf: Endpoint, Region, Bucket, Prefix, AccessKey,
+// SecretKey, PathStyle and ChunkSize (bytes of each multipart upload part, at least 5MB).
+func (f *s3DriverFactory) Create(parameters map[string]string) (Driver, error) {
+	d := &S3Driver{
+		Endpoint:  strings.TrimRight(parameters["endpoint"], "/"),
+		Region:    parameters["region"],
+		Bucket:    parameters["bucket"],
+		Prefix:    strings.Trim(parameters["prefix"], "/"),
+		AccessKey: parameters["accesskey"],
+		SecretKey: parameters["secretkey"],
+		PathStyle: true,
+		ChunkSize: S3_MIN_CHUNK_SIZE,
+		CopySize:  S3_MAX_COPY_SIZE,
+		Client:    http.DefaultClient,
+	}
+
+	if len(d.Bucket) == 0 {
+		return nil, fmt.Errorf("S3 backend bucket is empty")
+	}
+
+	if len(d.Region) == 0 {
+		d.Region = S3_DEFAULT_REGION
+	}
+
+	if len(d.Endpoint) == 0 {
+		d.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", d.Region)
+		d.PathStyle = false
+	}
+
+	if value, exist := parameters["pathstyle"]; exist == true {
+		pathStyle, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("S3 backend PathStyle is invalid: %s", value)
+		}
+		d.PathStyle = pathStyle
+	}
+
+	if value, exist := parameters["chunksize"]; exist == true {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < S3_MIN_CHUNK_SIZE {
+			return nil, fmt.Errorf("S3 backend ChunkSize should be at least %d", S3_MIN_CHUNK_SIZE)
+		}
+		d.ChunkSize = size
+	}
+
+	if _, err := url.Parse(d.Endpoint); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// S3Driver stores files as objects in a bucket of Amazon S3 or any S3 compatible service,
+// requests are signed with AWS signature version 4. Objects larger than CopySize are moved with
+// a multipart upload copying parts of CopySize bytes.
+type S3Driver struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+	ChunkSize int64
+	CopySize  int64
+	Client    *http.Client
+}
+
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("S3 error %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		Size         int64  `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3InitiateResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CopyResult struct {
+	ETag string `xml:"ETag"`
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+func (d *S3Driver) Name() string {
+	return S3_DRIVER
+}
+
+func (d *S3Driver) key(p string) string {
+	p = strings.TrimLeft(path.Clean("/"+p), "/")
+
+	if len(d.Prefix) == 0 {
+		return p
+	}
+
+	return d.Prefix + "/" + p
+}
+
+func (d *S3Driver) Reader(p string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := d.do("GET", d.key(p), nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Writer buffers ChunkSize bytes in memory, small files are uploaded with one PUT and larger
+// files with a multipart upload. Cancel aborts the multipart upload, nothing is put before Close otherwise.
+func (d *S3Driver) Writer(p string) (FileWriter, error) {
+	return &s3Writer{driver: d, key: d.key(p)}, nil
+}
+
+func (d *S3Driver) Stat(p string) (*FileInfo, error) {
+	resp, err := d.do("HEAD", d.key(p), nil, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+
+		size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+		modified, _ := time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+
+		return &FileInfo{Path: p, Size: size, Modified: modified}, nil
+	}
+
+	if e, ok := err.(*s3Error); !ok || e.StatusCode != http.StatusNotFound {
+		return nil, err
+	}
+
+	//S3 has no directory, a path is a directory when any object has it as prefix.
+	result, err := d.list(d.key(p)+"/", "", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Contents) == 0 {
+		return nil, fmt.Errorf("%s not found in S3 backend", p)
+	}
+
+	return &FileInfo{Path: p, IsDir: true}, nil
+}
+
+func (d *S3Driver) Delete(p string) error {
+	key := d.key(p)
+
+	files, err := d.listKeys(key + "/")
+	if err != nil {
+		return err
+	}
+
+	for _, k := range append(files, key) {
+		resp, err := d.do("DELETE", k, nil, nil, nil)
+		if err != nil {
+			if e, ok := err.(*s3Error); ok && e.StatusCode == http.StatusNotFound {
+				continue
+			}
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	return nil
+}
+
+func (d *S3Driver) List(p string) ([]string, error) {
+	prefix := d.key(p) + "/"
+	if p == "" || p == "/" {
+		prefix = ""
+		if len(d.Prefix) > 0 {
+			prefix = d.Prefix + "/"
+		}
+	}
+
+	keys, err := d.listKeys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, k := range keys {
+		if len(d.Prefix) > 0 {
+			k = strings.TrimPrefix(k, d.Prefix+"/")
+		}
+		result = append(result, k)
+	}
+
+	return result, nil
+}
+
+func (d *S3Driver) Move(source, dest string) error {
+	resp, err := d.do("HEAD", d.key(source), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+
+	if size > d.CopySize {
+		w := &s3Writer{driver: d, key: d.key(dest)}
+
+		for start := int64(0); start < size; start += d.CopySize {
+			end := start + d.CopySize - 1
+			if end >= size {
+				end = size - 1
+			}
+
+			if err := w.copyPart(d.key(source), start, end); err != nil {
+				w.abort()
+				return err
+			}
+		}
+
+		if err := w.Close(); err != nil {
+			return err
+		}
+	} else {
+		header := http.Header{}
+		header.Set("X-Amz-Copy-Source", d.copySource(d.key(source)))
+
+		resp, err := d.do("PUT", d.key(dest), nil, header, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := s3Result(resp, new(s3CopyResult)); err != nil {
+			return err
+		}
+	}
+
+	resp, err = d.do("DELETE", d.key(source), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (d *S3Driver) listKeys(prefix string) ([]string, error) {
+	keys := []string{}
+	token := ""
+
+	for {
+		result, err := d.list(prefix, token, 1000)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+
+		if result.IsTruncated == false || len(result.NextContinuationToken) == 0 {
+			break
+		}
+
+		token = result.NextContinuationToken
+	}
+
+	return keys, nil
+}
+
+func (d *S3Driver) list(prefix, token string, max int) (*s3ListResult, error) {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+	query.Set("max-keys", strconv.Itoa(max))
+	if len(token) > 0 {
+		query.Set("continuation-token", token)
+	}
+
+	resp, err := d.do("GET", "", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := new(s3ListResult)
+	if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (d *S3Driver) copySource(key string) string {
+	return "/" + d.Bucket + "/" + s3Escape(key, false)
+}
+
+func (d *S3Driver) url(key string, query url.Values) *url.URL {
+	u, _ := url.Parse(d.Endpoint)
+
+	if d.PathStyle {
+		u.Path = "/" + d.Bucket + "/" + key
+	} else {
+		u.Host = d.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+
+	return u
+}
+
+// do sends a signed request and turns every non 2xx response into *s3Error.
+func (d *S3Driver) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := d.url(key, query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawPath = u.RawPath
+	req.ContentLength = int64(len(body))
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	d.sign(req, u, body, time.Now().UTC())
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+
+		e := &s3Error{StatusCode: resp.StatusCode}
+		data, _ := ioutil.ReadAll(resp.Body)
+		xml.Unmarshal(data, e)
+
+		return nil, e
+	}
+
+	return resp, nil
+}
+
+func (d *S3Driver) sign(req *http.Request, u *url.URL, body []byte, now time.Time) {
+	payload := S3_EMPTY_PAYLOAD
+	if len(body) > 0 {
+		payload = hexSHA256(body)
+	}
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	headers := map[string]string{"host": u.Host}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") || k == "content-md5" || k == "content-type" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	names := []string{}
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, u.RawPath, u.RawQuery, canonicalHeaders, signedHeaders, payload}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, d.Region)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hexSHA256([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+d.SecretKey), date)
+	key = hmacSHA256(key, d.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", d.AccessKey, scope, signedHeaders, signature))
+}
+
+// s3Result decodes the response body into v and closes it, copy and complete multipart upload
+// may fail with status 200 and an error body.
+func s3Result(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	e := &s3Error{StatusCode: resp.StatusCode}
+	if xml.Unmarshal(body, e) == nil && len(e.Code) > 0 {
+		return e
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	return xml.Unmarshal(body, v)
+}
+
+func hexSHA256(data []byte) string {
+	h := sha256.New()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape is the URI encoding of signature version 4, only unreserved characters are kept.
+func s3Escape(s string, encodeSlash bool) string {
+	result := ""
+
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			result += string(b)
+		case b == '/' && encodeSlash == false:
+			result += "/"
+		default:
+			result += fmt.Sprintf("%%%02X", b)
+		}
+	}
+
+	return result
+}
+
+func s3Query(query url.Values) string {
+	keys := []string{}
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	params := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+type s3Writer struct {
+	driver   *S3Driver
+	key      string
+	buffer   bytes.Buffer
+	uploadId string
+	parts    []s3CompletePart
+	err      error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n, _ := w.buffer.Write(p)
+
+	for int64(w.buffer.Len()) >= w.driver.ChunkSize {
+		if w.err = w.flush(w.buffer.Next(int(w.driver.ChunkSize))); w.err != nil {
+			w.abort()
+			return 0, w.err
+		}
+	}
+
+	return n, nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	if len(w.uploadId) == 0 {
+		resp, err := w.driver.do("PUT", w.key, nil, nil, w.buffer.Bytes())
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		return nil
+	}
+
+	if w.buffer.Len() > 0 {
+		if err := w.flush(w.buffer.Bytes()); err != nil {
+			w.abort()
+			return err
+		}
+	}
+
+	data, err := xml.Marshal(s3CompleteUpload{Parts: w.parts})
+	if err != nil {
+		w.abort()
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("uploadId", w.uploadId)
+
+	resp, err := w.driver.do("POST", w.key, query, nil, data)
+	if err != nil {
+		w.abort()
+		return err
+	}
+
+	if err := s3Result(resp, &struct{}{}); err != nil {
+		w.abort()
+		return err
+	}
+
+	return nil
+}
+
+func (w *s3Writer) Cancel() error {
+	if w.err == nil {
+		w.err = fmt.Errorf("S3 writer is canceled")
+	}
+
+	w.buffer.Reset()
+	w.abort()
+
+	return nil
+}
+
+func (w *s3Writer) initiate() error {
+	if len(w.uploadId) > 0 {
+		return nil
+	}
+
+	query := url.Values{}
+	query.Set("uploads", "")
+
+	resp, err := w.driver.do("POST", w.key, query, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	result := new(s3InitiateResult)
+	if err := s3Result(resp, result); err != nil {
+		return err
+	}
+
+	w.uploadId = result.UploadId
+
+	return nil
+}
+
+// copyPart copies the bytes from start to end of the source object as the next part.
+func (w *s3Writer) copyPart(source string, start, end int64) error {
+	if err := w.initiate(); err != nil {
+		return err
+	}
+
+	number := len(w.parts) + 1
+
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(number))
+	query.Set("uploadId", w.uploadId)
+
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", w.driver.copySource(source))
+	header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := w.driver.do("PUT", w.key, query, header, nil)
+	if err != nil {
+		return err
+	}
+
+	result := new(s3CopyResult)
+	if err := s3Result(resp, result); err != nil {
+		return err
+	}
+
+	w.parts = append(w.parts, s3CompletePart{PartNumber: number, ETag: result.ETag})
+
+	return nil
+}
+
+func (w *s3Writer) flush(part []byte) error {
+	if err := w.initiate(); err != nil {
+		return err
+	}
+
+	number := len(w.parts) + 1
+
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(number))
+	query.Set("uploadId", w.uploadId)
+
+	resp, err := w.driver.do("PUT", w.key, query, nil, part)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	w.parts = append(w.parts, s3CompletePart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+	return nil
+}
+
+func (w *s3Writer) abort() {
+	if len(w.uploadId) == 0 {
+		return
+	}
+
+	query := url.Values{}
+	query.Set("uploadId", w.uploadId)
+
+	if resp, err := w.driver.do("DELETE", w.key, query, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+
+	w.uploadId = ""
+}
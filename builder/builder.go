@@ -0,0 +1,564 @@
+package builder
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+
+	"github.com/containerops/wharf/backend"
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/notifications"
+	"github.com/containerops/wharf/replication"
+)
+
+const (
+	DEFAULT_EXECUTOR = "docker"
+	DEFAULT_WORKERS  = 1
+	DEFAULT_TIMEOUT  = 3600 // Seconds of a build
+)
+
+// Executor builds the image of the Dockerfile in the context directory, the output of the build is written to the log.
+type Executor interface {
+	Name() string
+	Build(job *Job, log io.Writer) (*Image, error)
+}
+
+type ExecutorFactory interface {
+	Create(parameters map[string]string) (Executor, error)
+}
+
+// Job is a build prepared in the work directory.
+type Job struct {
+	Id         string        // Id of the build
+	Name       string        // Like "namespace/repository:tag"
+	Dockerfile string        // Path of the Dockerfile, it's out of the context
+	Context    string        // Directory of the context
+	Dir        string        // Work directory of the executor, removed after the build
+	Timeout    time.Duration //
+}
+
+// Image is built by the executor, the layers are gzipped tarballs in the work directory and the base layer is the
+// first.
+type Image struct {
+	Config []byte
+	Layers []string
+}
+
+var (
+	factories = map[string]ExecutorFactory{}
+	Current   Executor
+
+	Workers = DEFAULT_WORKERS
+	Timeout = DEFAULT_TIMEOUT * time.Second
+	WorkDir = os.TempDir()
+
+	once sync.Once
+)
+
+func Register(name string, factory ExecutorFactory) {
+	if factory == nil {
+		panic("builder: register executor factory is nil")
+	}
+
+	if _, exist := factories[name]; exist == true {
+		panic(fmt.Sprintf("builder: register executor factory twice: %s", name))
+	}
+
+	factories[name] = factory
+}
+
+func Executors() []string {
+	names := []string{}
+
+	for name := range factories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func Create(name string, parameters map[string]string) (Executor, error) {
+	factory, exist := factories[name]
+	if exist == false {
+		return nil, fmt.Errorf("Unknown build executor: %s", name)
+	}
+
+	return factory.Create(parameters)
+}
+
+// InitBuilder creates the executor named by "build::Executor" in bucket.conf, the [build] section has the parameters
+// of the executor too: Workers, Timeout (seconds) and WorkDir. Then it starts the workers building the queue.
+func InitBuilder() {
+	name := beego.AppConfig.DefaultString("build::Executor", DEFAULT_EXECUTOR)
+
+	parameters, err := beego.AppConfig.GetSection("build")
+	if err != nil {
+		parameters = map[string]string{}
+	}
+
+	if Current, err = Create(name, parameters); err != nil {
+		println(err.Error())
+		panic(err)
+	}
+
+	if value, err := strconv.Atoi(parameters["workers"]); err == nil && value > 0 {
+		Workers = value
+	}
+
+	if value, err := strconv.Atoi(parameters["timeout"]); err == nil && value > 0 {
+		Timeout = time.Duration(value) * time.Second
+	}
+
+	if len(parameters["workdir"]) > 0 {
+		WorkDir = parameters["workdir"]
+	}
+
+	once.Do(func() {
+		for i := 0; i < Workers; i++ {
+			go Run(time.Second)
+		}
+	})
+}
+
+// Submit saves the context tarball of the build when it isn't nil, and puts the build in the queue.
+func Submit(b *models.Build, context io.Reader) error {
+	if context != nil {
+		b.Context = fmt.Sprintf("builds/%s/context", strings.TrimPrefix(b.Id, "build:"))
+
+		writer, err := backend.Storage.Writer(b.Context)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(writer, context); err != nil {
+			writer.Cancel()
+			return err
+		}
+
+		if err := writer.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err := b.Schedule(); err != nil {
+		return err
+	}
+
+	//Builds of a new repository are linked when the image is pushed
+	repo := new(models.Repository)
+	if has, _, err := repo.Has(b.Namespace, b.Repository); err != nil || has == false {
+		return err
+	}
+
+	return repo.PutBuild(b.Namespace, b.Repository, b.Id)
+}
+
+// Run builds the queue one by one at the interval, the builds waiting before a restart are built too.
+func Run(interval time.Duration) {
+	for {
+		if Dispatch() == 0 {
+			time.Sleep(interval)
+		}
+	}
+}
+
+// Dispatch claims the oldest build in the queue and builds it, it returns how many builds were built.
+func Dispatch() int {
+	ids, err := models.DueBuilds(Workers)
+	if err != nil {
+		beego.Error(fmt.Sprintf("[build] read queue error: %s", err.Error()))
+		return 0
+	}
+
+	for _, id := range ids {
+		if claimed, err := models.ClaimBuild(id); err != nil || claimed == false {
+			continue
+		}
+
+		b := new(models.Build)
+		if has, err := b.Has(id); err != nil || has == false {
+			continue
+		}
+
+		if err := Execute(b); err != nil {
+			beego.Error(fmt.Sprintf("[build] %s %s/%s:%s error: %s", b.Id, b.Namespace, b.Repository, b.Tag, err.Error()))
+		}
+
+		return 1
+	}
+
+	return 0
+}
+
+// Execute prepares the context of the build, runs the executor and pushes the image to the tag. The error is saved
+// in the build too.
+func Execute(b *models.Build) error {
+	log := &logWriter{build: b}
+
+	b.Status, b.Executor = models.BUILD_STATUS_RUNNING, Current.Name()
+	b.Started = time.Now().UnixNano() / int64(time.Millisecond)
+	b.Updated = b.Started
+
+	if err := b.Save(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(log, "Building %s/%s:%s with the %s executor\n", b.Namespace, b.Repository, b.Tag, Current.Name())
+
+	digest, err := execute(b, log)
+
+	b.Digest, b.Updated = digest, time.Now().UnixNano()/int64(time.Millisecond)
+	b.Duration = b.Updated - b.Started
+
+	if err != nil {
+		fmt.Fprintf(log, "Build failed: %s\n", err.Error())
+		b.Status, b.Error = models.BUILD_STATUS_FAILED, err.Error()
+	} else {
+		fmt.Fprintf(log, "Pushed %s/%s:%s %s\n", b.Namespace, b.Repository, b.Tag, digest)
+		b.Status = models.BUILD_STATUS_SUCCEEDED
+	}
+
+	//The context tarball isn't needed after the build
+	if len(b.Context) > 0 {
+		backend.Storage.Delete(b.Context)
+	}
+
+	if e := b.Save(); e != nil {
+		return e
+	}
+
+	if has, _, e := new(models.Repository).Has(b.Namespace, b.Repository); e == nil && has == true {
+		if e := new(models.Repository).PutBuild(b.Namespace, b.Repository, b.Id); e != nil {
+			return e
+		}
+	}
+
+	return err
+}
+
+func execute(b *models.Build, log io.Writer) (string, error) {
+	dir, err := ioutil.TempDir(WorkDir, "wharf-build-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	job := &Job{
+		Id:         b.Id,
+		Name:       fmt.Sprintf("%s/%s:%s", b.Namespace, b.Repository, b.Tag),
+		Dockerfile: filepath.Join(dir, "Dockerfile"),
+		Context:    filepath.Join(dir, "context"),
+		Dir:        dir,
+		Timeout:    Timeout,
+	}
+
+	if err := prepare(b, job, log); err != nil {
+		return "", err
+	}
+
+	image, err := Current.Build(job, log)
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := Push(b.Namespace, b.Repository, b.Tag, image)
+	if err != nil {
+		return "", err
+	}
+
+	event := notifications.Event{
+		Action: models.WEBHOOK_EVENT_PUSH,
+		Target: notifications.Target{
+			MediaType: models.MEDIATYPE_MANIFEST_V2,
+			Digest:    digest,
+			Tag:       b.Tag,
+			URL:       fmt.Sprintf("https://%s/v2/%s/%s/manifests/%s", beego.AppConfig.String("docker::Endpoints"), b.Namespace, b.Repository, digest),
+		},
+		Request: notifications.Request{Id: b.Id, UserAgent: "Wharf-Builder"},
+		Actor:   notifications.Actor{Name: b.User},
+	}
+
+	if err := notifications.Notify(b.Namespace, b.Repository, event); err != nil {
+		beego.Error(fmt.Sprintf("[webhook] notify push %s/%s error: %s", b.Namespace, b.Repository, err.Error()))
+	}
+
+	if err := replication.Replicate(b.Namespace, b.Repository, b.Tag); err != nil {
+		beego.Error(fmt.Sprintf("[replication] enqueue %s/%s:%s error: %s", b.Namespace, b.Repository, b.Tag, err.Error()))
+	}
+
+	return digest, nil
+}
+
+// prepare clones the git repository or extracts the context tarball, then writes the Dockerfile of the build, of the
+// repository or of the context.
+func prepare(b *models.Build, job *Job, log io.Writer) error {
+	if err := os.MkdirAll(job.Context, 0755); err != nil {
+		return err
+	}
+
+	switch {
+	case len(b.Git) > 0:
+		commit, err := clone(b.Git, b.Ref, job, log)
+		if err != nil {
+			return err
+		}
+
+		b.Commit = commit
+	case len(b.Context) > 0:
+		reader, err := backend.Storage.Reader(b.Context, 0)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		if err := extract(reader, job.Context, log); err != nil {
+			return err
+		}
+	}
+
+	dockerfile := b.Dockerfile
+
+	if len(dockerfile) == 0 {
+		repo := new(models.Repository)
+		if has, _, err := repo.Has(b.Namespace, b.Repository); err == nil && has == true {
+			dockerfile = repo.Dockerfile
+		}
+	}
+
+	if len(dockerfile) == 0 {
+		data, err := ioutil.ReadFile(filepath.Join(job.Context, "Dockerfile"))
+		if err != nil {
+			return fmt.Errorf("Dockerfile not found in the build, the repository or the context")
+		}
+
+		dockerfile = string(data)
+	}
+
+	b.DockerfileDigest = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(dockerfile)))
+
+	return ioutil.WriteFile(job.Dockerfile, []byte(dockerfile), 0644)
+}
+
+// clone fetches the branch or tag of the git repository without the history, and returns the commit.
+func clone(url, ref string, job *Job, log io.Writer) (string, error) {
+	args := []string{"clone", "--depth", "1"}
+	if len(ref) > 0 {
+		args = append(args, "--branch", ref)
+	}
+	args = append(args, "--", url, job.Context)
+
+	fmt.Fprintf(log, "Cloning %s %s\n", url, ref)
+
+	cmd := exec.Command("git", args...)
+	cmd.Stdout, cmd.Stderr = log, log
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL=http:https:ssh:git", "GIT_SSH_COMMAND=ssh -o BatchMode=yes")
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Git clone error: %s", err.Error())
+	}
+
+	commit, err := exec.Command("git", "-C", job.Context, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", fmt.Errorf("Git rev-parse error: %s", err.Error())
+	}
+
+	return strings.TrimSpace(string(commit)), nil
+}
+
+// extract unpacks the tarball or the gzipped tarball to the directory. Entries out of the directory are refused, and
+// links are skipped so files aren't written out of it.
+func extract(reader io.Reader, dir string, log io.Writer) error {
+	buffered := bufio.NewReader(reader)
+
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+
+		reader = gz
+	} else {
+		reader = buffered
+	}
+
+	tr := tar.NewReader(reader)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Context tarball is invalid: %s", err.Error())
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) == true || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) == true {
+			return fmt.Errorf("Context tarball entry is out of the context: %s", header.Name)
+		}
+
+		target := filepath.Join(dir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode)&0755|0600)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(file, tr)
+			file.Close()
+
+			if err != nil {
+				return err
+			}
+		default:
+			fmt.Fprintf(log, "Skipped context entry %s\n", header.Name)
+		}
+	}
+}
+
+// Push saves the config and the layers of the image as blobs, then the schema2 manifest and the tag like pushed with
+// Docker Registry API V2. It returns the digest of the manifest.
+func Push(namespace, repository, tag string, image *Image) (string, error) {
+	config, err := putBlob(bytes.NewReader(image.Config))
+	if err != nil {
+		return "", err
+	}
+
+	config.MediaType = models.MEDIATYPE_IMAGE_CONFIG
+
+	manifest := struct {
+		SchemaVersion int                 `json:"schemaVersion"`
+		MediaType     string              `json:"mediaType"`
+		Config        models.Descriptor   `json:"config"`
+		Layers        []models.Descriptor `json:"layers"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     models.MEDIATYPE_MANIFEST_V2,
+		Config:        *config,
+		Layers:        []models.Descriptor{},
+	}
+
+	for _, path := range image.Layers {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+
+		layer, err := putBlob(file)
+		file.Close()
+
+		if err != nil {
+			return "", err
+		}
+
+		layer.MediaType = models.MEDIATYPE_LAYER
+		manifest.Layers = append(manifest.Layers, *layer)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "   ")
+	if err != nil {
+		return "", err
+	}
+
+	//The repository serves only the blobs linked to it
+	for _, descriptor := range append([]models.Descriptor{*config}, manifest.Layers...) {
+		if err := models.LinkBlob(namespace, repository, descriptor.Digest); err != nil {
+			return "", err
+		}
+	}
+
+	repo := new(models.Repository)
+	if err := repo.Put(namespace, repository, "", "Wharf-Builder", models.APIVERSION_V2); err != nil {
+		return "", err
+	}
+
+	m := new(models.Manifest)
+	if err := m.Put(namespace, repository, models.MEDIATYPE_MANIFEST_V2, data); err != nil {
+		return "", err
+	}
+
+	if err := repo.PutTagFromManifests(strings.TrimPrefix(config.Digest, "sha256:"), namespace, repository, tag, string(data), m.Digest); err != nil {
+		return "", err
+	}
+
+	return m.Digest, nil
+}
+
+// putBlob saves the blob at the path of the blobs uploaded with Docker Registry API V2, the blob is hashed first so
+// blobs saved already aren't written again.
+func putBlob(reader io.ReadSeeker) (*models.Descriptor, error) {
+	h := sha256.New()
+
+	size, err := io.Copy(h, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptor := &models.Descriptor{Size: size, Digest: fmt.Sprintf("sha256:%x", h.Sum(nil))}
+	path := fmt.Sprintf("uuid/%s/layer", strings.TrimPrefix(descriptor.Digest, "sha256:"))
+
+	if _, err := backend.Storage.Stat(path); err == nil {
+		return descriptor, nil
+	}
+
+	if _, err := reader.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	writer, err := backend.Storage.Writer(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(writer, reader); err != nil {
+		writer.Cancel()
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return descriptor, nil
+}
+
+// logWriter appends the output to the log of the build.
+type logWriter struct {
+	build *models.Build
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	if err := w.build.AppendLog(p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,344 @@
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/siddontang/ledisdb/config"
+	"github.com/siddontang/ledisdb/ledis"
+
+	"github.com/containerops/wharf/backend"
+	"github.com/containerops/wharf/models"
+)
+
+func setup(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "wharf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.NewConfigDefault()
+	cfg.DataDir = filepath.Join(dir, "ledis")
+
+	l, err := ledis.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models.LedisDB, _ = l.Select(0)
+	backend.Storage = &backend.LocalDriver{Root: filepath.Join(dir, "storage")}
+
+	current, workDir := Current, WorkDir
+	Current, WorkDir = &FakeExecutor{}, dir
+
+	return func() {
+		Current, WorkDir = current, workDir
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// tarball returns the tarball of the entries.
+func tarball(t *testing.T, compressed bool, entries ...*tar.Header) []byte {
+	buffer := new(bytes.Buffer)
+
+	var tw *tar.Writer
+	var gz *gzip.Writer
+
+	if compressed == true {
+		gz = gzip.NewWriter(buffer)
+		tw = tar.NewWriter(gz)
+	} else {
+		tw = tar.NewWriter(buffer)
+	}
+
+	for _, entry := range entries {
+		header := *entry
+
+		//The content of a file is in the link name of the entry
+		content := header.Linkname
+		if header.Typeflag == tar.TypeReg {
+			header.Linkname, header.Size, header.Mode = "", int64(len(content)), 0644
+		}
+
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			tw.Write([]byte(content))
+		}
+	}
+
+	tw.Close()
+	if gz != nil {
+		gz.Close()
+	}
+
+	return buffer.Bytes()
+}
+
+// file returns the entry of a file with the content.
+func file(name, content string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeReg, Linkname: content}
+}
+
+// build submits the build of the context and dispatches it.
+func build(t *testing.T, dockerfile string, context []byte) *models.Build {
+	b := new(models.Build)
+	if err := b.Create(models.BUILD_TRIGGER_API, "alice", "app", "v1", dockerfile, "", "", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Submit(b, bytes.NewReader(context)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backend.Storage.Stat(b.Context); err != nil {
+		t.Fatalf("context isn't saved: %v", err)
+	}
+
+	if count := Dispatch(); count != 1 {
+		t.Fatalf("dispatched %d builds, want 1", count)
+	}
+
+	if count := Dispatch(); count != 0 {
+		t.Errorf("dispatched %d builds after the queue is empty", count)
+	}
+
+	result := new(models.Build)
+	if has, err := result.Has(b.Id); err != nil || has == false {
+		t.Fatalf("build isn't saved: %v", err)
+	}
+
+	//The context tarball is removed after the build
+	if _, err := backend.Storage.Stat(b.Context); err == nil {
+		t.Errorf("context is left after the build")
+	}
+
+	return result
+}
+
+func buildLog(t *testing.T, b *models.Build) string {
+	log, _, err := b.Log(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return log
+}
+
+func TestBuild(t *testing.T) {
+	defer setup(t)()
+
+	context := tarball(t, true, &tar.Header{Name: "src/", Typeflag: tar.TypeDir, Mode: 0755}, file("src/main.go", "package main"), file("Dockerfile", "FROM scratch\nCOPY src /src\n"))
+
+	b := build(t, "", context)
+
+	if b.Status != models.BUILD_STATUS_SUCCEEDED || b.Executor != FAKE_EXECUTOR || len(b.Error) > 0 || len(b.DockerfileDigest) == 0 {
+		t.Fatalf("build is %+v: %s", b, buildLog(t, b))
+	}
+
+	for _, line := range []string{"Step 1/2 : FROM scratch", "Step 2/2 : COPY src /src", "Pushed alice/app:v1 " + b.Digest} {
+		if strings.Contains(buildLog(t, b), line) == false {
+			t.Errorf("log doesn't have %q: %s", line, buildLog(t, b))
+		}
+	}
+
+	tag := new(models.Tag)
+	if has, _, err := tag.Has("alice", "app", "v1"); err != nil || has == false || tag.Digest != b.Digest {
+		t.Fatalf("tag of the build is %+v: %v", tag, err)
+	}
+
+	manifest := new(models.Manifest)
+	if has, _, err := manifest.Has("alice", "app", b.Digest); err != nil || has == false || manifest.MediaType != models.MEDIATYPE_MANIFEST_V2 {
+		t.Fatalf("manifest of the build is %+v: %v", manifest, err)
+	}
+
+	blobs, err := manifest.Blobs()
+	if err != nil || len(blobs) != 2 {
+		t.Fatalf("blobs of the manifest are %v: %v", blobs, err)
+	}
+
+	for _, digest := range blobs {
+		if _, err := backend.Storage.Stat("uuid/" + strings.TrimPrefix(digest, "sha256:") + "/layer"); err != nil {
+			t.Errorf("blob %s isn't saved: %v", digest, err)
+		}
+	}
+
+	//The layer has the files of the context
+	reader, err := backend.Storage.Reader("uuid/"+strings.TrimPrefix(blobs[1], "sha256:")+"/layer", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for tr := tar.NewReader(gz); ; {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+
+	if strings.Join(names, ",") != "Dockerfile,src/,src/main.go" {
+		t.Errorf("layer has %v", names)
+	}
+
+	repo := new(models.Repository)
+	if has, _, err := repo.Has("alice", "app"); err != nil || has == false || len(repo.Builds) != 1 || repo.Builds[0] != b.Id {
+		t.Errorf("builds of the repository are %v: %v", repo.Builds, err)
+	}
+}
+
+func TestBuildFailure(t *testing.T) {
+	defer setup(t)()
+
+	tests := []struct {
+		name, dockerfile string
+		context          []byte
+		message          string
+	}{
+		{"failed command", "FROM scratch\nRUN false\n", tarball(t, false, file("hello.txt", "hello")), "returned a non-zero code"},
+		{"no FROM", "COPY . /\n", tarball(t, false, file("hello.txt", "hello")), "must start with a FROM"},
+		{"no Dockerfile", "", tarball(t, false, file("hello.txt", "hello")), "Dockerfile not found"},
+		{"out of the context", "FROM scratch\n", tarball(t, false, file("../evil", "evil")), "out of the context"},
+	}
+
+	for _, test := range tests {
+		b := build(t, test.dockerfile, test.context)
+
+		if b.Status != models.BUILD_STATUS_FAILED || strings.Contains(b.Error, test.message) == false || len(b.Digest) > 0 {
+			t.Errorf("%s: build is %+v", test.name, b)
+		}
+
+		if log := buildLog(t, b); strings.Contains(log, "Build failed: "+b.Error) == false {
+			t.Errorf("%s: log doesn't have the error: %s", test.name, log)
+		}
+
+		if has, _, _ := new(models.Tag).Has("alice", "app", "v1"); has == true {
+			t.Errorf("%s: failed build pushed the tag", test.name)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wharf-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		entries []*tar.Header
+		refused bool
+	}{
+		{"parent", []*tar.Header{file("../evil", "evil")}, true},
+		{"parent in the path", []*tar.Header{file("a/../../evil", "evil")}, true},
+		{"absolute", []*tar.Header{file("/tmp/evil", "evil")}, true},
+		{"parent directory", []*tar.Header{{Name: "..", Typeflag: tar.TypeDir, Mode: 0755}}, true},
+		{"inner parent", []*tar.Header{file("a/../b", "b")}, false},
+		{"symlink out of the context", []*tar.Header{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}}, false},
+		{"hard link", []*tar.Header{{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../evil"}}, false},
+	}
+
+	for _, test := range tests {
+		for _, compressed := range []bool{false, true} {
+			context := filepath.Join(dir, "context")
+			os.RemoveAll(dir)
+			os.MkdirAll(context, 0755)
+
+			log := new(bytes.Buffer)
+			err := extract(bytes.NewReader(tarball(t, compressed, test.entries...)), context, log)
+
+			if (err != nil) != test.refused {
+				t.Errorf("%s: error is %v", test.name, err)
+			}
+
+			//Nothing is written out of the context
+			if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+				t.Errorf("%s: files out of the context: %d", test.name, len(files))
+			}
+
+			//Links are skipped
+			if entry := test.entries[0]; entry.Typeflag == tar.TypeSymlink || entry.Typeflag == tar.TypeLink {
+				if _, err := os.Lstat(filepath.Join(context, entry.Name)); err == nil {
+					t.Errorf("%s: link is extracted", test.name)
+				}
+
+				if strings.Contains(log.String(), "Skipped context entry "+entry.Name) == false {
+					t.Errorf("%s: log is %q", test.name, log.String())
+				}
+			}
+		}
+	}
+
+	if err := extract(strings.NewReader("not a tarball at all, not a tarball at all, not a tarball at all"), dir, new(bytes.Buffer)); err == nil {
+		t.Errorf("invalid tarball is extracted")
+	}
+}
+
+func TestPush(t *testing.T) {
+	defer setup(t)()
+
+	dir, err := ioutil.TempDir("", "wharf-push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	layer := filepath.Join(dir, "layer.tar.gz")
+	if err := ioutil.WriteFile(layer, []byte("layer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	image := &Image{Config: []byte(`{"architecture":"amd64","os":"linux"}`), Layers: []string{layer}}
+
+	digest, err := Push("alice", "app", "latest", image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := new(models.Manifest)
+	if has, _, err := manifest.Has("alice", "app", digest); err != nil || has == false {
+		t.Fatalf("manifest isn't saved: %v", err)
+	}
+
+	var m struct {
+		Config models.Descriptor   `json:"config"`
+		Layers []models.Descriptor `json:"layers"`
+	}
+
+	if err := json.Unmarshal([]byte(manifest.Data), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Config.MediaType != models.MEDIATYPE_IMAGE_CONFIG || m.Config.Size != int64(len(image.Config)) || len(m.Layers) != 1 || m.Layers[0].MediaType != models.MEDIATYPE_LAYER || m.Layers[0].Size != 5 {
+		t.Errorf("manifest is %s", manifest.Data)
+	}
+
+	//Pushing the same image again gets the same digest
+	if again, err := Push("alice", "app", "stable", image); err != nil || again != digest {
+		t.Errorf("digest of the same image is %s: %v", again, err)
+	}
+
+	for _, tag := range []string{"latest", "stable"} {
+		if has, _, _ := new(models.Tag).Has("alice", "app", tag); has == false {
+			t.Errorf("tag %s isn't pushed", tag)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package builder
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DOCKER_EXECUTOR = "docker"
+)
+
+func init() {
+	Register(DOCKER_EXECUTOR, &dockerExecutorFactory{})
+}
+
+type dockerExecutorFactory struct{}
+
+// Create reads "DockerBinary" and "DockerHost" of the [build] section, the docker CLI in the PATH and the local daemon
+// are used when they are empty.
+func (f *dockerExecutorFactory) Create(parameters map[string]string) (Executor, error) {
+	e := &DockerExecutor{Binary: parameters["dockerbinary"], Host: parameters["dockerhost"]}
+
+	if len(e.Binary) == 0 {
+		e.Binary = "docker"
+	}
+
+	return e, nil
+}
+
+// DockerExecutor builds with the docker daemon and saves the image out of it, the image is removed from the daemon
+// after the build.
+type DockerExecutor struct {
+	Binary string
+	Host   string
+}
+
+func (e *DockerExecutor) Name() string {
+	return DOCKER_EXECUTOR
+}
+
+func (e *DockerExecutor) Build(job *Job, log io.Writer) (*Image, error) {
+	name := fmt.Sprintf("wharf-build-%s", strings.TrimPrefix(job.Id, "build:"))
+	deadline := time.Now().Add(job.Timeout)
+
+	if err := e.run(deadline, log, "build", "--force-rm", "-f", job.Dockerfile, "-t", name, job.Context); err != nil {
+		return nil, err
+	}
+	defer e.run(deadline.Add(time.Minute), ioutil.Discard, "rmi", "-f", name)
+
+	archive := filepath.Join(job.Dir, "image.tar")
+
+	if err := e.run(deadline, log, "save", "-o", archive, name); err != nil {
+		return nil, err
+	}
+
+	return e.load(archive, job.Dir)
+}
+
+// run runs the docker CLI, it's killed at the deadline.
+func (e *DockerExecutor) run(deadline time.Time, log io.Writer, args ...string) error {
+	if len(e.Host) > 0 {
+		args = append([]string{"-H", e.Host}, args...)
+	}
+
+	cmd := exec.Command(e.Binary, args...)
+	cmd.Stdout, cmd.Stderr = log, log
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	timer := time.AfterFunc(deadline.Sub(time.Now()), func() {
+		cmd.Process.Kill()
+	})
+	defer timer.Stop()
+
+	if err := cmd.Wait(); err != nil {
+		if time.Now().After(deadline) == true {
+			return fmt.Errorf("Build timeout")
+		}
+
+		return fmt.Errorf("Docker %s error: %s", args[0], err.Error())
+	}
+
+	return nil
+}
+
+// load reads the config and the layers in the archive of "docker save", the layers are gzipped in the directory.
+func (e *DockerExecutor) load(archive, dir string) (*Image, error) {
+	files := filepath.Join(dir, "image")
+
+	file, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := extract(file, files, ioutil.Discard); err != nil {
+		return nil, err
+	}
+
+	var manifests []struct {
+		Config string
+		Layers []string
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(files, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &manifests); err != nil || len(manifests) == 0 {
+		return nil, fmt.Errorf("Docker save manifest is invalid")
+	}
+
+	image := &Image{Layers: []string{}}
+
+	if image.Config, err = ioutil.ReadFile(filepath.Join(files, filepath.FromSlash(manifests[0].Config))); err != nil {
+		return nil, err
+	}
+
+	for i, layer := range manifests[0].Layers {
+		path := filepath.Join(dir, fmt.Sprintf("layer-%d.tar.gz", i))
+
+		if err := compress(filepath.Join(files, filepath.FromSlash(layer)), path); err != nil {
+			return nil, err
+		}
+
+		image.Layers = append(image.Layers, path)
+	}
+
+	return image, nil
+}
+
+// compress gzips the layer tarball, the layers saved by docker aren't compressed.
+func compress(source, dest string) error {
+	reader, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	//Newer docker saves the layers compressed already
+	header := make([]byte, 2)
+	if n, _ := io.ReadFull(reader, header); n == 2 && header[0] == 0x1f && header[1] == 0x8b {
+		reader.Close()
+		return os.Rename(source, dest)
+	}
+
+	if _, err := reader.Seek(0, 0); err != nil {
+		return err
+	}
+
+	writer, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	gz := gzip.NewWriter(writer)
+
+	if _, err := io.Copy(gz, reader); err != nil {
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
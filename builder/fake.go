@@ -0,0 +1,215 @@
+package builder
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	FAKE_EXECUTOR = "fake"
+)
+
+func init() {
+	Register(FAKE_EXECUTOR, &fakeExecutorFactory{})
+}
+
+type fakeExecutorFactory struct{}
+
+func (f *fakeExecutorFactory) Create(parameters map[string]string) (Executor, error) {
+	return &FakeExecutor{}, nil
+}
+
+// FakeExecutor builds without a docker daemon for tests: it logs the instructions of the Dockerfile and makes an image
+// with one layer of the context files. The Dockerfile must start with FROM, and "RUN false" fails the build.
+type FakeExecutor struct{}
+
+func (e *FakeExecutor) Name() string {
+	return FAKE_EXECUTOR
+}
+
+func (e *FakeExecutor) Build(job *Job, log io.Writer) (*Image, error) {
+	instructions, err := fakeInstructions(job.Dockerfile)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(instructions) == 0 || strings.HasPrefix(strings.ToUpper(instructions[0]), "FROM ") == false {
+		return nil, fmt.Errorf("Dockerfile must start with a FROM instruction")
+	}
+
+	type history struct {
+		Created    time.Time `json:"created"`
+		CreatedBy  string    `json:"created_by"`
+		EmptyLayer bool      `json:"empty_layer,omitempty"`
+	}
+
+	config := struct {
+		Architecture string    `json:"architecture"`
+		OS           string    `json:"os"`
+		Created      time.Time `json:"created"`
+		Config       struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+		History []history `json:"history"`
+		RootFS  struct {
+			Type    string   `json:"type"`
+			DiffIds []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}{Architecture: "amd64", OS: "linux", History: []history{}}
+
+	config.Config.Labels = map[string]string{"wharf.build": job.Id}
+
+	for i, instruction := range instructions {
+		fmt.Fprintf(log, "Step %d/%d : %s\n", i+1, len(instructions), instruction)
+
+		if strings.ToUpper(instruction) == "RUN FALSE" {
+			return nil, fmt.Errorf("The command '%s' returned a non-zero code: 1", instruction)
+		}
+
+		config.History = append(config.History, history{CreatedBy: instruction, EmptyLayer: true})
+	}
+
+	//The context files are the only layer, made by the last instruction
+	config.History[len(config.History)-1].EmptyLayer = false
+
+	layer := filepath.Join(job.Dir, "layer.tar.gz")
+
+	diffId, err := fakeLayer(job.Context, layer)
+	if err != nil {
+		return nil, err
+	}
+
+	config.RootFS.Type, config.RootFS.DiffIds = "layers", []string{diffId}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(log, "Successfully built %s\n", job.Name)
+
+	return &Image{Config: data, Layers: []string{layer}}, nil
+}
+
+// fakeInstructions returns the instructions of the Dockerfile without the comments and the empty lines, continued
+// lines are joined.
+func fakeInstructions(dockerfile string) ([]string, error) {
+	file, err := os.Open(dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	instructions, current := []string{}, ""
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(current) == 0 && (len(line) == 0 || strings.HasPrefix(line, "#") == true) {
+			continue
+		}
+
+		if strings.HasSuffix(line, "\\") == true {
+			current += strings.TrimSpace(strings.TrimSuffix(line, "\\")) + " "
+			continue
+		}
+
+		instructions = append(instructions, strings.TrimSpace(current+line))
+		current = ""
+	}
+
+	if len(strings.TrimSpace(current)) > 0 {
+		instructions = append(instructions, strings.TrimSpace(current))
+	}
+
+	return instructions, scanner.Err()
+}
+
+// fakeLayer gzips the tarball of the directory to the path, and returns the diff id of the tarball.
+func fakeLayer(dir, path string) (string, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	h := sha256.New()
+
+	if err := tarDirectory(dir, io.MultiWriter(gz, h)); err != nil {
+		return "", err
+	}
+
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), file.Close()
+}
+
+// tarDirectory writes the files in the directory to the tarball in the order of the names, the times are zero so
+// the same files get the same layer.
+func tarDirectory(dir string, writer io.Writer) error {
+	tw := tar.NewWriter(writer)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil || name == "." {
+			return err
+		}
+
+		if info.IsDir() == false && info.Mode().IsRegular() == false {
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		header.Name = filepath.ToSlash(name)
+		header.ModTime, header.AccessTime, header.ChangeTime = time.Unix(0, 0), time.Time{}, time.Time{}
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+
+		if info.IsDir() == true {
+			header.Name += "/"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if info.IsDir() == true {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(tw, file)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
@@ -0,0 +1,149 @@
+package builder
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+
+	"github.com/containerops/wharf/models"
+)
+
+const (
+	PROVIDER_GITHUB = "github"
+	PROVIDER_GITLAB = "gitlab"
+	PROVIDER_GITEA  = "gitea"
+)
+
+// GitPush is a branch or a tag pushed to a git repository, it's received from the webhook of the git provider.
+type GitPush struct {
+	Type   string   // "branch" or "tag"
+	Name   string   // Name of the branch or the tag
+	Commit string   //
+	URLs   []string // Clone and web URLs of the git repository
+}
+
+// pushPayload has the fields of the push events of GitHub, GitLab and Gitea, Gitea sends the same payload as GitHub.
+type pushPayload struct {
+	Ref         string         `json:"ref"`
+	After       string         `json:"after"`
+	CheckoutSHA string         `json:"checkout_sha"`
+	Deleted     bool           `json:"deleted"`
+	Repository  pushRepository `json:"repository"`
+	Project     pushRepository `json:"project"`
+}
+
+type pushRepository struct {
+	CloneURL   string `json:"clone_url"`
+	HTMLURL    string `json:"html_url"`
+	SSHURL     string `json:"ssh_url"`
+	GitHTTPURL string `json:"git_http_url"`
+	GitSSHURL  string `json:"git_ssh_url"`
+	WebURL     string `json:"web_url"`
+	Homepage   string `json:"homepage"`
+}
+
+// ParsePush returns the push of the webhook request of the provider, it's nil when the event isn't a push of a
+// branch or a tag, or deletes it.
+func ParsePush(provider string, header http.Header, body []byte) (*GitPush, error) {
+	switch provider {
+	case PROVIDER_GITHUB:
+		if header.Get("X-GitHub-Event") != "push" {
+			return nil, nil
+		}
+	case PROVIDER_GITLAB:
+		if event := header.Get("X-Gitlab-Event"); event != "Push Hook" && event != "Tag Push Hook" {
+			return nil, nil
+		}
+	case PROVIDER_GITEA:
+		//Gogs sends the same events as Gitea
+		if header.Get("X-Gitea-Event") != "push" && header.Get("X-Gogs-Event") != "push" {
+			return nil, nil
+		}
+	default:
+		return nil, fmt.Errorf("Unknown git provider: %s", provider)
+	}
+
+	var payload pushPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("Push payload is invalid: %s", err.Error())
+	}
+
+	push := &GitPush{Commit: payload.After, URLs: []string{}}
+
+	if len(payload.CheckoutSHA) > 0 {
+		push.Commit = payload.CheckoutSHA
+	}
+
+	//GitLab sends the zero commit when the branch or the tag is deleted
+	if payload.Deleted == true || len(strings.Trim(push.Commit, "0")) == 0 {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(payload.Ref, "refs/heads/") == true {
+		push.Type, push.Name = models.BUILD_RULE_BRANCH, strings.TrimPrefix(payload.Ref, "refs/heads/")
+	} else if strings.HasPrefix(payload.Ref, "refs/tags/") == true {
+		push.Type, push.Name = models.BUILD_RULE_TAG, strings.TrimPrefix(payload.Ref, "refs/tags/")
+	} else {
+		return nil, nil
+	}
+
+	for _, repo := range []pushRepository{payload.Repository, payload.Project} {
+		for _, u := range []string{repo.CloneURL, repo.HTMLURL, repo.SSHURL, repo.GitHTTPURL, repo.GitSSHURL, repo.WebURL, repo.Homepage} {
+			if len(u) > 0 {
+				push.URLs = append(push.URLs, u)
+			}
+		}
+	}
+
+	return push, nil
+}
+
+// VerifyPush checks the webhook request of the provider with the secret, GitHub and Gitea sign the body with HMAC
+// and GitLab sends the secret as the token.
+func VerifyPush(provider string, header http.Header, body []byte, secret string) bool {
+	if len(secret) == 0 {
+		return false
+	}
+
+	switch provider {
+	case PROVIDER_GITHUB:
+		if signature := header.Get("X-Hub-Signature-256"); len(signature) > 0 {
+			return verifySignature(sha256.New, secret, body, strings.TrimPrefix(signature, "sha256="))
+		}
+
+		if signature := header.Get("X-Hub-Signature"); len(signature) > 0 {
+			return verifySignature(sha1.New, secret, body, strings.TrimPrefix(signature, "sha1="))
+		}
+	case PROVIDER_GITLAB:
+		return subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), []byte(secret)) == 1
+	case PROVIDER_GITEA:
+		if signature := header.Get("X-Gitea-Signature"); len(signature) > 0 {
+			return verifySignature(sha256.New, secret, body, signature)
+		}
+
+		if signature := header.Get("X-Gogs-Signature"); len(signature) > 0 {
+			return verifySignature(sha256.New, secret, body, signature)
+		}
+	}
+
+	return false
+}
+
+func verifySignature(h func() hash.Hash, secret string, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
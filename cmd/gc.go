@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/containerops/wharf/backend"
+	"github.com/containerops/wharf/gc"
+	"github.com/containerops/wharf/models"
+)
+
+var CmdGC = cli.Command{
+	Name:        "gc",
+	Usage:       "Remove image layers not referenced by any tag and expired upload sessions",
+	Description: "Mark all layers reachable from tags through manifests and image ancestry, then sweep the others and the expired upload sessions from the backend storage. The database is locked by the web service, run it when the web service is stopped, or set the interval of the [gc] section to collect in the web service.",
+	Action:      runGC,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only report the layers and uploads would be removed",
+		},
+		cli.DurationFlag{
+			Name:  "grace",
+			Value: gc.DEFAULT_GRACE * time.Second,
+			Usage: "Keep layers and images created or updated in the grace period, default: 24h",
+		},
+		cli.DurationFlag{
+			Name:  "uploads",
+			Value: gc.DEFAULT_UPLOAD_EXPIRES * time.Second,
+			Usage: "Keep upload sessions updated in the period, default: 24h",
+		},
+	},
+}
+
+func runGC(c *cli.Context) {
+	models.InitDb()
+	backend.InitBackend()
+
+	dryRun := c.Bool("dry-run")
+
+	result, err := gc.Collect(c.Duration("grace"), c.Duration("uploads"), dryRun, func(format string, v ...interface{}) {
+		fmt.Printf(format+"\n", v...)
+	})
+
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if dryRun == true {
+		fmt.Printf("%d layers (%d bytes) and %d uploads would be removed\n", result.Layers, result.Bytes, result.Uploads)
+	} else {
+		fmt.Printf("%d layers (%d bytes) and %d uploads removed\n", result.Layers, result.Bytes, result.Uploads)
+	}
+}
@@ -9,7 +9,14 @@ import (
 	_ "github.com/astaxie/beego/session/ledis"
 	"github.com/codegangsta/cli"
 
+	"github.com/containerops/wharf/auth"
+	"github.com/containerops/wharf/backend"
+	"github.com/containerops/wharf/builder"
+	"github.com/containerops/wharf/gc"
 	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/notifications"
+	"github.com/containerops/wharf/proxy"
+	"github.com/containerops/wharf/replication"
 	_ "github.com/containerops/wharf/routers"
 )
 
@@ -50,6 +57,38 @@ func runWeb(c *cli.Context) {
 
 	models.InitDb()
 
+	if count, err := models.HashPlainPasswords(); err != nil {
+		beego.Error(fmt.Sprintf("Hash plain passwords error: %s", err.Error()))
+	} else if count > 0 {
+		beego.Info(fmt.Sprintf("%d plain passwords hashed", count))
+	}
+
+	if count, err := models.IndexTags(); err != nil {
+		beego.Error(fmt.Sprintf("Index tags error: %s", err.Error()))
+	} else if count > 0 {
+		beego.Info(fmt.Sprintf("%d tags moved to the index without the image id", count))
+	}
+
+	if count, err := models.IndexManifests(); err != nil {
+		beego.Error(fmt.Sprintf("Index manifests error: %s", err.Error()))
+	} else if count > 0 {
+		beego.Info(fmt.Sprintf("%d manifests indexed by repository", count))
+	}
+
+	if count, err := models.IndexBlobLinks(); err != nil {
+		beego.Error(fmt.Sprintf("Index blob links error: %s", err.Error()))
+	} else if count > 0 {
+		beego.Info(fmt.Sprintf("%d blob links indexed by repository", count))
+	}
+
+	backend.InitBackend()
+	auth.InitAuth()
+	notifications.InitNotifications()
+	proxy.InitProxy()
+	replication.InitReplication()
+	builder.InitBuilder()
+	gc.InitGC()
+
 	beego.StaticDir["/static"] = "external"
 
 	beego.SetStaticPath(beego.AppConfig.String("docker::StaticPath"), fmt.Sprintf("%s/images", beego.AppConfig.String("docker::BasePath")))
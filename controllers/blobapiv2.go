@@ -1,16 +1,19 @@
 package controllers
 
 import (
+	"crypto/sha256"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/astaxie/beego"
 
+	"github.com/containerops/wharf/backend"
+	"github.com/containerops/wharf/filters"
 	"github.com/containerops/wharf/models"
 	"github.com/containerops/wharf/modules"
+	"github.com/containerops/wharf/proxy"
 	"github.com/containerops/wharf/utils"
 )
 
@@ -21,8 +24,12 @@ type BlobAPIV2Controller struct {
 func (this *BlobAPIV2Controller) URLMapping() {
 	this.Mapping("HeadDigest", this.HeadDigest)
 	this.Mapping("PostBlobs", this.PostBlobs)
+	this.Mapping("PatchBlobs", this.PatchBlobs)
+	this.Mapping("GetUploadStatus", this.GetUploadStatus)
+	this.Mapping("DeleteUpload", this.DeleteUpload)
 	this.Mapping("PutBlobs", this.PutBlobs)
 	this.Mapping("GetBlobs", this.GetBlobs)
+	this.Mapping("DeleteBlobs", this.DeleteBlobs)
 }
 
 func (this *BlobAPIV2Controller) JSONOut(code int, message string, data interface{}) {
@@ -43,85 +50,354 @@ func (this *BlobAPIV2Controller) Prepare() {
 }
 
 func (this *BlobAPIV2Controller) HeadDigest() {
-	image := new(models.Image)
-	digest := strings.Split(this.Ctx.Input.Param(":digest"), ":")[1]
+	this.serveBlob()
+}
 
-	if has, _, _ := image.HasTarsum(digest); has == false {
-		this.JSONOut(http.StatusNotFound, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnauthorized]}})
+func (this *BlobAPIV2Controller) PostBlobs() {
+	//Mounting links a blob of the source repository the user may pull, the upload session starts as usual when the
+	//blob isn't linked to the source repository.
+	if mount, from := this.Ctx.Input.Query("mount"), this.Ctx.Input.Query("from"); utils.IsDigest(mount) == true && len(from) > 0 {
+		if source := strings.SplitN(from, "/", 2); len(source) == 2 && filters.ReadAllowed(this.Ctx, source[0], source[1]) == true && models.BlobLinked(source[0], source[1], mount) == true {
+			if _, err := backend.Storage.Stat(fmt.Sprintf("uuid/%s/layer", strings.TrimPrefix(mount, "sha256:"))); err == nil {
+				if err := models.LinkBlob(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat"), mount); err != nil {
+					this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnknown]}})
+					return
+				}
+
+				this.Ctx.Output.Context.ResponseWriter.Header().Set("Location", fmt.Sprintf("https://%s/v2/%s/%s/blobs/%s", beego.AppConfig.String("docker::Endpoints"), this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat"), mount))
+				this.Ctx.Output.Context.ResponseWriter.Header().Set("Docker-Content-Digest", mount)
+				this.Ctx.Output.Context.Output.SetStatus(http.StatusCreated)
+				this.Ctx.Output.Context.Output.Body([]byte(""))
+				return
+			}
+		}
+	}
+
+	upload := new(models.Upload)
+
+	if err := upload.Start(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")); err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeBlobUploadUnknown]}})
 		return
 	}
 
-	this.Ctx.Output.Context.Output.SetStatus(http.StatusOK)
-	this.ServeJson()
+	//Monolithic upload with digest and layer data in one request.
+	if digest := this.Ctx.Input.Query("digest"); len(digest) > 0 {
+		this.completeUpload(upload, digest)
+		return
+	}
+
+	this.uploadStatus(upload, http.StatusAccepted)
 	return
 }
 
-func (this *BlobAPIV2Controller) PostBlobs() {
-	uuid := utils.GeneralKey(fmt.Sprintf("%s/%s", this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":repo_name")))
-	random := fmt.Sprintf("https://%s/v2/%s/%s/blobs/uploads/%s", beego.AppConfig.String("docker::Endpoints"), this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":repo_name"), uuid)
+func (this *BlobAPIV2Controller) PatchBlobs() {
+	upload, ok := this.upload()
+	if ok == false {
+		return
+	}
 
-	this.Ctx.Output.Context.ResponseWriter.Header().Set("Location", random)
-	this.Ctx.Output.Context.ResponseWriter.Header().Set("Range", "bytes=0-0")
-	this.Ctx.Output.Context.Output.SetStatus(http.StatusAccepted)
+	if this.lockUpload(upload) == false {
+		return
+	}
+	defer upload.Unlock()
+
+	//The chunk must start at the end of the data already uploaded.
+	if contentRange := this.Ctx.Input.Header("Content-Range"); len(contentRange) > 0 {
+		var start, end int64
+
+		if _, err := fmt.Sscanf(strings.TrimPrefix(contentRange, "bytes="), "%d-%d", &start, &end); err != nil || start != upload.Offset || end < start {
+			this.uploadStatus(upload, http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+
+	if _, err := putUploadChunk(upload, this.Ctx.Request.Body); err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeBlobUploadUnknown]}})
+		return
+	}
+
+	this.uploadStatus(upload, http.StatusAccepted)
+	return
+}
+
+func (this *BlobAPIV2Controller) GetUploadStatus() {
+	upload, ok := this.upload()
+	if ok == false {
+		return
+	}
+
+	this.uploadStatus(upload, http.StatusNoContent)
+	return
+}
+
+func (this *BlobAPIV2Controller) DeleteUpload() {
+	upload, ok := this.upload()
+	if ok == false {
+		return
+	}
+
+	backend.Storage.Delete(fmt.Sprintf("uploads/%s", upload.UUID))
+
+	if err := upload.Remove(); err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnknown]}})
+		return
+	}
+
+	this.Ctx.Output.Context.Output.SetStatus(http.StatusNoContent)
 	this.Ctx.Output.Context.Output.Body([]byte(""))
 	return
 }
 
 func (this *BlobAPIV2Controller) PutBlobs() {
-	var digest string
+	upload, ok := this.upload()
+	if ok == false {
+		return
+	}
 
-	this.Ctx.Input.Bind(&digest, "digest")
+	this.completeUpload(upload, this.Ctx.Input.Query("digest"))
+	return
+}
+
+// upload returns the upload session of the uuid in the repository of the request, knowing the uuid of an upload in
+// another repository isn't enough to change it.
+func (this *BlobAPIV2Controller) upload() (*models.Upload, bool) {
+	upload := new(models.Upload)
+
+	if has, _, err := upload.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat"), this.Ctx.Input.Param(":uuid")); err != nil || has == false {
+		this.JSONOut(http.StatusNotFound, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeBlobUploadUnknown]}})
+		return nil, false
+	}
+
+	return upload, true
+}
+
+// lockUpload claims the upload session for the request, requests writing to the same session run one at a time. The
+// request gets 416 with the status of the session when another one is writing.
+func (this *BlobAPIV2Controller) lockUpload(upload *models.Upload) bool {
+	if locked, err := upload.Lock(); err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeBlobUploadUnknown]}})
+		return false
+	} else if locked == false {
+		this.uploadStatus(upload, http.StatusRequestedRangeNotSatisfiable)
+		return false
+	}
+
+	return true
+}
+
+// completeUpload appends the request body as the last chunk, then joins all chunks to the layer file of digest.
+// The layer is saved only when the sha256 of the joined data matches the digest.
+func (this *BlobAPIV2Controller) completeUpload(upload *models.Upload, digest string) {
+	if utils.IsDigest(digest) == false {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeDigestInvalid]}})
+		return
+	}
+
+	if this.lockUpload(upload) == false {
+		return
+	}
+	defer upload.Unlock()
+
+	size, err := putUploadChunk(upload, this.Ctx.Request.Body)
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeBlobUploadUnknown]}})
+		return
+	}
+
+	if this.Ctx.Request.ContentLength > 0 && this.Ctx.Request.ContentLength != size {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeSizeInvalid]}})
+		return
+	}
 
-	basePath := beego.AppConfig.String("docker::BasePath")
-	imagePath := fmt.Sprintf("%v/uuid/%v", basePath, strings.Split(digest, ":")[1])
-	layerfile := fmt.Sprintf("%v/uuid/%v/layer", basePath, strings.Split(digest, ":")[1])
+	staging := fmt.Sprintf("uploads/%s/data", upload.UUID)
+	layerfile := fmt.Sprintf("uuid/%v/layer", strings.Split(digest, ":")[1])
 
-	if !utils.IsDirExists(imagePath) {
-		os.MkdirAll(imagePath, os.ModePerm)
+	sum, err := joinUploadChunks(upload, staging)
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeBlobUploadUnknown]}})
+		return
 	}
 
-	if _, err := os.Stat(layerfile); err == nil {
-		os.Remove(layerfile)
+	if sum != digest {
+		backend.Storage.Delete(fmt.Sprintf("uploads/%s", upload.UUID))
+		upload.Remove()
+
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeDigestInvalid]}})
+		return
 	}
 
-	data, _ := ioutil.ReadAll(this.Ctx.Request.Body)
+	//The link is saved first, the blob of another repository is never deleted between the move and the link
+	if err := models.LinkBlob(upload.Namespace, upload.Repository, digest); err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnknown]}})
+		return
+	}
 
-	if err := ioutil.WriteFile(layerfile, data, 0777); err != nil {
+	if err := backend.Storage.Move(staging, layerfile); err != nil {
 		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeBlobUploadUnknown]}})
 		return
 	}
 
+	backend.Storage.Delete(fmt.Sprintf("uploads/%s", upload.UUID))
+	upload.Remove()
+
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Location", fmt.Sprintf("https://%s/v2/%s/%s/blobs/%s", beego.AppConfig.String("docker::Endpoints"), upload.Namespace, upload.Repository, digest))
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Docker-Content-Digest", digest)
 	this.Ctx.Output.Context.Output.SetStatus(http.StatusCreated)
 	this.Ctx.Output.Context.Output.Body([]byte(""))
 	return
 }
 
+func (this *BlobAPIV2Controller) uploadStatus(upload *models.Upload, code int) {
+	location := fmt.Sprintf("https://%s/v2/%s/%s/blobs/uploads/%s", beego.AppConfig.String("docker::Endpoints"), upload.Namespace, upload.Repository, upload.UUID)
+
+	end := upload.Offset - 1
+	if end < 0 {
+		end = 0
+	}
+
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Location", location)
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Range", fmt.Sprintf("0-%d", end))
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Docker-Upload-UUID", upload.UUID)
+	this.Ctx.Output.Context.Output.SetStatus(code)
+	this.Ctx.Output.Context.Output.Body([]byte(""))
+}
+
+// putUploadChunk saves data as a new chunk of the upload session, an empty body adds nothing.
+func putUploadChunk(upload *models.Upload, data io.Reader) (int64, error) {
+	chunk := fmt.Sprintf("uploads/%s/%d", upload.UUID, len(upload.Chunks))
+
+	writer, err := backend.Storage.Writer(chunk)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := io.Copy(writer, data)
+	if err != nil || size == 0 {
+		writer.Cancel()
+		return 0, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+
+	return size, upload.PutChunk(chunk, size)
+}
+
+// joinUploadChunks writes all chunks to path and returns the sha256 digest of the joined data.
+func joinUploadChunks(upload *models.Upload, path string) (string, error) {
+	writer, err := backend.Storage.Writer(path)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	w := io.MultiWriter(writer, h)
+
+	for _, chunk := range upload.Chunks {
+		reader, err := backend.Storage.Reader(chunk, 0)
+		if err != nil {
+			writer.Cancel()
+			return "", err
+		}
+
+		_, err = io.Copy(w, reader)
+		reader.Close()
+
+		if err != nil {
+			writer.Cancel()
+			return "", err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
 func (this *BlobAPIV2Controller) GetBlobs() {
-	image := new(models.Image)
-	digest := strings.Split(this.Ctx.Input.Param(":digest"), ":")[1]
+	this.serveBlob()
+}
+
+// DeleteBlobs unlinks the blob from the repository, blobs still referenced by any manifest can't be deleted. The layer
+// file of digest is removed when no other repository links the blob, orphans uploaded before the links existed are
+// left to the gc.
+func (this *BlobAPIV2Controller) DeleteBlobs() {
+	namespace, repository, digest := this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat"), this.Ctx.Input.Param(":digest")
+
+	if utils.IsDigest(digest) == false {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeDigestInvalid]}})
+		return
+	}
+
+	layerfile := fmt.Sprintf("uuid/%v/layer", strings.Split(digest, ":")[1])
 
-	if has, _, _ := image.HasTarsum(digest); has == false {
-		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnauthorized]}})
+	if _, err := backend.Storage.Stat(layerfile); err != nil || models.BlobLinked(namespace, repository, digest) == false {
+		this.JSONOut(http.StatusNotFound, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeBlobUnknown]}})
 		return
 	}
 
-	layerfile := image.Path
+	//Layers are shared by all repositories, the layer is only deleted when no repository is linked to it
+	if manifestsReferenced(namespace, repository, digest) == true {
+		this.JSONOut(http.StatusMethodNotAllowed, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnsupported]}})
+		return
+	}
 
-	if _, err := os.Stat(layerfile); err != nil {
+	if linked, err := models.UnlinkBlob(namespace, repository, digest); err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnknown]}})
+		return
+	} else if linked > 0 {
+		this.Ctx.Output.Context.Output.SetStatus(http.StatusAccepted)
+		this.Ctx.Output.Context.Output.Body([]byte(""))
+		return
+	}
+
+	if err := backend.Storage.Delete(fmt.Sprintf("uuid/%v", strings.Split(digest, ":")[1])); err != nil {
 		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeBlobUnknown]}})
 		return
 	}
 
-	file, err := ioutil.ReadFile(layerfile)
-	if err != nil {
+	image := new(models.Image)
+	if err := image.RemoveTarsum(strings.Split(digest, ":")[1]); err != nil {
 		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeBlobUnknown]}})
 		return
 	}
 
-	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Type", "application/octet-stream")
-	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Transfer-Encoding", "binary")
-	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Length", string(int64(len(file))))
-	this.Ctx.Output.Context.Output.SetStatus(http.StatusOK)
-	this.Ctx.Output.Context.Output.Body(file)
+	this.Ctx.Output.Context.Output.SetStatus(http.StatusAccepted)
+	this.Ctx.Output.Context.Output.Body([]byte(""))
+	return
+}
+
+// serveBlob streams the blob for both HEAD and GET, blobs uploaded without a manifest yet are found in the "uuid" folder.
+func (this *BlobAPIV2Controller) serveBlob() {
+	digest := this.Ctx.Input.Param(":digest")
+
+	if utils.IsDigest(digest) == false {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeDigestInvalid]}})
+		return
+	}
+
+	namespace, repository := this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")
+
+	image := new(models.Image)
+	path := fmt.Sprintf("uuid/%v/layer", strings.Split(digest, ":")[1])
+
+	if has, _, _ := image.HasTarsum(strings.Split(digest, ":")[1]); has == true {
+		path = image.Path
+	}
+
+	//Only the blobs linked to the repository are served, the others are unknown even if another repository has them
+	if blobLinked(namespace, repository, digest) == false || serveLayer(this.Ctx, path, digest) != nil {
+		//Blobs missed in proxy mode are streamed from the upstream registry and cached
+		if proxy.Proxied(namespace) == true && proxyBlob(this.Ctx, namespace, repository, digest, path) == nil {
+			return
+		}
+
+		this.JSONOut(http.StatusNotFound, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeBlobUnknown]}})
+		return
+	}
+
 	return
 }
@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerops/wharf/backend"
+	"github.com/containerops/wharf/models"
+)
+
+func TestUploadChunks(t *testing.T) {
+	server, teardown := setup(t)
+	defer teardown()
+
+	url := server.URL + "/v2/alice/app/blobs/uploads"
+
+	resp, _ := request(t, "POST", url, nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("start upload status is %d", resp.StatusCode)
+	}
+
+	session := fmt.Sprintf("%s/%s", url, resp.Header.Get("Docker-Upload-UUID"))
+
+	if resp, _ := request(t, "PATCH", session, strings.NewReader("hello "), "Content-Range", "0-5"); resp.StatusCode != http.StatusAccepted || resp.Header.Get("Range") != "0-5" {
+		t.Fatalf("first chunk is %d with range %s", resp.StatusCode, resp.Header.Get("Range"))
+	}
+
+	//The chunk not starting at the offset is refused
+	if resp, _ := request(t, "PATCH", session, strings.NewReader("again"), "Content-Range", "0-4"); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("stale chunk status is %d", resp.StatusCode)
+	}
+
+	//The session written by another request is refused
+	upload := new(models.Upload)
+	if has, _, err := upload.Has("alice", "app", resp.Header.Get("Docker-Upload-UUID")); err != nil || has == false {
+		t.Fatalf("upload isn't saved: %v", err)
+	}
+
+	if locked, err := upload.Lock(); err != nil || locked == false {
+		t.Fatalf("upload isn't locked: %v", err)
+	}
+
+	if resp, _ := request(t, "PATCH", session, strings.NewReader("world"), "Content-Range", "6-10"); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Range") != "0-5" {
+		t.Errorf("chunk of the locked session is %d with range %s", resp.StatusCode, resp.Header.Get("Range"))
+	}
+
+	if locked, _ := upload.Lock(); locked == true {
+		t.Errorf("upload is locked twice")
+	}
+
+	upload.Unlock()
+
+	//Concurrent requests never write the same chunk, every accepted one advances the offset
+	accepted, data := make(chan string, 8), "hello "
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(chunk string) {
+			defer wg.Done()
+
+			if resp, _ := request(t, "PATCH", session, strings.NewReader(chunk)); resp.StatusCode == http.StatusAccepted {
+				accepted <- chunk
+			}
+		}(fmt.Sprintf("%d", i))
+	}
+	wg.Wait()
+	close(accepted)
+
+	for chunk := range accepted {
+		data += chunk
+	}
+
+	if has, _, _ := upload.Has("alice", "app", upload.UUID); has == false || upload.Offset != int64(len(data)) || len(upload.Chunks) != len(data)-5 {
+		t.Fatalf("upload is %+v after %q", upload, data)
+	}
+
+	//The chunks are joined in the order they are written, the accepted ones are all there
+	joined := ""
+	for _, chunk := range upload.Chunks {
+		reader, err := backend.Storage.Reader(chunk, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, _ := ioutil.ReadAll(reader)
+		reader.Close()
+
+		joined += string(content)
+	}
+
+	if len(joined) != len(data) || strings.HasPrefix(joined, "hello ") == false {
+		t.Errorf("joined chunks are %q, accepted %q", joined, data)
+	}
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(joined)))
+
+	if resp, body := request(t, "PUT", fmt.Sprintf("%s?digest=%s", session, digest), nil); resp.StatusCode != http.StatusCreated {
+		t.Errorf("complete upload status is %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestMountBlobs(t *testing.T) {
+	server, teardown := setup(t)
+	defer teardown()
+
+	_, public := pushImage(t, server.URL+"/v2/alice/public", "latest", "public layer")
+	_, secret := pushImage(t, server.URL+"/v2/alice/secret", "latest", "secret layer")
+
+	repo := new(models.Repository)
+	if has, _, err := repo.Has("alice", "secret"); err != nil || has == false {
+		t.Fatalf("repository isn't saved: %v", err)
+	}
+
+	repo.Privated = true
+	if err := repo.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	url := server.URL + "/v2/bob/app/blobs/uploads"
+
+	//Blobs of a repository the user can't pull, or not linked to the source, are uploaded as usual
+	for _, query := range []string{
+		"mount=" + secret + "&from=alice/secret",
+		"mount=" + secret,
+		"mount=" + secret + "&from=alice/public",
+		"mount=" + public + "&from=alice",
+	} {
+		if resp, _ := request(t, "POST", url+"?"+query, nil); resp.StatusCode != http.StatusAccepted {
+			t.Errorf("mount %s status is %d", query, resp.StatusCode)
+		}
+	}
+
+	if resp, _ := request(t, "POST", url+"?mount="+public+"&from=alice/public", nil); resp.StatusCode != http.StatusCreated || resp.Header.Get("Docker-Content-Digest") != public {
+		t.Fatalf("mount public blob status is %d", resp.StatusCode)
+	}
+
+	if resp, _ := request(t, "HEAD", server.URL+"/v2/bob/app/blobs/"+public, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("head mounted blob status is %d", resp.StatusCode)
+	}
+
+	//The blobs of other repositories are unknown without the link
+	if resp, _ := request(t, "GET", server.URL+"/v2/bob/app/blobs/"+secret, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("get blob of another repository status is %d", resp.StatusCode)
+	}
+
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":10,"digest":"%s"},"layers":[{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","size":12,"digest":"%s"}]}`, models.MEDIATYPE_MANIFEST_V2, public, secret)
+	if resp, _ := request(t, "PUT", server.URL+"/v2/bob/app/manifests/latest", strings.NewReader(manifest), "Content-Type", models.MEDIATYPE_MANIFEST_V2); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("put manifest with a blob of another repository status is %d", resp.StatusCode)
+	}
+}
@@ -1,7 +1,22 @@
 package controllers
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/astaxie/beego"
+
+	"github.com/containerops/wharf/auth"
+	"github.com/containerops/wharf/builder"
+	"github.com/containerops/wharf/filters"
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/utils"
 )
 
 type BuilderAPIV1Controller struct {
@@ -21,17 +36,299 @@ func (this *BuilderAPIV1Controller) JSONOut(code int, message string, data inter
 
 func (this *BuilderAPIV1Controller) Prepare() {
 	this.EnableXSRF = false
+
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Type", "application/json;charset=UTF-8")
 }
 
 func (this *BuilderAPIV1Controller) URLMapping() {
 	this.Mapping("PostBuild", this.PostBuild)
 	this.Mapping("GetStatus", this.GetStatus)
+	this.Mapping("PostHook", this.PostHook)
 }
 
+// PostBuild queues a build of the multipart form: "namespace", "repository", "tag" ("latest" when empty), "dockerfile",
+// "git" and "ref" to clone the context, or the "context" file of a tarball. The Dockerfile of the repository or of the
+// context is used when "dockerfile" is empty.
 func (this *BuilderAPIV1Controller) PostBuild() {
+	namespace, repository := this.GetString("namespace"), this.GetString("repository")
+
+	user, ok := this.authorize(namespace, repository, filters.PERMISSION_WRITE)
+	if ok == false {
+		return
+	}
+
+	var context io.Reader
+
+	if file, _, err := this.GetFile("context"); err == nil {
+		defer file.Close()
+		context = file
+	} else if err != http.ErrMissingFile {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	repo := new(models.Repository)
+	if _, _, err := repo.Has(namespace, repository); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	//The Dockerfile is in the git repository or the context tarball otherwise
+	if len(this.GetString("dockerfile")) == 0 && len(repo.Dockerfile) == 0 && len(this.GetString("git")) == 0 && context == nil {
+		this.JSONOut(http.StatusBadRequest, "Dockerfile is empty", nil)
+		return
+	}
 
+	//The build is queued only after every check, rejected requests don't leave builds never run in the history
+	b := new(models.Build)
+
+	if err := b.Create(models.BUILD_TRIGGER_API, namespace, repository, this.GetString("tag"), this.GetString("dockerfile"), this.GetString("git"), this.GetString("ref"), user.Username); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	if err := builder.Submit(b, context); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	user.Log(models.ACTION_ADD_BUILD, models.LEVELINFORMATIONAL, models.TYPE_APIV1, b.Id, memo)
+	if len(repo.Id) > 0 {
+		repo.Log(models.ACTION_ADD_BUILD, models.LEVELINFORMATIONAL, models.TYPE_APIV1, b.Id, memo)
+	}
+
+	this.JSONOut(http.StatusAccepted, "", b)
+	return
 }
 
+// GetStatus returns the build of the "id" with the log from the chunk at the "offset", the "offset" of the next
+// chunk is returned too. The log is streamed until the build finishes when "follow" is true, or as server-sent events
+// when the request accepts "text/event-stream".
 func (this *BuilderAPIV1Controller) GetStatus() {
+	b := new(models.Build)
+
+	if has, err := b.Has(this.GetString("id")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if has == false {
+		this.JSONOut(http.StatusNotFound, "Build not exist", nil)
+		return
+	}
+
+	if _, ok := this.authorize(b.Namespace, b.Repository, filters.PERMISSION_READ); ok == false {
+		return
+	}
+
+	offset, _ := strconv.ParseInt(this.GetString("offset"), 10, 64)
+
+	events := strings.Contains(this.Ctx.Input.Header("Accept"), "text/event-stream")
+
+	//The event source reconnects from the last event received
+	if id, err := strconv.ParseInt(this.Ctx.Input.Header("Last-Event-ID"), 10, 64); err == nil && events == true {
+		offset = id
+	}
+
+	if events == true || this.GetString("follow") == "true" {
+		this.stream(b, offset, events)
+		return
+	}
+
+	log, next, err := b.Log(offset)
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	this.JSONOut(http.StatusOK, "", map[string]interface{}{"build": b, "log": log, "offset": next})
+	return
+}
+
+// PostHook receives the push webhooks of GitHub, GitLab and Gitea at "/b1/hooks/<provider>". The active build rules
+// of the pushed git repository verified with their secrets and matching the branch or the tag submit the builds.
+func (this *BuilderAPIV1Controller) PostHook() {
+	provider, body := this.Ctx.Input.Param(":provider"), this.Ctx.Input.CopyBody()
+
+	push, err := builder.ParsePush(provider, this.Ctx.Request.Header, body)
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if push == nil {
+		this.JSONOut(http.StatusOK, "Event ignored", nil)
+		return
+	}
+
+	rules := new(models.BuildRule).Matched(push.URLs)
+	if len(rules) == 0 {
+		this.JSONOut(http.StatusNotFound, "Build rule not exist", nil)
+		return
+	}
+
+	verified := false
+	builds := []*models.Build{}
+
+	for _, rule := range rules {
+		//Every rule has its own secret, rules of the same git repository in other namespaces aren't trusted
+		if builder.VerifyPush(provider, this.Ctx.Request.Header, body, rule.Secret) == false {
+			continue
+		}
+
+		verified = true
+
+		tag, matched := rule.Expand(push.Type, push.Name, push.Commit)
+		if matched == false {
+			continue
+		}
+
+		b, err := this.trigger(rule, push, tag)
+		if err != nil {
+			beego.Error(fmt.Sprintf("[build] %s %s/%s push %s error: %s", rule.Id, rule.Namespace, rule.Repository, push.Name, err.Error()))
+			continue
+		}
+
+		builds = append(builds, b)
+	}
+
+	if verified == false {
+		this.JSONOut(http.StatusUnauthorized, "Signature is invalid", nil)
+		return
+	}
+
+	if len(builds) == 0 {
+		this.JSONOut(http.StatusOK, "", builds)
+		return
+	}
+
+	this.JSONOut(http.StatusAccepted, "", builds)
+	return
+}
+
+// trigger submits the build of the rule as the user who created the rule, the user must still could push the
+// repository.
+func (this *BuilderAPIV1Controller) trigger(rule *models.BuildRule, push *builder.GitPush, tag string) (*models.Build, error) {
+	user := new(models.User)
+	if has, _, err := user.Has(rule.User); err != nil {
+		return nil, err
+	} else if has == false {
+		return nil, fmt.Errorf("User not exist: %s", rule.User)
+	}
+
+	if filters.CheckPermission(user, rule.Namespace, rule.Repository, filters.PERMISSION_WRITE) == false {
+		return nil, fmt.Errorf("Permission denied: %s", rule.User)
+	}
+
+	b := new(models.Build)
+
+	if err := b.Create(models.BUILD_TRIGGER_PUSH, rule.Namespace, rule.Repository, tag, rule.Dockerfile, rule.Git, push.Name, rule.User); err != nil {
+		return nil, err
+	}
+
+	if err := builder.Submit(b, nil); err != nil {
+		return nil, err
+	}
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	user.Log(models.ACTION_ADD_BUILD, models.LEVELINFORMATIONAL, models.TYPE_APIV1, b.Id, memo)
+
+	repo := new(models.Repository)
+	if has, _, err := repo.Has(rule.Namespace, rule.Repository); err == nil && has == true {
+		repo.Log(models.ACTION_ADD_BUILD, models.LEVELINFORMATIONAL, models.TYPE_APIV1, b.Id, memo)
+	}
+
+	return b, nil
+}
+
+// stream writes the log of the build in a chunked response until the build finishes. The log is written as "log"
+// events with the offset of the next chunk as the id when events is true, and the build is the last "status" event.
+func (this *BuilderAPIV1Controller) stream(b *models.Build, offset int64, events bool) {
+	hijacker, ok := this.Ctx.ResponseWriter.(http.Hijacker)
+	if ok == false {
+		this.JSONOut(http.StatusInternalServerError, "Streaming unsupported", nil)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		this.JSONOut(http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	defer conn.Close()
+
+	this.EnableRender = false
+
+	contentType := "text/plain;charset=UTF-8"
+	if events == true {
+		contentType = "text/event-stream;charset=UTF-8"
+	}
+
+	fmt.Fprintf(rw, "HTTP/1.1 200 OK\r\nContent-Type: %s\r\nCache-Control: no-cache\r\nX-Accel-Buffering: no\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n", contentType)
+
+	chunked := httputil.NewChunkedWriter(rw)
+
+	for {
+		//The status is read before the log, the whole log is written when the build finished
+		if has, err := b.Has(b.Id); err != nil || has == false {
+			break
+		}
+
+		log, next, err := b.Log(offset)
+		if err != nil {
+			break
+		}
+
+		if next > offset {
+			if events == true {
+				fmt.Fprintf(chunked, "id: %d\nevent: log\n", next)
+				for _, line := range strings.Split(strings.TrimSuffix(log, "\n"), "\n") {
+					fmt.Fprintf(chunked, "data: %s\n", line)
+				}
+				fmt.Fprint(chunked, "\n")
+			} else {
+				fmt.Fprint(chunked, log)
+			}
+
+			if err := rw.Flush(); err != nil {
+				return
+			}
+
+			offset = next
+		} else if b.Finished() == true {
+			break
+		} else {
+			time.Sleep(time.Second)
+		}
+	}
+
+	if events == true {
+		data, _ := json.Marshal(b)
+		fmt.Fprintf(chunked, "id: %d\nevent: status\ndata: %s\n\n", offset, data)
+	}
+
+	chunked.Close()
+	fmt.Fprint(rw, "\r\n")
+	rw.Flush()
+}
+
+// authorize checks the basic authorization like Docker Registry API V1, access tokens are limited by the scopes and
+// repositories too.
+func (this *BuilderAPIV1Controller) authorize(namespace, repository string, permission int) (*models.User, bool) {
+	username, passwd, err := utils.DecodeBasicAuth(this.Ctx.Input.Header("Authorization"))
+	if err != nil {
+		this.Ctx.Output.Context.ResponseWriter.Header().Set("WWW-Authenticate", "Basic realm=\"Wharf\"")
+		this.JSONOut(http.StatusUnauthorized, "Unauthorized", nil)
+		return nil, false
+	}
+
+	user, token, err := auth.Authenticate(username, passwd)
+	if err != nil {
+		this.JSONOut(http.StatusUnauthorized, err.Error(), nil)
+		return nil, false
+	}
+
+	if filters.CheckPermission(user, namespace, repository, permission) == false || (token != nil && token.Allowed(namespace, repository, filters.TokenScope(permission)) == false) {
+		this.JSONOut(http.StatusForbidden, "Permission denied", nil)
+		return nil, false
+	}
 
+	return user, true
 }
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/astaxie/beego"
+
+	"github.com/containerops/wharf/filters"
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/modules"
+)
+
+type CatalogAPIV2Controller struct {
+	beego.Controller
+}
+
+func (this *CatalogAPIV2Controller) URLMapping() {
+	this.Mapping("GetCatalog", this.GetCatalog)
+}
+
+func (this *CatalogAPIV2Controller) JSONOut(code int, message string, data interface{}) {
+	if data == nil {
+		this.Data["json"] = map[string]string{"message": message}
+	} else {
+		this.Data["json"] = data
+	}
+
+	this.Ctx.Output.Context.Output.SetStatus(code)
+	this.ServeJson()
+}
+
+func (this *CatalogAPIV2Controller) Prepare() {
+	this.EnableXSRF = false
+
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+}
+
+func (this *CatalogAPIV2Controller) GetCatalog() {
+	user, ok := this.Ctx.Input.GetData("user").(*models.User)
+	if ok == false {
+		this.JSONOut(http.StatusUnauthorized, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnauthorized]}})
+		return
+	}
+
+	repo := new(models.Repository)
+
+	names, err := repo.All()
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnknown]}})
+		return
+	}
+
+	//Only the repositories the user could pull
+	repositories := []string{}
+
+	for _, name := range names {
+		//Nested repository names belong to the top-level namespace
+		if parts := strings.SplitN(name, "/", 2); filters.CheckPermission(user, parts[0], parts[1], filters.PERMISSION_READ) == true {
+			repositories = append(repositories, name)
+		}
+	}
+
+	n := this.Ctx.Input.Query("n")
+
+	repositories, more, err := paginate(repositories, n, this.Ctx.Input.Query("last"))
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodePaginationNumberInvalid]}})
+		return
+	}
+
+	if more == true && len(repositories) > 0 {
+		paginateLink(this.Ctx, n, repositories[len(repositories)-1])
+	}
+
+	this.JSONOut(http.StatusOK, "", map[string][]string{"repositories": repositories})
+	return
+}
@@ -3,79 +3,495 @@ package controllers
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/context"
+	"github.com/satori/go.uuid"
 
+	"github.com/containerops/wharf/backend"
 	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/notifications"
+	"github.com/containerops/wharf/replication"
+	"github.com/containerops/wharf/utils"
 )
 
-func manifestsConvertV1(data []byte) error {
-	var manifest map[string]interface{}
+// manifestsConvertV1 saves the V1 images of a schema1 manifest for pulling with Docker Registry API V1, then the tag
+// when it isn't empty.
+func manifestsConvertV1(namespace, repository, tag string, data []byte, digest string) error {
+	var manifest struct {
+		FSLayers []struct {
+			BlobSum string `json:"blobSum"`
+		} `json:"fsLayers"`
+		History []struct {
+			V1Compatibility string `json:"v1Compatibility"`
+		} `json:"history"`
+	}
+
 	if err := json.Unmarshal(data, &manifest); err != nil {
 		return err
 	}
 
-	tag := manifest["tag"]
-	namespace, repository := strings.Split(manifest["name"].(string), "/")[0], strings.Split(manifest["name"].(string), "/")[1]
+	if len(manifest.History) == 0 || len(manifest.History) != len(manifest.FSLayers) {
+		return fmt.Errorf("Manifest fsLayers and history length mismatch")
+	}
 
-	for k := len(manifest["history"].([]interface{})) - 1; k >= 0; k-- {
-		v := manifest["history"].([]interface{})[k]
-		compatibility := v.(map[string]interface{})["v1Compatibility"].(string)
+	for k := len(manifest.History) - 1; k >= 0; k-- {
+		compatibility := manifest.History[k].V1Compatibility
+
+		var image struct {
+			Id   string `json:"id"`
+			Size int64  `json:"Size"`
+		}
 
-		var image map[string]interface{}
 		if err := json.Unmarshal([]byte(compatibility), &image); err != nil {
 			return err
 		}
 
+		if len(image.Id) == 0 {
+			return fmt.Errorf("Manifest v1Compatibility id is empty")
+		}
+
 		i := map[string]string{}
 		r := new(models.Repository)
 
-		if k == 0 {
-			i["Tag"] = tag.(string)
+		if k == 0 && len(tag) > 0 {
+			i["Tag"] = tag
 		}
-		i["id"] = image["id"].(string)
+		i["id"] = image.Id
 
 		//Put V1 JSON
 		if err := r.PutJSONFromManifests(i, namespace, repository); err != nil {
 			return err
 		}
 
-		if k == 0 {
+		if k == 0 && len(tag) > 0 {
 			//Put V1 Tag
-			if err := r.PutTagFromManifests(image["id"].(string), namespace, repository, tag.(string), string(data)); err != nil {
+			if err := r.PutTagFromManifests(image.Id, namespace, repository, tag, string(data), digest); err != nil {
 				return err
 			}
 		}
 
 		img := new(models.Image)
 
-		tarsum := manifest["fsLayers"].([]interface{})[k].(map[string]interface{})["blobSum"].(string)
+		tarsum := manifest.FSLayers[k].BlobSum
+		if utils.IsDigest(tarsum) == false {
+			return fmt.Errorf("Manifest blobSum is invalid")
+		}
+
 		sha256 := strings.Split(tarsum, ":")[1]
 
 		//Put Image Json
-		if err := img.PutJSON(image["id"].(string), v.(map[string]interface{})["v1Compatibility"].(string), models.APIVERSION_V2); err != nil {
+		if err := img.PutJSON(image.Id, compatibility, models.APIVERSION_V2); err != nil {
 			return err
 		}
 
 		//Put Image Layer
-		basePath := beego.AppConfig.String("docker::BasePath")
-		layerfile := fmt.Sprintf("%v/uuid/%v/layer", basePath, sha256)
+		layerfile := fmt.Sprintf("uuid/%v/layer", sha256)
 
-		if err := img.PutLayer(image["id"].(string), layerfile, true, int64(image["Size"].(float64))); err != nil {
+		if err := img.PutLayer(image.Id, backend.Storage.Name(), layerfile, true, image.Size); err != nil {
 			return err
 		}
 
 		//Put Checksum
-		if err := img.PutChecksum(image["id"].(string), sha256, true, ""); err != nil {
+		if err := img.PutChecksum(image.Id, sha256, true, ""); err != nil {
 			return err
 		}
 
 		//Put Ancestry
-		if err := img.PutAncestry(image["id"].(string)); err != nil {
+		if err := img.PutAncestry(image.Id); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+// manifestsPlatform returns the manifest of linux/amd64 in a manifest list, or the first one when there is no linux/amd64.
+func manifestsPlatform(namespace, repository string, list *models.Manifest) (*models.Manifest, error) {
+	references, err := list.References()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(references) == 0 {
+		return nil, fmt.Errorf("Manifest list is empty")
+	}
+
+	selected := references[0]
+
+	for _, descriptor := range references {
+		if descriptor.Platform != nil && descriptor.Platform.OS == "linux" && descriptor.Platform.Architecture == "amd64" {
+			selected = descriptor
+			break
+		}
+	}
+
+	manifest := new(models.Manifest)
+	if has, _, err := manifest.Has(namespace, repository, selected.Digest); err != nil {
+		return nil, err
+	} else if has == false {
+		return nil, fmt.Errorf("Manifest %s not found", selected.Digest)
+	}
+
+	return manifest, nil
+}
+
+// manifestsReferenced returns whether the blob is referenced by a manifest of the repository. The manifests of other
+// repositories only reference the blobs linked to them, so the blob isn't deleted while they are.
+func manifestsReferenced(namespace, repository, digest string) bool {
+	manifests := new(models.Manifest).InRepository(namespace, repository)
+
+	//Tags pushed before manifests are saved by digest
+	repo := new(models.Repository)
+	if has, _, err := repo.Has(namespace, repository); err == nil && has == true {
+		for _, id := range repo.Tags {
+			tag := new(models.Tag)
+			if err := tag.GetById(id); err == nil && len(tag.Digest) == 0 && len(tag.Manifest) > 0 {
+				manifests = append(manifests, &models.Manifest{MediaType: models.ManifestMediaType([]byte(tag.Manifest)), Data: tag.Manifest})
+			}
+		}
+	}
+
+	for _, manifest := range manifests {
+		blobs, err := manifest.Blobs()
+		if err != nil {
+			continue
+		}
+
+		for _, blobSum := range blobs {
+			if blobSum == digest {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// blobLinked returns whether the repository may serve and reference the blob, the blobs of manifests saved before the
+// links are checked in the manifests.
+func blobLinked(namespace, repository, digest string) bool {
+	return models.BlobLinked(namespace, repository, digest) == true || manifestsReferenced(namespace, repository, digest) == true
+}
+
+// serveLayer streams the layer file at path from the backend storage, supports a single "Range: bytes=" and "If-None-Match".
+// The error is returned only when nothing has been written to the response yet.
+func serveLayer(ctx *context.Context, path, digest string) error {
+	info, err := backend.Storage.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	header := ctx.ResponseWriter.Header()
+
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Transfer-Encoding", "binary")
+	header.Set("Accept-Ranges", "bytes")
+
+	if digest != "" {
+		header.Set("Docker-Content-Digest", digest)
+		header.Set("ETag", fmt.Sprintf("\"%s\"", digest))
+
+		if match := ctx.Input.Header("If-None-Match"); match != "" {
+			for _, etag := range strings.Split(match, ",") {
+				etag = strings.TrimSpace(etag)
+
+				if etag == "*" || strings.Trim(etag, "\"") == digest {
+					ctx.ResponseWriter.WriteHeader(http.StatusNotModified)
+					return nil
+				}
+			}
+		}
+	}
+
+	start, length, status := int64(0), info.Size, http.StatusOK
+
+	if value := ctx.Input.Header("Range"); value != "" {
+		var valid bool
+
+		if start, length, valid = parseRange(value, info.Size); valid == false {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			ctx.ResponseWriter.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return nil
+		}
+
+		if length != info.Size {
+			status = http.StatusPartialContent
+			header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, info.Size))
+		}
+	}
+
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+
+	if ctx.Input.IsHead() {
+		ctx.ResponseWriter.WriteHeader(status)
+		return nil
+	}
+
+	reader, err := backend.Storage.Reader(path, start)
+	if err != nil {
+		header.Del("Content-Length")
+		header.Del("Content-Range")
+		return err
+	}
+	defer reader.Close()
+
+	ctx.ResponseWriter.WriteHeader(status)
+
+	io.CopyN(ctx.ResponseWriter, reader, length)
+
+	return nil
+}
+
+// parseRange parses "bytes=start-end", "bytes=start-" and "bytes=-suffix" of a file with size bytes.
+// Multiple ranges are not supported and the whole file is served.
+func parseRange(value string, size int64) (int64, int64, bool) {
+	if strings.HasPrefix(value, "bytes=") == false || strings.Contains(value, ",") == true {
+		return 0, size, true
+	}
+
+	spec := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(value, "bytes=")), "-", 2)
+	if len(spec) != 2 {
+		return 0, 0, false
+	}
+
+	if spec[0] == "" {
+		suffix, err := strconv.ParseInt(spec[1], 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false
+		}
+
+		if suffix > size {
+			suffix = size
+		}
+
+		return size - suffix, suffix, size > 0
+	}
+
+	start, err := strconv.ParseInt(spec[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+
+	end := size - 1
+
+	if spec[1] != "" {
+		if end, err = strconv.ParseInt(spec[1], 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return start, end - start + 1, true
+}
+
+// paginate returns at most n names after last from the sorted names, n is ignored when empty.
+// The second return value is true when there are more names left after a page which isn't empty.
+func paginate(names []string, n, last string) ([]string, bool, error) {
+	start := 0
+
+	if last != "" {
+		start = sort.SearchStrings(names, last)
+		if start < len(names) && names[start] == last {
+			start++
+		}
+	}
+
+	result := names[start:]
+
+	if n == "" {
+		return result, false, nil
+	}
+
+	number, err := strconv.Atoi(n)
+	if err != nil || number < 0 {
+		return nil, false, fmt.Errorf("Invalid pagination number: %s", n)
+	}
+
+	if number >= len(result) {
+		return result, false, nil
+	}
+
+	//An empty page has no last name to link the next page
+	if number == 0 {
+		return result[:0], false, nil
+	}
+
+	return result[:number], true, nil
+}
+
+// paginateLink sets the RFC5988 "Link" header to the next page of the request.
+func paginateLink(ctx *context.Context, n, last string) {
+	query := url.Values{}
+	query.Set("n", n)
+	query.Set("last", last)
+
+	ctx.ResponseWriter.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", ctx.Request.URL.Path, query.Encode()))
+}
+
+// notifyEvent enqueues the event of the repository to its webhooks, the actor is the user of the request.
+func notifyEvent(ctx *context.Context, action, namespace, repository string, target notifications.Target) {
+	event := notifications.Event{Action: action, Target: target}
+
+	event.Request = notifications.Request{
+		Id:        uuid.NewV4().String(),
+		Addr:      ctx.Input.IP(),
+		Host:      ctx.Input.Host(),
+		Method:    ctx.Input.Method(),
+		UserAgent: ctx.Input.UserAgent(),
+	}
+
+	if user, ok := ctx.Input.GetData("user").(*models.User); ok == true && user != nil {
+		event.Actor.Name = user.Username
+	} else if subject, ok := ctx.Input.GetData("actor").(string); ok == true {
+		event.Actor.Name = subject
+	} else if username, _, err := utils.DecodeBasicAuth(ctx.Input.Header("Authorization")); err == nil {
+		event.Actor.Name = username
+	}
+
+	if len(target.Digest) > 0 && len(target.URL) == 0 {
+		event.Target.URL = fmt.Sprintf("https://%s/v2/%s/%s/manifests/%s", beego.AppConfig.String("docker::Endpoints"), namespace, repository, target.Digest)
+	}
+
+	if err := notifications.Notify(namespace, repository, event); err != nil {
+		beego.Error(fmt.Sprintf("[webhook] notify %s %s/%s error: %s", action, namespace, repository, err.Error()))
+	}
+}
+
+// replicate enqueues the pushed tag to the replications, an empty tag enqueues all tags of the repository pushed with
+// Docker Registry API V1.
+func replicate(namespace, repository, tag string) {
+	var err error
+
+	if len(tag) > 0 {
+		err = replication.Replicate(namespace, repository, tag)
+	} else {
+		err = replication.ReplicateRepository(namespace, repository)
+	}
+
+	if err != nil {
+		beego.Error(fmt.Sprintf("[replication] enqueue %s/%s:%s error: %s", namespace, repository, tag, err.Error()))
+	}
+}
+
+// sessionUser returns the signed in user, the session saves a pointer at sign in and a value somewhere else.
+func sessionUser(ctx *context.Context) (*models.User, bool) {
+	switch user := ctx.Input.CruSession.Get("user").(type) {
+	case *models.User:
+		return user, true
+	case models.User:
+		return &user, true
+	}
+
+	return nil, false
+}
+
+// startSigninTOTP keeps the user checked by the password or the OpenID Connect issuer in the session, the session user
+// is set after the code of the authenticator is checked in SigninTOTP.
+func startSigninTOTP(ctx *context.Context, user *models.User) {
+	ctx.Input.CruSession.Set("signin_user", user.Id)
+	ctx.Input.CruSession.Set("signin_expires", time.Now().Add(TOTP_SIGNIN_TIMEOUT).Unix())
+}
+
+const (
+	TOTP_SIGNIN_TIMEOUT  = 5 * time.Minute
+	TOTP_SIGNIN_ATTEMPTS = 5
+)
+
+// totpRequest is the body with a code of the authenticator or a recovery code.
+type totpRequest struct {
+	Code string `json:"code"`
+}
+
+// accessTokenRequest is the body creating a personal access token or a robot account.
+type accessTokenRequest struct {
+	Name         string   `json:"name"`
+	Scopes       []string `json:"scopes"`
+	Repositories []string `json:"repositories"`
+	Expires      int64    `json:"expires"`
+}
+
+// accessTokenView hides the secret of the token in responses.
+func accessTokenView(token *models.AccessToken) map[string]interface{} {
+	return map[string]interface{}{
+		"name":         token.Name,
+		"namespace":    token.Namespace,
+		"robot":        token.Robot,
+		"scopes":       token.Scopes,
+		"repositories": token.Repositories,
+		"expires":      token.Expires,
+		"used":         token.Used,
+		"created":      token.Created,
+	}
+}
+
+// webhookRequest is the body creating or updating a webhook, the secret is kept when updated with an empty one.
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+}
+
+// webhookView hides the secret of the webhook in responses.
+func webhookView(hook *models.Webhook) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         hook.Id,
+		"namespace":  hook.Namespace,
+		"repository": hook.Repository,
+		"url":        hook.URL,
+		"secret":     len(hook.Secret) > 0,
+		"events":     hook.Events,
+		"active":     hook.Active,
+		"created":    hook.Created,
+		"updated":    hook.Updated,
+	}
+}
+
+// saveWebhook creates the webhook of the namespace and the repository with the body, or updates it when the id
+// isn't empty.
+func saveWebhook(body []byte, namespace, repository, id string) (*models.Webhook, int, error) {
+	var request webhookRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	hook := new(models.Webhook)
+
+	if len(id) == 0 {
+		active := request.Active == nil || *request.Active == true
+
+		if err := hook.Create(namespace, repository, request.URL, request.Secret, request.Events, active); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+
+		return hook, http.StatusOK, nil
+	}
+
+	if exist, err := hook.Get(namespace, repository, id); err != nil {
+		return nil, http.StatusBadRequest, err
+	} else if exist == false {
+		return nil, http.StatusNotFound, fmt.Errorf("Webhook not exist")
+	}
+
+	active := hook.Active
+	if request.Active != nil {
+		active = *request.Active
+	}
+
+	if err := hook.Update(request.URL, request.Secret, request.Events, active); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	return hook, http.StatusOK, nil
+}
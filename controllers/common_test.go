@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	names := []string{"a", "b", "c", "d"}
+
+	cases := []struct {
+		n, last string
+		result  string
+		more    bool
+		invalid bool
+	}{
+		{"", "", "a,b,c,d", false, false},
+		{"2", "", "a,b", true, false},
+		{"2", "b", "c,d", false, false},
+		{"3", "a", "b,c,d", false, false},
+		{"1", "bb", "c", true, false},
+		{"0", "", "", false, false},
+		{"0", "d", "", false, false},
+		{"5", "d", "", false, false},
+		{"-1", "", "", false, true},
+		{"x", "", "", false, true},
+	}
+
+	for _, c := range cases {
+		result, more, err := paginate(names, c.n, c.last)
+
+		if c.invalid == true {
+			if err == nil {
+				t.Errorf("n=%q last=%q: error is expected", c.n, c.last)
+			}
+			continue
+		}
+
+		if err != nil || strings.Join(result, ",") != c.result || more != c.more {
+			t.Errorf("n=%q last=%q: %v %v %v", c.n, c.last, result, more, err)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/astaxie/beego"
+
+	"github.com/containerops/wharf/filters"
+	"github.com/containerops/wharf/models"
+)
+
+type ComposeWebV1Controller struct {
+	beego.Controller
+}
+
+// composeRequest is the body creating or updating a compose, the YAML is saved as the version of the tag ("latest"
+// when it's empty) when it isn't empty.
+type composeRequest struct {
+	Compose     string `json:"compose"`
+	Short       string `json:"short"`
+	Description string `json:"description"`
+	Privated    *bool  `json:"privated"`
+	Tag         string `json:"tag"`
+	YAML        string `json:"yaml"`
+}
+
+func (this *ComposeWebV1Controller) URLMapping() {
+	this.Mapping("GetComposes", this.GetComposes)
+	this.Mapping("PostCompose", this.PostCompose)
+	this.Mapping("GetCompose", this.GetCompose)
+	this.Mapping("PutCompose", this.PutCompose)
+	this.Mapping("DeleteCompose", this.DeleteCompose)
+	this.Mapping("GetTag", this.GetTag)
+	this.Mapping("PutTag", this.PutTag)
+}
+
+func (this *ComposeWebV1Controller) JSONOut(code int, message string, data interface{}) {
+	if data == nil {
+		this.Data["json"] = map[string]string{"message": message}
+	} else {
+		this.Data["json"] = data
+	}
+
+	this.Ctx.Output.Context.Output.SetStatus(code)
+	this.ServeJson()
+}
+
+func (this *ComposeWebV1Controller) Prepare() {
+	this.EnableXSRF = false
+
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Type", "application/json;charset=UTF-8")
+}
+
+// GetComposes returns the composes of the namespace, the private ones are returned to the owner only.
+func (this *ComposeWebV1Controller) GetComposes() {
+	user, _ := sessionUser(this.Ctx)
+
+	composes := []*models.Compose{}
+
+	for _, c := range new(models.Compose).All(this.Ctx.Input.Param(":namespace")) {
+		if composeReadable(user, c) == true {
+			composes = append(composes, c)
+		}
+	}
+
+	this.JSONOut(http.StatusOK, "", composes)
+	return
+}
+
+// PostCompose creates a compose of the namespace, the compose file in "yaml" is the first version.
+func (this *ComposeWebV1Controller) PostCompose() {
+	namespace, user, org, ok := this.namespaceOwner()
+	if ok == false {
+		return
+	}
+
+	var request composeRequest
+	if err := json.Unmarshal(this.Ctx.Input.CopyBody(), &request); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	//The compose isn't saved without a valid compose file
+	if _, err := models.ParseCompose(request.YAML); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	c := new(models.Compose)
+
+	if err := c.Create(namespace, request.Compose, request.Short, request.Description, request.Privated != nil && *request.Privated == true); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	if _, err := c.PutTag(request.Tag, request.YAML, user.Username); err != nil {
+		c.Delete()
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	this.log(user, org, c, models.ACTION_ADD_COMPOSE)
+
+	this.JSONOut(http.StatusOK, "", this.composeView(user, c))
+	return
+}
+
+// GetCompose returns the compose with the versions, and the images of the version pushed last.
+func (this *ComposeWebV1Controller) GetCompose() {
+	c, user, ok := this.compose()
+	if ok == false {
+		return
+	}
+
+	this.JSONOut(http.StatusOK, "", this.composeView(user, c))
+	return
+}
+
+// PutCompose updates the description and the privacy of the compose, the compose file in "yaml" is saved as the
+// version of "tag" too.
+func (this *ComposeWebV1Controller) PutCompose() {
+	namespace, user, org, ok := this.namespaceOwner()
+	if ok == false {
+		return
+	}
+
+	c := new(models.Compose)
+	if exist, _, err := c.Has(namespace, this.Ctx.Input.Param(":compose")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if exist == false {
+		this.JSONOut(http.StatusNotFound, "Compose not exist", nil)
+		return
+	}
+
+	var request composeRequest
+	if err := json.Unmarshal(this.Ctx.Input.CopyBody(), &request); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	if len(request.YAML) > 0 {
+		if _, err := c.PutTag(request.Tag, request.YAML, user.Username); err != nil {
+			this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+	}
+
+	c.Short, c.Description = request.Short, request.Description
+	if request.Privated != nil {
+		c.Privated = *request.Privated
+	}
+
+	if err := c.Save(); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	this.log(user, org, c, models.ACTION_UPDATE_COMPOSE)
+
+	this.JSONOut(http.StatusOK, "", this.composeView(user, c))
+	return
+}
+
+func (this *ComposeWebV1Controller) DeleteCompose() {
+	namespace, user, org, ok := this.namespaceOwner()
+	if ok == false {
+		return
+	}
+
+	c := new(models.Compose)
+	if exist, _, err := c.Has(namespace, this.Ctx.Input.Param(":compose")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if exist == false {
+		this.JSONOut(http.StatusNotFound, "Compose not exist", nil)
+		return
+	}
+
+	if err := c.Delete(); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	user.Log(models.ACTION_REMOVE_COMPOSE, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, c.Id, memo)
+	if org != nil {
+		org.Log(models.ACTION_REMOVE_COMPOSE, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, c.Id, memo)
+	}
+
+	this.JSONOut(http.StatusOK, "Remove compose successfully", nil)
+	return
+}
+
+// GetTag returns the version of the compose with the images of it.
+func (this *ComposeWebV1Controller) GetTag() {
+	c, user, ok := this.compose()
+	if ok == false {
+		return
+	}
+
+	t, exist := c.GetTag(this.Ctx.Input.Param(":tag"))
+	if exist == false {
+		this.JSONOut(http.StatusNotFound, "Tag not exist", nil)
+		return
+	}
+
+	this.JSONOut(http.StatusOK, "", map[string]interface{}{"tag": t, "images": composeImages(user, t.YAML)})
+	return
+}
+
+// PutTag saves the compose file in "yaml" as the version of the tag, the version is replaced when it exists.
+func (this *ComposeWebV1Controller) PutTag() {
+	namespace, user, org, ok := this.namespaceOwner()
+	if ok == false {
+		return
+	}
+
+	c := new(models.Compose)
+	if exist, _, err := c.Has(namespace, this.Ctx.Input.Param(":compose")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if exist == false {
+		this.JSONOut(http.StatusNotFound, "Compose not exist", nil)
+		return
+	}
+
+	var request composeRequest
+	if err := json.Unmarshal(this.Ctx.Input.CopyBody(), &request); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	t, err := c.PutTag(this.Ctx.Input.Param(":tag"), request.YAML, user.Username)
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	this.log(user, org, c, models.ACTION_UPDATE_COMPOSE)
+
+	this.JSONOut(http.StatusOK, "", map[string]interface{}{"tag": t, "images": composeImages(user, t.YAML)})
+	return
+}
+
+// namespaceOwner returns the namespace when it's the signed in user, or an organization the user owns or co-owns.
+func (this *ComposeWebV1Controller) namespaceOwner() (string, *models.User, *models.Organization, bool) {
+	user, exist := sessionUser(this.Ctx)
+	if exist == false {
+		this.JSONOut(http.StatusUnauthorized, "", map[string]string{"message": "Session load failure", "url": "/auth"})
+		return "", nil, nil, false
+	}
+
+	namespace := this.Ctx.Input.Param(":namespace")
+
+	if namespace == user.Username {
+		return namespace, user, nil, true
+	}
+
+	org := new(models.Organization)
+
+	if exist, _, err := org.Has(namespace); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return "", nil, nil, false
+	} else if exist == false {
+		this.JSONOut(http.StatusBadRequest, "Namespace not exist", nil)
+		return "", nil, nil, false
+	}
+
+	if filters.OwnNamespace(user, namespace) == false {
+		this.JSONOut(http.StatusForbidden, "Only the owner of organization could manage it", nil)
+		return "", nil, nil, false
+	}
+
+	return namespace, user, org, true
+}
+
+// compose returns the compose the signed in user could read, the private composes are not exist to others.
+func (this *ComposeWebV1Controller) compose() (*models.Compose, *models.User, bool) {
+	user, _ := sessionUser(this.Ctx)
+
+	c := new(models.Compose)
+	if exist, _, err := c.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":compose")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return nil, nil, false
+	} else if exist == false || composeReadable(user, c) == false {
+		this.JSONOut(http.StatusNotFound, "Compose not exist", nil)
+		return nil, nil, false
+	}
+
+	return c, user, true
+}
+
+func (this *ComposeWebV1Controller) log(user *models.User, org *models.Organization, c *models.Compose, action int) {
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+
+	user.Log(int64(action), models.LEVELINFORMATIONAL, models.TYPE_WEBV1, c.Id, memo)
+	if org != nil {
+		org.Log(int64(action), models.LEVELINFORMATIONAL, models.TYPE_WEBV1, c.Id, memo)
+	}
+
+	c.Log(int64(action), models.LEVELINFORMATIONAL, models.TYPE_WEBV1, c.Id, memo)
+}
+
+func (this *ComposeWebV1Controller) composeView(user *models.User, c *models.Compose) map[string]interface{} {
+	return map[string]interface{}{"compose": c, "versions": c.Versions(), "images": composeImages(user, c.YAML)}
+}
+
+// composeReadable returns whether the user could read the compose, the private composes are read by the owners of the
+// namespace and the collaborators of the compose only. The user is nil when not signed in.
+func composeReadable(user *models.User, c *models.Compose) bool {
+	if c.Privated == false {
+		return true
+	}
+
+	if user == nil || len(user.Username) == 0 {
+		return false
+	}
+
+	for _, collaborator := range c.Collaborators {
+		if collaborator == user.Username {
+			return true
+		}
+	}
+
+	return filters.OwnNamespace(user, c.Namespace)
+}
+
+// composeImages resolves the images of the compose file with the repositories the user could pull.
+func composeImages(user *models.User, yaml string) []*models.ComposeImage {
+	if user == nil {
+		user = new(models.User)
+	}
+
+	images, err := models.ParseCompose(yaml)
+	if err != nil {
+		return []*models.ComposeImage{}
+	}
+
+	for _, image := range images {
+		image.Resolve(beego.AppConfig.String("docker::Endpoints"), func(namespace, repository string) bool {
+			return filters.CheckPermission(user, namespace, repository, filters.PERMISSION_READ)
+		})
+	}
+
+	return images
+}
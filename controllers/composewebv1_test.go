@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/containerops/wharf/models"
+)
+
+func TestComposeReadable(t *testing.T) {
+	_, teardown := setup(t)
+	defer teardown()
+
+	for _, username := range []string{"owner", "coowner", "collaborator", "stranger"} {
+		user := &models.User{Id: "user:" + username, Username: username, Password: "Passw0rd!Passw0rd", Email: username + "@example.com"}
+		if err := user.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	org := &models.Organization{Id: "org:acme", Name: "acme", Username: "owner"}
+	if err := org.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &models.Compose{Namespace: "acme", Compose: "stack", Privated: true, Collaborators: []string{"collaborator"}}
+
+	tests := []struct {
+		user     *models.User
+		readable bool
+	}{
+		{&models.User{Username: "owner"}, true},
+		{&models.User{Username: "coowner", Organizations: []string{org.Id}}, true},
+		{&models.User{Username: "collaborator"}, true},
+		{&models.User{Username: "stranger"}, false},
+		{&models.User{Username: "acme+ci"}, false},
+		{new(models.User), false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if readable := composeReadable(test.user, c); readable != test.readable {
+			t.Errorf("compose is readable by %+v: %v, want %v", test.user, readable, test.readable)
+		}
+	}
+
+	c.Privated = false
+	if composeReadable(nil, c) == false {
+		t.Errorf("public compose isn't readable")
+	}
+}
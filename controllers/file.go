@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
 
 	"github.com/astaxie/beego"
 )
@@ -47,7 +48,7 @@ func (this *FileController) GetGPG() {
 
 	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Type", "application/octet-stream")
 	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Transfer-Encoding", "binary")
-	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Length", string(int64(len(file))))
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Length", strconv.Itoa(len(file)))
 	this.Ctx.Output.Context.Output.SetStatus(http.StatusOK)
 	this.Ctx.Output.Context.Output.Body(file)
 	return
@@ -3,14 +3,15 @@ package controllers
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/astaxie/beego"
 
+	"github.com/containerops/wharf/backend"
 	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/proxy"
 	"github.com/containerops/wharf/utils"
 )
 
@@ -98,26 +99,28 @@ func (this *ImageAPIV1Controller) PutImageLayer() {
 
 	image := new(models.Image)
 
-	basePath := beego.AppConfig.String("docker::BasePath")
-	imagePath := fmt.Sprintf("%v/images/%v", basePath, imageId)
-	layerfile := fmt.Sprintf("%v/images/%v/layer", basePath, imageId)
+	layerfile := fmt.Sprintf("images/%v/layer", imageId)
 
-	if !utils.IsDirExists(imagePath) {
-		os.MkdirAll(imagePath, os.ModePerm)
+	writer, err := backend.Storage.Writer(layerfile)
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, "Put Image Layer File Error", nil)
+		return
 	}
 
-	if _, err := os.Stat(layerfile); err == nil {
-		os.Remove(layerfile)
-	}
+	size, err := io.Copy(writer, this.Ctx.Request.Body)
+	if err != nil {
+		writer.Cancel()
 
-	data, _ := ioutil.ReadAll(this.Ctx.Request.Body)
+		this.JSONOut(http.StatusBadRequest, "Put Image Layer File Error", nil)
+		return
+	}
 
-	if err := ioutil.WriteFile(layerfile, data, 0777); err != nil {
+	if err := writer.Close(); err != nil {
 		this.JSONOut(http.StatusBadRequest, "Put Image Layer File Error", nil)
 		return
 	}
 
-	if err := image.PutLayer(imageId, layerfile, true, int64(len(data))); err != nil {
+	if err := image.PutLayer(imageId, backend.Storage.Name(), layerfile, true, size); err != nil {
 		this.JSONOut(http.StatusBadRequest, "Put Image Layer File Data Error", nil)
 		return
 	}
@@ -187,23 +190,36 @@ func (this *ImageAPIV1Controller) GetImageLayer() {
 		return
 	}
 
-	layerfile := image.Path
+	digest := imageLayerDigest(image.Checksum)
 
-	if _, err := os.Stat(layerfile); err != nil {
-		this.JSONOut(http.StatusBadRequest, "Read Image file state error", nil)
-		return
+	checksum := ""
+	if image.Checksumed == true {
+		checksum = digest
 	}
 
-	file, err := ioutil.ReadFile(layerfile)
-	if err != nil {
+	if err := serveLayer(this.Ctx, image.Path, checksum); err != nil {
+		//Layers of the images cached in proxy mode are fetched from the upstream repository of the blob
+		if proxy.Upstream != nil && len(digest) > 0 {
+			if namespace, repository, _ := models.ProxyBlob(digest); len(namespace) > 0 && proxyBlob(this.Ctx, namespace, repository, digest, image.Path) == nil {
+				return
+			}
+		}
+
 		this.JSONOut(http.StatusBadRequest, "Read Image file error", nil)
 		return
 	}
 
-	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Type", "application/octet-stream")
-	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Transfer-Encoding", "binary")
-	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Length", string(int64(len(file))))
-	this.Ctx.Output.Context.Output.SetStatus(http.StatusOK)
-	this.Ctx.Output.Context.Output.Body(file)
 	return
 }
+
+// imageLayerDigest returns the checksum of the image as "sha256:<hex>" like the digests of V2, the checksum is saved
+// as the bare hex or in the "tarsum+sha256:<hex>" form. It's empty when the checksum isn't a sha256.
+func imageLayerDigest(checksum string) string {
+	digest := fmt.Sprintf("sha256:%s", checksum[strings.LastIndex(checksum, ":")+1:])
+
+	if utils.IsDigest(digest) == false {
+		return ""
+	}
+
+	return digest
+}
@@ -0,0 +1,21 @@
+package controllers
+
+import (
+	"testing"
+)
+
+func TestImageLayerDigest(t *testing.T) {
+	hex := "2d711642b726b04401627ca9fbac32f5c8530fb1903cc4db02258717921a4881"
+
+	for checksum, digest := range map[string]string{
+		hex:                    "sha256:" + hex,
+		"sha256:" + hex:        "sha256:" + hex,
+		"tarsum+sha256:" + hex: "sha256:" + hex,
+		"":                     "",
+		"md5:abc":              "",
+	} {
+		if result := imageLayerDigest(checksum); result != digest {
+			t.Errorf("digest of %q is %q, want %q", checksum, result, digest)
+		}
+	}
+}
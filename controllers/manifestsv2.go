@@ -1,14 +1,21 @@
 package controllers
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/astaxie/beego"
 
+	"github.com/containerops/wharf/backend"
 	"github.com/containerops/wharf/models"
 	"github.com/containerops/wharf/modules"
+	"github.com/containerops/wharf/notifications"
+	"github.com/containerops/wharf/proxy"
+	"github.com/containerops/wharf/utils"
 )
 
 type ManifestsAPIV2Controller struct {
@@ -19,6 +26,8 @@ func (this *ManifestsAPIV2Controller) URLMapping() {
 	this.Mapping("PutManifests", this.PutManifests)
 	this.Mapping("GetTags", this.GetTags)
 	this.Mapping("GetManifests", this.GetManifests)
+	this.Mapping("DeleteManifests", this.DeleteManifests)
+	this.Mapping("GetReferrers", this.GetReferrers)
 }
 
 func (this *ManifestsAPIV2Controller) JSONOut(code int, message string, data interface{}) {
@@ -39,10 +48,73 @@ func (this *ManifestsAPIV2Controller) Prepare() {
 }
 
 func (this *ManifestsAPIV2Controller) PutManifests() {
-	manifest, _ := ioutil.ReadAll(this.Ctx.Request.Body)
+	data, _ := ioutil.ReadAll(this.Ctx.Request.Body)
 
 	namespace := this.Ctx.Input.Param(":namespace")
-	repository := this.Ctx.Input.Param(":repo_name")
+	repository := this.Ctx.Input.Param(":splat")
+	reference := this.Ctx.Input.Param(":tag")
+
+	mediaType := strings.TrimSpace(strings.Split(this.Ctx.Input.Header("Content-Type"), ";")[0])
+	detected := models.ManifestMediaType(data)
+
+	switch mediaType {
+	case "", "application/json", models.MEDIATYPE_MANIFEST_V1, models.MEDIATYPE_MANIFEST_V1_SIGNED:
+		//Old clients don't send the media type of schema1 manifests
+		mediaType = detected
+	}
+
+	if len(detected) == 0 || mediaType != detected {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestInvalid]}})
+		return
+	}
+
+	digest := models.ManifestDigest(data)
+
+	if utils.IsDigest(reference) == true && reference != digest {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeDigestInvalid]}})
+		return
+	}
+
+	manifest := &models.Manifest{MediaType: mediaType, Data: string(data)}
+
+	blobs, err := manifest.Blobs()
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestInvalid]}})
+		return
+	}
+
+	//All layers must be uploaded to or mounted in the repository and verified before the manifest
+	for _, blobSum := range blobs {
+		if utils.IsDigest(blobSum) == false {
+			this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeDigestInvalid]}})
+			return
+		}
+
+		if blobLinked(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat"), blobSum) == false {
+			this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeBlobUnknown]}})
+			return
+		}
+
+		if _, err := backend.Storage.Stat(fmt.Sprintf("uuid/%v/layer", strings.Split(blobSum, ":")[1])); err != nil {
+			this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeBlobUnknown]}})
+			return
+		}
+	}
+
+	//Manifests of a manifest list must be pushed to the repository before
+	references, err := manifest.References()
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestInvalid]}})
+		return
+	}
+
+	for _, descriptor := range references {
+		m := new(models.Manifest)
+		if has, _, err := m.Has(namespace, repository, descriptor.Digest); err != nil || has == false {
+			this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestUnknown]}})
+			return
+		}
+	}
 
 	repo := new(models.Repository)
 
@@ -51,16 +123,55 @@ func (this *ManifestsAPIV2Controller) PutManifests() {
 		return
 	}
 
-	manifestsConvertV1(manifest)
+	if err := manifest.Put(namespace, repository, mediaType, data); err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestInvalid]}})
+		return
+	}
 
-	this.Ctx.Output.Context.Output.SetStatus(http.StatusOK)
+	//Push by digest doesn't change any tag
+	tag := reference
+	if utils.IsDigest(reference) == true {
+		tag = ""
+	}
+
+	switch mediaType {
+	case models.MEDIATYPE_MANIFEST_V1, models.MEDIATYPE_MANIFEST_V1_SIGNED:
+		err = manifestsConvertV1(namespace, repository, tag, data, digest)
+	default:
+		if len(tag) > 0 {
+			image := ""
+			if config, _, e := manifest.Config(); e == nil {
+				image = strings.TrimPrefix(config.Digest, "sha256:")
+			}
+
+			err = repo.PutTagFromManifests(image, namespace, repository, tag, string(data), digest)
+		}
+	}
+
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestInvalid]}})
+		return
+	}
+
+	notifyEvent(this.Ctx, models.WEBHOOK_EVENT_PUSH, namespace, repository, notifications.Target{MediaType: mediaType, Size: int64(len(data)), Length: int64(len(data)), Digest: digest, Tag: tag})
+
+	if len(tag) > 0 {
+		replicate(namespace, repository, tag)
+	}
+
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Location", fmt.Sprintf("https://%s/v2/%s/%s/manifests/%s", beego.AppConfig.String("docker::Endpoints"), namespace, repository, digest))
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Docker-Content-Digest", digest)
+	if len(manifest.Subject) > 0 {
+		this.Ctx.Output.Context.ResponseWriter.Header().Set("OCI-Subject", manifest.Subject)
+	}
+	this.Ctx.Output.Context.Output.SetStatus(http.StatusCreated)
 	this.Ctx.Output.Context.Output.Body([]byte(""))
 	return
 }
 
 func (this *ManifestsAPIV2Controller) GetTags() {
 	namespace := this.Ctx.Input.Param(":namespace")
-	repository := this.Ctx.Input.Param(":repo_name")
+	repository := this.Ctx.Input.Param(":splat")
 
 	repo := new(models.Repository)
 
@@ -84,6 +195,20 @@ func (this *ManifestsAPIV2Controller) GetTags() {
 		tags = append(tags, t.Name)
 	}
 
+	sort.Strings(tags)
+
+	n := this.Ctx.Input.Query("n")
+
+	tags, more, err := paginate(tags, n, this.Ctx.Input.Query("last"))
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodePaginationNumberInvalid]}})
+		return
+	}
+
+	if more == true && len(tags) > 0 {
+		paginateLink(this.Ctx, n, tags[len(tags)-1])
+	}
+
 	data["tags"] = tags
 
 	this.JSONOut(http.StatusOK, "", data)
@@ -92,16 +217,269 @@ func (this *ManifestsAPIV2Controller) GetTags() {
 
 func (this *ManifestsAPIV2Controller) GetManifests() {
 	namespace := this.Ctx.Input.Param(":namespace")
-	repository := this.Ctx.Input.Param(":repo_name")
-	tag := this.Ctx.Input.Param(":tag")
+	repository := this.Ctx.Input.Param(":splat")
+	reference := this.Ctx.Input.Param(":tag")
+
+	//Repositories of the namespaces not in Wharf are pulled through the upstream registry in proxy mode
+	if proxy.Proxied(namespace) == true {
+		if err := proxyManifests(namespace, repository, reference); err != nil {
+			beego.Error(fmt.Sprintf("[proxy] fetch manifest %s/%s:%s error: %s", namespace, repository, reference, err.Error()))
+		}
+	}
+
+	repo := new(models.Repository)
+
+	if has, _, err := repo.Has(namespace, repository); err != nil || has == false {
+		this.JSONOut(http.StatusNotFound, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeNameUnknown]}})
+		return
+	}
+
+	manifest := new(models.Manifest)
+	tag := ""
+
+	if utils.IsDigest(reference) == true {
+		if has, _, err := manifest.Has(namespace, repository, reference); err != nil || has == false {
+			this.JSONOut(http.StatusNotFound, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestUnknown]}})
+			return
+		}
+	} else {
+		tag = reference
+
+		//Removed tags are not in the repository any more
+		has := false
+		for _, v := range repo.Tags {
+			if v == fmt.Sprintf("%s:%s:%s", namespace, repository, tag) {
+				has = true
+			}
+		}
+
+		if has == false {
+			this.JSONOut(http.StatusNotFound, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestUnknown]}})
+			return
+		}
+
+		t := new(models.Tag)
+		if err := t.GetById(fmt.Sprintf("%s:%s:%s", namespace, repository, tag)); err != nil {
+			this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeTagInvalid]}})
+			return
+		}
+
+		if len(t.Digest) > 0 {
+			if has, _, err := manifest.Has(namespace, repository, t.Digest); err != nil || has == false {
+				this.JSONOut(http.StatusNotFound, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestUnknown]}})
+				return
+			}
+		} else {
+			//Tags pushed before manifests are saved by digest
+			manifest.Data, manifest.Digest = t.Manifest, models.ManifestDigest([]byte(t.Manifest))
+			manifest.MediaType = models.ManifestMediaType([]byte(t.Manifest))
+		}
+	}
+
+	accepts := this.accepts()
+
+	//Clients don't accept manifest lists or OCI indexes get the manifest of default platform
+	if (manifest.MediaType == models.MEDIATYPE_MANIFEST_LIST || manifest.MediaType == models.MEDIATYPE_OCI_INDEX) && accepts[manifest.MediaType] == false && len(tag) > 0 {
+		platform, err := manifestsPlatform(namespace, repository, manifest)
+		if err != nil {
+			this.JSONOut(http.StatusNotFound, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestUnknown]}})
+			return
+		}
+
+		manifest = platform
+	}
+
+	data, digest, mediaType := []byte(manifest.Data), manifest.Digest, manifest.MediaType
+
+	//Clients don't accept schema2 get the schema1 manifest converted, which has a different digest
+	if mediaType == models.MEDIATYPE_MANIFEST_V2 && accepts[models.MEDIATYPE_MANIFEST_V2] == false {
+		if len(tag) == 0 {
+			this.JSONOut(http.StatusNotFound, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestUnknown]}})
+			return
+		}
+
+		var err error
+
+		if data, digest, err = manifestsSchema1(namespace, repository, tag, manifest); err != nil {
+			this.JSONOut(http.StatusNotFound, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestUnknown]}})
+			return
+		}
+
+		mediaType = models.MEDIATYPE_MANIFEST_V1_SIGNED
+	}
+
+	//HEAD checks the manifest without pulling it
+	if this.Ctx.Input.Method() == "GET" {
+		notifyEvent(this.Ctx, models.WEBHOOK_EVENT_PULL, namespace, repository, notifications.Target{MediaType: mediaType, Size: int64(len(data)), Length: int64(len(data)), Digest: digest, Tag: tag})
+	}
+
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Type", mediaType)
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Docker-Content-Digest", digest)
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("ETag", fmt.Sprintf("\"%s\"", digest))
+	this.Ctx.Output.Context.Output.SetStatus(http.StatusOK)
+	this.Ctx.Output.Context.Output.Body(data)
+	return
+}
+
+// DeleteManifests removes the manifest and all tags of the repository pointing to it, layers are left to the "gc" command.
+// Deleting by tag only removes the tag.
+func (this *ManifestsAPIV2Controller) DeleteManifests() {
+	namespace := this.Ctx.Input.Param(":namespace")
+	repository := this.Ctx.Input.Param(":splat")
+	digest := this.Ctx.Input.Param(":tag")
+
+	repo := new(models.Repository)
+
+	if has, _, err := repo.Has(namespace, repository); err != nil || has == false {
+		this.JSONOut(http.StatusNotFound, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeNameUnknown]}})
+		return
+	}
+
+	if utils.IsDigest(digest) == false {
+		this.deleteTag(repo, namespace, repository, digest)
+		return
+	}
+
+	manifest := new(models.Manifest)
+
+	exist, _, err := manifest.Has(namespace, repository, digest)
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestUnknown]}})
+		return
+	}
+
+	tags := []string{}
+
+	for _, value := range repo.Tags {
+		t := new(models.Tag)
+		if err := t.GetById(value); err != nil {
+			this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeTagInvalid]}})
+			return
+		}
+
+		if t.Digest == digest || (len(t.Digest) == 0 && len(t.Manifest) > 0 && models.ManifestDigest([]byte(t.Manifest)) == digest) {
+			tags = append(tags, t.Name)
+		}
+	}
+
+	if exist == false && len(tags) == 0 {
+		this.JSONOut(http.StatusNotFound, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestUnknown]}})
+		return
+	}
+
+	for _, tag := range tags {
+		if err := repo.RemoveTag(namespace, repository, tag); err != nil {
+			this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeTagInvalid]}})
+			return
+		}
+	}
+
+	if exist == true {
+		if err := manifest.Remove(); err != nil {
+			this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestUnknown]}})
+			return
+		}
+
+		//The blobs no other manifest of the repository references are unlinked, gc sweeps them when no tag reaches them
+		if blobs, err := manifest.Blobs(); err == nil {
+			for _, blob := range blobs {
+				if manifestsReferenced(namespace, repository, blob) == false {
+					models.UnlinkBlob(namespace, repository, blob)
+				}
+			}
+		}
+	}
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	repo.Log(models.ACTION_REMOVE_MANIFEST, models.LEVELINFORMATIONAL, models.TYPE_APIV2, repo.Id, memo)
+
+	notifyEvent(this.Ctx, models.WEBHOOK_EVENT_DELETE, namespace, repository, notifications.Target{Digest: digest})
+
+	this.Ctx.Output.Context.Output.SetStatus(http.StatusAccepted)
+	this.Ctx.Output.Context.Output.Body([]byte(""))
+	return
+}
+
+func (this *ManifestsAPIV2Controller) deleteTag(repo *models.Repository, namespace, repository, tag string) {
+	if utils.IsTag(tag) == false {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeTagInvalid]}})
+		return
+	}
+
+	has := false
+	for _, v := range repo.Tags {
+		if v == fmt.Sprintf("%s:%s:%s", namespace, repository, tag) {
+			has = true
+		}
+	}
+
+	if has == false {
+		this.JSONOut(http.StatusNotFound, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeManifestUnknown]}})
+		return
+	}
 
-	t := new(models.Tag)
-	if err := t.GetById(fmt.Sprintf("%s:%s:%s", namespace, repository, tag)); err != nil {
+	if err := repo.RemoveTag(namespace, repository, tag); err != nil {
 		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeTagInvalid]}})
 		return
 	}
 
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	repo.Log(models.ACTION_REMOVE_TAG, models.LEVELINFORMATIONAL, models.TYPE_APIV2, repo.Id, memo)
+
+	notifyEvent(this.Ctx, models.WEBHOOK_EVENT_DELETE, namespace, repository, notifications.Target{Tag: tag})
+
+	this.Ctx.Output.Context.Output.SetStatus(http.StatusAccepted)
+	this.Ctx.Output.Context.Output.Body([]byte(""))
+	return
+}
+
+// GetReferrers returns an OCI index of the manifests which subject is the digest, filtered by the "artifactType" query.
+func (this *ManifestsAPIV2Controller) GetReferrers() {
+	namespace := this.Ctx.Input.Param(":namespace")
+	repository := this.Ctx.Input.Param(":splat")
+	digest := this.Ctx.Input.Param(":digest")
+
+	if utils.IsDigest(digest) == false {
+		this.JSONOut(http.StatusBadRequest, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeDigestInvalid]}})
+		return
+	}
+
+	manifest := new(models.Manifest)
+	referrers := manifest.Referrers(namespace, repository, digest)
+
+	if artifactType := this.Ctx.Input.Query("artifactType"); len(artifactType) > 0 {
+		filtered := []models.Descriptor{}
+		for _, descriptor := range referrers {
+			if descriptor.ArtifactType == artifactType {
+				filtered = append(filtered, descriptor)
+			}
+		}
+
+		referrers = filtered
+		this.Ctx.Output.Context.ResponseWriter.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     models.MEDIATYPE_OCI_INDEX,
+		"manifests":     referrers,
+	})
+
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Type", models.MEDIATYPE_OCI_INDEX)
 	this.Ctx.Output.Context.Output.SetStatus(http.StatusOK)
-	this.Ctx.Output.Context.Output.Body([]byte(t.Manifest))
+	this.Ctx.Output.Context.Output.Body(data)
 	return
 }
+
+// accepts returns the media types in all "Accept" headers.
+func (this *ManifestsAPIV2Controller) accepts() map[string]bool {
+	result := map[string]bool{}
+
+	for _, value := range this.Ctx.Request.Header["Accept"] {
+		for _, mediaType := range strings.Split(value, ",") {
+			result[strings.TrimSpace(strings.Split(mediaType, ";")[0])] = true
+		}
+	}
+
+	return result
+}
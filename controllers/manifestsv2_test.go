@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/containerops/wharf/models"
+)
+
+// pushBlob uploads the data in one request, returns the digest.
+func pushBlob(t *testing.T, url string, data []byte) string {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+
+	if resp, body := request(t, "POST", fmt.Sprintf("%s/blobs/uploads?digest=%s", url, digest), bytes.NewReader(data)); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload blob status is %d: %s", resp.StatusCode, body)
+	}
+
+	return digest
+}
+
+// pushManifest puts the manifest of the media type, returns the response.
+func pushManifest(t *testing.T, url, reference, mediaType string, manifest interface{}) (*http.Response, string) {
+	data, _ := json.Marshal(manifest)
+
+	resp, body := request(t, "PUT", fmt.Sprintf("%s/manifests/%s", url, reference), bytes.NewReader(data), "Content-Type", mediaType)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("put manifest %s status is %d: %s", reference, resp.StatusCode, body)
+	}
+
+	if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data)); resp.Header.Get("Docker-Content-Digest") != digest {
+		t.Errorf("digest of manifest %s is %s, want %s", reference, resp.Header.Get("Docker-Content-Digest"), digest)
+	}
+
+	return resp, resp.Header.Get("Docker-Content-Digest")
+}
+
+// referrers gets the referrers of the digest, returns the response and the digests of the referrers.
+func referrers(t *testing.T, url, digest, query string) (*http.Response, []string) {
+	resp, body := request(t, "GET", fmt.Sprintf("%s/referrers/%s%s", url, digest, query), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("referrers status is %d: %s", resp.StatusCode, body)
+	}
+
+	index := struct {
+		MediaType string              `json:"mediaType"`
+		Manifests []models.Descriptor `json:"manifests"`
+	}{}
+
+	if err := json.Unmarshal(body, &index); err != nil || index.MediaType != models.MEDIATYPE_OCI_INDEX {
+		t.Fatalf("referrers is not an OCI index: %s", body)
+	}
+
+	digests := []string{}
+	for _, descriptor := range index.Manifests {
+		digests = append(digests, descriptor.Digest)
+	}
+
+	return resp, digests
+}
+
+func TestOCIManifests(t *testing.T) {
+	server, teardown := setup(t)
+	defer teardown()
+
+	url := fmt.Sprintf("%s/v2/library/app", server.URL)
+
+	config := pushBlob(t, url, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layer := pushBlob(t, url, []byte("layer"))
+	empty := pushBlob(t, url, []byte("{}"))
+
+	image := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     models.MEDIATYPE_OCI_MANIFEST,
+		"config":        map[string]interface{}{"mediaType": models.MEDIATYPE_OCI_CONFIG, "size": 37, "digest": config},
+		"layers":        []interface{}{map[string]interface{}{"mediaType": models.MEDIATYPE_OCI_LAYER, "size": 5, "digest": layer}},
+	}
+
+	_, subject := pushManifest(t, url, "latest", models.MEDIATYPE_OCI_MANIFEST, image)
+
+	if resp, body := request(t, "GET", url+"/manifests/latest", nil, "Accept", models.MEDIATYPE_OCI_MANIFEST); resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != models.MEDIATYPE_OCI_MANIFEST || resp.Header.Get("Docker-Content-Digest") != subject {
+		t.Errorf("get manifest status is %d, type %s: %s", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+
+	if resp, _ := request(t, "HEAD", url+"/manifests/"+subject, nil, "Accept", models.MEDIATYPE_OCI_MANIFEST); resp.StatusCode != http.StatusOK || resp.Header.Get("Docker-Content-Digest") != subject {
+		t.Errorf("head manifest status is %d", resp.StatusCode)
+	}
+
+	if resp, _ := request(t, "GET", url+"/manifests/sha256:0000000000000000000000000000000000000000000000000000000000000000", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("get unknown manifest status is %d", resp.StatusCode)
+	}
+
+	//Referrers of a subject without any are an empty index
+	if _, digests := referrers(t, url, subject, ""); len(digests) != 0 {
+		t.Errorf("referrers before any artifact are %v", digests)
+	}
+
+	artifacts := map[string]string{}
+	for _, artifactType := range []string{"application/vnd.example.sbom", "application/vnd.example.signature"} {
+		artifact := map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     models.MEDIATYPE_OCI_MANIFEST,
+			"artifactType":  artifactType,
+			"config":        map[string]interface{}{"mediaType": models.MEDIATYPE_OCI_EMPTY, "size": 2, "digest": empty},
+			"layers":        []interface{}{map[string]interface{}{"mediaType": models.MEDIATYPE_OCI_EMPTY, "size": 2, "digest": empty}},
+			"subject":       map[string]interface{}{"mediaType": models.MEDIATYPE_OCI_MANIFEST, "size": 1, "digest": subject},
+		}
+
+		resp, digest := pushManifest(t, url, fmt.Sprintf("sha256:%x", sha256.Sum256(mustMarshal(artifact))), models.MEDIATYPE_OCI_MANIFEST, artifact)
+		if resp.Header.Get("OCI-Subject") != subject {
+			t.Errorf("OCI-Subject of %s is %q", artifactType, resp.Header.Get("OCI-Subject"))
+		}
+
+		artifacts[artifactType] = digest
+	}
+
+	if _, digests := referrers(t, url, subject, ""); len(digests) != 2 {
+		t.Errorf("referrers are %v", digests)
+	}
+
+	resp, digests := referrers(t, url, subject, "?artifactType=application/vnd.example.sbom")
+	if len(digests) != 1 || digests[0] != artifacts["application/vnd.example.sbom"] || resp.Header.Get("OCI-Filters-Applied") != "artifactType" {
+		t.Errorf("filtered referrers are %v, filters %q", digests, resp.Header.Get("OCI-Filters-Applied"))
+	}
+
+	//Referrers are scoped to the repository
+	if _, digests := referrers(t, fmt.Sprintf("%s/v2/library/other", server.URL), subject, ""); len(digests) != 0 {
+		t.Errorf("referrers of another repository are %v", digests)
+	}
+
+	if resp, body := request(t, "DELETE", url+"/manifests/"+artifacts["application/vnd.example.signature"], nil); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("delete referrer status is %d: %s", resp.StatusCode, body)
+	}
+
+	if _, digests := referrers(t, url, subject, ""); len(digests) != 1 || digests[0] != artifacts["application/vnd.example.sbom"] {
+		t.Errorf("referrers after delete are %v", digests)
+	}
+
+	index := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     models.MEDIATYPE_OCI_INDEX,
+		"manifests": []interface{}{map[string]interface{}{
+			"mediaType": models.MEDIATYPE_OCI_MANIFEST,
+			"size":      len(mustMarshal(image)),
+			"digest":    subject,
+			"platform":  map[string]string{"architecture": "amd64", "os": "linux"},
+		}},
+	}
+
+	_, digest := pushManifest(t, url, "multi", models.MEDIATYPE_OCI_INDEX, index)
+
+	if resp, body := request(t, "GET", url+"/manifests/multi", nil, "Accept", models.MEDIATYPE_OCI_INDEX); resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != models.MEDIATYPE_OCI_INDEX || resp.Header.Get("Docker-Content-Digest") != digest {
+		t.Errorf("get index status is %d, type %s: %s", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+
+	//Clients don't accept the index get the manifest of the platform
+	if resp, _ := request(t, "GET", url+"/manifests/multi", nil, "Accept", models.MEDIATYPE_OCI_MANIFEST); resp.StatusCode != http.StatusOK || resp.Header.Get("Docker-Content-Digest") != subject {
+		t.Errorf("get platform manifest status is %d, digest %s", resp.StatusCode, resp.Header.Get("Docker-Content-Digest"))
+	}
+
+	//Manifests of an index must be pushed before
+	index["manifests"] = []interface{}{map[string]interface{}{"mediaType": models.MEDIATYPE_OCI_MANIFEST, "size": 1, "digest": "sha256:1111111111111111111111111111111111111111111111111111111111111111"}}
+	data, _ := json.Marshal(index)
+	if resp, _ := request(t, "PUT", url+"/manifests/broken", bytes.NewReader(data), "Content-Type", models.MEDIATYPE_OCI_INDEX); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("put index of unknown manifest status is %d", resp.StatusCode)
+	}
+
+	tags := struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{}
+
+	if _, body := request(t, "GET", url+"/tags/list", nil); json.Unmarshal(body, &tags) != nil || tags.Name != "library/app" || fmt.Sprint(tags.Tags) != "[latest multi]" {
+		t.Errorf("tags are %s", body)
+	}
+}
+
+func mustMarshal(v interface{}) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
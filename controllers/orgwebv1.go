@@ -385,6 +385,7 @@ func (this *OrganizationWebV1Controller) PostTeam() {
 	}
 
 	team.Id = fmt.Sprintf("%s-%s", this.Ctx.Input.Param(":org"), this.Ctx.Input.Param(":team"))
+	team.Name, team.Organization = this.Ctx.Input.Param(":team"), org.Name
 	team.Username = this.Ctx.Input.Param(":username")
 	team.Users, team.Repositories = []string{this.Ctx.Input.Param(":username")}, []string{}
 	team.Created = time.Now().UnixNano() / int64(time.Millisecond)
@@ -523,7 +524,7 @@ func (this *OrganizationWebV1Controller) PostMember() {
 		return
 	}
 
-	if exist, _, err := user.Has(this.Ctx.Input.Param(":member")); err != nil {
+	if exist, _, err := member.Has(this.Ctx.Input.Param(":member")); err != nil {
 		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
 		return
 	} else if exist == false {
@@ -592,7 +593,7 @@ func (this *OrganizationWebV1Controller) PutMember() {
 		return
 	}
 
-	if exist, _, err := user.Has(this.Ctx.Input.Param(":member")); err != nil {
+	if exist, _, err := member.Has(this.Ctx.Input.Param(":member")); err != nil {
 		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
 		return
 	} else if exist == false {
@@ -612,12 +613,12 @@ func (this *OrganizationWebV1Controller) PutMember() {
 		}
 	}
 
-	for i, v := range user.JoinTeams {
+	for i, v := range member.JoinTeams {
 		if v == team.Id {
-			user.JoinTeams = append(user.JoinTeams[:i], user.JoinTeams[i+1:]...)
-			user.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+			member.JoinTeams = append(member.JoinTeams[:i], member.JoinTeams[i+1:]...)
+			member.Updated = time.Now().UnixNano() / int64(time.Millisecond)
 
-			if err := user.Save(); err != nil {
+			if err := member.Save(); err != nil {
 				this.JSONOut(http.StatusBadRequest, "User save error", nil)
 				return
 			}
@@ -658,3 +659,208 @@ func (this *OrganizationWebV1Controller) PutMember() {
 	this.JSONOut(http.StatusOK, "User remove successfully.", nil)
 	return
 }
+
+// organizationOwner returns the organization when the signed in user owns it.
+func (this *OrganizationWebV1Controller) organizationOwner() (*models.User, *models.Organization, bool) {
+	user, exist := sessionUser(this.Ctx)
+	if exist == false {
+		this.JSONOut(http.StatusUnauthorized, "", map[string]string{"message": "Session load failure", "url": "/auth"})
+		return nil, nil, false
+	}
+
+	org := new(models.Organization)
+
+	if exist, _, err := org.Has(this.Ctx.Input.Param(":org")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return nil, nil, false
+	} else if exist == false {
+		this.JSONOut(http.StatusBadRequest, "Organization not exist", nil)
+		return nil, nil, false
+	}
+
+	if org.Username != user.Username {
+		this.JSONOut(http.StatusForbidden, "Only the owner of organization could manage it", nil)
+		return nil, nil, false
+	}
+
+	return user, org, true
+}
+
+func (this *OrganizationWebV1Controller) GetRobots() {
+	_, org, ok := this.organizationOwner()
+	if ok == false {
+		return
+	}
+
+	robots := make([]map[string]interface{}, 0)
+
+	for _, token := range new(models.AccessToken).All(org.Name, true) {
+		robot := accessTokenView(token)
+		robot["username"] = org.Name + models.ROBOT_SEPARATOR + token.Name
+
+		robots = append(robots, robot)
+	}
+
+	this.JSONOut(http.StatusOK, "", robots)
+	return
+}
+
+// PostRobot creates a robot account signs in with the username "<org>+<name>" and the token in this response.
+func (this *OrganizationWebV1Controller) PostRobot() {
+	user, org, ok := this.organizationOwner()
+	if ok == false {
+		return
+	}
+
+	var request accessTokenRequest
+	if err := json.Unmarshal(this.Ctx.Input.CopyBody(), &request); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	token := new(models.AccessToken)
+
+	secret, err := token.Create(org.Name, request.Name, true, request.Scopes, request.Repositories, request.Expires)
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	user.Log(models.ACTION_ADD_ROBOT, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, token.Id, memo)
+	org.Log(models.ACTION_ADD_ROBOT, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, token.Id, memo)
+
+	result := accessTokenView(token)
+	result["username"] = org.Name + models.ROBOT_SEPARATOR + token.Name
+	result["token"] = secret
+
+	this.JSONOut(http.StatusOK, "", result)
+	return
+}
+
+func (this *OrganizationWebV1Controller) DeleteRobot() {
+	user, org, ok := this.organizationOwner()
+	if ok == false {
+		return
+	}
+
+	token := new(models.AccessToken)
+
+	if has, _, err := token.Has(org.Name, this.Ctx.Input.Param(":robot")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if has == false || token.Robot == false {
+		this.JSONOut(http.StatusNotFound, "Robot account not exist", nil)
+		return
+	}
+
+	if err := token.Revoke(); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	user.Log(models.ACTION_REMOVE_ROBOT, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, token.Id, memo)
+	org.Log(models.ACTION_REMOVE_ROBOT, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, token.Id, memo)
+
+	this.JSONOut(http.StatusOK, "Remove robot account successfully", nil)
+	return
+}
+
+func (this *OrganizationWebV1Controller) GetWebhooks() {
+	_, org, ok := this.organizationOwner()
+	if ok == false {
+		return
+	}
+
+	hooks := make([]map[string]interface{}, 0)
+
+	for _, hook := range new(models.Webhook).All(org.Name, "") {
+		hooks = append(hooks, webhookView(hook))
+	}
+
+	this.JSONOut(http.StatusOK, "", hooks)
+	return
+}
+
+// PostWebhook creates a webhook of all repositories in the organization.
+func (this *OrganizationWebV1Controller) PostWebhook() {
+	this.saveWebhook("")
+}
+
+func (this *OrganizationWebV1Controller) PutWebhook() {
+	this.saveWebhook(this.Ctx.Input.Param(":webhook"))
+}
+
+func (this *OrganizationWebV1Controller) saveWebhook(id string) {
+	user, org, ok := this.organizationOwner()
+	if ok == false {
+		return
+	}
+
+	hook, code, err := saveWebhook(this.Ctx.Input.CopyBody(), org.Name, "", id)
+	if err != nil {
+		this.JSONOut(code, err.Error(), nil)
+		return
+	}
+
+	action := models.ACTION_ADD_WEBHOOK
+	if len(id) > 0 {
+		action = models.ACTION_UPDATE_WEBHOOK
+	}
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	user.Log(int64(action), models.LEVELINFORMATIONAL, models.TYPE_WEBV1, hook.Id, memo)
+	org.Log(int64(action), models.LEVELINFORMATIONAL, models.TYPE_WEBV1, hook.Id, memo)
+
+	this.JSONOut(http.StatusOK, "", webhookView(hook))
+	return
+}
+
+func (this *OrganizationWebV1Controller) DeleteWebhook() {
+	user, org, ok := this.organizationOwner()
+	if ok == false {
+		return
+	}
+
+	hook := new(models.Webhook)
+	if exist, err := hook.Get(org.Name, "", this.Ctx.Input.Param(":webhook")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if exist == false {
+		this.JSONOut(http.StatusNotFound, "Webhook not exist", nil)
+		return
+	}
+
+	if err := hook.Remove(); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	user.Log(models.ACTION_REMOVE_WEBHOOK, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, hook.Id, memo)
+	org.Log(models.ACTION_REMOVE_WEBHOOK, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, hook.Id, memo)
+
+	this.JSONOut(http.StatusOK, "Remove webhook successfully", nil)
+	return
+}
+
+// GetDeliveries returns the delivery history of the webhook, the newest is the first.
+func (this *OrganizationWebV1Controller) GetDeliveries() {
+	_, org, ok := this.organizationOwner()
+	if ok == false {
+		return
+	}
+
+	hook := new(models.Webhook)
+	if exist, err := hook.Get(org.Name, "", this.Ctx.Input.Param(":webhook")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if exist == false {
+		this.JSONOut(http.StatusNotFound, "Webhook not exist", nil)
+		return
+	}
+
+	this.JSONOut(http.StatusOK, "", hook.History())
+	return
+}
@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/astaxie/beego"
 
+	"github.com/containerops/wharf/auth"
 	"github.com/containerops/wharf/models"
 	"github.com/containerops/wharf/modules"
 	"github.com/containerops/wharf/utils"
@@ -35,11 +37,33 @@ func (this *PingAPIV2Controller) Prepare() {
 	this.EnableXSRF = false
 
 	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Type", "application/json;charset=UTF-8")
-	this.Ctx.Output.Context.ResponseWriter.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=\"\"", beego.AppConfig.String("docker::Endpoints")))
+	if modules.TokenEnabled() == true {
+		this.Ctx.Output.Context.ResponseWriter.Header().Set("WWW-Authenticate", modules.TokenChallenge("", ""))
+	} else {
+		this.Ctx.Output.Context.ResponseWriter.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=\"%s\"", beego.AppConfig.String("docker::Endpoints")))
+	}
 	this.Ctx.Output.Context.ResponseWriter.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
 }
 
 func (this *PingAPIV2Controller) GetPing() {
+	//Clients get a token from the realm in "WWW-Authenticate" and ping again with it
+	if modules.TokenEnabled() == true {
+		authorization := this.Ctx.Input.Header("Authorization")
+
+		if strings.HasPrefix(authorization, "Bearer ") == false {
+			this.JSONOut(http.StatusUnauthorized, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnauthorized]}})
+			return
+		}
+
+		if _, err := modules.ParseToken(strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))); err != nil {
+			this.JSONOut(http.StatusUnauthorized, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnauthorized]}})
+			return
+		}
+
+		this.JSONOut(http.StatusOK, "", map[string]string{})
+		return
+	}
+
 	if len(this.Ctx.Input.Header("Authorization")) == 0 {
 		this.JSONOut(http.StatusUnauthorized, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnauthorized]}})
 		return
@@ -49,9 +73,8 @@ func (this *PingAPIV2Controller) GetPing() {
 		this.JSONOut(http.StatusUnauthorized, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnauthorized]}})
 		return
 	} else {
-		user := new(models.User)
-
-		if err := user.Get(username, passwd); err != nil {
+		user, _, err := auth.Authenticate(username, passwd)
+		if err != nil {
 			this.JSONOut(http.StatusUnauthorized, "", map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnauthorized]}})
 			return
 		}
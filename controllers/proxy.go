@@ -0,0 +1,372 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/context"
+	"github.com/satori/go.uuid"
+
+	"github.com/containerops/wharf/backend"
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/proxy"
+	"github.com/containerops/wharf/utils"
+)
+
+// proxyManifests fetches the manifest of the reference from the upstream registry when it isn't cached, or the cached
+// tag expired. The cached manifest is still served when the upstream registry fails.
+func proxyManifests(namespace, repository, reference string) error {
+	if utils.IsDigest(reference) == true {
+		if has, _, err := new(models.Manifest).Has(namespace, repository, reference); err != nil || has == true {
+			return err
+		}
+
+		_, err := proxyManifest(namespace, repository, reference)
+		return err
+	}
+
+	t := new(models.Tag)
+
+	has, _, err := t.Has(namespace, repository, reference)
+	if err != nil {
+		return err
+	}
+
+	if has == true {
+		fetched, err := models.ProxyFetched(namespace, repository, reference)
+		if err != nil || proxy.Upstream.Expired(fetched) == false {
+			return err
+		}
+
+		//Checking the digest first doesn't pull the manifest again when the tag isn't changed
+		if digest, err := proxy.Upstream.ManifestDigest(namespace, repository, reference); err == nil && digest == t.Digest {
+			return models.PutProxyFetched(namespace, repository, reference)
+		}
+	}
+
+	_, err = proxyManifest(namespace, repository, reference)
+	return err
+}
+
+// proxyManifest fetches the manifest of the reference from the upstream registry and saves it like pushed. The
+// manifests of a manifest list and the image config are fetched too, layers are fetched when they are pulled.
+func proxyManifest(namespace, repository, reference string) (*models.Manifest, error) {
+	data, mediaType, err := proxy.Upstream.Manifest(namespace, repository, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	detected := models.ManifestMediaType(data)
+
+	switch mediaType {
+	case "", "application/json", "text/plain", models.MEDIATYPE_MANIFEST_V1, models.MEDIATYPE_MANIFEST_V1_SIGNED:
+		mediaType = detected
+	}
+
+	if len(detected) == 0 || mediaType != detected {
+		return nil, fmt.Errorf("Upstream manifest %s/%s:%s is invalid", namespace, repository, reference)
+	}
+
+	digest := models.ManifestDigest(data)
+
+	if utils.IsDigest(reference) == true && reference != digest {
+		return nil, fmt.Errorf("Upstream manifest %s/%s digest mismatch: %s", namespace, repository, reference)
+	}
+
+	manifest := &models.Manifest{MediaType: mediaType, Data: string(data)}
+
+	blobs, err := manifest.Blobs()
+	if err != nil {
+		return nil, err
+	}
+
+	//Layers are fetched from the repository when they are pulled with the image id of Docker Registry API V1
+	for _, blobSum := range blobs {
+		if utils.IsDigest(blobSum) == false {
+			return nil, fmt.Errorf("Upstream manifest blob digest is invalid: %s", blobSum)
+		}
+
+		if err := models.PutProxyBlob(blobSum, namespace, repository); err != nil {
+			return nil, err
+		}
+	}
+
+	//The config is read to convert the manifest to schema1
+	if config, _, err := manifest.Config(); err == nil && utils.IsDigest(config.Digest) == true {
+		if err := proxyFetchBlob(namespace, repository, config.Digest); err != nil {
+			return nil, err
+		}
+	}
+
+	references, err := manifest.References()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, descriptor := range references {
+		if has, _, err := new(models.Manifest).Has(namespace, repository, descriptor.Digest); err != nil {
+			return nil, err
+		} else if has == false {
+			if _, err := proxyManifest(namespace, repository, descriptor.Digest); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	repo := new(models.Repository)
+
+	if has, _, err := repo.Has(namespace, repository); err != nil {
+		return nil, err
+	} else if has == false {
+		if err := repo.Put(namespace, repository, "", "Wharf-Proxy", models.APIVERSION_V2); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := manifest.Put(namespace, repository, mediaType, data); err != nil {
+		return nil, err
+	}
+
+	if utils.IsDigest(reference) == true {
+		return manifest, nil
+	}
+
+	switch mediaType {
+	case models.MEDIATYPE_MANIFEST_V1, models.MEDIATYPE_MANIFEST_V1_SIGNED:
+		err = manifestsConvertV1(namespace, repository, reference, data, digest)
+	default:
+		image := ""
+		if config, _, e := manifest.Config(); e == nil {
+			image = strings.TrimPrefix(config.Digest, "sha256:")
+		}
+
+		err = repo.PutTagFromManifests(image, namespace, repository, reference, string(data), digest)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := models.PutProxyFetched(namespace, repository, reference); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// proxyImages caches the tags of the repository for the pulls with Docker Registry API V1, "latest" is cached first
+// and the number of tags is limited by "proxy::V1Tags".
+func proxyImages(namespace, repository string) error {
+	if fetched, err := models.ProxyFetched(namespace, repository, ""); err != nil || proxy.Upstream.Expired(fetched) == false {
+		return err
+	}
+
+	tags, err := proxy.Upstream.Tags(namespace, repository)
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(tags)
+
+	selected := []string{}
+	for _, tag := range tags {
+		if tag == "latest" {
+			selected = append([]string{tag}, selected...)
+		} else {
+			selected = append(selected, tag)
+		}
+	}
+
+	if len(selected) > proxy.Upstream.V1Tags {
+		selected = selected[:proxy.Upstream.V1Tags]
+	}
+
+	//A broken tag doesn't stop caching the others, the last error is returned
+	for _, tag := range selected {
+		if e := proxyManifests(namespace, repository, tag); e != nil {
+			err = e
+			continue
+		}
+
+		if e := proxyImagesV1(namespace, repository, tag); e != nil {
+			err = e
+		}
+	}
+
+	if e := models.PutProxyFetched(namespace, repository, ""); e != nil {
+		return e
+	}
+
+	return err
+}
+
+// proxyImagesV1 saves the V1 images of the schema2 manifest of the tag, so the tag points to the V1 image id.
+// Schema1 manifests were saved with the V1 images already.
+func proxyImagesV1(namespace, repository, tag string) error {
+	t := new(models.Tag)
+	if has, _, err := t.Has(namespace, repository, tag); err != nil || has == false {
+		return err
+	}
+
+	manifest := new(models.Manifest)
+	if has, _, err := manifest.Has(namespace, repository, t.Digest); err != nil || has == false {
+		return err
+	}
+
+	if manifest.MediaType == models.MEDIATYPE_MANIFEST_LIST || manifest.MediaType == models.MEDIATYPE_OCI_INDEX {
+		platform, err := manifestsPlatform(namespace, repository, manifest)
+		if err != nil {
+			return err
+		}
+
+		manifest = platform
+	}
+
+	if manifest.MediaType != models.MEDIATYPE_MANIFEST_V2 {
+		return nil
+	}
+
+	data, digest, err := manifestsSchema1(namespace, repository, tag, manifest)
+	if err != nil {
+		return err
+	}
+
+	if err := manifestsConvertV1(namespace, repository, "", data, digest); err != nil {
+		return err
+	}
+
+	var schema1 schema1Manifest
+	if err := json.Unmarshal(data, &schema1); err != nil {
+		return err
+	}
+
+	var image schema1V1Compatibility
+
+	if err := json.Unmarshal([]byte(schema1.History[0].V1Compatibility), &image); err != nil {
+		return err
+	}
+
+	return new(models.Repository).PutTagFromManifests(image.Id, namespace, repository, tag, t.Manifest, t.Digest)
+}
+
+// proxyBlob streams the blob from the upstream registry to the response and caches it at path at the same time, HEAD
+// only checks the blob in the upstream registry. The error is returned only when nothing has been written to the
+// response yet.
+func proxyBlob(ctx *context.Context, namespace, repository, digest, path string) error {
+	header := ctx.ResponseWriter.Header()
+
+	if ctx.Input.IsHead() == true {
+		size, err := proxy.Upstream.StatBlob(namespace, repository, digest)
+		if err != nil {
+			return err
+		}
+
+		header.Set("Content-Type", "application/octet-stream")
+		header.Set("Docker-Content-Digest", digest)
+		header.Set("ETag", fmt.Sprintf("\"%s\"", digest))
+
+		if size >= 0 {
+			header.Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+
+		ctx.ResponseWriter.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	reader, size, err := proxy.Upstream.Blob(namespace, repository, digest)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Transfer-Encoding", "binary")
+	header.Set("Docker-Content-Digest", digest)
+	header.Set("ETag", fmt.Sprintf("\"%s\"", digest))
+
+	if size >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	ctx.ResponseWriter.WriteHeader(http.StatusOK)
+
+	if err := proxyStore(reader, ctx.ResponseWriter, path, digest); err != nil {
+		beego.Error(fmt.Sprintf("[proxy] cache blob %s/%s %s error: %s", namespace, repository, digest, err.Error()))
+		return nil
+	}
+
+	models.PutProxyBlob(digest, namespace, repository)
+
+	return nil
+}
+
+// proxyFetchBlob caches the blob from the upstream registry without a client, like the image config.
+func proxyFetchBlob(namespace, repository, digest string) error {
+	path := fmt.Sprintf("uuid/%v/layer", strings.Split(digest, ":")[1])
+
+	if _, err := backend.Storage.Stat(path); err == nil {
+		return nil
+	}
+
+	reader, _, err := proxy.Upstream.Blob(namespace, repository, digest)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return proxyStore(reader, ioutil.Discard, path, digest)
+}
+
+// proxyStore copies the blob to w and to a staging file, the staging file is moved to path only when the sha256
+// matches the digest. The client going away doesn't stop caching the blob.
+func proxyStore(reader io.Reader, w io.Writer, path, digest string) error {
+	staging := fmt.Sprintf("proxy/%s", uuid.NewV4().String())
+
+	writer, err := backend.Storage.Writer(staging)
+	if err != nil {
+		//The client still gets the blob when it can't be cached
+		io.Copy(w, reader)
+		return err
+	}
+
+	h := sha256.New()
+
+	_, err = io.Copy(io.MultiWriter(writer, h, &detachedWriter{writer: w}), reader)
+
+	if err == nil && fmt.Sprintf("sha256:%x", h.Sum(nil)) != digest {
+		err = fmt.Errorf("Upstream blob digest mismatch: %s", digest)
+	}
+
+	if err != nil {
+		writer.Cancel()
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return backend.Storage.Move(staging, path)
+}
+
+// detachedWriter ignores the errors of the writer after the first one, so copying to other writers goes on.
+type detachedWriter struct {
+	writer io.Writer
+	err    error
+}
+
+func (w *detachedWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.writer.Write(p)
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerops/wharf/backend"
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/proxy"
+)
+
+// pushImage pushes an image of one layer with the tag, returns the digests of the manifest and the layer.
+func pushImage(t *testing.T, url, tag, layer string) (string, string) {
+	config := pushBlob(t, url, []byte(fmt.Sprintf(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":["%s"]}}`, layer)))
+	digest := pushBlob(t, url, []byte(layer))
+
+	_, manifest := pushManifest(t, url, tag, models.MEDIATYPE_MANIFEST_V2, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     models.MEDIATYPE_MANIFEST_V2,
+		"config":        map[string]interface{}{"mediaType": "application/vnd.docker.container.image.v1+json", "size": 10, "digest": config},
+		"layers":        []map[string]interface{}{{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": len(layer), "digest": digest}},
+	})
+
+	return manifest, digest
+}
+
+func cached(digest string) bool {
+	_, err := backend.Storage.Stat(fmt.Sprintf("uuid/%s/layer", strings.Split(digest, ":")[1]))
+	return err == nil
+}
+
+func TestProxy(t *testing.T) {
+	upstream, stop := instance(t)
+	defer stop()
+
+	server, teardown := setup(t)
+	defer teardown()
+
+	registry, err := proxy.NewRegistry(map[string]string{"url": upstream, "tagttl": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := proxy.Upstream
+	defer func() { proxy.Upstream = original }()
+	proxy.Upstream = registry
+
+	first, layer := pushImage(t, upstream+"/v2/library/app", "latest", "first layer")
+
+	//A miss fetches the manifest and the config, the layer is fetched when it's pulled
+	resp, _ := request(t, "GET", server.URL+"/v2/library/app/manifests/latest", nil, "Accept", models.MEDIATYPE_MANIFEST_V2)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Docker-Content-Digest") != first {
+		t.Fatalf("proxied manifest is %d %s, want %s", resp.StatusCode, resp.Header.Get("Docker-Content-Digest"), first)
+	}
+
+	if has, _, _ := new(models.Tag).Has("library", "app", "latest"); has == false {
+		t.Errorf("proxied tag isn't cached")
+	}
+
+	if cached(layer) == true {
+		t.Errorf("layer is cached before it's pulled")
+	}
+
+	if resp, body := request(t, "GET", fmt.Sprintf("%s/v2/library/app/blobs/%s", server.URL, layer), nil); resp.StatusCode != http.StatusOK || string(body) != "first layer" {
+		t.Fatalf("proxied layer is %d: %s", resp.StatusCode, body)
+	}
+
+	if cached(layer) == false {
+		t.Errorf("pulled layer isn't cached")
+	}
+
+	//The cached tag is served until the TTL expires
+	second, _ := pushImage(t, upstream+"/v2/library/app", "latest", "second layer")
+
+	if resp, _ := request(t, "GET", server.URL+"/v2/library/app/manifests/latest", nil, "Accept", models.MEDIATYPE_MANIFEST_V2); resp.Header.Get("Docker-Content-Digest") != first {
+		t.Errorf("manifest before the TTL expires is %s, want %s", resp.Header.Get("Docker-Content-Digest"), first)
+	}
+
+	time.Sleep(registry.TagTTL + 100*time.Millisecond)
+
+	if resp, _ := request(t, "GET", server.URL+"/v2/library/app/manifests/latest", nil, "Accept", models.MEDIATYPE_MANIFEST_V2); resp.Header.Get("Docker-Content-Digest") != second {
+		t.Errorf("manifest after the TTL expires is %s, want %s", resp.Header.Get("Docker-Content-Digest"), second)
+	}
+
+	//The cache is still served when the upstream registry is gone
+	stop()
+	time.Sleep(registry.TagTTL + 100*time.Millisecond)
+
+	if resp, _ := request(t, "GET", server.URL+"/v2/library/app/manifests/latest", nil, "Accept", models.MEDIATYPE_MANIFEST_V2); resp.StatusCode != http.StatusOK || resp.Header.Get("Docker-Content-Digest") != second {
+		t.Errorf("manifest without upstream is %d %s", resp.StatusCode, resp.Header.Get("Docker-Content-Digest"))
+	}
+
+	if resp, body := request(t, "GET", fmt.Sprintf("%s/v2/library/app/blobs/%s", server.URL, layer), nil); resp.StatusCode != http.StatusOK || string(body) != "first layer" {
+		t.Errorf("cached layer without upstream is %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestProxyStoreDigestMismatch(t *testing.T) {
+	_, teardown := setup(t)
+	defer teardown()
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("layer")))
+	path := fmt.Sprintf("uuid/%s/layer", strings.Split(digest, ":")[1])
+
+	//The client gets what the upstream sent, but it isn't cached
+	w := new(bytes.Buffer)
+	if err := proxyStore(strings.NewReader("tampered"), w, path, digest); err == nil {
+		t.Errorf("blob of another digest is stored")
+	}
+
+	if w.String() != "tampered" {
+		t.Errorf("client got %q", w.String())
+	}
+
+	if _, err := backend.Storage.Stat(path); err == nil {
+		t.Errorf("blob of another digest is cached")
+	}
+
+	if files, _ := backend.Storage.List("proxy"); len(files) > 0 {
+		t.Errorf("staging files are left: %v", files)
+	}
+
+	if err := proxyStore(strings.NewReader("layer"), new(bytes.Buffer), path, digest); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backend.Storage.Stat(path); err != nil {
+		t.Errorf("blob isn't cached: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/replication"
+)
+
+// lastJob returns the newest job of the replication.
+func lastJob(t *testing.T, r *models.Replication) *models.ReplicationJob {
+	if err := r.GetById(r.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := r.History()
+	if len(jobs) == 0 {
+		t.Fatalf("replication has no job")
+	}
+
+	return jobs[0]
+}
+
+func manifestDigest(t *testing.T, url, reference string) string {
+	resp, _ := request(t, "HEAD", fmt.Sprintf("%s/manifests/%s", url, reference), nil, "Accept", models.MEDIATYPE_MANIFEST_V2)
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	return resp.Header.Get("Docker-Content-Digest")
+}
+
+func TestReplication(t *testing.T) {
+	target, stop := instance(t)
+	defer stop()
+
+	server, teardown := setup(t)
+	defer teardown()
+
+	attempts, backoff := replication.Attempts, replication.Backoff
+	defer func() { replication.Attempts, replication.Backoff = attempts, backoff }()
+
+	r := new(models.Replication)
+	if err := r.Create("library", "", "v*", target, "", "", true); err != nil {
+		t.Fatal(err)
+	}
+
+	source, destination := server.URL+"/v2/library/app", target+"/v2/library/app"
+
+	//The push enqueues the tags the replication wants
+	manifest, layer := pushImage(t, source, "v1", "layer")
+	pushImage(t, source, "latest", "latest layer")
+
+	if count := replication.Dispatch(); count != 1 {
+		t.Fatalf("dispatched %d jobs, want 1", count)
+	}
+
+	if job := lastJob(t, r); job.Status != models.REPLICATION_STATUS_SUCCEEDED || job.Tag != "v1" || job.Digest != manifest || job.Blobs != 2 || job.Attempts != 1 {
+		t.Errorf("job is %+v", job)
+	}
+
+	if digest := manifestDigest(t, destination, "v1"); digest != manifest {
+		t.Errorf("replicated manifest is %s, want %s", digest, manifest)
+	}
+
+	if resp, body := request(t, "GET", fmt.Sprintf("%s/blobs/%s", destination, layer), nil); resp.StatusCode != http.StatusOK || string(body) != "layer" {
+		t.Errorf("replicated layer is %d: %s", resp.StatusCode, body)
+	}
+
+	if digest := manifestDigest(t, destination, "latest"); len(digest) > 0 {
+		t.Errorf("tag out of the pattern is replicated: %s", digest)
+	}
+
+	//Blobs the target has already aren't uploaded again
+	pushImage(t, source, "v2", "layer")
+	replication.Dispatch()
+
+	if job := lastJob(t, r); job.Status != models.REPLICATION_STATUS_SUCCEEDED || job.Tag != "v2" || job.Blobs != 0 {
+		t.Errorf("job of the tag with the same blobs is %+v", job)
+	}
+
+	//The full sync enqueues only the tags changed in the target
+	if count, err := replication.Sync(r); err != nil || count != 0 {
+		t.Errorf("sync of the replicated tags enqueued %d: %v", count, err)
+	}
+
+	changed, _ := pushImage(t, destination, "v1", "changed in the target")
+
+	if count, err := replication.Sync(r); err != nil || count != 1 {
+		t.Fatalf("sync of the changed tag enqueued %d: %v", count, err)
+	}
+
+	if job := lastJob(t, r); job.Trigger != models.REPLICATION_TRIGGER_SYNC || job.Tag != "v1" {
+		t.Errorf("sync job is %+v", job)
+	}
+
+	replication.Dispatch()
+
+	if digest := manifestDigest(t, destination, "v1"); digest != manifest || digest == changed {
+		t.Errorf("synced manifest is %s, want %s", digest, manifest)
+	}
+
+	//Failed jobs are retried after the backoff until the attempts run out
+	stop()
+
+	replication.Attempts, replication.Backoff = 2, time.Hour
+
+	pushImage(t, source, "v3", "unreachable")
+	replication.Dispatch()
+
+	job := lastJob(t, r)
+	if job.Status != models.REPLICATION_STATUS_PENDING || job.Attempts != 1 || len(job.Error) == 0 {
+		t.Errorf("failed job is %+v", job)
+	}
+
+	if wait := time.Duration(job.NextAttempt-job.Updated) * time.Millisecond; wait != time.Hour {
+		t.Errorf("retry is after %s, want 1h", wait)
+	}
+
+	if count := replication.Dispatch(); count != 0 {
+		t.Errorf("job is retried before the backoff")
+	}
+
+	if err := job.Schedule(time.Now().UnixNano() / int64(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	replication.Dispatch()
+
+	if job := lastJob(t, r); job.Status != models.REPLICATION_STATUS_FAILED || job.Attempts != 2 {
+		t.Errorf("job after the attempts is %+v", job)
+	}
+}
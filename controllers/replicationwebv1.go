@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/astaxie/beego"
+
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/replication"
+)
+
+type ReplicationWebV1Controller struct {
+	beego.Controller
+}
+
+type replicationRequest struct {
+	Repository string `json:"repository"`
+	Tags       string `json:"tags"`
+	Endpoint   string `json:"endpoint"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Active     *bool  `json:"active"`
+}
+
+func (this *ReplicationWebV1Controller) URLMapping() {
+	this.Mapping("GetReplications", this.GetReplications)
+	this.Mapping("PostReplication", this.PostReplication)
+	this.Mapping("PutReplication", this.PutReplication)
+	this.Mapping("DeleteReplication", this.DeleteReplication)
+	this.Mapping("GetJobs", this.GetJobs)
+	this.Mapping("PostSync", this.PostSync)
+}
+
+func (this *ReplicationWebV1Controller) JSONOut(code int, message string, data interface{}) {
+	if data == nil {
+		this.Data["json"] = map[string]string{"message": message}
+	} else {
+		this.Data["json"] = data
+	}
+
+	this.Ctx.Output.Context.Output.SetStatus(code)
+	this.ServeJson()
+}
+
+func (this *ReplicationWebV1Controller) Prepare() {
+	this.EnableXSRF = false
+
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Type", "application/json;charset=UTF-8")
+}
+
+func (this *ReplicationWebV1Controller) GetReplications() {
+	namespace, _, _, ok := this.namespaceOwner()
+	if ok == false {
+		return
+	}
+
+	replications := make([]map[string]interface{}, 0)
+
+	for _, r := range new(models.Replication).All(namespace) {
+		replications = append(replications, replicationView(r))
+	}
+
+	this.JSONOut(http.StatusOK, "", replications)
+	return
+}
+
+// PostReplication creates a replication of the namespace, it's active unless "active" is false.
+func (this *ReplicationWebV1Controller) PostReplication() {
+	this.saveReplication("")
+}
+
+// PutReplication updates the replication, the password is kept when it's empty.
+func (this *ReplicationWebV1Controller) PutReplication() {
+	this.saveReplication(this.Ctx.Input.Param(":replication"))
+}
+
+func (this *ReplicationWebV1Controller) saveReplication(id string) {
+	namespace, user, org, ok := this.namespaceOwner()
+	if ok == false {
+		return
+	}
+
+	var request replicationRequest
+	if err := json.Unmarshal(this.Ctx.Input.CopyBody(), &request); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	r := new(models.Replication)
+	action := models.ACTION_ADD_REPLICATION
+
+	if len(id) == 0 {
+		active := request.Active == nil || *request.Active == true
+
+		if err := r.Create(namespace, request.Repository, request.Tags, request.Endpoint, request.Username, request.Password, active); err != nil {
+			this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+	} else {
+		if exist, err := r.Get(namespace, id); err != nil {
+			this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+			return
+		} else if exist == false {
+			this.JSONOut(http.StatusNotFound, "Replication not exist", nil)
+			return
+		}
+
+		active := r.Active
+		if request.Active != nil {
+			active = *request.Active
+		}
+
+		if err := r.Update(request.Repository, request.Tags, request.Endpoint, request.Username, request.Password, active); err != nil {
+			this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+
+		action = models.ACTION_UPDATE_REPLICATION
+	}
+
+	this.log(user, org, action, r.Id)
+
+	this.JSONOut(http.StatusOK, "", replicationView(r))
+	return
+}
+
+func (this *ReplicationWebV1Controller) DeleteReplication() {
+	r, user, org, ok := this.replication()
+	if ok == false {
+		return
+	}
+
+	if err := r.Remove(); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	this.log(user, org, models.ACTION_REMOVE_REPLICATION, r.Id)
+
+	this.JSONOut(http.StatusOK, "Remove replication successfully", nil)
+	return
+}
+
+// GetJobs returns the job history of the replication with the counts by the status, the newest job is the first.
+func (this *ReplicationWebV1Controller) GetJobs() {
+	r, _, _, ok := this.replication()
+	if ok == false {
+		return
+	}
+
+	this.JSONOut(http.StatusOK, "", map[string]interface{}{"status": r.Status(), "jobs": r.History()})
+	return
+}
+
+// PostSync starts the full sync of the replication in the background, the jobs enqueued are listed in GetJobs.
+func (this *ReplicationWebV1Controller) PostSync() {
+	r, user, org, ok := this.replication()
+	if ok == false {
+		return
+	}
+
+	if r.Active == false {
+		this.JSONOut(http.StatusBadRequest, "Replication is inactive", nil)
+		return
+	}
+
+	go func() {
+		if _, err := replication.Sync(r); err != nil {
+			beego.Error(fmt.Sprintf("[replication] sync %s error: %s", r.Id, err.Error()))
+		}
+	}()
+
+	this.log(user, org, models.ACTION_SYNC_REPLICATION, r.Id)
+
+	this.JSONOut(http.StatusAccepted, "Replication sync started", nil)
+	return
+}
+
+// namespaceOwner returns the namespace when it's the signed in user, or an organization the user owns.
+func (this *ReplicationWebV1Controller) namespaceOwner() (string, *models.User, *models.Organization, bool) {
+	user, exist := sessionUser(this.Ctx)
+	if exist == false {
+		this.JSONOut(http.StatusUnauthorized, "", map[string]string{"message": "Session load failure", "url": "/auth"})
+		return "", nil, nil, false
+	}
+
+	namespace := this.Ctx.Input.Param(":namespace")
+
+	if namespace == user.Username {
+		return namespace, user, nil, true
+	}
+
+	org := new(models.Organization)
+
+	if exist, _, err := org.Has(namespace); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return "", nil, nil, false
+	} else if exist == false {
+		this.JSONOut(http.StatusBadRequest, "Namespace not exist", nil)
+		return "", nil, nil, false
+	}
+
+	if org.Username != user.Username {
+		this.JSONOut(http.StatusForbidden, "Only the owner of organization could manage it", nil)
+		return "", nil, nil, false
+	}
+
+	return namespace, user, org, true
+}
+
+func (this *ReplicationWebV1Controller) replication() (*models.Replication, *models.User, *models.Organization, bool) {
+	namespace, user, org, ok := this.namespaceOwner()
+	if ok == false {
+		return nil, nil, nil, false
+	}
+
+	r := new(models.Replication)
+	if exist, err := r.Get(namespace, this.Ctx.Input.Param(":replication")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return nil, nil, nil, false
+	} else if exist == false {
+		this.JSONOut(http.StatusNotFound, "Replication not exist", nil)
+		return nil, nil, nil, false
+	}
+
+	return r, user, org, true
+}
+
+func (this *ReplicationWebV1Controller) log(user *models.User, org *models.Organization, action int, id string) {
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+
+	user.Log(int64(action), models.LEVELINFORMATIONAL, models.TYPE_WEBV1, id, memo)
+	if org != nil {
+		org.Log(int64(action), models.LEVELINFORMATIONAL, models.TYPE_WEBV1, id, memo)
+	}
+}
+
+// replicationView hides the password of the replication in responses.
+func replicationView(r *models.Replication) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         r.Id,
+		"namespace":  r.Namespace,
+		"repository": r.Repository,
+		"tags":       r.Tags,
+		"endpoint":   r.Endpoint,
+		"username":   r.Username,
+		"password":   len(r.Password) > 0,
+		"active":     r.Active,
+		"synced":     r.Synced,
+		"status":     r.Status(),
+		"created":    r.Created,
+		"updated":    r.Updated,
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"github.com/astaxie/beego"
 
 	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/notifications"
+	"github.com/containerops/wharf/proxy"
 	"github.com/containerops/wharf/utils"
 )
 
@@ -22,6 +24,8 @@ func (this *RepoAPIV1Controller) URLMapping() {
 	this.Mapping("GetRepositoryImages", this.GetRepositoryImages)
 	this.Mapping("GetRepositoryTags", this.GetRepositoryTags)
 	this.Mapping("PutRepository", this.PutRepository)
+	this.Mapping("DeleteTag", this.DeleteTag)
+	this.Mapping("DeleteRepository", this.DeleteRepository)
 }
 
 func (this *RepoAPIV1Controller) JSONOut(code int, message string, data interface{}) {
@@ -49,7 +53,7 @@ func (this *RepoAPIV1Controller) PutRepository() {
 	username, _, _ := utils.DecodeBasicAuth(this.Ctx.Input.Header("Authorization"))
 
 	namespace := string(this.Ctx.Input.Param(":namespace"))
-	repository := string(this.Ctx.Input.Param(":repo_name"))
+	repository := string(this.Ctx.Input.Param(":splat"))
 
 	repo := new(models.Repository)
 
@@ -83,7 +87,7 @@ func (this *RepoAPIV1Controller) PutRepository() {
 
 func (this *RepoAPIV1Controller) PutTag() {
 	namespace := this.Ctx.Input.Param(":namespace")
-	repository := this.Ctx.Input.Param(":repo_name")
+	repository := this.Ctx.Input.Param(":splat")
 
 	tag := this.Ctx.Input.Param(":tag")
 
@@ -99,6 +103,56 @@ func (this *RepoAPIV1Controller) PutTag() {
 	memo, _ := json.Marshal(this.Ctx.Input.Header)
 	repo.Log(models.ACTION_PUT_TAG, models.LEVELINFORMATIONAL, models.TYPE_APIV1, repo.Id, memo)
 
+	notifyEvent(this.Ctx, models.WEBHOOK_EVENT_TAG, namespace, repository, notifications.Target{Tag: tag})
+
+	this.Ctx.Output.Context.Output.SetStatus(http.StatusOK)
+	this.Ctx.Output.Context.Output.Body([]byte(""))
+	return
+}
+
+func (this *RepoAPIV1Controller) DeleteTag() {
+	namespace := this.Ctx.Input.Param(":namespace")
+	repository := this.Ctx.Input.Param(":splat")
+
+	tag := this.Ctx.Input.Param(":tag")
+
+	repo := new(models.Repository)
+	if err := repo.RemoveTag(namespace, repository, tag); err != nil {
+		this.JSONOut(http.StatusNotFound, err.Error(), nil)
+		return
+	}
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	repo.Log(models.ACTION_REMOVE_TAG, models.LEVELINFORMATIONAL, models.TYPE_APIV1, repo.Id, memo)
+
+	notifyEvent(this.Ctx, models.WEBHOOK_EVENT_DELETE, namespace, repository, notifications.Target{Tag: tag})
+
+	this.Ctx.Output.Context.Output.SetStatus(http.StatusOK)
+	this.Ctx.Output.Context.Output.Body([]byte(""))
+	return
+}
+
+func (this *RepoAPIV1Controller) DeleteRepository() {
+	username, _, _ := utils.DecodeBasicAuth(this.Ctx.Input.Header("Authorization"))
+
+	namespace := this.Ctx.Input.Param(":namespace")
+	repository := this.Ctx.Input.Param(":splat")
+
+	repo := new(models.Repository)
+	if err := repo.Delete(namespace, repository); err != nil {
+		this.JSONOut(http.StatusNotFound, err.Error(), nil)
+		return
+	}
+
+	//The repository is removed, log with the user
+	user := new(models.User)
+	if has, _, err := user.Has(username); err == nil && has == true {
+		memo, _ := json.Marshal(this.Ctx.Input.Header)
+		user.Log(models.ACTION_REMOVE_REPO, models.LEVELINFORMATIONAL, models.TYPE_APIV1, repo.Id, memo)
+	}
+
+	notifyEvent(this.Ctx, models.WEBHOOK_EVENT_DELETE, namespace, repository, notifications.Target{})
+
 	this.Ctx.Output.Context.Output.SetStatus(http.StatusOK)
 	this.Ctx.Output.Context.Output.Body([]byte(""))
 	return
@@ -106,7 +160,7 @@ func (this *RepoAPIV1Controller) PutTag() {
 
 func (this *RepoAPIV1Controller) PutRepositoryImages() {
 	namespace := this.Ctx.Input.Param(":namespace")
-	repository := this.Ctx.Input.Param(":repo_name")
+	repository := this.Ctx.Input.Param(":splat")
 
 	repo := new(models.Repository)
 
@@ -118,6 +172,9 @@ func (this *RepoAPIV1Controller) PutRepositoryImages() {
 	memo, _ := json.Marshal(this.Ctx.Input.Header)
 	repo.Log(models.ACTION_PUT_REPO_IMAGES, models.LEVELINFORMATIONAL, models.TYPE_APIV1, repo.Id, memo)
 
+	notifyEvent(this.Ctx, models.WEBHOOK_EVENT_PUSH, namespace, repository, notifications.Target{})
+	replicate(namespace, repository, "")
+
 	org := new(models.Organization)
 	isOrg, _, err := org.Has(namespace)
 	if err != nil {
@@ -156,7 +213,14 @@ func (this *RepoAPIV1Controller) PutRepositoryImages() {
 
 func (this *RepoAPIV1Controller) GetRepositoryImages() {
 	namespace := string(this.Ctx.Input.Param(":namespace"))
-	repository := string(this.Ctx.Input.Param(":repo_name"))
+	repository := string(this.Ctx.Input.Param(":splat"))
+
+	//Repositories of the namespaces not in Wharf are pulled through the upstream registry in proxy mode
+	if proxy.Proxied(namespace) == true {
+		if err := proxyImages(namespace, repository); err != nil {
+			beego.Error(fmt.Sprintf("[proxy] fetch images %s/%s error: %s", namespace, repository, err.Error()))
+		}
+	}
 
 	repo := new(models.Repository)
 
@@ -177,6 +241,8 @@ func (this *RepoAPIV1Controller) GetRepositoryImages() {
 	memo, _ := json.Marshal(this.Ctx.Input.Header)
 	repo.Log(models.ACTION_GET_REPO, models.LEVELINFORMATIONAL, models.TYPE_APIV1, repo.Id, memo)
 
+	notifyEvent(this.Ctx, models.WEBHOOK_EVENT_PULL, namespace, repository, notifications.Target{})
+
 	this.Ctx.Output.Context.Output.SetStatus(http.StatusOK)
 	this.Ctx.Output.Context.Output.Body([]byte(repo.JSON))
 	return
@@ -184,7 +250,7 @@ func (this *RepoAPIV1Controller) GetRepositoryImages() {
 
 func (this *RepoAPIV1Controller) GetRepositoryTags() {
 	namespace := this.Ctx.Input.Param(":namespace")
-	repository := this.Ctx.Input.Param(":repo_name")
+	repository := this.Ctx.Input.Param(":splat")
 
 	repo := new(models.Repository)
 
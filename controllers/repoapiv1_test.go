@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/containerops/wharf/models"
+)
+
+func TestDeleteRepository(t *testing.T) {
+	server, teardown := setup(t)
+	defer teardown()
+
+	url, other := server.URL+"/v2/library/app", server.URL+"/v2/library/other"
+
+	manifest, layer := pushImage(t, url, "latest", "layer")
+	pushImage(t, other, "latest", "layer")
+
+	hook := new(models.Webhook)
+	if err := hook.Create("library", "app", "http://127.0.0.1:1/hook", "", []string{models.WEBHOOK_EVENT_PUSH}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	//The blob referenced by a manifest of the repository isn't deleted, the manifests of other repositories don't matter
+	if resp, _ := request(t, "DELETE", fmt.Sprintf("%s/blobs/%s", url, layer), nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("delete referenced blob status is %d", resp.StatusCode)
+	}
+
+	if resp, _ := request(t, "DELETE", server.URL+"/v1/repositories/library/app", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete repository status is %d", resp.StatusCode)
+	}
+
+	if resp, _ := request(t, "GET", fmt.Sprintf("%s/manifests/%s", url, manifest), nil, "Accept", models.MEDIATYPE_MANIFEST_V2); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("manifest of the deleted repository status is %d", resp.StatusCode)
+	}
+
+	if has, _, _ := new(models.Manifest).Has("library", "app", manifest); has == true {
+		t.Errorf("manifest of the deleted repository is left")
+	}
+
+	if blobs := models.RepositoryBlobs("library", "app"); len(blobs) != 0 || models.BlobLinked("library", "app", layer) == true {
+		t.Errorf("blobs of the deleted repository are still linked: %v", blobs)
+	}
+
+	if hooks := new(models.Webhook).All("library", "app"); len(hooks) != 0 {
+		t.Errorf("webhooks of the deleted repository are left: %d", len(hooks))
+	}
+
+	//The other repository still has the layer
+	if models.BlobLinked("library", "other", layer) == false {
+		t.Errorf("layer of the other repository is unlinked")
+	}
+
+	if resp, body := request(t, "GET", fmt.Sprintf("%s/blobs/%s", other, layer), nil); resp.StatusCode != http.StatusOK || string(body) != "layer" {
+		t.Errorf("layer of the other repository is %d: %s", resp.StatusCode, body)
+	}
+
+	//Links and manifests saved before the indexes are indexed on start
+	models.LedisDB.HClear([]byte("repoblobs:library/other"))
+	models.LedisDB.HClear([]byte("repomanifests:library/other"))
+
+	if count, err := models.IndexBlobLinks(); err != nil || count != 2 {
+		t.Errorf("indexed %d blob links: %v", count, err)
+	}
+
+	if count, err := models.IndexManifests(); err != nil || count != 1 {
+		t.Errorf("indexed %d manifests: %v", count, err)
+	}
+
+	if len(models.RepositoryBlobs("library", "other")) != 2 || len(new(models.Manifest).InRepository("library", "other")) != 1 {
+		t.Errorf("indexes of the other repository aren't rebuilt")
+	}
+}
+
+func TestIndexTags(t *testing.T) {
+	_, teardown := setup(t)
+	defer teardown()
+
+	//Tags were indexed with the image id before
+	tag := &models.Tag{Id: "library:app:latest", Name: "latest", ImageId: "abc", Namespace: "library", Repository: "app"}
+	if err := models.Save(tag, []byte(tag.Id)); err != nil {
+		t.Fatal(err)
+	}
+	models.LedisDB.HSet([]byte(models.GLOBAL_TAG_INDEX), []byte("library:app:abc:latest"), []byte(tag.Id))
+
+	if has, _, _ := new(models.Tag).Has("library", "app", "latest"); has == true {
+		t.Fatalf("tag of the old index is found before it's moved")
+	}
+
+	if count, err := models.IndexTags(); err != nil || count != 1 {
+		t.Fatalf("moved %d tags: %v", count, err)
+	}
+
+	if has, _, _ := new(models.Tag).Has("library", "app", "latest"); has == false {
+		t.Errorf("moved tag isn't found")
+	}
+
+	if tags := new(models.Tag).All(); len(tags) != 1 {
+		t.Errorf("index has %d tags", len(tags))
+	}
+
+	if count, _ := models.IndexTags(); count != 0 {
+		t.Errorf("moved %d tags again", count)
+	}
+}
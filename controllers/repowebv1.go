@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/astaxie/beego"
@@ -38,9 +39,19 @@ func (this *RepoWebAPIV1Controller) URLMapping() {
 	this.Mapping("PostRepository", this.PostRepository)
 	this.Mapping("PutRepository", this.PutRepository)
 	this.Mapping("GetRepository", this.GetRepository)
+	this.Mapping("GetBuilds", this.GetBuilds)
+	this.Mapping("GetBuildRules", this.GetBuildRules)
+	this.Mapping("PostBuildRule", this.PostBuildRule)
+	this.Mapping("PutBuildRule", this.PutBuildRule)
+	this.Mapping("DeleteBuildRule", this.DeleteBuildRule)
 	this.Mapping("GetCollaborators", this.GetCollaborators)
 	this.Mapping("PostCollaborator", this.PostCollaborator)
 	this.Mapping("PutCollaborator", this.PutCollaborator)
+	this.Mapping("GetWebhooks", this.GetWebhooks)
+	this.Mapping("PostWebhook", this.PostWebhook)
+	this.Mapping("PutWebhook", this.PutWebhook)
+	this.Mapping("DeleteWebhook", this.DeleteWebhook)
+	this.Mapping("GetDeliveries", this.GetDeliveries)
 }
 
 func (this *RepoWebAPIV1Controller) GetRepositories() {
@@ -94,7 +105,13 @@ func (this *RepoWebAPIV1Controller) PostRepository() {
 		return
 	}
 
-	if exist, _, err := repo.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":repository")); err != nil {
+	//Repository names could be nested like "team/service/component"
+	if utils.IsRepositoryName(fmt.Sprintf("%s/%s", this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat"))) == false {
+		this.JSONOut(http.StatusBadRequest, "Invalid repository name.", nil)
+		return
+	}
+
+	if exist, _, err := repo.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")); err != nil {
 		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
 		return
 	} else if exist == true {
@@ -152,7 +169,7 @@ func (this *RepoWebAPIV1Controller) PostRepository() {
 func (this *RepoWebAPIV1Controller) PutRepository() {
 	repo := new(models.Repository)
 
-	if exist, _, err := repo.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":repository")); err != nil {
+	if exist, _, err := repo.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")); err != nil {
 		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
 		return
 	} else if exist == false {
@@ -182,7 +199,7 @@ func (this *RepoWebAPIV1Controller) PutRepository() {
 func (this *RepoWebAPIV1Controller) GetRepository() {
 	repo := new(models.Repository)
 
-	if exist, _, err := repo.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":repository")); err != nil {
+	if exist, _, err := repo.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")); err != nil {
 		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
 		return
 	} else if exist == false {
@@ -194,12 +211,159 @@ func (this *RepoWebAPIV1Controller) GetRepository() {
 	return
 }
 
+// GetBuilds returns the build history of the repository from the newest, "n" builds (20 by default) after the build
+// of "last" in a page.
+func (this *RepoWebAPIV1Controller) GetBuilds() {
+	repo := new(models.Repository)
+
+	if exist, _, err := repo.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if exist == false {
+		this.JSONOut(http.StatusNotFound, "Repository not exist", nil)
+		return
+	}
+
+	n := 20
+
+	if value := this.Ctx.Input.Query("n"); len(value) > 0 {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			this.JSONOut(http.StatusBadRequest, "Pagination number is invalid", nil)
+			return
+		}
+
+		n = number
+	}
+
+	builds, more := repo.History(this.Ctx.Input.Query("last"), n)
+
+	if more == true && len(builds) > 0 {
+		paginateLink(this.Ctx, strconv.Itoa(n), builds[len(builds)-1].Id)
+	}
+
+	this.JSONOut(http.StatusOK, "", builds)
+	return
+}
+
+// The build rules of the repository need the admin permission, which is checked by filters.FilterRepository.
+func (this *RepoWebAPIV1Controller) GetBuildRules() {
+	rules := make([]map[string]interface{}, 0)
+
+	for _, rule := range new(models.BuildRule).All(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")) {
+		rules = append(rules, buildRuleView(rule))
+	}
+
+	this.JSONOut(http.StatusOK, "", rules)
+	return
+}
+
+// PostBuildRule creates a build rule of the repository, it's active unless "active" is false.
+func (this *RepoWebAPIV1Controller) PostBuildRule() {
+	this.saveBuildRule("")
+}
+
+// PutBuildRule updates the build rule, the secret is kept when it's empty.
+func (this *RepoWebAPIV1Controller) PutBuildRule() {
+	this.saveBuildRule(this.Ctx.Input.Param(":buildrule"))
+}
+
+func (this *RepoWebAPIV1Controller) saveBuildRule(id string) {
+	namespace, repository := this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")
+
+	user, exist := sessionUser(this.Ctx)
+	if exist == false {
+		this.JSONOut(http.StatusUnauthorized, "", map[string]string{"message": "Session load failure", "url": "/auth"})
+		return
+	}
+
+	repo := new(models.Repository)
+	if exist, _, err := repo.Has(namespace, repository); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if exist == false {
+		this.JSONOut(http.StatusBadRequest, "Repository Invalid", nil)
+		return
+	}
+
+	var request buildRuleRequest
+	if err := json.Unmarshal(this.Ctx.Input.CopyBody(), &request); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	rule := new(models.BuildRule)
+	action := models.ACTION_ADD_BUILD_RULE
+
+	if len(id) == 0 {
+		active := request.Active == nil || *request.Active == true
+
+		if err := rule.Create(namespace, repository, request.Git, request.Type, request.Ref, request.Tag, request.Dockerfile, request.Secret, user.Username, active); err != nil {
+			this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+	} else {
+		if exist, err := rule.Get(namespace, repository, id); err != nil {
+			this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+			return
+		} else if exist == false {
+			this.JSONOut(http.StatusNotFound, "Build rule not exist", nil)
+			return
+		}
+
+		active := rule.Active
+		if request.Active != nil {
+			active = *request.Active
+		}
+
+		if err := rule.Update(request.Git, request.Type, request.Ref, request.Tag, request.Dockerfile, request.Secret, active); err != nil {
+			this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+
+		action = models.ACTION_UPDATE_BUILD_RULE
+	}
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	repo.Log(int64(action), models.LEVELINFORMATIONAL, models.TYPE_WEBV1, rule.Id, memo)
+
+	this.JSONOut(http.StatusOK, "", buildRuleView(rule))
+	return
+}
+
+func (this *RepoWebAPIV1Controller) DeleteBuildRule() {
+	namespace, repository := this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")
+
+	rule := new(models.BuildRule)
+	if exist, err := rule.Get(namespace, repository, this.Ctx.Input.Param(":buildrule")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if exist == false {
+		this.JSONOut(http.StatusNotFound, "Build rule not exist", nil)
+		return
+	}
+
+	if err := rule.Remove(); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	repo := new(models.Repository)
+	if exist, _, err := repo.Has(namespace, repository); err == nil && exist == true {
+		memo, _ := json.Marshal(this.Ctx.Input.Header)
+		repo.Log(models.ACTION_REMOVE_BUILD_RULE, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, rule.Id, memo)
+	}
+
+	this.JSONOut(http.StatusOK, "Remove build rule successfully", nil)
+	return
+}
+
 func (this *RepoWebAPIV1Controller) GetCollaborators() {
 	repo := new(models.Repository)
 	user := new(models.User)
 	org := new(models.Organization)
 
-	if exist, _, err := repo.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":repository")); err != nil {
+	if exist, _, err := repo.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")); err != nil {
 		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
 		return
 	} else if exist == false {
@@ -239,7 +403,7 @@ func (this *RepoWebAPIV1Controller) PostCollaborator() {
 		this.JSONOut(http.StatusBadRequest, "Collaborator Invalid", nil)
 	}
 
-	if exist, _, err := repo.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":repository")); err != nil {
+	if exist, _, err := repo.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")); err != nil {
 		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
 		return
 	} else if exist == false {
@@ -336,7 +500,7 @@ func (this *RepoWebAPIV1Controller) PutCollaborator() {
 		this.JSONOut(http.StatusBadRequest, "Collaborator Invalid", nil)
 	}
 
-	if exist, _, err := repo.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":repository")); err != nil {
+	if exist, _, err := repo.Has(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")); err != nil {
 		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
 		return
 	} else if exist == false {
@@ -437,3 +601,125 @@ func (this *RepoWebAPIV1Controller) PutCollaborator() {
 
 	this.JSONOut(http.StatusBadRequest, "Remove collaborator failure.", nil)
 }
+
+// The webhooks of the repository need the admin permission, which is checked by filters.FilterRepository.
+func (this *RepoWebAPIV1Controller) GetWebhooks() {
+	hooks := make([]map[string]interface{}, 0)
+
+	for _, hook := range new(models.Webhook).All(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")) {
+		hooks = append(hooks, webhookView(hook))
+	}
+
+	this.JSONOut(http.StatusOK, "", hooks)
+	return
+}
+
+func (this *RepoWebAPIV1Controller) PostWebhook() {
+	this.saveWebhook("")
+}
+
+func (this *RepoWebAPIV1Controller) PutWebhook() {
+	this.saveWebhook(this.Ctx.Input.Param(":webhook"))
+}
+
+func (this *RepoWebAPIV1Controller) saveWebhook(id string) {
+	namespace, repository := this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")
+
+	repo := new(models.Repository)
+	if exist, _, err := repo.Has(namespace, repository); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if exist == false {
+		this.JSONOut(http.StatusBadRequest, "Repository Invalid", nil)
+		return
+	}
+
+	hook, code, err := saveWebhook(this.Ctx.Input.CopyBody(), namespace, repository, id)
+	if err != nil {
+		this.JSONOut(code, err.Error(), nil)
+		return
+	}
+
+	action := models.ACTION_ADD_WEBHOOK
+	if len(id) > 0 {
+		action = models.ACTION_UPDATE_WEBHOOK
+	}
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	repo.Log(int64(action), models.LEVELINFORMATIONAL, models.TYPE_WEBV1, hook.Id, memo)
+
+	this.JSONOut(http.StatusOK, "", webhookView(hook))
+	return
+}
+
+func (this *RepoWebAPIV1Controller) DeleteWebhook() {
+	namespace, repository := this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat")
+
+	hook := new(models.Webhook)
+	if exist, err := hook.Get(namespace, repository, this.Ctx.Input.Param(":webhook")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if exist == false {
+		this.JSONOut(http.StatusNotFound, "Webhook not exist", nil)
+		return
+	}
+
+	if err := hook.Remove(); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	repo := new(models.Repository)
+	if exist, _, err := repo.Has(namespace, repository); err == nil && exist == true {
+		memo, _ := json.Marshal(this.Ctx.Input.Header)
+		repo.Log(models.ACTION_REMOVE_WEBHOOK, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, hook.Id, memo)
+	}
+
+	this.JSONOut(http.StatusOK, "Remove webhook successfully", nil)
+	return
+}
+
+// GetDeliveries returns the delivery history of the webhook, the newest is the first.
+func (this *RepoWebAPIV1Controller) GetDeliveries() {
+	hook := new(models.Webhook)
+	if exist, err := hook.Get(this.Ctx.Input.Param(":namespace"), this.Ctx.Input.Param(":splat"), this.Ctx.Input.Param(":webhook")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if exist == false {
+		this.JSONOut(http.StatusNotFound, "Webhook not exist", nil)
+		return
+	}
+
+	this.JSONOut(http.StatusOK, "", hook.History())
+	return
+}
+
+// buildRuleRequest is the body creating or updating a build rule, the secret is kept when updated with an empty one.
+type buildRuleRequest struct {
+	Git        string `json:"git"`
+	Type       string `json:"type"`
+	Ref        string `json:"ref"`
+	Tag        string `json:"tag"`
+	Dockerfile string `json:"dockerfile"`
+	Secret     string `json:"secret"`
+	Active     *bool  `json:"active"`
+}
+
+// buildRuleView hides the secret of the build rule in responses.
+func buildRuleView(rule *models.BuildRule) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         rule.Id,
+		"namespace":  rule.Namespace,
+		"repository": rule.Repository,
+		"git":        rule.Git,
+		"type":       rule.Type,
+		"ref":        rule.Ref,
+		"tag":        rule.Tag,
+		"dockerfile": rule.Dockerfile,
+		"secret":     len(rule.Secret) > 0,
+		"user":       rule.User,
+		"active":     rule.Active,
+		"created":    rule.Created,
+		"updated":    rule.Updated,
+	}
+}
@@ -0,0 +1,346 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerops/wharf/backend"
+	"github.com/containerops/wharf/models"
+)
+
+// gzippedEmptyTar is the layer of the history entries with "empty_layer" in schema1 manifests.
+var gzippedEmptyTar = []byte{31, 139, 8, 0, 0, 9, 110, 136, 0, 255, 98, 24, 5, 163, 96, 20, 140, 88, 0, 8, 0, 0, 255, 255, 46, 175, 181, 239, 0, 4, 0, 0}
+
+var (
+	schema1KeyOnce sync.Once
+	schema1Key     *ecdsa.PrivateKey
+	schema1KeyErr  error
+)
+
+type schema1History struct {
+	Created    time.Time `json:"created"`
+	Author     string    `json:"author,omitempty"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+type schema1V1Compatibility struct {
+	Id              string    `json:"id"`
+	Parent          string    `json:"parent,omitempty"`
+	Comment         string    `json:"comment,omitempty"`
+	Created         time.Time `json:"created"`
+	ContainerConfig struct {
+		Cmd []string
+	} `json:"container_config,omitempty"`
+	Author    string `json:"author,omitempty"`
+	ThrowAway bool   `json:"throwaway,omitempty"`
+}
+
+type schema1FSLayer struct {
+	BlobSum string `json:"blobSum"`
+}
+
+type schema1Compatibility struct {
+	V1Compatibility string `json:"v1Compatibility"`
+}
+
+type schema1Manifest struct {
+	SchemaVersion int                    `json:"schemaVersion"`
+	Name          string                 `json:"name"`
+	Tag           string                 `json:"tag"`
+	Architecture  string                 `json:"architecture"`
+	FSLayers      []schema1FSLayer       `json:"fsLayers"`
+	History       []schema1Compatibility `json:"history"`
+}
+
+// manifestsSchema1 down-converts a schema2 manifest to a signed schema1 manifest for the clients which don't accept schema2.
+// It returns the manifest and the digest of its payload.
+func manifestsSchema1(namespace, repository, tag string, manifest *models.Manifest) ([]byte, string, error) {
+	config, layers, err := manifest.Config()
+	if err != nil {
+		return nil, "", err
+	}
+
+	reader, err := backend.Storage.Reader(fmt.Sprintf("uuid/%s/layer", strings.TrimPrefix(config.Digest, "sha256:")), 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	configJSON, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var image struct {
+		Architecture string           `json:"architecture"`
+		History      []schema1History `json:"history"`
+		RootFS       struct {
+			DiffIds []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+
+	if err := json.Unmarshal(configJSON, &image); err != nil {
+		return nil, "", err
+	}
+
+	if len(image.History) == 0 {
+		return nil, "", fmt.Errorf("Image config history is empty")
+	}
+
+	if len(image.RootFS.DiffIds) != len(layers) {
+		return nil, "", fmt.Errorf("Image config diff_ids and manifest layers length mismatch")
+	}
+
+	empty, err := manifestsEmptyLayer()
+	if err != nil {
+		return nil, "", err
+	}
+
+	//The empty layer is pulled from the repository like the other layers of the schema1 manifest
+	if err := models.LinkBlob(namespace, repository, empty); err != nil {
+		return nil, "", err
+	}
+
+	result := schema1Manifest{
+		SchemaVersion: 1,
+		Name:          fmt.Sprintf("%s/%s", namespace, repository),
+		Tag:           tag,
+		Architecture:  image.Architecture,
+		FSLayers:      make([]schema1FSLayer, len(image.History)),
+		History:       make([]schema1Compatibility, len(image.History)),
+	}
+
+	parent, index := "", 0
+
+	for i, h := range image.History {
+		blobSum := empty
+
+		if h.EmptyLayer == false {
+			if index >= len(layers) {
+				return nil, "", fmt.Errorf("Image config history has more layers than the manifest")
+			}
+
+			blobSum = layers[index].Digest
+			index++
+		}
+
+		reversed := len(image.History) - i - 1
+		result.FSLayers[reversed] = schema1FSLayer{BlobSum: blobSum}
+
+		//The top layer is the image config with the V1 id
+		if i == len(image.History)-1 {
+			id := fmt.Sprintf("%x", sha256.Sum256([]byte(strings.TrimPrefix(blobSum, "sha256:")+" "+parent+" "+string(configJSON))))
+
+			var v1 map[string]*json.RawMessage
+			if err := json.Unmarshal(configJSON, &v1); err != nil {
+				return nil, "", err
+			}
+
+			delete(v1, "rootfs")
+			delete(v1, "history")
+
+			v1["id"] = schema1RawJSON(id)
+			if parent != "" {
+				v1["parent"] = schema1RawJSON(parent)
+			}
+			if h.EmptyLayer == true {
+				v1["throwaway"] = schema1RawJSON(true)
+			}
+
+			data, err := json.Marshal(v1)
+			if err != nil {
+				return nil, "", err
+			}
+
+			result.History[reversed] = schema1Compatibility{V1Compatibility: string(data)}
+			break
+		}
+
+		compatibility := schema1V1Compatibility{
+			Id:        fmt.Sprintf("%x", sha256.Sum256([]byte(strings.TrimPrefix(blobSum, "sha256:")+" "+parent))),
+			Parent:    parent,
+			Comment:   h.Comment,
+			Created:   h.Created,
+			Author:    h.Author,
+			ThrowAway: h.EmptyLayer,
+		}
+		compatibility.ContainerConfig.Cmd = []string{h.CreatedBy}
+
+		data, err := json.Marshal(&compatibility)
+		if err != nil {
+			return nil, "", err
+		}
+
+		result.History[reversed] = schema1Compatibility{V1Compatibility: string(data)}
+		parent = compatibility.Id
+	}
+
+	payload, err := json.MarshalIndent(result, "", "   ")
+	if err != nil {
+		return nil, "", err
+	}
+
+	signed, err := schema1Sign(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return signed, models.ManifestDigest(payload), nil
+}
+
+// manifestsEmptyLayer saves the gzipped empty tar as a blob when it doesn't exist, and returns the digest.
+func manifestsEmptyLayer() (string, error) {
+	digest := models.ManifestDigest(gzippedEmptyTar)
+	layerfile := fmt.Sprintf("uuid/%s/layer", strings.TrimPrefix(digest, "sha256:"))
+
+	if _, err := backend.Storage.Stat(layerfile); err == nil {
+		return digest, nil
+	}
+
+	writer, err := backend.Storage.Writer(layerfile)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := writer.Write(gzippedEmptyTar); err != nil {
+		writer.Cancel()
+		return "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return digest, nil
+}
+
+func schema1RawJSON(value interface{}) *json.RawMessage {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+
+	raw := json.RawMessage(data)
+
+	return &raw
+}
+
+func schema1Base64(data []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+}
+
+// schema1KeyId returns the libtrust key id, the base32 of the first 240 bits of the sha256 of the public key in groups of 4.
+func schema1KeyId(key *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(der)
+	encoded := strings.TrimRight(base32.StdEncoding.EncodeToString(sum[:30]), "=")
+
+	groups := []string{}
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+
+	return strings.Join(groups, ":"), nil
+}
+
+func schema1Pad(value *big.Int) []byte {
+	data := value.Bytes()
+
+	if len(data) >= 32 {
+		return data
+	}
+
+	return append(make([]byte, 32-len(data)), data...)
+}
+
+// schema1Sign appends a JWS "signatures" to the pretty payload with an ECDSA P-256 key generated at the first call,
+// the same format as libtrust used by Docker clients to parse schema1 manifests.
+func schema1Sign(payload []byte) ([]byte, error) {
+	schema1KeyOnce.Do(func() {
+		schema1Key, schema1KeyErr = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	})
+
+	if schema1KeyErr != nil {
+		return nil, schema1KeyErr
+	}
+
+	end := bytes.LastIndex(payload, []byte("}"))
+	if end == -1 {
+		return nil, fmt.Errorf("Manifest payload is invalid")
+	}
+
+	length := len(bytes.TrimRight(payload[:end], " \t\r\n"))
+	tail := payload[length:]
+
+	protected, err := json.Marshal(map[string]interface{}{
+		"formatLength": length,
+		"formatTail":   schema1Base64(tail),
+		"time":         time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signing := schema1Base64(protected) + "." + schema1Base64(payload)
+	hash := sha256.Sum256([]byte(signing))
+
+	r, s, err := ecdsa.Sign(rand.Reader, schema1Key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	kid, err := schema1KeyId(&schema1Key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	signatures := []map[string]interface{}{
+		{
+			"header": map[string]interface{}{
+				"jwk": map[string]string{
+					"crv": "P-256",
+					"kid": kid,
+					"kty": "EC",
+					"x":   schema1Base64(schema1Pad(schema1Key.PublicKey.X)),
+					"y":   schema1Base64(schema1Pad(schema1Key.PublicKey.Y)),
+				},
+				"alg": "ES256",
+			},
+			"signature": schema1Base64(append(schema1Pad(r), schema1Pad(s)...)),
+			"protected": schema1Base64(protected),
+		},
+	}
+
+	data, err := json.MarshalIndent(signatures, "   ", "   ")
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+
+	buffer.Write(payload[:length])
+	buffer.WriteString(",\n   \"signatures\": ")
+	buffer.Write(data)
+	buffer.WriteString("\n}")
+
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/containerops/wharf/models"
+)
+
+func TestSchema1Digest(t *testing.T) {
+	payload := []byte(`{
+   "schemaVersion": 1,
+   "name": "library/app",
+   "tag": "latest",
+   "architecture": "amd64",
+   "fsLayers": [
+      {
+         "blobSum": "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+      }
+   ],
+   "history": [
+      {
+         "v1Compatibility": "{\"id\":\"1\"}"
+      }
+   ]
+}`)
+
+	signed, err := schema1Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(signed, payload) == true || models.ManifestMediaType(signed) != models.MEDIATYPE_MANIFEST_V1_SIGNED {
+		t.Fatalf("manifest isn't signed: %s", signed)
+	}
+
+	if extracted, err := models.ManifestPayload(signed); err != nil || bytes.Equal(extracted, payload) == false {
+		t.Errorf("payload is %q, %v", extracted, err)
+	}
+
+	expected := fmt.Sprintf("sha256:%x", sha256.Sum256(payload))
+
+	if digest := models.ManifestDigest(signed); digest != expected {
+		t.Errorf("digest of the signed manifest is %s, not the digest of the payload %s", digest, expected)
+	}
+
+	//Signing again changes the signatures but not the digest
+	if again, _ := schema1Sign(payload); models.ManifestDigest(again) != expected {
+		t.Errorf("digest changes with the signatures")
+	}
+
+	if digest := models.ManifestDigest(payload); digest != expected {
+		t.Errorf("digest of the unsigned manifest is %s", digest)
+	}
+
+	if digest := models.ManifestDigest(gzippedEmptyTar); digest != "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4" {
+		t.Errorf("digest of the empty layer is %s", digest)
+	}
+}
@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/session"
+	"github.com/siddontang/ledisdb/config"
+	"github.com/siddontang/ledisdb/ledis"
+
+	"github.com/containerops/wharf/backend"
+	"github.com/containerops/wharf/models"
+)
+
+var routes sync.Once
+
+// setup opens an empty database and storage, then serves the routes of Docker Registry API V2 and the sign in without
+// the filters.
+func setup(t *testing.T) (*httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "wharf-controllers")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.NewConfigDefault()
+	cfg.DataDir = filepath.Join(dir, "ledis")
+
+	l, err := ledis.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models.LedisDB, _ = l.Select(0)
+	backend.Storage = &backend.LocalDriver{Root: filepath.Join(dir, "storage")}
+
+	routes.Do(func() {
+		beego.RunMode = "test"
+
+		beego.SessionOn = true
+		beego.GlobalSessions, _ = session.NewManager("memory", `{"cookieName":"wharf","gclifetime":3600}`)
+
+		beego.Router("/auth/oidc", &WebController{}, "get:GetOIDC")
+		beego.Router("/auth/oidc/callback", &WebController{}, "get:GetOIDCCallback")
+
+		beego.AddNamespace(beego.NewNamespace("/w1/user",
+			beego.NSRouter("/signin", &UserWebAPIV1Controller{}, "post:Signin"),
+			beego.NSRouter("/signin/totp", &UserWebAPIV1Controller{}, "post:SigninTOTP"),
+		))
+
+		beego.AddNamespace(beego.NewNamespace("/v1",
+			beego.NSRouter("/repositories/:namespace/*", &RepoAPIV1Controller{}, "delete:DeleteRepository"),
+		))
+
+		beego.AddNamespace(beego.NewNamespace("/v2",
+			beego.NSRouter("/:namespace/*/blobs/:digest", &BlobAPIV2Controller{}, "head:HeadDigest"),
+			beego.NSRouter("/:namespace/*/blobs/uploads", &BlobAPIV2Controller{}, "post:PostBlobs"),
+			beego.NSRouter("/:namespace/*/blobs/uploads/:uuid", &BlobAPIV2Controller{}, "patch:PatchBlobs"),
+			beego.NSRouter("/:namespace/*/blobs/uploads/:uuid", &BlobAPIV2Controller{}, "get:GetUploadStatus"),
+			beego.NSRouter("/:namespace/*/blobs/uploads/:uuid", &BlobAPIV2Controller{}, "delete:DeleteUpload"),
+			beego.NSRouter("/:namespace/*/blobs/uploads/:uuid", &BlobAPIV2Controller{}, "put:PutBlobs"),
+			beego.NSRouter("/:namespace/*/manifests/:tag", &ManifestsAPIV2Controller{}, "put:PutManifests"),
+			beego.NSRouter("/:namespace/*/tags/list", &ManifestsAPIV2Controller{}, "get:GetTags"),
+			beego.NSRouter("/:namespace/*/manifests/:tag", &ManifestsAPIV2Controller{}, "get:GetManifests"),
+			beego.NSRouter("/:namespace/*/manifests/:tag", &ManifestsAPIV2Controller{}, "head:GetManifests"),
+			beego.NSRouter("/:namespace/*/blobs/:digest", &BlobAPIV2Controller{}, "get:GetBlobs"),
+			beego.NSRouter("/:namespace/*/referrers/:digest", &ManifestsAPIV2Controller{}, "get:GetReferrers"),
+			beego.NSRouter("/:namespace/*/manifests/:tag", &ManifestsAPIV2Controller{}, "delete:DeleteManifests"),
+			beego.NSRouter("/:namespace/*/blobs/:digest", &BlobAPIV2Controller{}, "delete:DeleteBlobs"),
+		))
+	})
+
+	server := httptest.NewServer(beego.BeeApp.Handlers)
+
+	return server, func() {
+		server.Close()
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// request sends the request with the headers in pairs, and returns the response with the body read.
+func request(t *testing.T, method, url string, body io.Reader, headers ...string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Add(headers[i], headers[i+1])
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+
+	return resp, data
+}
+
+// instance starts another Wharf in a process of the test binary, it has its own database and storage like a registry
+// on another host. It returns the URL of the instance and the function stopping it, which could be called again.
+func instance(t *testing.T) (string, func()) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInstance$")
+	cmd.Env = append(os.Environ(), "WHARF_TEST_INSTANCE=1")
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, output := io.Pipe()
+	cmd.Stdout = output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		output.Close()
+		close(done)
+	}()
+
+	//Beego logs to the stdout too
+	address := ""
+	for scanner := bufio.NewScanner(stdout); len(address) == 0 && scanner.Scan(); {
+		if line := scanner.Text(); strings.HasPrefix(line, "instance: ") == true {
+			address = strings.TrimPrefix(line, "instance: ")
+		}
+	}
+
+	if len(address) == 0 {
+		t.Fatalf("instance doesn't start")
+	}
+
+	go io.Copy(ioutil.Discard, stdout)
+
+	return address, func() {
+		stdin.Close()
+		<-done
+	}
+}
+
+// TestInstance serves the instance until the stdin is closed, it does nothing in the test run.
+func TestInstance(t *testing.T) {
+	if os.Getenv("WHARF_TEST_INSTANCE") != "1" {
+		return
+	}
+
+	server, teardown := setup(t)
+	defer teardown()
+
+	fmt.Printf("instance: %s\n", server.URL)
+	ioutil.ReadAll(os.Stdin)
+}
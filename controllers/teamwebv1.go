@@ -91,7 +91,7 @@ func (this *TeamWebV1Controller) PostTeam() {
 	user.Log(models.ACTION_ADD_TEAM, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, team.Id, memo)
 
 	//Reload User Data In Session
-	user.Get(user.Username, user.Password)
+	user.Has(user.Username)
 	this.Ctx.Input.CruSession.Set("user", user)
 
 	this.JSONOut(http.StatusOK, "Team Create Successfully!", nil)
@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego"
+
+	"github.com/containerops/wharf/auth"
+	"github.com/containerops/wharf/filters"
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/modules"
+	"github.com/containerops/wharf/utils"
+)
+
+type TokenAPIV2Controller struct {
+	beego.Controller
+}
+
+func (this *TokenAPIV2Controller) URLMapping() {
+	this.Mapping("GetToken", this.GetToken)
+}
+
+func (this *TokenAPIV2Controller) JSONOut(code int, message string, data interface{}) {
+	if data == nil {
+		this.Data["json"] = map[string]string{"message": message}
+	} else {
+		this.Data["json"] = data
+	}
+
+	this.Ctx.Output.Context.Output.SetStatus(code)
+	this.ServeJson()
+}
+
+func (this *TokenAPIV2Controller) Prepare() {
+	this.EnableXSRF = false
+
+	this.Ctx.Output.Context.ResponseWriter.Header().Set("Content-Type", "application/json;charset=UTF-8")
+}
+
+// GetToken issues a bearer token with the access of the "scope" queries the user has, anonymous users only get the
+// pull access of public repositories. The password is only checked here, "/v2/*" requests check the token.
+func (this *TokenAPIV2Controller) GetToken() {
+	if service := this.Ctx.Input.Query("service"); len(service) > 0 && service != modules.TokenService() {
+		this.JSONOut(http.StatusBadRequest, "Invalid service", nil)
+		return
+	}
+
+	user := new(models.User)
+	var token *models.AccessToken
+
+	if len(this.Ctx.Input.Header("Authorization")) > 0 {
+		username, passwd, err := utils.DecodeBasicAuth(this.Ctx.Input.Header("Authorization"))
+		if err != nil {
+			this.JSONOut(http.StatusUnauthorized, "Invalid authorization", nil)
+			return
+		}
+
+		//Access tokens and robot accounts sign in like the password
+		if user, token, err = auth.Authenticate(username, passwd); err != nil {
+			this.JSONOut(http.StatusUnauthorized, "Invalid username or password", nil)
+			return
+		}
+	}
+
+	access := []*modules.TokenAccess{}
+
+	//The scope query could repeat, and each has scopes separated by space
+	for _, value := range this.Ctx.Request.URL.Query()["scope"] {
+		for _, scope := range strings.Fields(value) {
+			requested, err := modules.ParseScope(scope)
+			if err != nil {
+				this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+				return
+			}
+
+			if granted := this.grant(user, token, requested); len(granted.Actions) > 0 {
+				access = append(access, granted)
+			}
+		}
+	}
+
+	signed, claims, err := modules.SignToken(user.Username, access)
+	if err != nil {
+		this.JSONOut(http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+
+	this.JSONOut(http.StatusOK, "", map[string]interface{}{
+		"token":        signed,
+		"access_token": signed,
+		"expires_in":   claims.Expiration - claims.IssuedAt,
+		"issued_at":    time.Unix(claims.IssuedAt, 0).UTC().Format(time.RFC3339),
+	})
+	return
+}
+
+// grant returns the actions of the requested access the user has, limited by the access token when signed in with it.
+func (this *TokenAPIV2Controller) grant(user *models.User, token *models.AccessToken, requested *modules.TokenAccess) *modules.TokenAccess {
+	granted := &modules.TokenAccess{Type: requested.Type, Name: requested.Name, Actions: []string{}}
+
+	switch requested.Type {
+	case "registry":
+		//Only signed in users could list the catalog, it's filtered by the permission of each repository
+		if requested.Name == "catalog" && len(user.Username) > 0 && (token == nil || token.Robot == false) {
+			granted.Actions = append(granted.Actions, "*")
+		}
+	case "repository":
+		parts := strings.SplitN(requested.Name, "/", 2)
+		if len(parts) != 2 || utils.IsRepositoryName(requested.Name) == false {
+			return granted
+		}
+
+		for _, action := range requested.Actions {
+			switch action {
+			case "pull":
+				if (token == nil || token.Allowed(parts[0], parts[1], models.TOKEN_SCOPE_PULL) == true) && filters.CheckPermission(user, parts[0], parts[1], filters.PERMISSION_READ) == true {
+					granted.Actions = append(granted.Actions, action)
+				}
+			case "push", "delete":
+				if (token == nil || token.Allowed(parts[0], parts[1], models.TOKEN_SCOPE_PUSH) == true) && len(user.Username) > 0 && filters.CheckPermission(user, parts[0], parts[1], filters.PERMISSION_WRITE) == true {
+					granted.Actions = append(granted.Actions, action)
+				}
+			}
+		}
+	}
+
+	return granted
+}
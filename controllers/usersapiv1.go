@@ -6,6 +6,7 @@ import (
 
 	"github.com/astaxie/beego"
 
+	"github.com/containerops/wharf/auth"
 	"github.com/containerops/wharf/models"
 	"github.com/containerops/wharf/utils"
 )
@@ -55,9 +56,8 @@ func (this *UserAPIV1Controller) GetUsers() {
 		this.JSONOut(http.StatusUnauthorized, err.Error(), nil)
 		return
 	} else {
-		user := new(models.User)
-
-		if err := user.Get(username, passwd); err != nil {
+		user, _, err := auth.Authenticate(username, passwd)
+		if err != nil {
 			this.JSONOut(http.StatusUnauthorized, err.Error(), nil)
 			return
 		}
@@ -15,6 +15,7 @@ import (
 	"github.com/astaxie/beego"
 	"github.com/nfnt/resize"
 
+	"github.com/containerops/wharf/auth"
 	"github.com/containerops/wharf/models"
 	"github.com/containerops/wharf/utils"
 )
@@ -32,6 +33,15 @@ func (this *UserWebAPIV1Controller) URLMapping() {
 	this.Mapping("PostGravatar", this.PostGravatar)
 	this.Mapping("PutPassword", this.PutPassword)
 	this.Mapping("PutProfile", this.PutProfile)
+	this.Mapping("GetTokens", this.GetTokens)
+	this.Mapping("PostToken", this.PostToken)
+	this.Mapping("DeleteToken", this.DeleteToken)
+	this.Mapping("SigninTOTP", this.SigninTOTP)
+	this.Mapping("GetTOTP", this.GetTOTP)
+	this.Mapping("PostTOTP", this.PostTOTP)
+	this.Mapping("PutTOTP", this.PutTOTP)
+	this.Mapping("DeleteTOTP", this.DeleteTOTP)
+	this.Mapping("PostRecoveryCodes", this.PostRecoveryCodes)
 }
 
 func (this *UserWebAPIV1Controller) JSONOut(code int, message string, data interface{}) {
@@ -58,11 +68,20 @@ func (this *UserWebAPIV1Controller) Signin() {
 		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
 		return
 	} else {
-		if err := user.Get(user.Username, user.Password); err != nil {
+		//The user is created at the first sign in with an external provider like LDAP
+		if user, err = auth.Password(user.Username, user.Password); err != nil {
 			this.JSONOut(http.StatusBadRequest, err.Error(), nil)
 			return
 		}
 
+		//The session user is set after the code of the authenticator is checked in SigninTOTP
+		if user.TOTPEnabled == true {
+			startSigninTOTP(this.Ctx, user)
+
+			this.JSONOut(http.StatusAccepted, "", map[string]interface{}{"message": "Two-factor authentication code required", "totp": true})
+			return
+		}
+
 		memo, _ := json.Marshal(this.Ctx.Input.Header)
 		user.Log(models.ACTION_SIGNIN, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, user.Id, memo)
 
@@ -73,6 +92,62 @@ func (this *UserWebAPIV1Controller) Signin() {
 	}
 }
 
+// SigninTOTP is the second step of Signin, it checks the code of the authenticator or a recovery code.
+func (this *UserWebAPIV1Controller) SigninTOTP() {
+	id, _ := this.Ctx.Input.CruSession.Get("signin_user").(string)
+	expires, _ := this.Ctx.Input.CruSession.Get("signin_expires").(int64)
+
+	if len(id) == 0 || time.Now().Unix() > expires {
+		this.clearSignin()
+		this.JSONOut(http.StatusUnauthorized, "", map[string]string{"message": "Session load failure", "url": "/auth"})
+		return
+	}
+
+	var request totpRequest
+	if err := json.Unmarshal(this.Ctx.Input.CopyBody(), &request); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	user := new(models.User)
+	if err := user.GetById(id); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	//The attempts are limited per user, signing in again with the password doesn't reset them
+	if attempts, err := user.CountTwoFactorAttempt(TOTP_SIGNIN_TIMEOUT); err != nil {
+		this.JSONOut(http.StatusInternalServerError, err.Error(), nil)
+		return
+	} else if attempts > TOTP_SIGNIN_ATTEMPTS {
+		this.clearSignin()
+		this.JSONOut(http.StatusTooManyRequests, "", map[string]string{"message": "Too many two-factor authentication attempts, try again later", "url": "/auth"})
+		return
+	}
+
+	if user.VerifyTwoFactor(request.Code) == false {
+		this.JSONOut(http.StatusBadRequest, "Two-factor authentication code error", nil)
+		return
+	}
+
+	this.clearSignin()
+	user.ResetTwoFactorAttempts()
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	user.Log(models.ACTION_SIGNIN, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, user.Id, memo)
+
+	this.Ctx.Input.CruSession.Set("user", user)
+
+	this.JSONOut(http.StatusOK, "User singin successfully!", nil)
+	return
+}
+
+func (this *UserWebAPIV1Controller) clearSignin() {
+	for _, key := range []string{"signin_user", "signin_expires"} {
+		this.Ctx.Input.CruSession.Delete(key)
+	}
+}
+
 func (this *UserWebAPIV1Controller) Signup() {
 	user := new(models.User)
 	org := new(models.Organization)
@@ -118,6 +193,10 @@ func (this *UserWebAPIV1Controller) GetUsers() {
 	user := new(models.User)
 	users := user.All()
 
+	for _, u := range users {
+		u.Password = "xxxxxx"
+	}
+
 	this.JSONOut(http.StatusOK, "", users)
 	return
 }
@@ -314,12 +393,12 @@ func (this *UserWebAPIV1Controller) PutPassword() {
 	} else if exist == false && err == nil {
 		this.JSONOut(http.StatusBadRequest, "Search user error", nil)
 		return
-	} else if p["oldPassword"].(string) != user.Password {
+	} else if err := user.Get(user.Username, fmt.Sprint(p["oldPassword"])); err != nil {
 		this.JSONOut(http.StatusBadRequest, "account and password not match", nil)
 		return
 	}
 
-	user.Password = p["newPassword"].(string)
+	user.Password, user.PasswordScheme = fmt.Sprint(p["newPassword"]), ""
 	user.Updated = time.Now().UnixNano() / int64(time.Millisecond)
 
 	if err := user.Save(); err != nil {
@@ -333,3 +412,240 @@ func (this *UserWebAPIV1Controller) PutPassword() {
 	this.JSONOut(http.StatusOK, "Update password success!", nil)
 	return
 }
+
+func (this *UserWebAPIV1Controller) GetTokens() {
+	user, exist := sessionUser(this.Ctx)
+	if exist == false || user.Username != this.Ctx.Input.Param(":username") {
+		this.JSONOut(http.StatusUnauthorized, "", map[string]string{"message": "Session load failure", "url": "/auth"})
+		return
+	}
+
+	tokens := make([]map[string]interface{}, 0)
+
+	for _, token := range new(models.AccessToken).All(user.Username, false) {
+		tokens = append(tokens, accessTokenView(token))
+	}
+
+	this.JSONOut(http.StatusOK, "", tokens)
+	return
+}
+
+// PostToken creates a personal access token, the token is only in this response.
+func (this *UserWebAPIV1Controller) PostToken() {
+	user, exist := sessionUser(this.Ctx)
+	if exist == false || user.Username != this.Ctx.Input.Param(":username") {
+		this.JSONOut(http.StatusUnauthorized, "", map[string]string{"message": "Session load failure", "url": "/auth"})
+		return
+	}
+
+	var request accessTokenRequest
+	if err := json.Unmarshal(this.Ctx.Input.CopyBody(), &request); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	token := new(models.AccessToken)
+
+	secret, err := token.Create(user.Username, request.Name, false, request.Scopes, request.Repositories, request.Expires)
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	user.Log(models.ACTION_ADD_TOKEN, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, token.Id, memo)
+
+	result := accessTokenView(token)
+	result["token"] = secret
+
+	this.JSONOut(http.StatusOK, "", result)
+	return
+}
+
+func (this *UserWebAPIV1Controller) DeleteToken() {
+	user, exist := sessionUser(this.Ctx)
+	if exist == false || user.Username != this.Ctx.Input.Param(":username") {
+		this.JSONOut(http.StatusUnauthorized, "", map[string]string{"message": "Session load failure", "url": "/auth"})
+		return
+	}
+
+	token := new(models.AccessToken)
+
+	if has, _, err := token.Has(user.Username, this.Ctx.Input.Param(":token")); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	} else if has == false || token.Robot == true {
+		this.JSONOut(http.StatusNotFound, "Token not exist", nil)
+		return
+	}
+
+	if err := token.Revoke(); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	user.Log(models.ACTION_REMOVE_TOKEN, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, token.Id, memo)
+
+	this.JSONOut(http.StatusOK, "Revoke token successfully", nil)
+	return
+}
+
+func (this *UserWebAPIV1Controller) GetTOTP() {
+	user, exist := sessionUser(this.Ctx)
+	if exist == false || user.Username != this.Ctx.Input.Param(":username") {
+		this.JSONOut(http.StatusUnauthorized, "", map[string]string{"message": "Session load failure", "url": "/auth"})
+		return
+	}
+
+	if err := user.GetById(user.Id); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	this.JSONOut(http.StatusOK, "", map[string]interface{}{"enabled": user.TOTPEnabled, "recovery": len(user.RecoveryCodes)})
+	return
+}
+
+// PostTOTP starts the enrollment with a new secret, the setting page shows the provisioning URI and the secret for the
+// authenticator app. The secret is kept in the session until PutTOTP confirms it.
+func (this *UserWebAPIV1Controller) PostTOTP() {
+	user, exist := sessionUser(this.Ctx)
+	if exist == false || user.Username != this.Ctx.Input.Param(":username") {
+		this.JSONOut(http.StatusUnauthorized, "", map[string]string{"message": "Session load failure", "url": "/auth"})
+		return
+	}
+
+	secret, err := utils.TOTPSecret()
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	this.Ctx.Input.CruSession.Set("totp_secret", secret)
+
+	uri := utils.TOTPURI(beego.AppConfig.String("docker::Endpoints"), user.Username, secret)
+
+	this.JSONOut(http.StatusOK, "", map[string]string{"secret": secret, "uri": uri})
+	return
+}
+
+// PutTOTP enables two-factor authentication with a code of the new secret, the recovery codes are only in this
+// response.
+func (this *UserWebAPIV1Controller) PutTOTP() {
+	user, exist := sessionUser(this.Ctx)
+	if exist == false || user.Username != this.Ctx.Input.Param(":username") {
+		this.JSONOut(http.StatusUnauthorized, "", map[string]string{"message": "Session load failure", "url": "/auth"})
+		return
+	}
+
+	secret, _ := this.Ctx.Input.CruSession.Get("totp_secret").(string)
+	if len(secret) == 0 {
+		this.JSONOut(http.StatusBadRequest, "Two-factor authentication enrollment not started", nil)
+		return
+	}
+
+	var request totpRequest
+	if err := json.Unmarshal(this.Ctx.Input.CopyBody(), &request); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	if err := user.GetById(user.Id); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	codes, err := user.EnableTOTP(secret, request.Code)
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	this.Ctx.Input.CruSession.Delete("totp_secret")
+	this.Ctx.Input.CruSession.Set("user", user)
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	user.Log(models.ACTION_ENABLE_TOTP, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, user.Id, memo)
+
+	this.JSONOut(http.StatusOK, "", map[string]interface{}{"recovery": codes})
+	return
+}
+
+// DeleteTOTP disables two-factor authentication with a code of the authenticator or a recovery code.
+func (this *UserWebAPIV1Controller) DeleteTOTP() {
+	user, exist := sessionUser(this.Ctx)
+	if exist == false || user.Username != this.Ctx.Input.Param(":username") {
+		this.JSONOut(http.StatusUnauthorized, "", map[string]string{"message": "Session load failure", "url": "/auth"})
+		return
+	}
+
+	var request totpRequest
+	if err := json.Unmarshal(this.Ctx.Input.CopyBody(), &request); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	if err := user.GetById(user.Id); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	if user.VerifyTwoFactor(request.Code) == false {
+		this.JSONOut(http.StatusBadRequest, "Two-factor authentication code error", nil)
+		return
+	}
+
+	if err := user.DisableTOTP(); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	this.Ctx.Input.CruSession.Set("user", user)
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	user.Log(models.ACTION_DISABLE_TOTP, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, user.Id, memo)
+
+	this.JSONOut(http.StatusOK, "Two-factor authentication disabled", nil)
+	return
+}
+
+// PostRecoveryCodes replaces the recovery codes with a code of the authenticator, the new codes are only in this
+// response.
+func (this *UserWebAPIV1Controller) PostRecoveryCodes() {
+	user, exist := sessionUser(this.Ctx)
+	if exist == false || user.Username != this.Ctx.Input.Param(":username") {
+		this.JSONOut(http.StatusUnauthorized, "", map[string]string{"message": "Session load failure", "url": "/auth"})
+		return
+	}
+
+	var request totpRequest
+	if err := json.Unmarshal(this.Ctx.Input.CopyBody(), &request); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	if err := user.GetById(user.Id); err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	if user.VerifyTwoFactor(request.Code) == false {
+		this.JSONOut(http.StatusBadRequest, "Two-factor authentication code error", nil)
+		return
+	}
+
+	codes, err := user.RenewRecoveryCodes()
+	if err != nil {
+		this.JSONOut(http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	this.Ctx.Input.CruSession.Set("user", user)
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	user.Log(models.ACTION_UPDATE_RECOVERY_CODES, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, user.Id, memo)
+
+	this.JSONOut(http.StatusOK, "", map[string]interface{}{"recovery": codes})
+	return
+}
@@ -0,0 +1,319 @@
+package controllers
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerops/wharf/auth"
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/utils"
+)
+
+// browser keeps the session cookie and doesn't follow redirects.
+func browser(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Client{Jar: jar, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+}
+
+func post(t *testing.T, client *http.Client, url, body string) int {
+	resp, err := client.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+// totpUser saves a user with two-factor authentication enabled, and returns the secret.
+func totpUser(t *testing.T, user *models.User) string {
+	secret, err := utils.TOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.TOTPEnabled, user.TOTPSecret, user.TOTPCounter = true, secret, 0
+	if err := user.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	return secret
+}
+
+func totpCode(t *testing.T, secret string) string {
+	code, err := utils.TOTPCode(secret, time.Now().Unix()/30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return code
+}
+
+func TestSigninTOTP(t *testing.T) {
+	server, teardown := setup(t)
+	defer teardown()
+
+	hash, err := utils.HashPassword("Passw0rd!Passw0rd", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &models.User{Id: "user:alice", Username: "alice", Password: hash, PasswordScheme: models.PASSWORD_SCHEME_PBKDF2, Email: "alice@example.com"}
+	secret := totpUser(t, user)
+
+	client := browser(t)
+	signin := `{"username": "alice", "password": "Passw0rd!Passw0rd"}`
+
+	if status := post(t, client, server.URL+"/w1/user/signin/totp", `{"code": "000000"}`); status != http.StatusUnauthorized {
+		t.Errorf("code without the password is %d", status)
+	}
+
+	if status := post(t, client, server.URL+"/w1/user/signin", signin); status != http.StatusAccepted {
+		t.Fatalf("sign in with two-factor authentication is %d", status)
+	}
+
+	for i := 0; i < TOTP_SIGNIN_ATTEMPTS; i++ {
+		if status := post(t, client, server.URL+"/w1/user/signin/totp", `{"code": "wrong"}`); status != http.StatusBadRequest {
+			t.Errorf("wrong code %d is %d", i, status)
+		}
+	}
+
+	//Signing in again with the password or in another session doesn't give more attempts
+	for _, c := range []*http.Client{client, browser(t)} {
+		if status := post(t, c, server.URL+"/w1/user/signin", signin); status != http.StatusAccepted {
+			t.Fatalf("sign in again is %d", status)
+		}
+
+		if status := post(t, c, server.URL+"/w1/user/signin/totp", fmt.Sprintf(`{"code": "%s"}`, totpCode(t, secret))); status != http.StatusTooManyRequests {
+			t.Errorf("code after the attempts is %d", status)
+		}
+	}
+
+	//The count expires with the period
+	if err := user.ResetTwoFactorAttempts(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := post(t, client, server.URL+"/w1/user/signin", signin); status != http.StatusAccepted {
+		t.Fatalf("sign in after the period is %d", status)
+	}
+
+	if status := post(t, client, server.URL+"/w1/user/signin/totp", `{"code": "wrong"}`); status != http.StatusBadRequest {
+		t.Errorf("wrong code after the period is %d", status)
+	}
+
+	if status := post(t, client, server.URL+"/w1/user/signin/totp", fmt.Sprintf(`{"code": "%s"}`, totpCode(t, secret))); status != http.StatusOK {
+		t.Errorf("code after the period is %d", status)
+	}
+
+	if count, err := user.CountTwoFactorAttempt(TOTP_SIGNIN_TIMEOUT); err != nil || count != 1 {
+		t.Errorf("attempts after sign in are %d: %v", count, err)
+	}
+}
+
+// fakeIssuer signs the ID token with the nonce of the last authorization request.
+type fakeIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	nonce  string
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.server.URL,
+			"authorization_endpoint": f.server.URL + "/authorize",
+			"token_endpoint":         f.server.URL + "/token",
+			"jwks_uri":               f.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kid": "rsa", "kty": "RSA", "alg": "RS256", "use": "sig", "n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes())},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": f.sign(t)})
+	})
+
+	f.server = httptest.NewServer(mux)
+
+	return f
+}
+
+func (f *fakeIssuer) sign(t *testing.T) string {
+	now := time.Now().Unix()
+
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "RS256", "kid": "rsa"})
+	payload, _ := json.Marshal(map[string]interface{}{"iss": f.server.URL, "aud": "wharf", "sub": "bobby", "email": "bobby@example.com", "nonce": f.nonce, "iat": now, "exp": now + 60})
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(input))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// oidcSignin goes through the issuer, and returns where the callback redirects.
+func oidcSignin(t *testing.T, client *http.Client, server string, issuer *fakeIssuer) string {
+	resp, err := client.Get(server + "/auth/oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("sign in with OIDC is %d: %v", resp.StatusCode, err)
+	}
+
+	issuer.nonce = location.Query().Get("nonce")
+
+	resp, err = client.Get(fmt.Sprintf("%s/auth/oidc/callback?code=code&state=%s", server, url.QueryEscape(location.Query().Get("state"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		body, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("OIDC callback is %d: %s", resp.StatusCode, body)
+	}
+
+	return resp.Header.Get("Location")
+}
+
+func TestOIDCCallbackTOTP(t *testing.T) {
+	server, teardown := setup(t)
+	defer teardown()
+
+	issuer := newFakeIssuer(t)
+	defer issuer.server.Close()
+
+	provider, err := auth.NewOIDCProvider(map[string]string{"issuer": issuer.server.URL, "clientid": "wharf", "redirecturl": server.URL + "/auth/oidc/callback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oidc := auth.OIDC
+	defer func() { auth.OIDC = oidc }()
+	auth.OIDC = provider
+
+	client := browser(t)
+
+	//The first sign in creates the user without two-factor authentication
+	if location := oidcSignin(t, client, server.URL, issuer); location != "/dashboard" {
+		t.Fatalf("OIDC sign in redirects to %s", location)
+	}
+
+	user := new(models.User)
+	if exist, id, err := user.Has("bobby"); err != nil || exist == false {
+		t.Fatalf("OIDC user isn't created: %v", err)
+	} else if err := user.GetById(string(id)); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := totpUser(t, user)
+
+	client = browser(t)
+
+	if location := oidcSignin(t, client, server.URL, issuer); location != "/auth#/totp" {
+		t.Fatalf("OIDC sign in with two-factor authentication redirects to %s", location)
+	}
+
+	if status := post(t, client, server.URL+"/w1/user/signin/totp", `{"code": "wrong"}`); status != http.StatusBadRequest {
+		t.Errorf("wrong code is %d", status)
+	}
+
+	if status := post(t, client, server.URL+"/w1/user/signin/totp", fmt.Sprintf(`{"code": "%s"}`, totpCode(t, secret))); status != http.StatusOK {
+		t.Errorf("code after OIDC is %d", status)
+	}
+}
+
+func TestHashPlainPasswords(t *testing.T) {
+	_, teardown := setup(t)
+	defer teardown()
+
+	//Users saved before the schemes have the plain password or the md5 hash, a plain password could look like the hash
+	passwords := map[string]string{
+		"plain": "Passw0rd!Passw0rd",
+		"hexed": "0123456789abcdef0123456789abcdef",
+		"md5ed": utils.EncodePassword("md5ed", "Passw0rd!Passw0rd"),
+	}
+
+	for username, password := range passwords {
+		user := &models.User{Id: "user:" + username, Username: username, Password: password, Email: username + "@example.com"}
+		if err := models.Save(user, []byte(user.Id)); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := models.LedisDB.HSet([]byte(models.GLOBAL_USER_INDEX), []byte(username), []byte(user.Id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if count, err := models.HashPlainPasswords(); err != nil || count != 3 {
+		t.Fatalf("hashed %d passwords: %v", count, err)
+	}
+
+	if count, err := models.HashPlainPasswords(); err != nil || count != 0 {
+		t.Fatalf("hashed %d passwords again: %v", count, err)
+	}
+
+	for username, password := range map[string]string{"plain": "Passw0rd!Passw0rd", "hexed": "0123456789abcdef0123456789abcdef", "md5ed": "Passw0rd!Passw0rd"} {
+		user := new(models.User)
+
+		if err := user.Get(username, password); err != nil {
+			t.Errorf("sign in of %s: %v", username, err)
+			continue
+		}
+
+		if user.PasswordScheme != models.PASSWORD_SCHEME_PBKDF2 || user.Password == password {
+			t.Errorf("password of %s isn't upgraded: %s", username, user.PasswordScheme)
+		}
+
+		if err := new(models.User).Get(username, password); err != nil {
+			t.Errorf("sign in of %s after the upgrade: %v", username, err)
+		}
+
+		//The md5 hash saved before isn't a password after the upgrade
+		if username == "md5ed" {
+			if err := new(models.User).Get(username, passwords[username]); err == nil {
+				t.Errorf("md5 hash of %s is accepted as the password", username)
+			}
+		}
+	}
+}
@@ -2,11 +2,13 @@ package controllers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/astaxie/beego"
 	"github.com/shurcooL/go/github_flavored_markdown"
 
+	"github.com/containerops/wharf/auth"
 	"github.com/containerops/wharf/models"
 )
 
@@ -17,6 +19,8 @@ type WebController struct {
 func (this *WebController) URLMapping() {
 	this.Mapping("GetIndex", this.GetIndex)
 	this.Mapping("GetAuth", this.GetAuth)
+	this.Mapping("GetOIDC", this.GetOIDC)
+	this.Mapping("GetOIDCCallback", this.GetOIDCCallback)
 	this.Mapping("GetDashboard", this.GetDashboard)
 	this.Mapping("GetSetting", this.GetSetting)
 	this.Mapping("GetRepository", this.GetRepository)
@@ -37,7 +41,11 @@ func (this *WebController) GetIndex() {
 }
 
 func (this *WebController) GetAuth() {
-	if _, exist := this.Ctx.Input.CruSession.Get("user").(models.User); exist == false {
+	if _, exist := sessionUser(this.Ctx); exist == false {
+		if auth.OIDC != nil {
+			this.Data["oidc"] = auth.OIDC.Name
+		}
+
 		this.TplNames = "auth.html"
 		this.Render()
 
@@ -47,8 +55,93 @@ func (this *WebController) GetAuth() {
 	}
 }
 
+func (this *WebController) GetOIDC() {
+	if auth.OIDC == nil {
+		this.Abort("404")
+		return
+	}
+
+	secrets := map[string]string{"oidc_state": "", "oidc_nonce": "", "oidc_verifier": ""}
+
+	for key := range secrets {
+		secret, err := auth.OIDCSecret()
+		if err != nil {
+			this.Ctx.Output.SetStatus(http.StatusInternalServerError)
+			this.Ctx.Output.Body([]byte(err.Error()))
+			return
+		}
+
+		secrets[key] = secret
+		this.Ctx.Input.CruSession.Set(key, secret)
+	}
+
+	location, err := auth.OIDC.AuthCodeURL(secrets["oidc_state"], secrets["oidc_nonce"], secrets["oidc_verifier"])
+	if err != nil {
+		this.Ctx.Output.SetStatus(http.StatusBadGateway)
+		this.Ctx.Output.Body([]byte(err.Error()))
+		return
+	}
+
+	this.Ctx.Redirect(http.StatusFound, location)
+}
+
+func (this *WebController) GetOIDCCallback() {
+	if auth.OIDC == nil {
+		this.Abort("404")
+		return
+	}
+
+	state, _ := this.Ctx.Input.CruSession.Get("oidc_state").(string)
+	nonce, _ := this.Ctx.Input.CruSession.Get("oidc_nonce").(string)
+	verifier, _ := this.Ctx.Input.CruSession.Get("oidc_verifier").(string)
+
+	//The state, nonce and verifier are used once
+	for _, key := range []string{"oidc_state", "oidc_nonce", "oidc_verifier"} {
+		this.Ctx.Input.CruSession.Delete(key)
+	}
+
+	if len(state) == 0 || this.GetString("state") != state {
+		this.Ctx.Output.SetStatus(http.StatusBadRequest)
+		this.Ctx.Output.Body([]byte("OIDC state is invalid"))
+		return
+	}
+
+	if e := this.GetString("error"); len(e) > 0 {
+		this.Ctx.Output.SetStatus(http.StatusUnauthorized)
+		this.Ctx.Output.Body([]byte(fmt.Sprintf("OIDC sign in error: %s %s", e, this.GetString("error_description"))))
+		return
+	}
+
+	claims, err := auth.OIDC.Exchange(this.GetString("code"), verifier, nonce)
+	if err != nil {
+		this.Ctx.Output.SetStatus(http.StatusUnauthorized)
+		this.Ctx.Output.Body([]byte(err.Error()))
+		return
+	}
+
+	user, err := auth.OIDC.Provision(claims)
+	if err != nil {
+		this.Ctx.Output.SetStatus(http.StatusUnauthorized)
+		this.Ctx.Output.Body([]byte(err.Error()))
+		return
+	}
+
+	//The issuer doesn't replace the two-factor authentication of Wharf
+	if user.TOTPEnabled == true {
+		startSigninTOTP(this.Ctx, user)
+		this.Ctx.Redirect(http.StatusFound, "/auth#/totp")
+		return
+	}
+
+	memo, _ := json.Marshal(this.Ctx.Input.Header)
+	user.Log(models.ACTION_SIGNIN, models.LEVELINFORMATIONAL, models.TYPE_WEBV1, user.Id, memo)
+
+	this.Ctx.Input.CruSession.Set("user", user)
+	this.Ctx.Redirect(http.StatusFound, "/dashboard")
+}
+
 func (this *WebController) GetDashboard() {
-	if user, exist := this.Ctx.Input.CruSession.Get("user").(models.User); exist == false {
+	if user, exist := sessionUser(this.Ctx); exist == false {
 		this.Ctx.Redirect(http.StatusMovedPermanently, "/auth")
 		return
 	} else {
@@ -61,12 +154,13 @@ func (this *WebController) GetDashboard() {
 }
 
 func (this *WebController) GetSetting() {
-	if user, exist := this.Ctx.Input.CruSession.Get("user").(models.User); exist == false {
+	if user, exist := sessionUser(this.Ctx); exist == false {
 		this.Ctx.Redirect(http.StatusMovedPermanently, "/auth")
 		return
 	} else {
 		this.TplNames = "setting.html"
 		this.Data["username"] = user.Username
+		this.Data["totp"] = user.TOTPEnabled
 
 		this.Render()
 		return
@@ -75,11 +169,11 @@ func (this *WebController) GetSetting() {
 
 func (this *WebController) GetRepository() {
 	namespace := this.Ctx.Input.Param(":namespace")
-	repository := this.Ctx.Input.Param(":repository")
+	repository := this.Ctx.Input.Param(":splat")
 
 	repo := new(models.Repository)
 	if exist, _, _ := repo.Has(namespace, repository); exist {
-		user, exist := this.Ctx.Input.CruSession.Get("user").(models.User)
+		user, exist := sessionUser(this.Ctx)
 		if repo.Privated {
 			if !exist == true {
 				this.Abort("404")
@@ -105,7 +199,9 @@ func (this *WebController) GetRepository() {
 				return
 			}
 		} else {
-			this.Data["username"] = user.Username
+			if exist == true {
+				this.Data["username"] = user.Username
+			}
 			this.Data["privated"] = repo.Privated
 			this.Data["namespace"] = repo.Namespace
 			this.Data["repository"] = repo.Repository
@@ -144,7 +240,7 @@ func (this *WebController) GetAdminAuth() {
 }
 
 func (this *WebController) GetSignout() {
-	if user, exist := this.Ctx.Input.CruSession.Get("user").(models.User); exist == false {
+	if user, exist := sessionUser(this.Ctx); exist == false {
 		this.TplNames = "auth.html"
 		this.Render()
 
@@ -158,6 +254,55 @@ func (this *WebController) GetSignout() {
 	}
 }
 
+// GetCompose renders the compose with the versions and the images of the version, the version of the "tag" or the
+// version pushed last.
 func (this *WebController) GetCompose() {
+	namespace := this.Ctx.Input.Param(":namespace")
+	compose := this.Ctx.Input.Param(":compose")
+
+	user, exist := sessionUser(this.Ctx)
+
+	c := new(models.Compose)
+	if has, _, err := c.Has(namespace, compose); err != nil || has == false || composeReadable(user, c) == false {
+		this.Abort("404")
+		return
+	}
+
+	if exist == true {
+		this.Data["username"] = user.Username
+	}
+
+	versions := c.Versions()
+	if len(versions) == 0 {
+		this.Abort("404")
+		return
+	}
+
+	version := versions[0]
+	if tag := this.GetString("tag"); len(tag) > 0 {
+		if version, exist = c.GetTag(tag); exist == false {
+			this.Abort("404")
+			return
+		}
+	}
+
+	this.Data["privated"] = c.Privated
+	this.Data["namespace"] = c.Namespace
+	this.Data["compose"] = c.Compose
+	this.Data["created"] = c.Created
+	this.Data["updated"] = version.Updated
+	this.Data["short"] = c.Short
+	this.Data["description"] = string(github_flavored_markdown.Markdown([]byte(c.Description)))
+	this.Data["download"] = c.Download
+	this.Data["comments"] = len(c.Comments)
+	this.Data["starts"] = len(c.Starts)
+	this.Data["tag"] = version.Name
+	this.Data["digest"] = version.Digest
+	this.Data["yaml"] = version.YAML
+	this.Data["versions"] = versions
+	this.Data["images"] = composeImages(user, version.YAML)
 
+	this.TplNames = "compose.html"
+	this.Render()
+	return
 }
@@ -14,7 +14,7 @@ angular.module('auth', ['ngRoute', 'ngMessages', 'ngCookies', 'angular-growl'])
   growlProvider.globalTimeToLive(3000);
 }])
 //Controllers
-.controller('SigninCtrl', ['$scope', '$cookies', '$http', 'growl', '$window', '$timeout', function($scope, $cookies, $http, growl, $window, $timeout) {
+.controller('SigninCtrl', ['$scope', '$cookies', '$http', 'growl', '$window', '$timeout', '$location', function($scope, $cookies, $http, growl, $window, $timeout, $location) {
   $scope.submitting = false;
 
   $scope.submit = function() {
@@ -25,6 +25,11 @@ angular.module('auth', ['ngRoute', 'ngMessages', 'ngCookies', 'angular-growl'])
         .success(function(data, status, headers, config) {
             $scope.submitting = false;
             growl.info(data.message);
+            //The code of the authenticator is checked in the second step
+            if (status == 202) {
+              $location.path('/totp');
+              return;
+            }
             $timeout(function() {
               $window.location.href = '/dashboard';
             }, 3000);
@@ -36,6 +41,34 @@ angular.module('auth', ['ngRoute', 'ngMessages', 'ngCookies', 'angular-growl'])
     }
   }
 }])
+.controller('TotpCtrl', ['$scope', '$cookies', '$http', 'growl', '$window', '$timeout', '$location', function($scope, $cookies, $http, growl, $window, $timeout, $location) {
+  $scope.submitting = false;
+
+  $scope.submit = function() {
+    if ($scope.totpForm.$valid) {
+      $scope.submitting = true;
+
+      $http.post('/w1/user/signin/totp', $scope.totp)
+        .success(function(data, status, headers, config) {
+            $scope.submitting = false;
+            growl.info(data.message);
+            $timeout(function() {
+              $window.location.href = '/dashboard';
+            }, 3000);
+        })
+        .error(function(data, status, headers, config) {
+            $scope.submitting = false;
+            growl.error(data.message);
+            //The sign in expires or the attempts run out, start again with the password
+            if (data.url) {
+              $timeout(function() {
+                $location.path('/auth');
+              }, 3000);
+            }
+        });
+    }
+  }
+}])
 .controller('SignupCtrl', ['$scope', '$cookies', '$http', 'growl', '$location', '$timeout', function($scope, $cookies, $http, growl, $location, $timeout) {
   $scope.submitting = false;
 
@@ -69,6 +102,10 @@ angular.module('auth', ['ngRoute', 'ngMessages', 'ngCookies', 'angular-growl'])
       templateUrl: '/static/views/auth/signin.html',
       controller: 'SigninCtrl'
     })
+    .when('/totp', {
+      templateUrl: '/static/views/auth/totp.html',
+      controller: 'TotpCtrl'
+    })
     .when('/signup', {
       templateUrl: '/static/views/auth/signup.html',
       controller: 'SignupCtrl'
@@ -82,6 +82,88 @@ angular.module('setting', ['ngRoute', 'ngMessages', 'ngCookies', 'angular-growl'
     }
   }
 }])
+//Two-Factor Authentication
+.controller('SettingSecurityCtrl', ['$scope', '$cookies', '$http', 'growl', '$location', '$timeout', '$upload', '$window', function($scope, $cookies, $http, growl, $location, $timeout, $upload, $window) {
+  $scope.totp = {enabled: false, recovery: 0};
+  $scope.enrollment = null;
+  $scope.recovery = [];
+  $scope.form = {code: ""};
+
+  //Get two-factor authentication status
+  $scope.load = function() {
+    $http.get('/w1/profile')
+      .success(function(data, status, headers, config) {
+        $scope.username = data.username;
+
+        $http.get('/w1/user/' + $scope.username + '/totp')
+          .success(function(data, status, headers, config) {
+            $scope.totp = data;
+          })
+          .error(function(data, status, headers, config) {
+            growl.error(data.message);
+          });
+      })
+      .error(function(data, status, headers, config) {
+        growl.error(data.message);
+      });
+  }
+
+  $scope.load();
+
+  //Start enrollment with a new secret
+  $scope.start = function() {
+    $http.post('/w1/user/' + $scope.username + '/totp/secret')
+      .success(function(data, status, headers, config) {
+        $scope.enrollment = data;
+        $scope.recovery = [];
+        $scope.form.code = "";
+      })
+      .error(function(data, status, headers, config) {
+        growl.error(data.message);
+      });
+  }
+
+  //Confirm enrollment with a code, the recovery codes are shown only once
+  $scope.enable = function() {
+    $http.put('/w1/user/' + $scope.username + '/totp', {code: $scope.form.code})
+      .success(function(data, status, headers, config) {
+        $scope.enrollment = null;
+        $scope.recovery = data.recovery;
+        $scope.form.code = "";
+        $scope.load();
+      })
+      .error(function(data, status, headers, config) {
+        growl.error(data.message);
+      });
+  }
+
+  //Renew recovery codes with a code
+  $scope.renew = function() {
+    $http.post('/w1/user/' + $scope.username + '/totp/recovery', {code: $scope.form.code})
+      .success(function(data, status, headers, config) {
+        $scope.recovery = data.recovery;
+        $scope.form.code = "";
+        $scope.load();
+      })
+      .error(function(data, status, headers, config) {
+        growl.error(data.message);
+      });
+  }
+
+  //Disable with a code
+  $scope.disable = function() {
+    $http({method: 'DELETE', url: '/w1/user/' + $scope.username + '/totp', data: {code: $scope.form.code}, headers: {'Content-Type': 'application/json'}})
+      .success(function(data, status, headers, config) {
+        growl.info(data.message);
+        $scope.recovery = [];
+        $scope.form.code = "";
+        $scope.load();
+      })
+      .error(function(data, status, headers, config) {
+        growl.error(data.message);
+      });
+  }
+}])
 //Email Setting
 .controller('SettingEmailsCtrl', ['$scope', '$cookies', '$http', 'growl', '$location', '$timeout', '$upload', '$window', function($scope, $cookies, $http, growl, $location, $timeout, $upload, $window) {
   $scope.submit = function(){}
@@ -301,6 +383,10 @@ angular.module('setting', ['ngRoute', 'ngMessages', 'ngCookies', 'angular-growl'
     templateUrl: '/static/views/setting/account.html',
     controller: 'SettingAccountCtrl'
   })
+  .when('/security', {
+    templateUrl: '/static/views/setting/security.html',
+    controller: 'SettingSecurityCtrl'
+  })
   .when('/emails', {
     templateUrl: '/static/views/setting/emails.html',
     controller: 'SettingEmailsCtrl'
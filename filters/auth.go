@@ -3,12 +3,14 @@ package filters
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"regexp"
 	"strings"
 
 	"github.com/astaxie/beego/context"
 
+	"github.com/containerops/wharf/auth"
 	"github.com/containerops/wharf/models"
 	"github.com/containerops/wharf/modules"
 	"github.com/containerops/wharf/utils"
@@ -17,60 +19,79 @@ import (
 const (
 	PERMISSION_WRITE = iota
 	PERMISSION_READ
+	PERMISSION_ADMIN
 )
 
 func FilterAuth(ctx *context.Context) {
 	var namespace, repository string
 	var permission int
 
-	auth := true
-	user := new(models.User)
+	//Docker Registry API V2 checks the bearer token issued by "/auth/token" instead of the user password
+	if strings.HasPrefix(ctx.Request.URL.Path, "/v2/") == true && modules.TokenEnabled() == true {
+		filterToken(ctx)
+		return
+	}
 
-	namespace = strings.Split(string(ctx.Input.Params[":splat"]), "/")[0]
-	repository = strings.Split(string(ctx.Input.Params[":splat"]), "/")[1]
+	allowed := true
+	user := new(models.User)
+	var token *models.AccessToken
 
 	//Get Permission
 	permission = getPermission(ctx.Input.Method())
 
 	//Check Authorization In Header
 	if len(ctx.Input.Header("Authorization")) == 0 || strings.Index(ctx.Input.Header("Authorization"), "Basic") == -1 {
-		auth = false
+		allowed = false
 		goto AUTH
 	}
 
 	//Check Username, Password And Get User
 	if username, passwd, err := utils.DecodeBasicAuth(ctx.Input.Header("Authorization")); err != nil {
-		auth = false
+		allowed = false
 		goto AUTH
 	} else {
-		if err := user.Get(username, passwd); err != nil {
-			auth = false
+		if u, t, err := auth.Authenticate(username, passwd); err != nil {
+			allowed = false
 			goto AUTH
+		} else {
+			user, token = u, t
 		}
 	}
 
+	//Controllers check the resources themselves with the user, like "/v2/_catalog"
+	ctx.Input.SetData("user", user)
+	if token != nil {
+		ctx.Input.SetData("token", token)
+	}
+
 	//Docker Registry V1 Image Don't Check User/Org Permission
 	if isImageResource(ctx.Request.URL.String()) == true {
+		if token != nil {
+			allowed = token.Scoped(TokenScope(permission))
+		}
+
 		goto AUTH
 	}
 
-	//Username != namespace
-	if user.Username != namespace {
-		u := new(models.User)
-		if has, _, err := u.Has(namespace); err != nil {
-			auth = false
-			goto AUTH
-		} else if has == false {
-			//Org Repository Check
-			auth = checkOrgRepositoryPermission(user, namespace, repository, permission)
-		} else if has == true {
-			//Different User and Public/Private Repository
-			auth = checkRepositoriesPrivate(namespace, repository)
-		}
+	//Not a repository resource
+	if namespace, repository = repositoryName(ctx.Request.URL.Path); len(namespace) == 0 || len(repository) == 0 {
+		goto AUTH
+	}
+
+	//Removing the whole repository needs the admin permission
+	if ctx.Input.Method() == "DELETE" && strings.TrimSuffix(ctx.Request.URL.Path, "/") == fmt.Sprintf("/v1/repositories/%s/%s", namespace, repository) {
+		permission = PERMISSION_ADMIN
+	}
+
+	allowed = CheckPermission(user, namespace, repository, permission)
+
+	//Access tokens and robot accounts are limited by the scopes and repositories, and never remove repositories
+	if allowed == true && token != nil {
+		allowed = token.Allowed(namespace, repository, TokenScope(permission))
 	}
 
 AUTH:
-	if auth == false {
+	if allowed == false {
 		result := map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnauthorized]}}
 
 		data, _ := json.Marshal(result)
@@ -81,85 +102,158 @@ AUTH:
 	}
 }
 
-func getPermission(method string) int {
-	write := map[string]string{"POST": "POST", "PUT": "PUT", "DELETE": "DELETE"}
-	read := map[string]string{"HEAD": "HEAD", "GET": "GET"}
+func filterToken(ctx *context.Context) {
+	var typ, name, action string
 
-	if _, ok := write[method]; ok == true {
-		return PERMISSION_WRITE
+	namespace, repository := repositoryName(ctx.Request.URL.Path)
+
+	if len(namespace) > 0 && len(repository) > 0 {
+		typ, name = "repository", fmt.Sprintf("%s/%s", namespace, repository)
+
+		switch ctx.Input.Method() {
+		case "DELETE":
+			action = "delete"
+		case "POST", "PUT", "PATCH":
+			action = "push"
+		default:
+			action = "pull"
+		}
+	} else if ctx.Request.URL.Path == "/v2/_catalog" {
+		typ, name, action = "registry", "catalog", "*"
+	} else {
+		//Not a protected resource, like "/v2/" checks the token itself
+		return
 	}
 
-	if _, ok := read[method]; ok == true {
-		return PERMISSION_READ
+	scope := fmt.Sprintf("%s:%s:%s", typ, name, action)
+	if typ == "repository" && action == "push" {
+		scope = fmt.Sprintf("%s:%s:pull,push", typ, name)
 	}
 
-	return PERMISSION_READ
-}
+	authorization := ctx.Input.Header("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") == false {
+		tokenError(ctx, modules.TokenChallenge(scope, ""))
+		return
+	}
 
-func isImageResource(url string) bool {
-	r := bytes.NewReader([]byte(url))
-	result, _ := regexp.MatchReader("/v1/images/*", r)
+	claims, err := modules.ParseToken(strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer ")))
+	if err != nil {
+		tokenError(ctx, modules.TokenChallenge(scope, "invalid_token"))
+		return
+	}
 
-	return result
-}
+	if claims.Allowed(typ, name, action) == false {
+		tokenError(ctx, modules.TokenChallenge(scope, "insufficient_scope"))
+		return
+	}
 
-func checkRepositoriesPrivate(namespace, repository string) bool {
-	repo := new(models.Repository)
+	//Webhook events name the subject of the token as the actor, controllers check other repositories with the claims
+	ctx.Input.SetData("actor", claims.Subject)
+	ctx.Input.SetData("claims", claims)
 
-	if has, _, err := repo.Has(namespace, repository); err != nil || has == false {
-		return false
-	} else if has == true {
-		if repo.Privated == true {
-			return false
-		} else {
-			return true
+	//Only the catalog filters repositories with the user
+	if typ == "registry" {
+		user := new(models.User)
+		if has, _, err := user.Has(claims.Subject); err != nil || has == false {
+			tokenError(ctx, modules.TokenChallenge(scope, "invalid_token"))
+			return
 		}
+
+		ctx.Input.SetData("user", user)
 	}
+}
+
+func tokenError(ctx *context.Context, challenge string) {
+	result := map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[modules.APIErrorCodeUnauthorized]}}
+
+	data, _ := json.Marshal(result)
+
+	ctx.Output.Context.ResponseWriter.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	ctx.Output.Context.ResponseWriter.Header().Set("WWW-Authenticate", challenge)
+	ctx.Output.Context.ResponseWriter.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	ctx.Output.Context.Output.SetStatus(http.StatusUnauthorized)
+	ctx.Output.Context.Output.Body(data)
+}
 
-	return false
+// CheckPermission returns whether the user has the permission of the repository, the user is empty when not signed in.
+// Nested repositories like "team/service/component" inherit the permission of the top-level namespace.
+func CheckPermission(user *models.User, namespace, repository string, permission int) bool {
+	return resolveLevel(loadPermissionFacts(user, namespace, repository)) >= requiredLevel(permission)
 }
 
-func checkOrgRepositoryPermission(user *models.User, namespace, repository string, permission int) bool {
-	owner := false
+// ReadAllowed checks the user or the token of the request may pull another repository than the one of the path, like
+// the source repository of a blob mount.
+func ReadAllowed(ctx *context.Context, namespace, repository string) bool {
+	if claims, ok := ctx.Input.GetData("claims").(*modules.TokenClaims); ok == true {
+		return claims.Allowed("repository", fmt.Sprintf("%s/%s", namespace, repository), "pull")
+	}
 
-	//Check Org exists
-	org := new(models.Organization)
-	if has, _, _ := org.Has(namespace); has == false {
+	user, _ := ctx.Input.GetData("user").(*models.User)
+	if CheckPermission(user, namespace, repository, PERMISSION_READ) == false {
 		return false
 	}
 
-	//Check Owner, don't care Join team
-	for _, k := range user.Organizations {
-		if org.Id == k {
-			owner = true
-		}
+	if token, ok := ctx.Input.GetData("token").(*models.AccessToken); ok == true {
+		return token.Allowed(namespace, repository, TokenScope(PERMISSION_READ))
 	}
 
-	//Check Repository
-	repo := new(models.Repository)
-	if has, _, _ := repo.Has(namespace, repository); has == false {
-		if owner == true {
-			return true
-		} else {
-			return false
-		}
+	return true
+}
+
+// TokenScope returns the scope of access tokens the permission needs.
+func TokenScope(permission int) string {
+	switch permission {
+	case PERMISSION_READ:
+		return models.TOKEN_SCOPE_PULL
+	case PERMISSION_WRITE:
+		return models.TOKEN_SCOPE_PUSH
 	}
 
-	if repo.Privated == false && permission == PERMISSION_READ {
-		return true
+	return models.TOKEN_SCOPE_ADMIN
+}
+
+func getPermission(method string) int {
+	write := map[string]string{"POST": "POST", "PUT": "PUT", "PATCH": "PATCH", "DELETE": "DELETE"}
+	read := map[string]string{"HEAD": "HEAD", "GET": "GET"}
+
+	if _, ok := write[method]; ok == true {
+		return PERMISSION_WRITE
+	}
+
+	if _, ok := read[method]; ok == true {
+		return PERMISSION_READ
 	}
 
-	//Loop Team
-	for _, k := range user.JoinTeams {
-		team := new(models.Team)
+	return PERMISSION_READ
+}
+
+// repositoryName splits the Registry API V1 and V2 path to the top-level namespace and the nested repository name,
+// like "/v2/org/team/service/manifests/latest" to "org" and "team/service".
+func repositoryName(path string) (string, string) {
+	var name string
 
-		if err := team.GetById(k); err != nil {
-			return false
+	if strings.HasPrefix(path, "/v2/") == true {
+		name, _ = utils.SplitRepositoryPath(strings.TrimPrefix(path, "/v2/"))
+	} else if strings.HasPrefix(path, "/v1/repositories/") == true {
+		name = strings.TrimSuffix(strings.TrimPrefix(path, "/v1/repositories/"), "/")
+
+		if i := strings.LastIndex(name, "/tags/"); i > 0 {
+			name = name[:i]
 		}
 
-		//TODO Check Team Perimssion
+		name = strings.TrimSuffix(strings.TrimSuffix(name, "/images"), "/tags")
+	}
 
+	if parts := strings.SplitN(name, "/", 2); len(parts) == 2 {
+		return parts[0], parts[1]
 	}
 
-	return false
+	return "", ""
+}
+
+func isImageResource(url string) bool {
+	r := bytes.NewReader([]byte(url))
+	result, _ := regexp.MatchReader("/v1/images/*", r)
+
+	return result
 }
@@ -0,0 +1,44 @@
+package filters
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/astaxie/beego/context"
+
+	"github.com/containerops/wharf/modules"
+	"github.com/containerops/wharf/utils"
+)
+
+// FilterName rejects the Registry API V2 requests which repository name or tag doesn't match the grammar of the distribution spec.
+func FilterName(ctx *context.Context) {
+	name, resource := utils.SplitRepositoryPath(strings.TrimPrefix(ctx.Request.URL.Path, "/v2/"))
+
+	//Not a repository resource, like "/v2/" and "/v2/_catalog"
+	if len(name) == 0 {
+		return
+	}
+
+	if utils.IsRepositoryName(name) == false {
+		nameError(ctx, modules.APIErrorCodeNameInvalid)
+		return
+	}
+
+	if strings.HasPrefix(resource, "manifests/") == true {
+		if reference := strings.TrimPrefix(resource, "manifests/"); utils.IsDigest(reference) == false && utils.IsTag(reference) == false {
+			nameError(ctx, modules.APIErrorCodeTagInvalid)
+			return
+		}
+	}
+}
+
+func nameError(ctx *context.Context, code int) {
+	result := map[string][]modules.ErrorDescriptor{"errors": []modules.ErrorDescriptor{modules.ErrorDescriptors[code]}}
+
+	data, _ := json.Marshal(result)
+
+	ctx.Output.Context.ResponseWriter.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	ctx.Output.Context.Output.SetStatus(http.StatusBadRequest)
+	ctx.Output.Context.Output.Body(data)
+}
@@ -0,0 +1,255 @@
+package filters
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/astaxie/beego/context"
+
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/proxy"
+)
+
+// Levels a user has on a repository, a higher level includes the lower ones.
+const (
+	LEVEL_NONE = iota
+	LEVEL_READ
+	LEVEL_WRITE
+	LEVEL_ADMIN
+)
+
+// permissionFacts is what the level of a user on a repository is resolved from. It's loaded from the models by
+// loadPermissionFacts, so resolveLevel only decides with the facts.
+type permissionFacts struct {
+	Signed       bool  // The user signed in
+	Self         bool  // The namespace is the user
+	Organization bool  // The namespace is an organization
+	Owner        bool  // The user owns the organization
+	Robot        bool  // The user is a robot account of the organization
+	Exists       bool  // The repository exists
+	Proxied      bool  // The namespace isn't in Wharf and is pulled through the upstream registry
+	Privated     bool  // The repository is private
+	Collaborator bool  // The user is a collaborator of the repository
+	Teams        []int // Levels of the organization teams the user joined which include the repository
+}
+
+// resolveLevel returns the level of the user:
+//   - The user has admin of the repositories in the namespace of the user or the organization the user owns.
+//   - Robot accounts could write the repositories of the organization, but they aren't owners.
+//   - Everyone could read public repositories and the repositories pulled through the upstream registry.
+//   - Collaborators could write the repository.
+//   - Members of organization teams have the level of the team on the repositories of the team.
+//
+// Creating a repository by pushing needs the write level, only owners and teams include the name have it.
+func resolveLevel(facts permissionFacts) int {
+	if facts.Signed == true && (facts.Self == true || (facts.Organization == true && facts.Owner == true)) {
+		return LEVEL_ADMIN
+	}
+
+	level := LEVEL_NONE
+
+	if (facts.Exists == true && facts.Privated == false) || facts.Proxied == true {
+		level = LEVEL_READ
+	}
+
+	if facts.Signed == false {
+		return level
+	}
+
+	if facts.Organization == true && facts.Robot == true {
+		return LEVEL_WRITE
+	}
+
+	if facts.Exists == true && facts.Collaborator == true && level < LEVEL_WRITE {
+		level = LEVEL_WRITE
+	}
+
+	if facts.Organization == true {
+		for _, l := range facts.Teams {
+			if l > level {
+				level = l
+			}
+		}
+	}
+
+	return level
+}
+
+// requiredLevel returns the level the permission needs.
+func requiredLevel(permission int) int {
+	switch permission {
+	case PERMISSION_READ:
+		return LEVEL_READ
+	case PERMISSION_WRITE:
+		return LEVEL_WRITE
+	case PERMISSION_ADMIN:
+		return LEVEL_ADMIN
+	}
+
+	return LEVEL_ADMIN
+}
+
+// loadPermissionFacts loads the facts of the user on the repository, the user is empty when not signed in.
+func loadPermissionFacts(user *models.User, namespace, repository string) permissionFacts {
+	facts := permissionFacts{Signed: user != nil && len(user.Username) > 0}
+
+	if facts.Signed == true && user.Username == namespace {
+		facts.Self = true
+	}
+
+	repo := new(models.Repository)
+	if has, _, err := repo.Has(namespace, repository); err == nil && has == true {
+		facts.Exists, facts.Privated = true, repo.Privated
+
+		if facts.Signed == true {
+			facts.Collaborator = contains(repo.Collaborators, user.Username)
+		}
+	}
+
+	if facts.Self == true {
+		return facts
+	}
+
+	if has, _, err := new(models.User).Has(namespace); err != nil || has == true {
+		return facts
+	}
+
+	org := new(models.Organization)
+	if has, _, err := org.Has(namespace); err != nil {
+		return facts
+	} else if has == false {
+		//Nobody could push to the namespaces in proxy mode, they are only pulled. The repositories cached already are
+		//read like the others, so a private one left in the namespace isn't opened
+		facts.Proxied = proxy.Upstream != nil && facts.Exists == false
+		return facts
+	}
+
+	facts.Organization = true
+
+	if facts.Signed == false {
+		return facts
+	}
+
+	//Organizations of the owner are saved with the name or the id
+	facts.Owner = org.Username == user.Username || contains(user.Organizations, org.Id) || contains(user.Organizations, org.Name)
+
+	//Usernames never have the separator, only robot accounts are named "<org>+<name>"
+	if strings.HasPrefix(user.Username, namespace+models.ROBOT_SEPARATOR) == true {
+		facts.Robot, facts.Owner = true, false
+		return facts
+	}
+
+	for _, team := range org.GetTeams() {
+		if contains(team.Users, user.Username) == false && contains(user.JoinTeams, team.Id) == false && contains(user.JoinTeams, team.Name) == false {
+			continue
+		}
+
+		//Teams list the repository with the id, or the name before it's created
+		if (facts.Exists == true && contains(team.Repositories, repo.Id)) || contains(team.Repositories, fmt.Sprintf("%s/%s", namespace, repository)) {
+			facts.Teams = append(facts.Teams, teamLevel(team))
+		}
+	}
+
+	return facts
+}
+
+// OwnNamespace returns whether the user owns the namespace, which is the user or an organization the user owns or
+// co-owns. Robot accounts of the organization don't own it.
+func OwnNamespace(user *models.User, namespace string) bool {
+	facts := loadPermissionFacts(user, namespace, "")
+
+	return facts.Signed == true && (facts.Self == true || (facts.Organization == true && facts.Owner == true))
+}
+
+// teamLevel returns the level of the team, teams saved before the permission have write or read with Write.
+func teamLevel(team *models.Team) int {
+	switch team.Permission {
+	case models.TEAM_PERMISSION_ADMIN:
+		return LEVEL_ADMIN
+	case models.TEAM_PERMISSION_WRITE:
+		return LEVEL_WRITE
+	case models.TEAM_PERMISSION_READ:
+		return LEVEL_READ
+	}
+
+	if team.Write == true {
+		return LEVEL_WRITE
+	}
+
+	return LEVEL_READ
+}
+
+// FilterRepository checks the permission of the signed in user to the web API of repositories, reading needs the read
+// level, changing the repository needs the write level and managing collaborators needs the admin level.
+func FilterRepository(ctx *context.Context) {
+	path := strings.Trim(strings.TrimPrefix(ctx.Request.URL.Path, "/w1/repository/"), "/")
+
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || (parts[1] == "repositories" && ctx.Input.Method() == "GET") {
+		return
+	}
+
+	namespace, repository := parts[0], parts[1]
+	permission := getPermission(ctx.Input.Method())
+
+	//Collaborators are listed at "<repository>/collaborators" and changed at "<repository>/collaborators/<name>"
+	segments := strings.Split(repository, "/")
+
+	if n := len(segments); n > 1 && segments[n-1] == "collaborators" && permission == PERMISSION_READ {
+		repository = strings.Join(segments[:n-1], "/")
+	} else if n > 2 && segments[n-2] == "collaborators" && permission == PERMISSION_WRITE {
+		repository, permission = strings.Join(segments[:n-2], "/"), PERMISSION_ADMIN
+	} else if n > 1 && segments[n-1] == "builds" && permission == PERMISSION_READ {
+		//The build history is at "<repository>/builds"
+		repository = strings.Join(segments[:n-1], "/")
+	} else if i := adminSegment(segments, "webhooks"); i > 0 {
+		//Webhooks are at "<repository>/webhooks", "<repository>/webhooks/<id>" and "<repository>/webhooks/<id>/deliveries"
+		repository, permission = strings.Join(segments[:i], "/"), PERMISSION_ADMIN
+	} else if i := adminSegment(segments, "buildrules"); i > 0 {
+		//Build rules are at "<repository>/buildrules" and "<repository>/buildrules/<id>", they have the secrets
+		repository, permission = strings.Join(segments[:i], "/"), PERMISSION_ADMIN
+	}
+
+	user := new(models.User)
+
+	switch u := ctx.Input.CruSession.Get("user").(type) {
+	case *models.User:
+		user = u
+	case models.User:
+		user = &u
+	}
+
+	if len(user.Username) == 0 && permission != PERMISSION_READ {
+		ctx.Output.SetStatus(http.StatusUnauthorized)
+		ctx.Output.Json(map[string]string{"message": "Session load failure", "url": "/auth"}, false, false)
+		return
+	}
+
+	if CheckPermission(user, namespace, repository, permission) == false {
+		ctx.Output.SetStatus(http.StatusForbidden)
+		ctx.Output.Json(map[string]string{"message": "Permission denied"}, false, false)
+		return
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// adminSegment returns the index of the segment managed with the admin level in the last three segments.
+func adminSegment(segments []string, name string) int {
+	for i := len(segments) - 1; i > 0 && i >= len(segments)-3; i-- {
+		if segments[i] == name {
+			return i
+		}
+	}
+
+	return -1
+}
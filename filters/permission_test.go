@@ -0,0 +1,204 @@
+package filters
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/siddontang/ledisdb/config"
+	"github.com/siddontang/ledisdb/ledis"
+
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/proxy"
+)
+
+func TestResolveLevel(t *testing.T) {
+	tests := []struct {
+		name  string
+		facts permissionFacts
+		level int
+	}{
+		{"anonymous of public", permissionFacts{Exists: true}, LEVEL_READ},
+		{"anonymous of private", permissionFacts{Exists: true, Privated: true}, LEVEL_NONE},
+		{"anonymous of missing", permissionFacts{}, LEVEL_NONE},
+		{"anonymous of proxied", permissionFacts{Proxied: true}, LEVEL_READ},
+		{"anonymous claims self", permissionFacts{Self: true, Exists: true, Privated: true}, LEVEL_NONE},
+		{"owner", permissionFacts{Signed: true, Self: true, Exists: true, Privated: true}, LEVEL_ADMIN},
+		{"owner creates", permissionFacts{Signed: true, Self: true}, LEVEL_ADMIN},
+		{"organization owner", permissionFacts{Signed: true, Organization: true, Owner: true, Exists: true, Privated: true}, LEVEL_ADMIN},
+		{"owner outside organization", permissionFacts{Signed: true, Owner: true, Exists: true, Privated: true}, LEVEL_NONE},
+		{"stranger of public", permissionFacts{Signed: true, Exists: true}, LEVEL_READ},
+		{"stranger of private", permissionFacts{Signed: true, Exists: true, Privated: true}, LEVEL_NONE},
+		{"collaborator", permissionFacts{Signed: true, Exists: true, Privated: true, Collaborator: true}, LEVEL_WRITE},
+		{"collaborator of missing", permissionFacts{Signed: true, Collaborator: true}, LEVEL_NONE},
+		{"team read", permissionFacts{Signed: true, Organization: true, Exists: true, Privated: true, Teams: []int{LEVEL_READ}}, LEVEL_READ},
+		{"team write", permissionFacts{Signed: true, Organization: true, Exists: true, Privated: true, Teams: []int{LEVEL_WRITE}}, LEVEL_WRITE},
+		{"team admin", permissionFacts{Signed: true, Organization: true, Exists: true, Privated: true, Teams: []int{LEVEL_ADMIN}}, LEVEL_ADMIN},
+		{"highest team", permissionFacts{Signed: true, Organization: true, Exists: true, Teams: []int{LEVEL_READ, LEVEL_ADMIN, LEVEL_WRITE}}, LEVEL_ADMIN},
+		{"team creates", permissionFacts{Signed: true, Organization: true, Teams: []int{LEVEL_WRITE}}, LEVEL_WRITE},
+		{"team outside organization", permissionFacts{Signed: true, Exists: true, Privated: true, Teams: []int{LEVEL_ADMIN}}, LEVEL_NONE},
+		{"robot", permissionFacts{Signed: true, Organization: true, Robot: true, Exists: true, Privated: true}, LEVEL_WRITE},
+		{"robot outside organization", permissionFacts{Signed: true, Robot: true, Exists: true, Privated: true}, LEVEL_NONE},
+		{"signed of proxied", permissionFacts{Signed: true, Proxied: true}, LEVEL_READ},
+	}
+
+	for _, test := range tests {
+		if level := resolveLevel(test.facts); level != test.level {
+			t.Errorf("%s: level is %d, want %d", test.name, level, test.level)
+		}
+	}
+}
+
+func TestRequiredLevel(t *testing.T) {
+	for permission, level := range map[int]int{PERMISSION_READ: LEVEL_READ, PERMISSION_WRITE: LEVEL_WRITE, PERMISSION_ADMIN: LEVEL_ADMIN, -1: LEVEL_ADMIN} {
+		if requiredLevel(permission) != level {
+			t.Errorf("required level of %d is %d, want %d", permission, requiredLevel(permission), level)
+		}
+	}
+}
+
+func setup(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "wharf-filters")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.NewConfigDefault()
+	cfg.DataDir = filepath.Join(dir, "ledis")
+
+	l, err := ledis.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models.LedisDB, _ = l.Select(0)
+
+	return func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLoadPermissionFacts(t *testing.T) {
+	defer setup(t)()
+
+	users := map[string]*models.User{}
+	for _, username := range []string{"owner", "coowner", "reader", "writer", "admin", "collaborator", "stranger"} {
+		user := &models.User{Id: "user:" + username, Username: username, Password: "Passw0rd!Passw0rd", Email: username + "@example.com"}
+		if err := user.Save(); err != nil {
+			t.Fatal(err)
+		}
+
+		users[username] = user
+	}
+
+	repos := map[string]*models.Repository{}
+	for _, name := range []string{"owner/private", "owner/public", "acme/private", "acme/public", "library/private", "library/cached"} {
+		repo := new(models.Repository)
+		if err := repo.Put(filepath.Dir(name), filepath.Base(name), "", "", models.APIVERSION_V2); err != nil {
+			t.Fatal(err)
+		}
+
+		repo.Privated = filepath.Base(name) == "private"
+		if repo.Privated == true {
+			repo.Collaborators = []string{"collaborator"}
+		}
+
+		if err := repo.Save(); err != nil {
+			t.Fatal(err)
+		}
+
+		repos[name] = repo
+	}
+
+	org := &models.Organization{Id: "org:acme", Name: "acme", Username: "owner"}
+	users["coowner"].Organizations = []string{org.Id}
+
+	//Teams have the repository id or the name of the repository not created yet
+	for username, permission := range map[string]string{"reader": models.TEAM_PERMISSION_READ, "writer": models.TEAM_PERMISSION_WRITE, "admin": models.TEAM_PERMISSION_ADMIN} {
+		team := &models.Team{Id: "team:" + username, Name: username, Organization: "acme", Permission: permission, Users: []string{username}, Repositories: []string{repos["acme/private"].Id, "acme/next"}}
+		if err := team.Save(); err != nil {
+			t.Fatal(err)
+		}
+
+		org.Teams = append(org.Teams, team.Id)
+	}
+
+	if err := org.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	users["anonymous"] = new(models.User)
+	users["acme+ci"] = &models.User{Username: "acme+ci"}
+	users["other+ci"] = &models.User{Username: "other+ci"}
+
+	upstream := proxy.Upstream
+	defer func() { proxy.Upstream = upstream }()
+	proxy.Upstream = &proxy.Registry{}
+
+	tests := []struct {
+		user, name string
+		level      int
+	}{
+		{"owner", "owner/private", LEVEL_ADMIN},
+		{"owner", "owner/next", LEVEL_ADMIN},
+		{"owner", "acme/private", LEVEL_ADMIN},
+		{"coowner", "acme/private", LEVEL_ADMIN},
+		{"coowner", "owner/private", LEVEL_NONE},
+		{"reader", "acme/private", LEVEL_READ},
+		{"writer", "acme/private", LEVEL_WRITE},
+		{"admin", "acme/private", LEVEL_ADMIN},
+		{"writer", "acme/next", LEVEL_WRITE},
+		{"writer", "acme/other", LEVEL_NONE},
+		{"reader", "acme/public", LEVEL_READ},
+		{"collaborator", "owner/private", LEVEL_WRITE},
+		{"collaborator", "acme/private", LEVEL_WRITE},
+		{"collaborator", "owner/public", LEVEL_READ},
+		{"stranger", "owner/private", LEVEL_NONE},
+		{"stranger", "owner/public", LEVEL_READ},
+		{"stranger", "acme/next", LEVEL_NONE},
+		{"anonymous", "owner/private", LEVEL_NONE},
+		{"anonymous", "owner/public", LEVEL_READ},
+		{"anonymous", "acme/public", LEVEL_READ},
+		{"anonymous", "acme/private", LEVEL_NONE},
+		{"acme+ci", "acme/private", LEVEL_WRITE},
+		{"acme+ci", "acme/next", LEVEL_WRITE},
+		{"acme+ci", "owner/private", LEVEL_NONE},
+		{"other+ci", "acme/private", LEVEL_NONE},
+		{"anonymous", "library/ubuntu", LEVEL_READ},
+		{"stranger", "library/ubuntu", LEVEL_READ},
+		{"anonymous", "library/cached", LEVEL_READ},
+		{"anonymous", "library/private", LEVEL_NONE},
+		{"stranger", "library/private", LEVEL_NONE},
+	}
+
+	for _, test := range tests {
+		namespace, repository := filepath.Dir(test.name), filepath.Base(test.name)
+
+		if level := resolveLevel(loadPermissionFacts(users[test.user], namespace, repository)); level != test.level {
+			t.Errorf("level of %s on %s is %d, want %d: %+v", test.user, test.name, level, test.level, loadPermissionFacts(users[test.user], namespace, repository))
+		}
+	}
+
+	//Nobody pushes to the namespaces in proxy mode
+	if CheckPermission(users["stranger"], "library", "ubuntu", PERMISSION_WRITE) == true {
+		t.Errorf("stranger could push to a proxied namespace")
+	}
+
+	for username, owned := range map[string]bool{"owner": true, "coowner": true, "acme+ci": false, "admin": false, "stranger": false, "anonymous": false} {
+		if OwnNamespace(users[username], "acme") != owned {
+			t.Errorf("%s owns the organization: %v, want %v", username, owned == false, owned)
+		}
+	}
+
+	if OwnNamespace(users["coowner"], "owner") == true || OwnNamespace(users["owner"], "owner") == false {
+		t.Errorf("owner of the user namespace is wrong")
+	}
+
+	proxy.Upstream = nil
+
+	if level := resolveLevel(loadPermissionFacts(users["anonymous"], "library", "ubuntu")); level != LEVEL_NONE {
+		t.Errorf("level without proxy mode is %d", level)
+	}
+}
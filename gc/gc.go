@@ -0,0 +1,358 @@
+package gc
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+
+	"github.com/containerops/wharf/backend"
+	"github.com/containerops/wharf/models"
+)
+
+const (
+	DEFAULT_INTERVAL       = 0     // Seconds between the collections of the web service, 0 disables them
+	DEFAULT_GRACE          = 86400 // Seconds layers and images created or updated are kept for the pushes in flight
+	DEFAULT_UPLOAD_EXPIRES = 86400 // Seconds an upload session is kept after its last chunk
+)
+
+var (
+	Interval      = DEFAULT_INTERVAL * time.Second
+	Grace         = DEFAULT_GRACE * time.Second
+	UploadExpires = DEFAULT_UPLOAD_EXPIRES * time.Second
+
+	once sync.Once
+	lock sync.Mutex
+)
+
+// Result counts what is removed by a collection, or would be removed by a dry run.
+type Result struct {
+	Layers  int64 `json:"layers"`
+	Bytes   int64 `json:"bytes"`
+	Uploads int64 `json:"uploads"`
+}
+
+// InitGC reads the [gc] section of bucket.conf: Interval, Grace and UploadExpires (seconds), then collects in the
+// background of the web service when the interval isn't 0. It shares the database with the pushes, so the collection
+// is safe while they are in flight.
+func InitGC() {
+	if value, err := beego.AppConfig.Int("gc::Interval"); err == nil && value >= 0 {
+		Interval = time.Duration(value) * time.Second
+	}
+
+	if value, err := beego.AppConfig.Int("gc::Grace"); err == nil && value >= 0 {
+		Grace = time.Duration(value) * time.Second
+	}
+
+	if value, err := beego.AppConfig.Int("gc::UploadExpires"); err == nil && value > 0 {
+		UploadExpires = time.Duration(value) * time.Second
+	}
+
+	if Interval == 0 {
+		return
+	}
+
+	once.Do(func() {
+		go Run(Interval)
+	})
+}
+
+// Run collects every interval.
+func Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		result, err := Collect(Grace, UploadExpires, false, func(format string, v ...interface{}) {
+			beego.Info(fmt.Sprintf("[gc] "+format, v...))
+		})
+
+		if err != nil {
+			beego.Error(fmt.Sprintf("[gc] collect error: %s", err.Error()))
+			continue
+		}
+
+		beego.Info(fmt.Sprintf("[gc] %d layers (%d bytes) and %d uploads removed", result.Layers, result.Bytes, result.Uploads))
+	}
+}
+
+// Collect removes the layers not reachable from any tag and not changed in the grace period, then the upload sessions
+// not updated in the expires period. Nothing is removed in a dry run, report is called with every file removed.
+func Collect(grace, expires time.Duration, dryRun bool, report func(format string, v ...interface{})) (*Result, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	result := new(Result)
+
+	if err := sweepLayers(time.Now().Add(-grace), dryRun, report, result); err != nil {
+		return nil, err
+	}
+
+	if err := expireUploads(time.Now().Add(-expires), dryRun, report, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func sweepLayers(deadline time.Time, dryRun bool, report func(format string, v ...interface{}), result *Result) error {
+	marked, err := mark()
+	if err != nil {
+		return fmt.Errorf("Mark layers error: %s", err.Error())
+	}
+
+	for _, folder := range []string{"images", "uuid"} {
+		files, err := backend.Storage.List(folder)
+		if err != nil {
+			return fmt.Errorf("List %s error: %s", folder, err.Error())
+		}
+
+		for _, file := range files {
+			if _, exist := marked[file]; exist == true || path.Base(file) != "layer" {
+				continue
+			}
+
+			info, err := backend.Storage.Stat(file)
+			if err != nil {
+				continue
+			}
+
+			//Layers may be uploaded before the tag or manifest
+			if info.Modified.After(deadline) || recent(file, deadline) {
+				continue
+			}
+
+			if dryRun == true {
+				result.Layers, result.Bytes = result.Layers+1, result.Bytes+info.Size
+				report("Would remove %s (%d bytes)", file, info.Size)
+				continue
+			}
+
+			if err := backend.Storage.Delete(path.Dir(file)); err != nil {
+				report("Remove %s error: %s", file, err.Error())
+				continue
+			}
+
+			if folder == "uuid" {
+				sha256 := path.Base(path.Dir(file))
+
+				image := new(models.Image)
+				image.RemoveTarsum(sha256)
+
+				models.RemoveBlobLinks(fmt.Sprintf("sha256:%s", sha256))
+			}
+
+			result.Layers, result.Bytes = result.Layers+1, result.Bytes+info.Size
+			report("Removed %s (%d bytes)", file, info.Size)
+		}
+	}
+
+	return nil
+}
+
+// expireUploads removes the upload sessions not updated after the deadline with their chunks, and the chunks of the
+// sessions removed without them.
+func expireUploads(deadline time.Time, dryRun bool, report func(format string, v ...interface{}), result *Result) error {
+	sessions := map[string]bool{}
+
+	for _, upload := range new(models.Upload).All() {
+		sessions[upload.UUID] = true
+
+		if time.Unix(0, upload.Updated*int64(time.Millisecond)).After(deadline) {
+			continue
+		}
+
+		result.Uploads++
+
+		if dryRun == true {
+			report("Would remove upload %s of %s/%s (%d bytes)", upload.UUID, upload.Namespace, upload.Repository, upload.Offset)
+			continue
+		}
+
+		if err := backend.Storage.Delete(fmt.Sprintf("uploads/%s", upload.UUID)); err != nil {
+			report("Remove upload %s error: %s", upload.UUID, err.Error())
+			continue
+		}
+
+		if err := upload.Remove(); err != nil {
+			report("Remove upload %s error: %s", upload.UUID, err.Error())
+			continue
+		}
+
+		report("Removed upload %s of %s/%s (%d bytes)", upload.UUID, upload.Namespace, upload.Repository, upload.Offset)
+	}
+
+	files, err := backend.Storage.List("uploads")
+	if err != nil {
+		return fmt.Errorf("List uploads error: %s", err.Error())
+	}
+
+	for _, file := range files {
+		parts := strings.Split(file, "/")
+		if len(parts) < 3 || sessions[parts[1]] == true {
+			continue
+		}
+
+		//Sessions started after the list of sessions are recent
+		if info, err := backend.Storage.Stat(file); err != nil || info.Modified.After(deadline) {
+			continue
+		}
+
+		sessions[parts[1]] = true
+		result.Uploads++
+
+		if dryRun == true {
+			report("Would remove uploads/%s without session", parts[1])
+			continue
+		}
+
+		if err := backend.Storage.Delete(fmt.Sprintf("uploads/%s", parts[1])); err != nil {
+			report("Remove uploads/%s error: %s", parts[1], err.Error())
+			continue
+		}
+
+		report("Removed uploads/%s without session", parts[1])
+	}
+
+	return nil
+}
+
+// mark walks every tag to the manifests, the manifests of lists and indexes and the referrers, then to the blobs and
+// the image ancestry, returns the reachable layer paths. Manifests no tag reaches aren't walked, so the layers of
+// untagged manifests and deleted repositories are swept.
+func mark() (map[string]bool, error) {
+	marked, walked := map[string]bool{}, map[string]bool{}
+
+	for _, tag := range new(models.Tag).All() {
+		if len(tag.Digest) > 0 {
+			if err := markManifest(tag.Namespace, tag.Repository, tag.Digest, marked, walked); err != nil {
+				return nil, err
+			}
+		} else if len(tag.Manifest) > 0 {
+			//Tags pushed before manifests are saved by digest
+			manifest := &models.Manifest{Id: tag.Id, MediaType: models.ManifestMediaType([]byte(tag.Manifest)), Data: tag.Manifest}
+
+			if err := markBlobs(manifest, marked); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := markAncestry(tag.ImageId, marked); err != nil {
+			return nil, err
+		}
+	}
+
+	return marked, nil
+}
+
+// markManifest marks the blobs of the manifest, then walks the manifests it references and its referrers.
+func markManifest(namespace, repository, digest string, marked, walked map[string]bool) error {
+	key := fmt.Sprintf("%s/%s@%s", namespace, repository, digest)
+	if walked[key] == true {
+		return nil
+	}
+	walked[key] = true
+
+	manifest := new(models.Manifest)
+	if has, _, err := manifest.Has(namespace, repository, digest); err != nil {
+		return err
+	} else if has == false {
+		return nil
+	}
+
+	if err := markBlobs(manifest, marked); err != nil {
+		return err
+	}
+
+	references, err := manifest.References()
+	if err != nil {
+		return fmt.Errorf("Manifest %s is invalid: %s", manifest.Id, err.Error())
+	}
+
+	//Signatures and other artifacts are pushed by digest with the manifest as the subject
+	for _, descriptor := range append(references, manifest.Referrers(namespace, repository, digest)...) {
+		if err := markManifest(namespace, repository, descriptor.Digest, marked, walked); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func markBlobs(manifest *models.Manifest, marked map[string]bool) error {
+	blobs, err := manifest.Blobs()
+	if err != nil {
+		return fmt.Errorf("Manifest %s is invalid: %s", manifest.Id, err.Error())
+	}
+
+	for _, blobSum := range blobs {
+		if parts := strings.Split(blobSum, ":"); len(parts) == 2 {
+			marked[fmt.Sprintf("uuid/%s/layer", parts[1])] = true
+		}
+	}
+
+	return nil
+}
+
+// markAncestry marks the V1 layers of the image and its ancestors.
+func markAncestry(imageId string, marked map[string]bool) error {
+	if len(imageId) == 0 {
+		return nil
+	}
+
+	image := new(models.Image)
+	if has, _, err := image.Has(imageId); err != nil {
+		return err
+	} else if has == false {
+		return nil
+	}
+
+	ancestry := []string{}
+	if err := json.Unmarshal([]byte(image.Ancestry), &ancestry); err != nil && len(image.Ancestry) > 0 {
+		return fmt.Errorf("Image %s ancestry is invalid: %s", image.ImageId, err.Error())
+	}
+
+	for _, id := range append(ancestry, imageId) {
+		i := new(models.Image)
+		if has, _, err := i.Has(id); err != nil {
+			return err
+		} else if has == true && len(i.Path) > 0 {
+			marked[relative(i.Path)] = true
+		}
+	}
+
+	return nil
+}
+
+// recent returns whether the image of a V1 layer "images/<id>/layer" is created or updated after deadline.
+func recent(file string, deadline time.Time) bool {
+	if strings.HasPrefix(file, "images/") == false {
+		return false
+	}
+
+	image := new(models.Image)
+	if has, _, err := image.Has(path.Base(path.Dir(file))); err != nil || has == false {
+		return false
+	}
+
+	updated := image.Created
+	if image.Updated > updated {
+		updated = image.Updated
+	}
+
+	return time.Unix(0, updated*int64(time.Millisecond)).After(deadline)
+}
+
+// relative converts the absolute paths saved before the backend existed to the relative path.
+func relative(p string) string {
+	base := strings.TrimSuffix(beego.AppConfig.String("docker::BasePath"), "/")
+
+	if len(base) > 0 && strings.HasPrefix(p, base+"/") {
+		return strings.TrimPrefix(p, base+"/")
+	}
+
+	return strings.TrimPrefix(p, "/")
+}
@@ -0,0 +1,207 @@
+package gc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siddontang/ledisdb/config"
+	"github.com/siddontang/ledisdb/ledis"
+
+	"github.com/containerops/wharf/backend"
+	"github.com/containerops/wharf/models"
+)
+
+func setup(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "wharf-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.NewConfigDefault()
+	cfg.DataDir = filepath.Join(dir, "ledis")
+
+	l, err := ledis.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models.LedisDB, _ = l.Select(0)
+	backend.Storage = &backend.LocalDriver{Root: filepath.Join(dir, "storage")}
+
+	return dir, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// put writes the file to the storage modified the age ago.
+func put(t *testing.T, dir, file, content string, age time.Duration) {
+	w, err := backend.Storage.Writer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(content))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	modified := time.Now().Add(-age)
+	os.Chtimes(filepath.Join(dir, "storage", file), modified, modified)
+}
+
+// pushManifest saves a manifest of the config blob like a push, with the tag when it isn't empty.
+func pushManifest(t *testing.T, namespace, repository, tag, config string) string {
+	data := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":10,"digest":"%s"},"layers":[]}`, models.MEDIATYPE_MANIFEST_V2, config))
+	digest := models.ManifestDigest(data)
+
+	repo := new(models.Repository)
+	if err := repo.Put(namespace, repository, "", "", models.APIVERSION_V2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := new(models.Manifest).Put(namespace, repository, models.MEDIATYPE_MANIFEST_V2, data); err != nil {
+		t.Fatal(err)
+	}
+
+	models.LinkBlob(namespace, repository, config)
+
+	if len(tag) > 0 {
+		if err := repo.PutTagFromManifests(strings.TrimPrefix(config, "sha256:"), namespace, repository, tag, string(data), digest); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return digest
+}
+
+func exists(file string) bool {
+	_, err := backend.Storage.Stat(file)
+	return err == nil
+}
+
+func TestCollect(t *testing.T) {
+	dir, teardown := setup(t)
+	defer teardown()
+
+	old := 48 * time.Hour
+
+	put(t, dir, "uuid/referenced/layer", "referenced", old)
+	put(t, dir, "uuid/orphan/layer", "orphan", old)
+	put(t, dir, "uuid/recent/layer", "recent", time.Minute)
+
+	models.LinkBlob("library", "app", "sha256:orphan")
+
+	put(t, dir, "uuid/untagged/layer", "untagged", old)
+
+	//Only the manifest of the tag is reachable, the one pushed by digest isn't
+	pushManifest(t, "library", "app", "latest", "sha256:referenced")
+	pushManifest(t, "library", "app", "", "sha256:untagged")
+
+	expired, active := new(models.Upload), new(models.Upload)
+	for _, upload := range []*models.Upload{expired, active} {
+		if err := upload.Start("library", "app"); err != nil {
+			t.Fatal(err)
+		}
+		put(t, dir, fmt.Sprintf("uploads/%s/0", upload.UUID), "chunk", old)
+		upload.PutChunk(fmt.Sprintf("uploads/%s/0", upload.UUID), 5)
+	}
+
+	expired.Updated = time.Now().Add(-old).UnixNano() / int64(time.Millisecond)
+	expired.Save()
+
+	put(t, dir, "uploads/lost/0", "chunk", old)
+	put(t, dir, "uploads/starting/0", "chunk", time.Minute)
+
+	reported := []string{}
+	report := func(format string, v ...interface{}) {
+		reported = append(reported, fmt.Sprintf(format, v...))
+	}
+
+	result, err := Collect(24*time.Hour, 24*time.Hour, true, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Layers != 2 || result.Bytes != int64(len("orphan")+len("untagged")) || result.Uploads != 2 {
+		t.Errorf("dry run result is %+v: %s", result, strings.Join(reported, "; "))
+	}
+
+	if exists("uuid/orphan/layer") == false || exists(fmt.Sprintf("uploads/%s/0", expired.UUID)) == false {
+		t.Errorf("dry run removed files")
+	}
+
+	if result, err = Collect(24*time.Hour, 24*time.Hour, false, report); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Layers != 2 || result.Uploads != 2 {
+		t.Errorf("result is %+v", result)
+	}
+
+	for file, kept := range map[string]bool{
+		"uuid/referenced/layer":                   true,
+		"uuid/recent/layer":                       true,
+		"uuid/orphan/layer":                       false,
+		"uuid/untagged/layer":                     false,
+		fmt.Sprintf("uploads/%s/0", active.UUID):  true,
+		fmt.Sprintf("uploads/%s/0", expired.UUID): false,
+		"uploads/lost/0":                          false,
+		"uploads/starting/0":                      true,
+	} {
+		if exists(file) != kept {
+			t.Errorf("%s exists: %v", file, exists(file))
+		}
+	}
+
+	if has, _, _ := new(models.Upload).Has("library", "app", expired.UUID); has == true {
+		t.Errorf("expired upload session exists")
+	}
+
+	if has, _, _ := new(models.Upload).Has("library", "app", active.UUID); has == false {
+		t.Errorf("active upload session is removed")
+	}
+
+	if models.BlobLinked("library", "app", "sha256:orphan") == true {
+		t.Errorf("link of the removed blob exists")
+	}
+}
+
+func TestCollectDeletedRepository(t *testing.T) {
+	dir, teardown := setup(t)
+	defer teardown()
+
+	old := 48 * time.Hour
+
+	put(t, dir, "uuid/deleted/layer", "deleted", old)
+	put(t, dir, "uuid/shared/layer", "shared", old)
+
+	pushManifest(t, "library", "deleted", "latest", "sha256:deleted")
+	pushManifest(t, "library", "deleted", "v1", "sha256:shared")
+	pushManifest(t, "library", "kept", "latest", "sha256:shared")
+
+	if result, err := Collect(24*time.Hour, 24*time.Hour, false, t.Logf); err != nil || result.Layers != 0 {
+		t.Fatalf("layers of tags are removed: %+v, %v", result, err)
+	}
+
+	if err := new(models.Repository).Delete("library", "deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Collect(24*time.Hour, 24*time.Hour, false, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Layers != 1 || exists("uuid/deleted/layer") == true || exists("uuid/shared/layer") == false {
+		t.Errorf("result after the repository is deleted is %+v", result)
+	}
+
+	if models.BlobLinked("library", "deleted", "sha256:deleted") == true || models.BlobLinked("library", "kept", "sha256:shared") == false {
+		t.Errorf("links after the repository is deleted are wrong")
+	}
+}
@@ -27,6 +27,7 @@ func main() {
 
 	app.Commands = []cli.Command{
 		cmd.CmdWeb,
+		cmd.CmdGC,
 	}
 
 	app.Flags = append(app.Flags, []cli.Flag{}...)
@@ -0,0 +1,287 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/containerops/wharf/utils"
+)
+
+const (
+	TOKEN_SCOPE_PULL  = "pull"
+	TOKEN_SCOPE_PUSH  = "push"
+	TOKEN_SCOPE_ADMIN = "admin" // Managing the repository like removing it, never granted to tokens
+
+	ROBOT_SEPARATOR = "+"
+)
+
+// AccessToken is a personal access token of a user, or the token of an organization robot account which
+// signs in with the username "<org>+<name>". Both are accepted anywhere the password is accepted.
+type AccessToken struct {
+	Id           string   `json:"id"`           //
+	Name         string   `json:"name"`         //
+	Namespace    string   `json:"namespace"`    // User or organization owns the token
+	Robot        bool     `json:"robot"`        //
+	Secret       string   `json:"secret"`       // sha256 of the token, the token itself is only shown when created
+	Scopes       []string `json:"scopes"`       // "pull" or "push", push includes pull
+	Repositories []string `json:"repositories"` // "namespace/repository" names, all repositories when empty
+	Expires      int64    `json:"expires"`      // Milliseconds, never expires when 0
+	Revoked      bool     `json:"revoked"`      //
+	Used         int64    `json:"used"`         // Milliseconds of last authorization
+	Created      int64    `json:"created"`      //
+	Updated      int64    `json:"updated"`      //
+	Memo         []string `json:"memo"`         //
+}
+
+func (t *AccessToken) Has(namespace, name string) (bool, []byte, error) {
+	id, err := GetByGobalId("accesstoken", fmt.Sprintf("%s:%s", namespace, name))
+	if err != nil {
+		return false, nil, err
+	}
+
+	if len(id) <= 0 {
+		return false, nil, nil
+	}
+
+	err = Get(t, id)
+
+	return true, id, err
+}
+
+// Create saves a new token and returns the token, only the sha256 of it is saved.
+func (t *AccessToken) Create(namespace, name string, robot bool, scopes, repositories []string, expires int64) (string, error) {
+	if regexp.MustCompile(`^[a-z0-9_-]{1,30}$`).MatchString(name) == false {
+		return "", fmt.Errorf("Token name must be 1 - 30, include a-z, 0-9, '_' and '-'")
+	}
+
+	if has, _, err := t.Has(namespace, name); err != nil {
+		return "", err
+	} else if has == true {
+		return "", fmt.Errorf("Token already exist: %s", name)
+	}
+
+	if len(scopes) == 0 {
+		return "", fmt.Errorf("Token scopes is empty")
+	}
+
+	for _, scope := range scopes {
+		if scope != TOKEN_SCOPE_PULL && scope != TOKEN_SCOPE_PUSH {
+			return "", fmt.Errorf("Invalid token scope: %s", scope)
+		}
+	}
+
+	for _, repository := range repositories {
+		if utils.IsRepositoryName(repository) == false || strings.Contains(repository, "/") == false {
+			return "", fmt.Errorf("Invalid repository name: %s", repository)
+		}
+
+		//Robot accounts only access the repositories of the organization
+		if robot == true && strings.HasPrefix(repository, namespace+"/") == false {
+			return "", fmt.Errorf("Repository %s is not in organization %s", repository, namespace)
+		}
+	}
+
+	if expires != 0 && expires <= time.Now().UnixNano()/int64(time.Millisecond) {
+		return "", fmt.Errorf("Token expires is in the past")
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	token := fmt.Sprintf("wharf_%s", hex.EncodeToString(random))
+
+	t.Id = fmt.Sprintf("accesstoken:%s", uuid.NewV4().String())
+	t.Name, t.Namespace, t.Robot = name, namespace, robot
+	t.Secret = accessTokenSecret(token)
+	t.Scopes, t.Repositories, t.Expires = scopes, repositories, expires
+	t.Revoked, t.Used = false, 0
+	t.Created = time.Now().UnixNano() / int64(time.Millisecond)
+	t.Updated = t.Created
+
+	if t.Repositories == nil {
+		t.Repositories = []string{}
+	}
+
+	if err := t.Save(); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (t *AccessToken) Save() error {
+	if err := Save(t, []byte(t.Id)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HSet([]byte(GLOBAL_ACCESSTOKEN_INDEX), []byte(fmt.Sprintf("%s:%s", t.Namespace, t.Name)), []byte(t.Id)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HSet([]byte(GLOBAL_ACCESSTOKEN_SECRET_INDEX), []byte(t.Secret), []byte(t.Id)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Revoke marks the token revoked and removes it from the indexes, so the name could be used again.
+func (t *AccessToken) Revoke() error {
+	t.Revoked = true
+	t.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+	if err := Save(t, []byte(t.Id)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HSet([]byte(fmt.Sprintf("%s_remove", GLOBAL_ACCESSTOKEN_INDEX)), []byte(fmt.Sprintf("%s:%s", t.Namespace, t.Name)), []byte(t.Id)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HDel([]byte(GLOBAL_ACCESSTOKEN_INDEX), []byte(fmt.Sprintf("%s:%s", t.Namespace, t.Name))); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HDel([]byte(GLOBAL_ACCESSTOKEN_SECRET_INDEX), []byte(t.Secret)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// All returns the tokens or the robot accounts of the namespace.
+func (t *AccessToken) All(namespace string, robot bool) []*AccessToken {
+	values, _ := LedisDB.HGetAll([]byte(GLOBAL_ACCESSTOKEN_INDEX))
+
+	tokens := make([]*AccessToken, 0)
+
+	for _, value := range values {
+		if strings.HasPrefix(string(value.Field), namespace+":") == false {
+			continue
+		}
+
+		token := new(AccessToken)
+		if err := Get(token, value.Value); err != nil || token.Robot != robot {
+			continue
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	return tokens
+}
+
+// Scoped returns whether the token has the scope, push includes pull and no token has admin.
+func (t *AccessToken) Scoped(scope string) bool {
+	if scope != TOKEN_SCOPE_PULL && scope != TOKEN_SCOPE_PUSH {
+		return false
+	}
+
+	for _, s := range t.Scopes {
+		if s == TOKEN_SCOPE_PUSH || s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allowed returns whether the token has the scope on the repository.
+func (t *AccessToken) Allowed(namespace, repository, scope string) bool {
+	if t.Scoped(scope) == false {
+		return false
+	}
+
+	if len(t.Repositories) == 0 {
+		return true
+	}
+
+	for _, r := range t.Repositories {
+		if r == fmt.Sprintf("%s/%s", namespace, repository) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AuthenticateToken checks the basic authorization with a robot account token or a personal access token, the user
+// and the token are nil when the password isn't a token. A robot account is a user only lives in the request named
+// "<org>+<name>", it could write the repositories of the organization but isn't an owner, the token limits it more.
+func AuthenticateToken(username, password string) (*User, *AccessToken, error) {
+	user := new(User)
+
+	token, err := authenticateToken(password)
+	if err != nil || token == nil {
+		return nil, nil, err
+	}
+
+	if token.Robot == true {
+		if username != token.Namespace+ROBOT_SEPARATOR+token.Name {
+			return nil, nil, fmt.Errorf("Robot account token error.")
+		}
+
+		org := new(Organization)
+		if has, _, err := org.Has(token.Namespace); err != nil {
+			return nil, nil, err
+		} else if has == false {
+			return nil, nil, fmt.Errorf("Organization is not exist: %s", token.Namespace)
+		}
+
+		user.Username = username
+
+		return user, token, nil
+	}
+
+	if token.Namespace != username {
+		return nil, nil, fmt.Errorf("Access token error.")
+	}
+
+	if has, _, err := user.Has(username); err != nil {
+		return nil, nil, err
+	} else if has == false {
+		return nil, nil, fmt.Errorf("User is not exist: %s", username)
+	}
+
+	return user, token, nil
+}
+
+// authenticateToken returns the valid token or nil when the password isn't a token.
+func authenticateToken(password string) (*AccessToken, error) {
+	if strings.HasPrefix(password, "wharf_") == false {
+		return nil, nil
+	}
+
+	id, err := GetByGobalId("accesstoken_secret", accessTokenSecret(password))
+	if err != nil || len(id) == 0 {
+		return nil, err
+	}
+
+	token := new(AccessToken)
+	if err := Get(token, id); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	if token.Revoked == true || (token.Expires != 0 && token.Expires <= now) {
+		return nil, fmt.Errorf("Access token is revoked or expired.")
+	}
+
+	LedisDB.HSet(id, []byte("Used"), utils.Int64ToBytes(now))
+
+	return token, nil
+}
+
+func accessTokenSecret(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/siddontang/ledisdb/ledis"
+
+	"github.com/containerops/wharf/utils"
+)
+
+// The blobs of Docker Registry API V2 are shared by all repositories, the repositories they are uploaded or mounted
+// to are linked in the "bloblink:<digest>" hash. A repository could only delete the blobs linked to it. The blobs of a
+// repository are indexed in the "repoblobs:<namespace>/<repository>" hash too, so they are unlinked when the repository
+// is deleted.
+
+// LinkBlob links the blob to the repository.
+func LinkBlob(namespace, repository, digest string) error {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	if _, err := LedisDB.HSet(blobLinkKey(digest), []byte(fmt.Sprintf("%s/%s", namespace, repository)), utils.Int64ToBytes(now)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HSet(repositoryBlobsKey(namespace, repository), []byte(digest), utils.Int64ToBytes(now)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// BlobLinked returns whether the blob is linked to the repository.
+func BlobLinked(namespace, repository, digest string) bool {
+	value, err := LedisDB.HGet(blobLinkKey(digest), []byte(fmt.Sprintf("%s/%s", namespace, repository)))
+
+	return err == nil && len(value) > 0
+}
+
+// UnlinkBlob removes the link of the repository, and returns the count of the repositories still linked to the blob.
+func UnlinkBlob(namespace, repository, digest string) (int64, error) {
+	if _, err := LedisDB.HDel(blobLinkKey(digest), []byte(fmt.Sprintf("%s/%s", namespace, repository))); err != nil {
+		return 0, err
+	}
+
+	if _, err := LedisDB.HDel(repositoryBlobsKey(namespace, repository), []byte(digest)); err != nil {
+		return 0, err
+	}
+
+	return LedisDB.HLen(blobLinkKey(digest))
+}
+
+// RemoveBlobLinks removes all links of the blob when the blob is removed.
+func RemoveBlobLinks(digest string) error {
+	repositories, _ := LedisDB.HKeys(blobLinkKey(digest))
+
+	for _, name := range repositories {
+		if _, err := LedisDB.HDel([]byte(fmt.Sprintf("repoblobs:%s", name)), []byte(digest)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := LedisDB.HClear(blobLinkKey(digest)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RepositoryBlobs returns the digests of the blobs linked to the repository.
+func RepositoryBlobs(namespace, repository string) []string {
+	digests := []string{}
+
+	values, _ := LedisDB.HKeys(repositoryBlobsKey(namespace, repository))
+	for _, value := range values {
+		digests = append(digests, string(value))
+	}
+
+	return digests
+}
+
+// UnlinkRepositoryBlobs removes all links of the repository when the repository is deleted.
+func UnlinkRepositoryBlobs(namespace, repository string) error {
+	for _, digest := range RepositoryBlobs(namespace, repository) {
+		if _, err := UnlinkBlob(namespace, repository, digest); err != nil {
+			return err
+		}
+	}
+
+	if _, err := LedisDB.HClear(repositoryBlobsKey(namespace, repository)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// IndexBlobLinks indexes the links saved before the blobs of repositories were indexed, and returns the count of the
+// links indexed.
+func IndexBlobLinks() (int, error) {
+	count, cursor, inclusive := 0, []byte("bloblink:"), true
+
+	for {
+		keys, err := LedisDB.Scan(ledis.HASH, cursor, 100, inclusive, "^bloblink:")
+		if err != nil {
+			return count, err
+		}
+
+		for _, key := range keys {
+			digest := strings.TrimPrefix(string(key), "bloblink:")
+
+			links, err := LedisDB.HGetAll(key)
+			if err != nil {
+				return count, err
+			}
+
+			for _, link := range links {
+				if value, _ := LedisDB.HGet([]byte(fmt.Sprintf("repoblobs:%s", link.Field)), []byte(digest)); len(value) > 0 {
+					continue
+				}
+
+				if _, err := LedisDB.HSet([]byte(fmt.Sprintf("repoblobs:%s", link.Field)), []byte(digest), link.Value); err != nil {
+					return count, err
+				}
+
+				count++
+			}
+		}
+
+		if len(keys) < 100 {
+			return count, nil
+		}
+
+		cursor, inclusive = keys[len(keys)-1], false
+	}
+}
+
+func repositoryBlobsKey(namespace, repository string) []byte {
+	return []byte(fmt.Sprintf("repoblobs:%s/%s", namespace, repository))
+}
+
+func blobLinkKey(digest string) []byte {
+	return []byte(fmt.Sprintf("bloblink:%s", digest))
+}
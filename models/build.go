@@ -0,0 +1,250 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/siddontang/ledisdb/ledis"
+
+	"github.com/containerops/wharf/utils"
+)
+
+const (
+	BUILD_STATUS_PENDING   = "pending"
+	BUILD_STATUS_RUNNING   = "running"
+	BUILD_STATUS_SUCCEEDED = "succeeded"
+	BUILD_STATUS_FAILED    = "failed"
+
+	BUILD_TRIGGER_API  = "api"
+	BUILD_TRIGGER_PUSH = "push" // Pushes to the git repository of a build rule
+
+	//Builds kept in the history of a repository, older ones are removed with the logs
+	REPOSITORY_BUILDS_HISTORY = 200
+)
+
+var buildLock sync.Mutex
+
+// Build runs a Dockerfile with the context tarball or the git repository, and pushes the image to the tag of the
+// repository.
+type Build struct {
+	Id               string `json:"id"`               //
+	Namespace        string `json:"namespace"`        //
+	Repository       string `json:"repository"`       //
+	Tag              string `json:"tag"`              // The tag pushed when the build succeeds
+	Trigger          string `json:"trigger"`          // "api" or "push"
+	Dockerfile       string `json:"dockerfile"`       // The Dockerfile of the context or of the repository is used when it's empty
+	DockerfileDigest string `json:"dockerfiledigest"` // sha256 digest of the Dockerfile built
+	Git              string `json:"git"`              // URL of the git repository cloned as the context
+	Ref              string `json:"ref"`              // Branch or tag of the git repository, the default branch when it's empty
+	Commit           string `json:"commit"`           // Commit of the git repository built
+	Context          string `json:"context"`          // Path of the context tarball in the storage
+	User             string `json:"user"`             // Who submitted the build
+	Executor         string `json:"executor"`         //
+	Status           string `json:"status"`           // "pending", "running", "succeeded" or "failed"
+	Digest           string `json:"digest"`           // Digest of the manifest pushed
+	Error            string `json:"error"`            //
+	Duration         int64  `json:"duration"`         // Milliseconds from the start to the end
+	Created          int64  `json:"created"`          //
+	Started          int64  `json:"started"`          //
+	Updated          int64  `json:"updated"`          //
+}
+
+// Create checks a new build of the tag, the build is saved when it's submitted.
+func (b *Build) Create(trigger, namespace, repository, tag, dockerfile, git, ref, user string) error {
+	if utils.IsRepositoryName(fmt.Sprintf("%s/%s", namespace, repository)) == false {
+		return fmt.Errorf("Repository name is invalid: %s/%s", namespace, repository)
+	}
+
+	if len(tag) == 0 {
+		tag = "latest"
+	}
+
+	if utils.IsTag(tag) == false {
+		return fmt.Errorf("Tag is invalid: %s", tag)
+	}
+
+	//Local paths and the transports of git running commands aren't cloned
+	if len(git) > 0 && utils.IsGitURL(git) == false {
+		return fmt.Errorf("Git URL is invalid: %s", git)
+	}
+
+	if strings.HasPrefix(ref, "-") == true {
+		return fmt.Errorf("Git ref is invalid: %s", ref)
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	b.Id = fmt.Sprintf("build:%s", uuid.NewV4().String())
+	b.Trigger, b.Namespace, b.Repository, b.Tag = trigger, namespace, repository, tag
+	b.Dockerfile, b.Git, b.Ref, b.User = dockerfile, git, ref, user
+	b.Status, b.Created, b.Updated = BUILD_STATUS_PENDING, now, now
+
+	return nil
+}
+
+func (b *Build) Save() error {
+	if err := Save(b, []byte(b.Id)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HSet([]byte(GLOBAL_BUILD_INDEX), []byte(b.Id), []byte(fmt.Sprintf("%s/%s", b.Namespace, b.Repository))); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Has returns whether the build exists.
+func (b *Build) Has(id string) (bool, error) {
+	if value, err := GetByGobalId("build", id); err != nil || len(value) == 0 {
+		return false, err
+	}
+
+	if err := Get(b, []byte(id)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Finished returns whether the build succeeded or failed.
+func (b *Build) Finished() bool {
+	return b.Status == BUILD_STATUS_SUCCEEDED || b.Status == BUILD_STATUS_FAILED
+}
+
+// Remove removes the build with the log.
+func (b *Build) Remove() error {
+	if _, err := LedisDB.HDel([]byte(GLOBAL_BUILD_INDEX), []byte(b.Id)); err != nil {
+		return err
+	}
+
+	LedisDB.ZRem([]byte(GLOBAL_BUILD_QUEUE), []byte(b.Id))
+	LedisDB.LClear([]byte(fmt.Sprintf("%s:log", b.Id)))
+
+	if _, err := LedisDB.HClear([]byte(b.Id)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Schedule saves the build and puts it in the queue.
+func (b *Build) Schedule() error {
+	b.Status = BUILD_STATUS_PENDING
+
+	if err := b.Save(); err != nil {
+		return err
+	}
+
+	_, err := LedisDB.ZAdd([]byte(GLOBAL_BUILD_QUEUE), ledis.ScorePair{Score: b.Created, Member: []byte(b.Id)})
+
+	return err
+}
+
+// AppendLog appends the output of the executor to the log of the build.
+func (b *Build) AppendLog(data []byte) error {
+	_, err := LedisDB.RPush([]byte(fmt.Sprintf("%s:log", b.Id)), data)
+
+	return err
+}
+
+// Log returns the log of the build from the chunk at the offset, and the offset of the next chunk.
+func (b *Build) Log(offset int64) (string, int64, error) {
+	chunks, err := LedisDB.LRange([]byte(fmt.Sprintf("%s:log", b.Id)), int32(offset), -1)
+	if err != nil {
+		return "", offset, err
+	}
+
+	result := []string{}
+	for _, chunk := range chunks {
+		result = append(result, string(chunk))
+	}
+
+	return strings.Join(result, ""), offset + int64(len(chunks)), nil
+}
+
+// PutBuild links the build to the repository, the oldest builds out of the history are removed.
+func (r *Repository) PutBuild(namespace, repository, id string) error {
+	buildLock.Lock()
+	defer buildLock.Unlock()
+
+	if has, _, err := r.Has(namespace, repository); err != nil {
+		return err
+	} else if has == false {
+		return fmt.Errorf("Repository not found")
+	}
+
+	for _, value := range r.Builds {
+		if value == id {
+			return nil
+		}
+	}
+
+	r.Builds = append(r.Builds, id)
+
+	for len(r.Builds) > REPOSITORY_BUILDS_HISTORY {
+		old := &Build{Id: r.Builds[0]}
+		old.Remove()
+
+		r.Builds = r.Builds[1:]
+	}
+
+	return r.Save()
+}
+
+// History returns the builds of the repository from the newest, after the build of the last id when it isn't empty.
+// At most n builds are returned when n is positive, and whether there are more builds.
+func (r *Repository) History(last string, n int) ([]*Build, bool) {
+	builds := []*Build{}
+
+	i := len(r.Builds) - 1
+
+	if len(last) > 0 {
+		for ; i >= 0; i-- {
+			if r.Builds[i] == last {
+				i--
+				break
+			}
+		}
+	}
+
+	for ; i >= 0; i-- {
+		if n > 0 && len(builds) == n {
+			return builds, true
+		}
+
+		b := new(Build)
+		if err := Get(b, []byte(r.Builds[i])); err != nil || len(b.Id) == 0 {
+			continue
+		}
+
+		builds = append(builds, b)
+	}
+
+	return builds, false
+}
+
+// DueBuilds returns the ids of the builds waiting in the queue, the oldest is the first.
+func DueBuilds(count int) ([]string, error) {
+	pairs, err := LedisDB.ZRangeByScore([]byte(GLOBAL_BUILD_QUEUE), 0, time.Now().UnixNano()/int64(time.Millisecond), 0, count)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, pair := range pairs {
+		ids = append(ids, string(pair.Member))
+	}
+
+	return ids, nil
+}
+
+// ClaimBuild takes the build out of the queue, it's false when another worker claimed it.
+func ClaimBuild(id string) (bool, error) {
+	n, err := LedisDB.ZRem([]byte(GLOBAL_BUILD_QUEUE), []byte(id))
+
+	return n == 1, err
+}
@@ -0,0 +1,237 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/containerops/wharf/utils"
+)
+
+const (
+	BUILD_RULE_BRANCH = "branch"
+	BUILD_RULE_TAG    = "tag"
+)
+
+var buildRuleTemplate = regexp.MustCompile(`\{(ref|commit|short|[0-9])\}`)
+
+// BuildRule builds the repository when a branch or a tag of the git repository matching the rule is pushed, the
+// pushes are received from the webhooks of GitHub, GitLab or Gitea.
+type BuildRule struct {
+	Id         string `json:"id"`         //
+	Namespace  string `json:"namespace"`  //
+	Repository string `json:"repository"` //
+	Git        string `json:"git"`        // URL of the git repository cloned, the pushes of the same repository are matched
+	Type       string `json:"type"`       // "branch" or "tag"
+	Ref        string `json:"ref"`        // Regular expression of the whole branch or tag name
+	Tag        string `json:"tag"`        // Template of the image tag with "{ref}", "{commit}", "{short}" and the submatches of the ref like "{1}"
+	Dockerfile string `json:"dockerfile"` // The Dockerfile of the repository or of the git repository is used when it's empty
+	Secret     string `json:"-"`          // Key of the signature or the token of the push webhooks
+	User       string `json:"user"`       // Who created the rule, the builds are submitted as the user
+	Active     bool   `json:"active"`     //
+	Created    int64  `json:"created"`    //
+	Updated    int64  `json:"updated"`    //
+}
+
+// Create checks and saves a new build rule of the repository.
+func (r *BuildRule) Create(namespace, repository, git, kind, ref, tag, dockerfile, secret, user string, active bool) error {
+	r.Id = fmt.Sprintf("buildrule:%s", uuid.NewV4().String())
+	r.Namespace, r.Repository, r.User = namespace, repository, user
+	r.Created = time.Now().UnixNano() / int64(time.Millisecond)
+
+	return r.Update(git, kind, ref, tag, dockerfile, secret, active)
+}
+
+// Update changes the build rule, the secret is kept when it's empty. The rule matches all branches with the
+// "{ref}" tag by default.
+func (r *BuildRule) Update(git, kind, ref, tag, dockerfile, secret string, active bool) error {
+	if utils.IsGitURL(git) == false {
+		return fmt.Errorf("Git URL is invalid: %s", git)
+	}
+
+	if len(kind) == 0 {
+		kind = BUILD_RULE_BRANCH
+	}
+
+	if kind != BUILD_RULE_BRANCH && kind != BUILD_RULE_TAG {
+		return fmt.Errorf("Build rule type is invalid: %s", kind)
+	}
+
+	if len(ref) == 0 {
+		ref = ".*"
+	}
+
+	if _, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", ref)); err != nil {
+		return fmt.Errorf("Build rule ref is invalid: %s", err.Error())
+	}
+
+	if len(tag) == 0 {
+		tag = "{ref}"
+	}
+
+	//The placeholders are checked as a valid tag, the tag expanded is checked again when a ref is pushed
+	if utils.IsTag(buildRuleTemplate.ReplaceAllString(tag, "a")) == false {
+		return fmt.Errorf("Build rule tag is invalid: %s", tag)
+	}
+
+	r.Git, r.Type, r.Ref, r.Tag, r.Dockerfile, r.Active = git, kind, ref, tag, dockerfile, active
+
+	if len(secret) > 0 {
+		r.Secret = secret
+	}
+
+	//Anyone could post to the push endpoint, the secret is required
+	if len(r.Secret) == 0 {
+		return fmt.Errorf("Build rule secret is required")
+	}
+
+	r.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+	return r.Save()
+}
+
+func (r *BuildRule) Save() error {
+	if err := Save(r, []byte(r.Id)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HSet([]byte(GLOBAL_BUILD_RULE_INDEX), []byte(r.Id), []byte(fmt.Sprintf("%s/%s", r.Namespace, r.Repository))); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Get returns the build rule with the id in the repository.
+func (r *BuildRule) Get(namespace, repository, id string) (bool, error) {
+	scope, err := GetByGobalId("buildrule", id)
+	if err != nil || len(scope) == 0 {
+		return false, err
+	}
+
+	if err := Get(r, []byte(id)); err != nil {
+		return false, err
+	}
+
+	return string(scope) == fmt.Sprintf("%s/%s", namespace, repository), nil
+}
+
+func (r *BuildRule) Remove() error {
+	if _, err := LedisDB.HDel([]byte(GLOBAL_BUILD_RULE_INDEX), []byte(r.Id)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HClear([]byte(r.Id)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// All returns the build rules of the repository.
+func (r *BuildRule) All(namespace, repository string) []*BuildRule {
+	return buildRules(func(scope string, rule *BuildRule) bool {
+		return scope == fmt.Sprintf("%s/%s", namespace, repository)
+	})
+}
+
+// Matched returns the active build rules of the git repository, the URLs are the clone and the web URLs of the
+// repository in the push.
+func (r *BuildRule) Matched(urls []string) []*BuildRule {
+	keys := map[string]bool{}
+
+	for _, u := range urls {
+		if key := gitRepositoryKey(u); len(key) > 0 {
+			keys[key] = true
+		}
+	}
+
+	return buildRules(func(scope string, rule *BuildRule) bool {
+		return rule.Active == true && keys[gitRepositoryKey(rule.Git)] == true
+	})
+}
+
+// Expand returns the image tag of the pushed branch or tag with the commit, it's false when the rule doesn't match
+// the ref.
+func (r *BuildRule) Expand(kind, name, commit string) (string, bool) {
+	if kind != r.Type {
+		return "", false
+	}
+
+	ref, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", r.Ref))
+	if err != nil {
+		return "", false
+	}
+
+	submatches := ref.FindStringSubmatch(name)
+	if submatches == nil {
+		return "", false
+	}
+
+	short := commit
+	if len(short) > 7 {
+		short = short[:7]
+	}
+
+	tag := buildRuleTemplate.ReplaceAllStringFunc(r.Tag, func(placeholder string) string {
+		switch value := strings.Trim(placeholder, "{}"); value {
+		case "ref":
+			return name
+		case "commit":
+			return commit
+		case "short":
+			return short
+		default:
+			if i := int(value[0] - '0'); i < len(submatches) {
+				return submatches[i]
+			}
+
+			return ""
+		}
+	})
+
+	//Branches like "feature/login" aren't valid tags
+	return strings.Replace(tag, "/", "-", -1), true
+}
+
+func buildRules(match func(scope string, rule *BuildRule) bool) []*BuildRule {
+	values, _ := LedisDB.HGetAll([]byte(GLOBAL_BUILD_RULE_INDEX))
+
+	result := []*BuildRule{}
+
+	for _, value := range values {
+		rule := new(BuildRule)
+		if err := Get(rule, value.Field); err != nil || len(rule.Id) == 0 {
+			continue
+		}
+
+		if match(string(value.Value), rule) == true {
+			result = append(result, rule)
+		}
+	}
+
+	return result
+}
+
+// gitRepositoryKey returns the host and the path of the git repository URL in lower case without ".git", the SSH
+// URLs like "git@github.com:org/app.git" are the same repository as "https://github.com/org/app".
+func gitRepositoryKey(address string) string {
+	if strings.Contains(address, "://") == false {
+		if i := strings.Index(address, ":"); i > 0 {
+			address = fmt.Sprintf("ssh://%s/%s", address[:i], address[i+1:])
+		}
+	}
+
+	u, err := url.Parse(address)
+	if err != nil || len(u.Host) == 0 {
+		return ""
+	}
+
+	path := strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+
+	return strings.ToLower(fmt.Sprintf("%s/%s", u.Hostname(), path))
+}
@@ -1,23 +1,39 @@
 package models
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/satori/go.uuid"
+
 	"github.com/containerops/wharf/utils"
 )
 
+const (
+	COMPOSE_IMAGE_FOUND              = "found"
+	COMPOSE_IMAGE_MISSING_TAG        = "missing-tag"        // The repository doesn't have the tag or the digest
+	COMPOSE_IMAGE_MISSING_REPOSITORY = "missing-repository" // The repository doesn't exist, or the user couldn't pull it
+	COMPOSE_IMAGE_EXTERNAL           = "external"           // The image is in another registry
+	COMPOSE_IMAGE_VARIABLE           = "variable"           // The image has variables substituted when it's deployed
+)
+
+var composeService = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
 type Compose struct {
 	Id            string   `json:"id"`            //
 	Compose       string   `json:"compose"`       //
 	Namespace     string   `json:"namespace"`     //
 	Organization  string   `json:"organization"`  //
-	Tags          []string `json:"tags"`          //
+	Tags          []string `json:"tags"`          // Ids of the versions, the newest pushed is the last
 	Starts        []string `json:"starts"`        //
 	Comments      []string `json:"comments"`      //
 	Short         string   `json:"short"`         //
 	Description   string   `json:"description"`   //
-	YAML          string   `json:"yaml"`          //
+	YAML          string   `json:"yaml"`          // The version pushed last
 	Download      int64    `json:"download"`      //
 	Icon          string   `json:"icon"`          //
 	Privated      bool     `json:"privated"`      //
@@ -72,3 +88,294 @@ func (compose *Compose) Log(action, level, t int64, actionId string, content []b
 
 	return nil
 }
+
+// ComposeTag is a version of the compose file.
+type ComposeTag struct {
+	Id        string `json:"id"`        //
+	Namespace string `json:"namespace"` //
+	Compose   string `json:"compose"`   //
+	Name      string `json:"name"`      //
+	YAML      string `json:"yaml"`      //
+	Digest    string `json:"digest"`    // sha256 digest of the YAML
+	User      string `json:"user"`      // Who pushed the version
+	Created   int64  `json:"created"`   //
+	Updated   int64  `json:"updated"`   //
+}
+
+// ComposeImage is the image of a service in the compose file, and whether the image is in the repositories of Wharf.
+type ComposeImage struct {
+	Service    string `json:"service"`    //
+	Image      string `json:"image"`      //
+	Namespace  string `json:"namespace"`  //
+	Repository string `json:"repository"` //
+	Tag        string `json:"tag"`        //
+	Digest     string `json:"digest"`     //
+	Status     string `json:"status"`     // "found", "missing-tag", "missing-repository", "external" or "variable"
+}
+
+// Create checks and saves a new compose of the namespace, the organization is the namespace when it's an
+// organization.
+func (c *Compose) Create(namespace, compose, short, description string, privated bool) error {
+	if utils.IsRepositoryName(fmt.Sprintf("%s/%s", namespace, compose)) == false || strings.Contains(compose, "/") == true {
+		return fmt.Errorf("Compose name is invalid: %s/%s", namespace, compose)
+	}
+
+	if has, _, err := c.Has(namespace, compose); err != nil {
+		return err
+	} else if has == true {
+		return fmt.Errorf("Compose already exist: %s/%s", namespace, compose)
+	}
+
+	org := new(Organization)
+	if has, _, err := org.Has(namespace); err != nil {
+		return err
+	} else if has == true {
+		c.Organization = namespace
+	}
+
+	c.Id = string(utils.GeneralKey(fmt.Sprintf("compose:%s:%s", namespace, compose)))
+	c.Namespace, c.Compose, c.Short, c.Description, c.Privated = namespace, compose, short, description, privated
+	c.Tags, c.Starts, c.Comments, c.Collaborators, c.Permissions, c.Memo = []string{}, []string{}, []string{}, []string{}, []string{}, []string{}
+	c.Created = time.Now().UnixNano() / int64(time.Millisecond)
+	c.Updated = c.Created
+
+	return c.Save()
+}
+
+// PutTag checks the compose file and saves it as the version, the version is replaced when it exists.
+func (c *Compose) PutTag(tag, yaml, user string) (*ComposeTag, error) {
+	if len(tag) == 0 {
+		tag = "latest"
+	}
+
+	if utils.IsTag(tag) == false {
+		return nil, fmt.Errorf("Tag is invalid: %s", tag)
+	}
+
+	if _, err := ParseCompose(yaml); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	t, exist := c.GetTag(tag)
+	if exist == false {
+		t = &ComposeTag{Id: fmt.Sprintf("composetag:%s", uuid.NewV4().String()), Namespace: c.Namespace, Compose: c.Compose, Name: tag, Created: now}
+	}
+
+	t.YAML, t.User, t.Updated = yaml, user, now
+	t.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(yaml)))
+
+	if err := Save(t, []byte(t.Id)); err != nil {
+		return nil, err
+	}
+
+	c.Tags = append(removeValue(c.Tags, t.Id), t.Id)
+	c.YAML, c.Updated = yaml, now
+
+	if err := c.Save(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// GetTag returns the version of the compose file.
+func (c *Compose) GetTag(tag string) (*ComposeTag, bool) {
+	for _, t := range c.Versions() {
+		if t.Name == tag {
+			return t, true
+		}
+	}
+
+	return nil, false
+}
+
+// Versions returns the versions of the compose file, the newest pushed is the first.
+func (c *Compose) Versions() []*ComposeTag {
+	result := []*ComposeTag{}
+
+	for i := len(c.Tags) - 1; i >= 0; i-- {
+		t := new(ComposeTag)
+		if err := Get(t, []byte(c.Tags[i])); err != nil || len(t.Id) == 0 {
+			continue
+		}
+
+		result = append(result, t)
+	}
+
+	return result
+}
+
+// Delete removes the versions and the compose.
+func (c *Compose) Delete() error {
+	for _, id := range c.Tags {
+		LedisDB.HClear([]byte(id))
+	}
+
+	if _, err := LedisDB.HDel([]byte(GLOBAL_COMPOSE_INDEX), []byte(fmt.Sprintf("%s:%s", c.Namespace, c.Compose))); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HClear([]byte(c.Id)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// All returns the composes of the namespace.
+func (c *Compose) All(namespace string) []*Compose {
+	values, _ := LedisDB.HGetAll([]byte(GLOBAL_COMPOSE_INDEX))
+
+	result := []*Compose{}
+
+	for _, value := range values {
+		if strings.HasPrefix(string(value.Field), fmt.Sprintf("%s:", namespace)) == false {
+			continue
+		}
+
+		compose := new(Compose)
+		if err := Get(compose, value.Value); err != nil || len(compose.Id) == 0 {
+			continue
+		}
+
+		result = append(result, compose)
+	}
+
+	return result
+}
+
+// ParseCompose checks the compose file and returns the images of the services sorted by the name. The services are
+// in "services", or at the top level of the version 1 files without "version". A service has the image or the build.
+func ParseCompose(yaml string) ([]*ComposeImage, error) {
+	if len(strings.TrimSpace(yaml)) == 0 {
+		return nil, fmt.Errorf("Compose file is empty")
+	}
+
+	document, err := utils.ParseYAML([]byte(yaml))
+	if err != nil {
+		return nil, fmt.Errorf("Compose file is invalid: %s", err.Error())
+	}
+
+	root, ok := document.(map[string]interface{})
+	if ok == false {
+		return nil, fmt.Errorf("Compose file must be a mapping")
+	}
+
+	services := root
+
+	_, versioned := root["version"]
+	if _, exist := root["services"]; exist == true || versioned == true {
+		versioned = true
+
+		if services, ok = root["services"].(map[string]interface{}); ok == false || len(services) == 0 {
+			return nil, fmt.Errorf("Compose file has no services")
+		}
+	}
+
+	names := []string{}
+	for name := range services {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	images := []*ComposeImage{}
+
+	for _, name := range names {
+		//Extension fields like "x-logging" aren't services
+		if strings.HasPrefix(name, "x-") == true && versioned == false {
+			continue
+		}
+
+		if composeService.MatchString(name) == false {
+			return nil, fmt.Errorf("Service name is invalid: %s", name)
+		}
+
+		service, ok := services[name].(map[string]interface{})
+		if ok == false {
+			return nil, fmt.Errorf("Service %s must be a mapping", name)
+		}
+
+		image, _ := service["image"].(string)
+
+		if _, exist := service["image"]; exist == true && len(image) == 0 {
+			return nil, fmt.Errorf("Service %s image is invalid", name)
+		}
+
+		if len(image) == 0 {
+			if service["build"] == nil {
+				return nil, fmt.Errorf("Service %s has neither image nor build", name)
+			}
+
+			continue
+		}
+
+		images = append(images, &ComposeImage{Service: name, Image: image})
+	}
+
+	return images, nil
+}
+
+// Resolve finds the image in the repositories of Wharf at the endpoint, the images without the registry are in
+// Wharf too. The repositories the user couldn't pull are missing.
+func (i *ComposeImage) Resolve(endpoint string, readable func(namespace, repository string) bool) {
+	if strings.Contains(i.Image, "$") == true {
+		i.Status = COMPOSE_IMAGE_VARIABLE
+		return
+	}
+
+	name := i.Image
+
+	if index := strings.Index(name, "@"); index >= 0 {
+		name, i.Digest = name[:index], name[index+1:]
+	}
+
+	if index := strings.LastIndex(name, ":"); index > strings.LastIndex(name, "/") {
+		name, i.Tag = name[:index], name[index+1:]
+	}
+
+	if len(i.Tag) == 0 && len(i.Digest) == 0 {
+		i.Tag = "latest"
+	}
+
+	if parts := strings.SplitN(name, "/", 2); len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") == true || parts[0] == "localhost") {
+		if strings.EqualFold(parts[0], endpoint) == false {
+			i.Status = COMPOSE_IMAGE_EXTERNAL
+			return
+		}
+
+		name = parts[1]
+	}
+
+	//Official images like "ubuntu" are in the "library" namespace
+	if strings.Contains(name, "/") == false {
+		name = fmt.Sprintf("library/%s", name)
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	i.Namespace, i.Repository = parts[0], parts[1]
+
+	repo := new(Repository)
+	if has, _, err := repo.Has(i.Namespace, i.Repository); err != nil || has == false || readable(i.Namespace, i.Repository) == false {
+		i.Status = COMPOSE_IMAGE_MISSING_REPOSITORY
+		return
+	}
+
+	if len(i.Digest) > 0 {
+		if has, _, err := new(Manifest).Has(i.Namespace, i.Repository, i.Digest); err != nil || has == false {
+			i.Status = COMPOSE_IMAGE_MISSING_TAG
+			return
+		}
+	}
+
+	if len(i.Tag) > 0 {
+		if has, _, err := new(Tag).Has(i.Namespace, i.Repository, i.Tag); err != nil || has == false {
+			i.Status = COMPOSE_IMAGE_MISSING_TAG
+			return
+		}
+	}
+
+	i.Status = COMPOSE_IMAGE_FOUND
+}
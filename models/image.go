@@ -91,6 +91,24 @@ func (i *Image) Remove() (err error) {
 	return nil
 }
 
+func (i *Image) RemoveTarsum(tarsum string) error {
+	if has, _, err := i.HasTarsum(tarsum); err != nil {
+		return err
+	} else if has == false {
+		return nil
+	}
+
+	if _, err := LedisDB.HSet([]byte(fmt.Sprintf("%s_remove", GLOBAL_TARSUM_INDEX)), []byte(tarsum), []byte(i.Id)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HDel([]byte(GLOBAL_TARSUM_INDEX), []byte(tarsum)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (i *Image) Pushed(imageId string) (bool, error) {
 	if has, _, err := i.Has(imageId); err != nil {
 		return false, err
@@ -148,13 +166,13 @@ func (i *Image) PutJSON(imageId, json string, version int64) error {
 	return nil
 }
 
-func (i *Image) PutLayer(imageId string, path string, uploaded bool, size int64) error {
+func (i *Image) PutLayer(imageId string, backend, path string, uploaded bool, size int64) error {
 	if has, _, err := i.Has(imageId); err != nil {
 		return err
 	} else if has == false {
 		return fmt.Errorf("Image not found")
 	} else {
-		i.Path, i.Uploaded, i.Size, i.Updated = path, uploaded, size, time.Now().UnixNano()/int64(time.Millisecond)
+		i.Backend, i.Path, i.Uploaded, i.Size, i.Updated = backend, path, uploaded, size, time.Now().UnixNano()/int64(time.Millisecond)
 
 		if err := i.Save(); err != nil {
 			return err
@@ -0,0 +1,414 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerops/wharf/utils"
+)
+
+const (
+	MEDIATYPE_MANIFEST_V1        = "application/vnd.docker.distribution.manifest.v1+json"
+	MEDIATYPE_MANIFEST_V1_SIGNED = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	MEDIATYPE_MANIFEST_V2        = "application/vnd.docker.distribution.manifest.v2+json"
+	MEDIATYPE_MANIFEST_LIST      = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MEDIATYPE_IMAGE_CONFIG       = "application/vnd.docker.container.image.v1+json"
+	MEDIATYPE_LAYER              = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	MEDIATYPE_OCI_MANIFEST = "application/vnd.oci.image.manifest.v1+json"
+	MEDIATYPE_OCI_INDEX    = "application/vnd.oci.image.index.v1+json"
+	MEDIATYPE_OCI_CONFIG   = "application/vnd.oci.image.config.v1+json"
+	MEDIATYPE_OCI_LAYER    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MEDIATYPE_OCI_EMPTY    = "application/vnd.oci.empty.v1+json"
+)
+
+// Manifest is a Docker Registry API V2 manifest saved by digest, tags point to it with Tag.Digest.
+type Manifest struct {
+	Id         string   `json:"id"`         //
+	Digest     string   `json:"digest"`     // sha256 of Data
+	Namespace  string   `json:"namespace"`  //
+	Repository string   `json:"repository"` //
+	MediaType  string   `json:"mediatype"`  //
+	Subject    string   `json:"subject"`    // Digest of the OCI subject manifest
+	Artifact   string   `json:"artifact"`   // OCI artifact type
+	Data       string   `json:"data"`       //
+	Size       int64    `json:"size"`       //
+	Created    int64    `json:"created"`    //
+	Updated    int64    `json:"updated"`    //
+	Memo       []string `json:"memo"`       //
+}
+
+// Descriptor references a blob or a manifest in schema2 manifests, manifest lists and OCI manifests and indexes.
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Size         int64             `json:"size"`
+	Digest       string            `json:"digest"`
+	URLs         []string          `json:"urls,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Platform     *Platform         `json:"platform,omitempty"`
+}
+
+type Platform struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+	Features     []string `json:"features,omitempty"`
+}
+
+type manifestContent struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType"`
+	Config        *Descriptor       `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Manifests     []Descriptor      `json:"manifests"`
+	Subject       *Descriptor       `json:"subject"`
+	Annotations   map[string]string `json:"annotations"`
+	FSLayers      []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+	Signatures []interface{} `json:"signatures"`
+}
+
+// ManifestMediaType detects the media type from the content of manifest, it's empty when the content is invalid.
+func ManifestMediaType(data []byte) string {
+	var content manifestContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return ""
+	}
+
+	switch content.SchemaVersion {
+	case 1:
+		if len(content.Signatures) > 0 {
+			return MEDIATYPE_MANIFEST_V1_SIGNED
+		}
+
+		return MEDIATYPE_MANIFEST_V1
+	case 2:
+		if len(content.MediaType) > 0 {
+			return content.MediaType
+		}
+
+		//The mediaType is optional in OCI manifests and indexes
+		if content.Manifests != nil {
+			return MEDIATYPE_OCI_INDEX
+		}
+
+		return MEDIATYPE_OCI_MANIFEST
+	}
+
+	return ""
+}
+
+// ManifestDigest returns the sha256 digest of the manifest. The digest of a signed schema1 manifest is the digest of
+// its payload without the signatures, the same as Docker clients compute.
+func ManifestDigest(data []byte) string {
+	if payload, err := ManifestPayload(data); err == nil {
+		data = payload
+	}
+
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// ManifestPayload returns the payload of a signed schema1 manifest, which is the manifest before the "formatLength"
+// of the JWS protected header and the "formatTail" after it.
+func ManifestPayload(data []byte) ([]byte, error) {
+	var signed struct {
+		SchemaVersion int `json:"schemaVersion"`
+		Signatures    []struct {
+			Protected string `json:"protected"`
+		} `json:"signatures"`
+	}
+
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, err
+	}
+
+	if signed.SchemaVersion != 1 || len(signed.Signatures) == 0 {
+		return nil, fmt.Errorf("Manifest isn't signed schema1")
+	}
+
+	protected, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(signed.Signatures[0].Protected, "="))
+	if err != nil {
+		return nil, err
+	}
+
+	var header struct {
+		FormatLength int    `json:"formatLength"`
+		FormatTail   string `json:"formatTail"`
+	}
+
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return nil, err
+	}
+
+	tail, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(header.FormatTail, "="))
+	if err != nil {
+		return nil, err
+	}
+
+	if header.FormatLength <= 0 || header.FormatLength > len(data) {
+		return nil, fmt.Errorf("Manifest signature formatLength is invalid: %d", header.FormatLength)
+	}
+
+	payload := append([]byte{}, data[:header.FormatLength]...)
+
+	return append(payload, tail...), nil
+}
+
+func (m *Manifest) Has(namespace, repository, digest string) (bool, []byte, error) {
+	id, err := GetByGobalId("manifest", fmt.Sprintf("%s:%s:%s", namespace, repository, digest))
+	if err != nil {
+		return false, nil, err
+	}
+
+	if len(id) <= 0 {
+		return false, nil, nil
+	}
+
+	err = Get(m, id)
+
+	return true, id, err
+}
+
+func (m *Manifest) Put(namespace, repository, mediaType string, data []byte) error {
+	digest := ManifestDigest(data)
+
+	if has, _, err := m.Has(namespace, repository, digest); err != nil {
+		return err
+	} else if has == false {
+		m.Id = string(utils.GeneralKey(fmt.Sprintf("%s:%s:%s", namespace, repository, digest)))
+		m.Created = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+
+	m.Digest, m.Namespace, m.Repository, m.MediaType = digest, namespace, repository, mediaType
+	m.Data, m.Size = string(data), int64(len(data))
+	m.Subject, m.Artifact = "", ""
+
+	var content manifestContent
+	if err := json.Unmarshal(data, &content); err == nil {
+		if content.Subject != nil {
+			m.Subject = content.Subject.Digest
+		}
+
+		//The config media type is the artifact type when the artifactType is empty
+		m.Artifact = content.ArtifactType
+		if len(m.Artifact) == 0 && content.Config != nil && mediaType == MEDIATYPE_OCI_MANIFEST {
+			m.Artifact = content.Config.MediaType
+		}
+	}
+
+	m.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+	if err := m.Save(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *Manifest) Save() error {
+	if err := Save(m, []byte(m.Id)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HSet([]byte(GLOBAL_MANIFEST_INDEX), []byte(fmt.Sprintf("%s:%s:%s", m.Namespace, m.Repository, m.Digest)), []byte(m.Id)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HSet(repositoryManifestsKey(m.Namespace, m.Repository), []byte(m.Digest), []byte(m.Id)); err != nil {
+		return err
+	}
+
+	//The referrers of a subject are listed without scanning all manifests
+	if len(m.Subject) > 0 {
+		if _, err := LedisDB.HSet(referrersKey(m.Namespace, m.Repository, m.Subject), []byte(m.Id), []byte(m.Digest)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Manifest) Remove() error {
+	if _, err := LedisDB.HSet([]byte(fmt.Sprintf("%s_remove", GLOBAL_MANIFEST_INDEX)), []byte(fmt.Sprintf("%s:%s:%s", m.Namespace, m.Repository, m.Digest)), []byte(m.Id)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HDel([]byte(GLOBAL_MANIFEST_INDEX), []byte(fmt.Sprintf("%s:%s:%s", m.Namespace, m.Repository, m.Digest))); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HDel(repositoryManifestsKey(m.Namespace, m.Repository), []byte(m.Digest)); err != nil {
+		return err
+	}
+
+	if len(m.Subject) > 0 {
+		if _, err := LedisDB.HDel(referrersKey(m.Namespace, m.Repository, m.Subject), []byte(m.Id)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Manifest) All() []*Manifest {
+	values, _ := LedisDB.HGetAll([]byte(GLOBAL_MANIFEST_INDEX))
+
+	manifests := make([]*Manifest, 0)
+
+	for _, value := range values {
+		manifest := new(Manifest)
+		if err := Get(manifest, value.Value); err != nil {
+			continue
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	return manifests
+}
+
+// InRepository returns the manifests of the repository, they are indexed by the repository when they are saved.
+func (m *Manifest) InRepository(namespace, repository string) []*Manifest {
+	values, _ := LedisDB.HGetAll(repositoryManifestsKey(namespace, repository))
+
+	manifests := make([]*Manifest, 0)
+
+	for _, value := range values {
+		manifest := new(Manifest)
+		if err := Get(manifest, value.Value); err != nil || len(manifest.Id) == 0 {
+			continue
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	return manifests
+}
+
+// IndexManifests indexes the manifests saved before they were indexed by the repository, and returns the count of the
+// manifests indexed.
+func IndexManifests() (int, error) {
+	count := 0
+
+	for _, manifest := range new(Manifest).All() {
+		if value, _ := LedisDB.HGet(repositoryManifestsKey(manifest.Namespace, manifest.Repository), []byte(manifest.Digest)); len(value) > 0 {
+			continue
+		}
+
+		if _, err := LedisDB.HSet(repositoryManifestsKey(manifest.Namespace, manifest.Repository), []byte(manifest.Digest), []byte(manifest.Id)); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// Blobs returns the digests of the config and layer blobs referenced by the manifest.
+func (m *Manifest) Blobs() ([]string, error) {
+	var content manifestContent
+	if err := json.Unmarshal([]byte(m.Data), &content); err != nil {
+		return nil, err
+	}
+
+	blobs := []string{}
+
+	switch m.MediaType {
+	case MEDIATYPE_MANIFEST_V1, MEDIATYPE_MANIFEST_V1_SIGNED:
+		if len(content.FSLayers) != len(content.History) {
+			return nil, fmt.Errorf("Manifest fsLayers and history length mismatch")
+		}
+
+		for _, layer := range content.FSLayers {
+			blobs = append(blobs, layer.BlobSum)
+		}
+	case MEDIATYPE_MANIFEST_V2, MEDIATYPE_OCI_MANIFEST:
+		if content.Config == nil {
+			return nil, fmt.Errorf("Manifest config is invalid")
+		}
+
+		blobs = append(blobs, content.Config.Digest)
+
+		for _, layer := range content.Layers {
+			blobs = append(blobs, layer.Digest)
+		}
+	case MEDIATYPE_MANIFEST_LIST, MEDIATYPE_OCI_INDEX:
+	default:
+		return nil, fmt.Errorf("Unsupported manifest media type: %s", m.MediaType)
+	}
+
+	return blobs, nil
+}
+
+// References returns the manifests referenced by a manifest list or an OCI index.
+func (m *Manifest) References() ([]Descriptor, error) {
+	var content manifestContent
+	if err := json.Unmarshal([]byte(m.Data), &content); err != nil {
+		return nil, err
+	}
+
+	if m.MediaType != MEDIATYPE_MANIFEST_LIST && m.MediaType != MEDIATYPE_OCI_INDEX {
+		return []Descriptor{}, nil
+	}
+
+	return content.Manifests, nil
+}
+
+// Config returns the config descriptor and the layer descriptors of a schema2 or OCI manifest.
+func (m *Manifest) Config() (*Descriptor, []Descriptor, error) {
+	var content manifestContent
+	if err := json.Unmarshal([]byte(m.Data), &content); err != nil {
+		return nil, nil, err
+	}
+
+	if (m.MediaType != MEDIATYPE_MANIFEST_V2 && m.MediaType != MEDIATYPE_OCI_MANIFEST) || content.Config == nil {
+		return nil, nil, fmt.Errorf("Manifest isn't a schema2 or OCI manifest")
+	}
+
+	return content.Config, content.Layers, nil
+}
+
+// Referrers returns the descriptors of the manifests in the repository which subject is the digest, the referrers are
+// indexed by the subject when they are saved.
+func (m *Manifest) Referrers(namespace, repository, digest string) []Descriptor {
+	result := []Descriptor{}
+
+	values, _ := LedisDB.HGetAll(referrersKey(namespace, repository, digest))
+
+	for _, value := range values {
+		manifest := new(Manifest)
+		if err := Get(manifest, value.Field); err != nil || len(manifest.Id) == 0 {
+			continue
+		}
+
+		descriptor := Descriptor{MediaType: manifest.MediaType, ArtifactType: manifest.Artifact, Size: manifest.Size, Digest: manifest.Digest}
+
+		var content manifestContent
+		if err := json.Unmarshal([]byte(manifest.Data), &content); err == nil {
+			descriptor.Annotations = content.Annotations
+		}
+
+		result = append(result, descriptor)
+	}
+
+	return result
+}
+
+func repositoryManifestsKey(namespace, repository string) []byte {
+	return []byte(fmt.Sprintf("repomanifests:%s/%s", namespace, repository))
+}
+
+func referrersKey(namespace, repository, subject string) []byte {
+	return []byte(fmt.Sprintf("referrers:%s:%s:%s", namespace, repository, subject))
+}
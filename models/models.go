@@ -26,6 +26,26 @@ const (
 	GLOBAL_ADMIN_INDEX        = "GLOBAL_ADMIN_INDEX"
 	GLOBAL_PRIVILEGE_INDEX    = "GLOBAL_PRIVILEGE_INDEX"
 	GLOBAL_LOG_INDEX          = "GLOBAL_LOG_INDEX"
+	GLOBAL_UPLOAD_INDEX       = "GLOBAL_UPLOAD_INDEX"
+	GLOBAL_MANIFEST_INDEX     = "GLOBAL_MANIFEST_INDEX"
+
+	GLOBAL_ACCESSTOKEN_INDEX        = "GLOBAL_ACCESSTOKEN_INDEX"
+	GLOBAL_ACCESSTOKEN_SECRET_INDEX = "GLOBAL_ACCESSTOKEN_SECRET_INDEX"
+	GLOBAL_IDENTITY_INDEX           = "GLOBAL_IDENTITY_INDEX"
+
+	GLOBAL_WEBHOOK_INDEX = "GLOBAL_WEBHOOK_INDEX"
+	GLOBAL_WEBHOOK_QUEUE = "GLOBAL_WEBHOOK_QUEUE" // Sorted set of the delivery ids scored by the next attempt
+
+	GLOBAL_PROXY_INDEX      = "GLOBAL_PROXY_INDEX"      // When the repositories and tags were fetched from the upstream registry
+	GLOBAL_PROXY_BLOB_INDEX = "GLOBAL_PROXY_BLOB_INDEX" // The upstream repository of the blobs
+
+	GLOBAL_REPLICATION_INDEX = "GLOBAL_REPLICATION_INDEX"
+	GLOBAL_REPLICATION_QUEUE = "GLOBAL_REPLICATION_QUEUE" // Sorted set of the job ids scored by the next attempt
+
+	GLOBAL_BUILD_INDEX = "GLOBAL_BUILD_INDEX"
+	GLOBAL_BUILD_QUEUE = "GLOBAL_BUILD_QUEUE" // Sorted set of the build ids scored by the time submitted
+
+	GLOBAL_BUILD_RULE_INDEX = "GLOBAL_BUILD_RULE_INDEX"
 )
 
 var (
@@ -78,6 +98,28 @@ func GetByGobalId(ObjectType, Object string) (Id []byte, err error) {
 		index = GLOBAL_ADMIN_INDEX
 	case "log":
 		index = GLOBAL_LOG_INDEX
+	case "upload":
+		index = GLOBAL_UPLOAD_INDEX
+	case "manifest":
+		index = GLOBAL_MANIFEST_INDEX
+	case "accesstoken":
+		index = GLOBAL_ACCESSTOKEN_INDEX
+	case "accesstoken_secret":
+		index = GLOBAL_ACCESSTOKEN_SECRET_INDEX
+	case "identity":
+		index = GLOBAL_IDENTITY_INDEX
+	case "webhook":
+		index = GLOBAL_WEBHOOK_INDEX
+	case "proxy":
+		index = GLOBAL_PROXY_INDEX
+	case "proxy_blob":
+		index = GLOBAL_PROXY_BLOB_INDEX
+	case "replication":
+		index = GLOBAL_REPLICATION_INDEX
+	case "build":
+		index = GLOBAL_BUILD_INDEX
+	case "buildrule":
+		index = GLOBAL_BUILD_RULE_INDEX
 	default:
 
 	}
@@ -90,6 +132,18 @@ func GetByGobalId(ObjectType, Object string) (Id []byte, err error) {
 
 }
 
+func removeValue(values []string, value string) []string {
+	result := []string{}
+
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
 func Save(obj interface{}, key []byte) (err error) {
 	s := reflect.TypeOf(obj).Elem()
 
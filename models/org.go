@@ -63,6 +63,23 @@ func (org *Organization) GetByName(name string) error {
 	return nil
 }
 
+// GetTeams returns the teams of the organization, which are saved with the team id or the team name.
+func (org *Organization) GetTeams() []*Team {
+	teams := make([]*Team, 0)
+
+	for _, key := range org.Teams {
+		team := new(Team)
+
+		if has, _, err := team.Has(org.Name, key); err == nil && has == true {
+			teams = append(teams, team)
+		} else if err := team.GetById(key); err == nil && len(team.Id) > 0 {
+			teams = append(teams, team)
+		}
+	}
+
+	return teams
+}
+
 func (org *Organization) Remove() error {
 	if _, err := LedisDB.HSet([]byte(fmt.Sprintf("%s_remove", GLOBAL_ORGANIZATION_INDEX)), []byte(org.Name), []byte(org.Id)); err != nil {
 		return err
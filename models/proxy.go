@@ -0,0 +1,65 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerops/wharf/utils"
+)
+
+// PutProxyFetched records the repository or the tag was fetched from the upstream registry now, the tag is empty for
+// the repository.
+func PutProxyFetched(namespace, repository, tag string) error {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	if _, err := LedisDB.HSet([]byte(GLOBAL_PROXY_INDEX), []byte(proxyKey(namespace, repository, tag)), utils.Int64ToBytes(now)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ProxyFetched returns when the repository or the tag was fetched from the upstream registry in milliseconds, it's 0
+// when never fetched.
+func ProxyFetched(namespace, repository, tag string) (int64, error) {
+	value, err := GetByGobalId("proxy", proxyKey(namespace, repository, tag))
+	if err != nil || len(value) == 0 {
+		return 0, err
+	}
+
+	return utils.BytesToInt64(value), nil
+}
+
+// PutProxyBlob records the upstream repository of the blob, Docker Registry API V1 pulls the layer only with the
+// image id. The blob is linked to the repository to be pulled with Docker Registry API V2.
+func PutProxyBlob(digest, namespace, repository string) error {
+	if _, err := LedisDB.HSet([]byte(GLOBAL_PROXY_BLOB_INDEX), []byte(digest), []byte(fmt.Sprintf("%s/%s", namespace, repository))); err != nil {
+		return err
+	}
+
+	return LinkBlob(namespace, repository, digest)
+}
+
+// ProxyBlob returns the namespace and the repository the blob was fetched from, they are empty when unknown.
+func ProxyBlob(digest string) (string, string, error) {
+	value, err := GetByGobalId("proxy_blob", digest)
+	if err != nil || len(value) == 0 {
+		return "", "", err
+	}
+
+	parts := strings.SplitN(string(value), "/", 2)
+	if len(parts) != 2 {
+		return "", "", nil
+	}
+
+	return parts[0], parts[1], nil
+}
+
+func proxyKey(namespace, repository, tag string) string {
+	if len(tag) == 0 {
+		return fmt.Sprintf("%s:%s", namespace, repository)
+	}
+
+	return fmt.Sprintf("%s:%s:%s", namespace, repository, tag)
+}
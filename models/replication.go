@@ -0,0 +1,357 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/siddontang/ledisdb/ledis"
+)
+
+const (
+	REPLICATION_TRIGGER_PUSH = "push"
+	REPLICATION_TRIGGER_SYNC = "sync"
+
+	REPLICATION_STATUS_PENDING   = "pending"
+	REPLICATION_STATUS_RUNNING   = "running"
+	REPLICATION_STATUS_SUCCEEDED = "succeeded"
+	REPLICATION_STATUS_FAILED    = "failed"
+
+	//Jobs kept in the history of a replication, older ones are removed
+	REPLICATION_JOBS_HISTORY = 100
+)
+
+var replicationLock sync.Mutex
+
+// Replication copies the tags of the repositories in the namespace to another registry with Docker Registry API V2.
+type Replication struct {
+	Id         string   `json:"id"`         //
+	Namespace  string   `json:"namespace"`  //
+	Repository string   `json:"repository"` // Pattern of the repository names like "web/*", all repositories when empty
+	Tags       string   `json:"tags"`       // Pattern of the tags like "v*", all tags when empty
+	Endpoint   string   `json:"endpoint"`   // URL of the target registry like "https://dc2.example.com"
+	Username   string   `json:"username"`   //
+	Password   string   `json:"-"`          //
+	Active     bool     `json:"active"`     //
+	Jobs       []string `json:"-"`          // Ids of the recent jobs, the newest is the last
+	Synced     int64    `json:"synced"`     // When the last full sync started
+	Created    int64    `json:"created"`    //
+	Updated    int64    `json:"updated"`    //
+}
+
+// ReplicationJob copies a tag with the manifests and the blobs, failed jobs are retried until the attempts run out.
+type ReplicationJob struct {
+	Id          string `json:"id"`          //
+	Replication string `json:"replication"` //
+	Namespace   string `json:"namespace"`   //
+	Repository  string `json:"repository"`  //
+	Tag         string `json:"tag"`         //
+	Digest      string `json:"digest"`      // Digest of the manifest copied
+	Trigger     string `json:"trigger"`     // "push" or "sync"
+	Status      string `json:"status"`      // "pending", "running", "succeeded" or "failed"
+	Attempts    int64  `json:"attempts"`    //
+	NextAttempt int64  `json:"nextattempt"` // Milliseconds
+	Blobs       int64  `json:"blobs"`       // Blobs uploaded by the last attempt, the target has the others already
+	Error       string `json:"error"`       //
+	Duration    int64  `json:"duration"`    // Milliseconds of the last attempt
+	Created     int64  `json:"created"`     //
+	Updated     int64  `json:"updated"`     //
+}
+
+// Create checks and saves a new replication of the namespace.
+func (r *Replication) Create(namespace, repository, tags, endpoint, username, password string, active bool) error {
+	r.Id = fmt.Sprintf("replication:%s", uuid.NewV4().String())
+	r.Namespace = namespace
+	r.Created = time.Now().UnixNano() / int64(time.Millisecond)
+
+	return r.Update(repository, tags, endpoint, username, password, active)
+}
+
+// Update changes the replication, the password is kept when it's empty.
+func (r *Replication) Update(repository, tags, endpoint, username, password string, active bool) error {
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("Replication endpoint is invalid: %s", endpoint)
+	}
+
+	for _, pattern := range []string{repository, tags} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Replication pattern is invalid: %s", pattern)
+		}
+	}
+
+	r.Repository, r.Tags, r.Endpoint, r.Username, r.Active = repository, tags, endpoint, username, active
+
+	if len(password) > 0 {
+		r.Password = password
+	}
+
+	if r.Jobs == nil {
+		r.Jobs = []string{}
+	}
+
+	r.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+	return r.Save()
+}
+
+func (r *Replication) Save() error {
+	if err := Save(r, []byte(r.Id)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HSet([]byte(GLOBAL_REPLICATION_INDEX), []byte(r.Id), []byte(r.Namespace)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Get returns the replication with the id in the namespace.
+func (r *Replication) Get(namespace, id string) (bool, error) {
+	scope, err := GetByGobalId("replication", id)
+	if err != nil || len(scope) == 0 {
+		return false, err
+	}
+
+	if err := Get(r, []byte(id)); err != nil {
+		return false, err
+	}
+
+	return string(scope) == namespace, nil
+}
+
+func (r *Replication) GetById(id string) error {
+	return Get(r, []byte(id))
+}
+
+func (r *Replication) Remove() error {
+	if _, err := LedisDB.HDel([]byte(GLOBAL_REPLICATION_INDEX), []byte(r.Id)); err != nil {
+		return err
+	}
+
+	for _, id := range r.Jobs {
+		LedisDB.HClear([]byte(id))
+		LedisDB.ZRem([]byte(GLOBAL_REPLICATION_QUEUE), []byte(id))
+	}
+
+	if _, err := LedisDB.HClear([]byte(r.Id)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// All returns the replications of the namespace, or of all namespaces when it's empty.
+func (r *Replication) All(namespace string) []*Replication {
+	values, _ := LedisDB.HGetAll([]byte(GLOBAL_REPLICATION_INDEX))
+
+	result := []*Replication{}
+
+	for _, value := range values {
+		if len(namespace) > 0 && string(value.Value) != namespace {
+			continue
+		}
+
+		replication := new(Replication)
+		if err := Get(replication, value.Field); err != nil {
+			continue
+		}
+
+		result = append(result, replication)
+	}
+
+	return result
+}
+
+// Matched returns the active replications of the namespace which want the tag of the repository.
+func (r *Replication) Matched(namespace, repository, tag string) []*Replication {
+	result := []*Replication{}
+
+	for _, replication := range r.All(namespace) {
+		if replication.Active == true && replication.Wants(repository, tag) == true {
+			result = append(result, replication)
+		}
+	}
+
+	return result
+}
+
+// Wants returns whether the repository and the tag match the patterns.
+func (r *Replication) Wants(repository, tag string) bool {
+	if len(r.Repository) > 0 {
+		if matched, _ := path.Match(r.Repository, repository); matched == false {
+			return false
+		}
+	}
+
+	if len(r.Tags) > 0 {
+		if matched, _ := path.Match(r.Tags, tag); matched == false {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Enqueue saves a pending job of the tag and puts it in the queue, the oldest jobs out of the history are removed.
+func (r *Replication) Enqueue(trigger, repository, tag string) (*ReplicationJob, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	job := &ReplicationJob{
+		Id:          fmt.Sprintf("replicationjob:%s", uuid.NewV4().String()),
+		Replication: r.Id,
+		Namespace:   r.Namespace,
+		Repository:  repository,
+		Tag:         tag,
+		Trigger:     trigger,
+		Status:      REPLICATION_STATUS_PENDING,
+		NextAttempt: now,
+		Created:     now,
+		Updated:     now,
+	}
+
+	if err := job.Save(); err != nil {
+		return nil, err
+	}
+
+	//Jobs of the same replication are enqueued concurrently by pushes and the full sync
+	replicationLock.Lock()
+	defer replicationLock.Unlock()
+
+	if err := Get(r, []byte(r.Id)); err != nil {
+		return nil, err
+	}
+
+	r.Jobs = append(r.Jobs, job.Id)
+
+	//Jobs waiting or running are kept, the full sync may enqueue more jobs than the history
+	for i := 0; len(r.Jobs) > REPLICATION_JOBS_HISTORY && i < len(r.Jobs); {
+		old := new(ReplicationJob)
+		if err := Get(old, []byte(r.Jobs[i])); err == nil && (old.Status == REPLICATION_STATUS_PENDING || old.Status == REPLICATION_STATUS_RUNNING) {
+			i++
+			continue
+		}
+
+		LedisDB.HClear([]byte(r.Jobs[i]))
+		r.Jobs = append(r.Jobs[:i], r.Jobs[i+1:]...)
+	}
+
+	if err := r.Save(); err != nil {
+		return nil, err
+	}
+
+	if err := job.Schedule(now); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// MarkSynced saves the time the full sync started in milliseconds.
+func (r *Replication) MarkSynced(at int64) error {
+	replicationLock.Lock()
+	defer replicationLock.Unlock()
+
+	if err := Get(r, []byte(r.Id)); err != nil {
+		return err
+	}
+
+	r.Synced = at
+
+	return r.Save()
+}
+
+// Pending returns whether a job of the tag is waiting in the queue, the full sync doesn't enqueue it again. Running
+// jobs aren't counted, they may be stopped by a restart.
+func (r *Replication) Pending(repository, tag string) bool {
+	for _, id := range r.Jobs {
+		job := new(ReplicationJob)
+		if err := Get(job, []byte(id)); err != nil || len(job.Id) == 0 {
+			continue
+		}
+
+		if job.Repository == repository && job.Tag == tag && job.Status == REPLICATION_STATUS_PENDING {
+			return true
+		}
+	}
+
+	return false
+}
+
+// History returns the recent jobs, the newest is the first.
+func (r *Replication) History() []*ReplicationJob {
+	result := []*ReplicationJob{}
+
+	for i := len(r.Jobs) - 1; i >= 0; i-- {
+		job := new(ReplicationJob)
+		if err := Get(job, []byte(r.Jobs[i])); err != nil || len(job.Id) == 0 {
+			continue
+		}
+
+		result = append(result, job)
+	}
+
+	return result
+}
+
+// Status counts the recent jobs by the status.
+func (r *Replication) Status() map[string]int64 {
+	result := map[string]int64{
+		REPLICATION_STATUS_PENDING:   0,
+		REPLICATION_STATUS_RUNNING:   0,
+		REPLICATION_STATUS_SUCCEEDED: 0,
+		REPLICATION_STATUS_FAILED:    0,
+	}
+
+	for _, job := range r.History() {
+		result[job.Status]++
+	}
+
+	return result
+}
+
+func (j *ReplicationJob) Get(id string) error {
+	return Get(j, []byte(id))
+}
+
+func (j *ReplicationJob) Save() error {
+	return Save(j, []byte(j.Id))
+}
+
+// Schedule puts the job in the queue at the time in milliseconds.
+func (j *ReplicationJob) Schedule(at int64) error {
+	j.Status, j.NextAttempt = REPLICATION_STATUS_PENDING, at
+
+	if err := j.Save(); err != nil {
+		return err
+	}
+
+	_, err := LedisDB.ZAdd([]byte(GLOBAL_REPLICATION_QUEUE), ledis.ScorePair{Score: at, Member: []byte(j.Id)})
+
+	return err
+}
+
+// DueReplicationJobs returns the ids of the jobs to attempt before the time in milliseconds.
+func DueReplicationJobs(now int64, count int) ([]string, error) {
+	pairs, err := LedisDB.ZRangeByScore([]byte(GLOBAL_REPLICATION_QUEUE), 0, now, 0, count)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, pair := range pairs {
+		ids = append(ids, string(pair.Member))
+	}
+
+	return ids, nil
+}
+
+// ClaimReplicationJob takes the job out of the queue, it's false when another worker claimed it.
+func ClaimReplicationJob(id string) (bool, error) {
+	n, err := LedisDB.ZRem([]byte(GLOBAL_REPLICATION_QUEUE), []byte(id))
+
+	return n == 1, err
+}
@@ -3,6 +3,8 @@ package models
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/containerops/wharf/utils"
@@ -13,6 +15,7 @@ type Repository struct {
 	Repository    string   `json:"repository"`    //
 	Namespace     string   `json:"namespace"`     //
 	Tags          []string `json:"tags"`          //
+	Builds        []string `json:"builds"`        // Ids of the recent builds, the newest is the last
 	Starts        []string `json:"starts"`        //
 	Comments      []string `json:"comments"`      //
 	Short         string   `json:"short"`         //
@@ -55,6 +58,24 @@ func (r *Repository) Has(namespace, repository string) (bool, []byte, error) {
 	return true, id, err
 }
 
+// All returns the "namespace/repository" names of all repositories in lexical order.
+func (r *Repository) All() ([]string, error) {
+	keys, err := LedisDB.HKeys([]byte(GLOBAL_REPOSITORY_INDEX))
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+
+	for _, key := range keys {
+		names = append(names, strings.Replace(string(key), ":", "/", 1))
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
 func (r *Repository) PutImages(namespace, repository string) error {
 	if has, _, err := r.Has(namespace, repository); err != nil {
 		return err
@@ -117,6 +138,169 @@ func (r *Repository) Put(namespace, repository, json, agent string, version int6
 	return nil
 }
 
+// RemoveTag removes the tag from the tag index and the Tags of the repository.
+func (r *Repository) RemoveTag(namespace, repository, tag string) error {
+	if has, _, err := r.Has(namespace, repository); err != nil {
+		return err
+	} else if has == false {
+		return fmt.Errorf("Repository not found")
+	}
+
+	t := new(Tag)
+	t.Id = fmt.Sprintf("%s:%s:%s", namespace, repository, tag)
+
+	index := -1
+	for i, v := range r.Tags {
+		if v == t.Id {
+			index = i
+		}
+	}
+
+	if index == -1 {
+		return fmt.Errorf("Tag not found")
+	}
+
+	if err := t.GetById(t.Id); err != nil {
+		return err
+	}
+
+	if err := t.Remove(); err != nil {
+		return err
+	}
+
+	r.Tags = append(r.Tags[:index], r.Tags[index+1:]...)
+	r.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+	if err := r.Save(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes all tags, manifests, blob links, webhooks and the repository, then the repository from the Repositories
+// of the owner user or organization, the collaborators and the teams.
+func (r *Repository) Delete(namespace, repository string) error {
+	if has, _, err := r.Has(namespace, repository); err != nil {
+		return err
+	} else if has == false {
+		return fmt.Errorf("Repository not found")
+	}
+
+	for _, id := range r.Tags {
+		t := new(Tag)
+
+		if err := t.GetById(id); err != nil {
+			return err
+		}
+
+		if err := t.Remove(); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range r.Builds {
+		b := &Build{Id: id}
+		b.Remove()
+	}
+
+	for _, rule := range new(BuildRule).All(namespace, repository) {
+		rule.Remove()
+	}
+
+	//The manifests aren't fetched by digest after the repository is deleted, the blobs not linked to other repositories
+	//are swept by gc
+	for _, manifest := range new(Manifest).InRepository(namespace, repository) {
+		if err := manifest.Remove(); err != nil {
+			return err
+		}
+	}
+
+	if err := UnlinkRepositoryBlobs(namespace, repository); err != nil {
+		return err
+	}
+
+	for _, hook := range new(Webhook).All(namespace, repository) {
+		hook.Remove()
+	}
+
+	//Replications of the namespace with a pattern are left for the other repositories
+	for _, replication := range new(Replication).All(namespace) {
+		if replication.Repository == repository {
+			replication.Remove()
+		}
+	}
+
+	r.Tags, r.Builds = []string{}, []string{}
+	r.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+	if err := r.Save(); err != nil {
+		return err
+	}
+
+	if err := r.Remove(); err != nil {
+		return err
+	}
+
+	user := new(User)
+
+	if has, _, err := user.Has(namespace); err != nil {
+		return err
+	} else if has == true {
+		user.Repositories = removeValue(user.Repositories, r.Id)
+		user.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+		if err := user.Save(); err != nil {
+			return err
+		}
+	} else {
+		org := new(Organization)
+
+		if has, _, err := org.Has(namespace); err != nil {
+			return err
+		} else if has == true {
+			org.Repositories = removeValue(org.Repositories, r.Id)
+			org.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+			if err := org.Save(); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range r.Permissions {
+			team := new(Team)
+
+			if has, _, err := team.Has(namespace, name); err != nil {
+				return err
+			} else if has == true {
+				team.Repositories = removeValue(team.Repositories, r.Id)
+				team.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+				if err := team.Save(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, username := range r.Collaborators {
+		collaborator := new(User)
+
+		if has, _, err := collaborator.Has(username); err != nil {
+			return err
+		} else if has == true {
+			collaborator.Repositories = removeValue(collaborator.Repositories, r.Id)
+			collaborator.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+			if err := collaborator.Save(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 func (repository *Repository) Get(id string) error {
 	if err := Get(repository, []byte(id)); err != nil {
 		return err
@@ -218,7 +402,7 @@ func (r *Repository) PutJSONFromManifests(image map[string]string, namespace, re
 	return nil
 }
 
-func (r *Repository) PutTagFromManifests(image, namespace, repository, tag, manifests string) error {
+func (r *Repository) PutTagFromManifests(image, namespace, repository, tag, manifests, digest string) error {
 	if has, _, err := r.Has(namespace, repository); err != nil {
 		return err
 	} else if has == false {
@@ -227,7 +411,7 @@ func (r *Repository) PutTagFromManifests(image, namespace, repository, tag, mani
 
 	t := new(Tag)
 	t.Id = string(fmt.Sprintf("%s:%s:%s", namespace, repository, tag))
-	t.Name, t.ImageId, t.Namespace, t.Repository, t.Manifest = tag, image, namespace, repository, manifests
+	t.Name, t.ImageId, t.Namespace, t.Repository, t.Manifest, t.Digest = tag, image, namespace, repository, manifests, digest
 
 	if err := t.Save(); err != nil {
 		return err
@@ -49,6 +49,30 @@ const (
 	ACTION_REMOVE_PRIVILEGE
 	ACTION_ADD_STAR
 	ACTION_REMOVE_STAR
+	ACTION_REMOVE_TAG
+	ACTION_REMOVE_MANIFEST
+	ACTION_REMOVE_BLOB
+	ACTION_ADD_TOKEN
+	ACTION_REMOVE_TOKEN
+	ACTION_ADD_ROBOT
+	ACTION_REMOVE_ROBOT
+	ACTION_ENABLE_TOTP
+	ACTION_DISABLE_TOTP
+	ACTION_UPDATE_RECOVERY_CODES
+	ACTION_ADD_WEBHOOK
+	ACTION_UPDATE_WEBHOOK
+	ACTION_REMOVE_WEBHOOK
+	ACTION_ADD_REPLICATION
+	ACTION_UPDATE_REPLICATION
+	ACTION_REMOVE_REPLICATION
+	ACTION_SYNC_REPLICATION
+	ACTION_ADD_BUILD
+	ACTION_ADD_BUILD_RULE
+	ACTION_UPDATE_BUILD_RULE
+	ACTION_REMOVE_BUILD_RULE
+	ACTION_ADD_COMPOSE
+	ACTION_UPDATE_COMPOSE
+	ACTION_REMOVE_COMPOSE
 )
 
 type Log struct {
@@ -12,6 +12,7 @@ type Tag struct {
   Repository string   `json:"repository"` //
   Sign       string   `json:"sign"`       //
   Manifest   string   `json:"manifest"`   //
+  Digest     string   `json:"digest"`     // Digest of the Manifest saved by digest
   Memo       []string `json:"memo"`       //
 }
 
@@ -35,7 +36,7 @@ func (t *Tag) Save() error {
     return err
   }
 
-  if _, err := LedisDB.HSet([]byte(GLOBAL_TAG_INDEX), []byte(fmt.Sprintf("%s:%s:%s:%s", t.Namespace, t.Repository, t.ImageId, t.Name)), []byte(t.Id)); err != nil {
+  if _, err := LedisDB.HSet([]byte(GLOBAL_TAG_INDEX), []byte(fmt.Sprintf("%s:%s:%s", t.Namespace, t.Repository, t.Name)), []byte(t.Id)); err != nil {
     return err
   }
 
@@ -44,4 +45,68 @@ func (t *Tag) Save() error {
 
 func (t *Tag) GetById(id string) error {
   return Get(t, []byte(id))
-}
\ No newline at end of file
+}
+
+func (t *Tag) Remove() error {
+  if _, err := LedisDB.HSet([]byte(fmt.Sprintf("%s_remove", GLOBAL_TAG_INDEX)), []byte(fmt.Sprintf("%s:%s:%s", t.Namespace, t.Repository, t.Name)), []byte(t.Id)); err != nil {
+    return err
+  }
+
+  //The index key had the image id before, like "namespace:repository:imageId:tag"
+  if _, err := LedisDB.HDel([]byte(GLOBAL_TAG_INDEX), []byte(fmt.Sprintf("%s:%s:%s", t.Namespace, t.Repository, t.Name)), []byte(fmt.Sprintf("%s:%s:%s:%s", t.Namespace, t.Repository, t.ImageId, t.Name))); err != nil {
+    return err
+  }
+
+  return nil
+}
+
+// IndexTags moves the tags saved with the index key "namespace:repository:imageId:tag" before to the key
+// "namespace:repository:tag" which Has finds, and returns the count of the tags moved.
+func IndexTags() (int, error) {
+  count := 0
+
+  values, err := LedisDB.HGetAll([]byte(GLOBAL_TAG_INDEX))
+  if err != nil {
+    return count, err
+  }
+
+  for _, value := range values {
+    tag := new(Tag)
+    if err := Get(tag, value.Value); err != nil || len(tag.Id) == 0 {
+      continue
+    }
+
+    key := fmt.Sprintf("%s:%s:%s", tag.Namespace, tag.Repository, tag.Name)
+    if string(value.Field) == key {
+      continue
+    }
+
+    if _, err := LedisDB.HSet([]byte(GLOBAL_TAG_INDEX), []byte(key), value.Value); err != nil {
+      return count, err
+    }
+
+    if _, err := LedisDB.HDel([]byte(GLOBAL_TAG_INDEX), value.Field); err != nil {
+      return count, err
+    }
+
+    count++
+  }
+
+  return count, nil
+}
+
+func (t *Tag) All() []*Tag {
+  values, _ := LedisDB.HGetAll([]byte(GLOBAL_TAG_INDEX))
+
+  tags := make([]*Tag, 0)
+
+  for _, value := range values {
+    tag := new(Tag)
+    if err := Get(tag, value.Value); err != nil {
+      continue
+    }
+    tags = append(tags, tag)
+  }
+
+  return tags
+}
@@ -7,6 +7,12 @@ import (
 	"github.com/containerops/wharf/utils"
 )
 
+const (
+	TEAM_PERMISSION_READ  = "read"
+	TEAM_PERMISSION_WRITE = "write"
+	TEAM_PERMISSION_ADMIN = "admin"
+)
+
 type Team struct {
 	Id           string   `json:"id"`           //
 	Name         string   `json:"name"`         //
@@ -14,6 +20,7 @@ type Team struct {
 	Username     string   `json:"username"`     //
 	Description  string   `json:"description"`  //
 	Write        bool     `json:"write"`        //
+	Permission   string   `json:"permission"`   // "read", "write" or "admin" of the repositories, Write decides when empty
 	Users        []string `json:"users"`        //
 	Repositories []string `json:"repositories"` //
 	Created      int64    `json:"created"`      //
@@ -55,6 +62,12 @@ func (team *Team) GetByName(org, name string) error {
 }
 
 func (team *Team) Save() error {
+	switch team.Permission {
+	case "", TEAM_PERMISSION_READ, TEAM_PERMISSION_WRITE, TEAM_PERMISSION_ADMIN:
+	default:
+		return fmt.Errorf("Invalid team permission: %s", team.Permission)
+	}
+
 	if err := Save(team, []byte(team.Id)); err != nil {
 		return err
 	}
@@ -0,0 +1,162 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerops/wharf/utils"
+)
+
+const (
+	RECOVERY_CODES_COUNT = 10
+)
+
+// EnableTOTP saves the secret confirmed with a code of the authenticator, and returns the new recovery codes.
+func (user *User) EnableTOTP(secret, code string) ([]string, error) {
+	if user.TOTPEnabled == true {
+		return nil, fmt.Errorf("Two-factor authentication is enabled already")
+	}
+
+	valid, counter := utils.VerifyTOTP(secret, code, time.Now())
+	if valid == false {
+		return nil, fmt.Errorf("Two-factor authentication code error")
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	user.TOTPEnabled, user.TOTPSecret, user.TOTPCounter, user.RecoveryCodes = true, secret, counter, hashes
+	user.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+	if err := user.Save(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (user *User) DisableTOTP() error {
+	user.TOTPEnabled, user.TOTPSecret, user.TOTPCounter, user.RecoveryCodes = false, "", 0, []string{}
+	user.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+	return user.Save()
+}
+
+// RenewRecoveryCodes replaces the unused recovery codes.
+func (user *User) RenewRecoveryCodes() ([]string, error) {
+	if user.TOTPEnabled == false {
+		return nil, fmt.Errorf("Two-factor authentication is disabled")
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	user.RecoveryCodes = hashes
+	user.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+	if err := user.Save(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// VerifyTwoFactor checks the code of the authenticator or a recovery code. A code of the authenticator can't be used
+// again, and the recovery code is removed after used.
+func (user *User) VerifyTwoFactor(code string) bool {
+	if user.TOTPEnabled == false {
+		return false
+	}
+
+	if valid, counter := utils.VerifyTOTP(user.TOTPSecret, code, time.Now()); valid == true {
+		if counter <= user.TOTPCounter {
+			return false
+		}
+
+		user.TOTPCounter = counter
+		LedisDB.HSet([]byte(user.Id), []byte("TOTPCounter"), utils.Int64ToBytes(counter))
+
+		return true
+	}
+
+	hash := recoveryCodeHash(code)
+
+	for _, h := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			user.RecoveryCodes = removeValue(user.RecoveryCodes, h)
+
+			if err := Save(user, []byte(user.Id)); err != nil {
+				return false
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// CountTwoFactorAttempt counts a code checked for the user, and returns the count of the period including it. The count
+// is kept in the database, so a new sign in or another session doesn't reset it.
+func (user *User) CountTwoFactorAttempt(period time.Duration) (int64, error) {
+	key := twoFactorAttemptsKey(user.Id)
+
+	count, err := LedisDB.Incr(key)
+	if err != nil {
+		return 0, err
+	}
+
+	//The period starts at the first attempt
+	if count == 1 {
+		if _, err := LedisDB.Expire(key, int64(period/time.Second)); err != nil {
+			return 0, err
+		}
+	}
+
+	return count, nil
+}
+
+// ResetTwoFactorAttempts clears the count after the user signs in.
+func (user *User) ResetTwoFactorAttempts() error {
+	_, err := LedisDB.Del(twoFactorAttemptsKey(user.Id))
+	return err
+}
+
+func twoFactorAttemptsKey(id string) []byte {
+	return []byte(fmt.Sprintf("totp_attempts:%s", id))
+}
+
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, hashes := []string{}, []string{}
+
+	for i := 0; i < RECOVERY_CODES_COUNT; i++ {
+		random := make([]byte, 5)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+
+		code := hex.EncodeToString(random)
+		code = fmt.Sprintf("%s-%s", code[:5], code[5:])
+
+		codes = append(codes, code)
+		hashes = append(hashes, recoveryCodeHash(code))
+	}
+
+	return codes, hashes, nil
+}
+
+func recoveryCodeHash(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,150 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// UPLOAD_LOCK_PERIOD is how long a request could hold the upload session, the lock of a request gone expires after it.
+const UPLOAD_LOCK_PERIOD = 10 * time.Minute
+
+// Upload is a Docker Registry API V2 blob upload session, it is saved in ledis so any Wharf instance
+// sharing the database and the backend could continue the upload.
+type Upload struct {
+	Id         string   `json:"id"`         //
+	UUID       string   `json:"uuid"`       //
+	Namespace  string   `json:"namespace"`  //
+	Repository string   `json:"repository"` //
+	Offset     int64    `json:"offset"`     //
+	Chunks     []string `json:"chunks"`     // Backend path of each uploaded chunk
+	Started    int64    `json:"started"`    //
+	Updated    int64    `json:"updated"`    //
+	Memo       []string `json:"memo"`       //
+}
+
+// Has loads the upload session of the repository, the sessions of other repositories are not exist.
+func (u *Upload) Has(namespace, repository, uuid string) (bool, []byte, error) {
+	id, err := GetByGobalId("upload", uuid)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if len(id) <= 0 {
+		return false, nil, nil
+	}
+
+	if err := Get(u, id); err != nil {
+		return false, nil, err
+	}
+
+	if u.Namespace != namespace || u.Repository != repository {
+		*u = Upload{}
+		return false, nil, nil
+	}
+
+	return true, id, nil
+}
+
+func (u *Upload) Start(namespace, repository string) error {
+	u.UUID = uuid.NewV4().String()
+	u.Id = fmt.Sprintf("upload:%s", u.UUID)
+	u.Namespace, u.Repository = namespace, repository
+	u.Offset, u.Chunks = 0, []string{}
+	u.Started = time.Now().UnixNano() / int64(time.Millisecond)
+	u.Updated = u.Started
+
+	if err := u.Save(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Lock claims the session for the request writing the next chunk, it returns false when another request holds it. The
+// session is reloaded after it's claimed, so the offset is the one saved by the last request.
+func (u *Upload) Lock() (bool, error) {
+	key := uploadLockKey(u.UUID)
+
+	if claimed, err := LedisDB.SetNX(key, []byte(u.Id)); err != nil {
+		return false, err
+	} else if claimed == 0 {
+		return false, nil
+	}
+
+	if _, err := LedisDB.Expire(key, int64(UPLOAD_LOCK_PERIOD/time.Second)); err != nil {
+		LedisDB.Del(key)
+		return false, err
+	}
+
+	//The session is removed when the request before completed the upload
+	if err := Get(u, []byte(u.Id)); err != nil || len(u.UUID) == 0 {
+		LedisDB.Del(key)
+		return false, fmt.Errorf("Upload session not exist")
+	}
+
+	return true, nil
+}
+
+func (u *Upload) Unlock() error {
+	_, err := LedisDB.Del(uploadLockKey(u.UUID))
+	return err
+}
+
+func (u *Upload) PutChunk(path string, size int64) error {
+	u.Chunks = append(u.Chunks, path)
+	u.Offset += size
+	u.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+	if err := u.Save(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (u *Upload) Save() error {
+	if err := Save(u, []byte(u.Id)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HSet([]byte(GLOBAL_UPLOAD_INDEX), []byte(u.UUID), []byte(u.Id)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Remove deletes the session when the upload is finished or cancelled, the chunks should be deleted from the backend by caller.
+func (u *Upload) Remove() error {
+	if _, err := LedisDB.HDel([]byte(GLOBAL_UPLOAD_INDEX), []byte(u.UUID)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HClear([]byte(u.Id)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (u *Upload) All() []*Upload {
+	values, _ := LedisDB.HGetAll([]byte(GLOBAL_UPLOAD_INDEX))
+
+	uploads := make([]*Upload, 0)
+
+	for _, value := range values {
+		upload := new(Upload)
+		if err := Get(upload, value.Value); err != nil {
+			continue
+		}
+		uploads = append(uploads, upload)
+	}
+
+	return uploads
+}
+
+func uploadLockKey(uuid string) []byte {
+	return []byte(fmt.Sprintf("upload_lock:%s", uuid))
+}
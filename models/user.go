@@ -3,15 +3,25 @@ package models
 import (
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
 
+	"github.com/astaxie/beego"
+	"github.com/siddontang/ledisdb/ledis"
+
 	"github.com/containerops/wharf/utils"
 )
 
+const (
+	PASSWORD_SCHEME_PBKDF2 = "pbkdf2_sha256"        // PBKDF2 of the password
+	PASSWORD_SCHEME_LEGACY = "legacy_pbkdf2_sha256" // PBKDF2 of the plain password or the md5 hash saved before the schemes
+)
+
 type User struct {
 	Id                string   `json:"id"`                //
 	Username          string   `json:"username"`          //
 	Password          string   `json:"password"`          //
+	PasswordScheme    string   `json:"-"`                 // How the password is hashed, empty when the password is plain
 	Email             string   `json:"email"`             //
 	Fullname          string   `json:"fullname"`          //
 	Company           string   `json:"company"`           //
@@ -29,6 +39,10 @@ type User struct {
 	Starts            []string `json:"starts"`            //
 	Comments          []string `json:"comments"`          //
 	Memo              []string `json:"memo"`              //
+	TOTPEnabled       bool     `json:"totp"`              // Sign in with the code of the authenticator after the password
+	TOTPSecret        string   `json:"-"`                 //
+	TOTPCounter       int64    `json:"-"`                 // Time step of the last used code, a code is used once
+	RecoveryCodes     []string `json:"-"`                 // SHA256 of the unused recovery codes
 }
 
 func (user *User) Has(username string) (bool, []byte, error) {
@@ -63,11 +77,33 @@ func (user *User) Get(username, password string) error {
 		if err := Get(user, id); err != nil {
 			return err
 		} else {
-			if user.Password != password {
+			valid, upgrade := false, false
+
+			switch user.PasswordScheme {
+			case PASSWORD_SCHEME_PBKDF2:
+				valid, upgrade = utils.VerifyPassword(password, user.Password, passwordIterations())
+			case PASSWORD_SCHEME_LEGACY:
+				//The saved value was the plain password or the md5 hash of it, both are always upgraded
+				if valid, _ = utils.VerifyPassword(password, user.Password, 0); valid == false {
+					valid, _ = utils.VerifyPassword(utils.EncodePassword(username, password), user.Password, 0)
+				}
+
+				upgrade = valid
+			}
+
+			if valid == false {
 				return fmt.Errorf("User password error.")
-			} else {
-				return nil
 			}
+
+			//Upgrade the legacy or weaker hash transparently
+			if upgrade == true {
+				if hash, err := utils.HashPassword(password, passwordIterations()); err == nil {
+					user.Password, user.PasswordScheme = hash, PASSWORD_SCHEME_PBKDF2
+					LedisDB.HMset(id, ledis.FVPair{Field: []byte("Password"), Value: []byte(hash)}, ledis.FVPair{Field: []byte("PasswordScheme"), Value: []byte(PASSWORD_SCHEME_PBKDF2)})
+				}
+			}
+
+			return nil
 		}
 	}
 	return nil
@@ -79,8 +115,30 @@ func (user *User) Save() error {
 		return fmt.Errorf("Username must be 4 - 30, include a-z, 0-9 and '_'")
 	}
 
-	if len(user.Password) < 5 {
-		return fmt.Errorf("Password length should be more than 5")
+	//A password without the scheme is a new plain password checked with the policy, unless it's the saved hash of a
+	//user loaded before the scheme was saved
+	if len(user.PasswordScheme) == 0 {
+		saved, _ := LedisDB.HGet([]byte(user.Id), []byte("Password"))
+		scheme, _ := LedisDB.HGet([]byte(user.Id), []byte("PasswordScheme"))
+
+		if len(scheme) > 0 && user.Password == string(saved) {
+			user.PasswordScheme = string(scheme)
+		} else {
+			if err := checkPasswordPolicy(user.Username, user.Password); err != nil {
+				return err
+			}
+
+			hash, err := utils.HashPassword(user.Password, passwordIterations())
+			if err != nil {
+				return err
+			}
+
+			user.Password, user.PasswordScheme = hash, PASSWORD_SCHEME_PBKDF2
+		}
+	}
+
+	if user.TOTPEnabled == true && len(user.TOTPSecret) == 0 {
+		return fmt.Errorf("Two-factor authentication secret is required")
 	}
 
 	validEmail := regexp.MustCompile("[\\w!#$%&'*+/=?^_`{|}~-]+(?:\\.[\\w!#$%&'*+/=?^_`{|}~-]+)*@(?:[\\w](?:[\\w-]*[\\w])?\\.)+[a-zA-Z0-9](?:[\\w-]*[\\w])?")
@@ -161,3 +219,57 @@ func (user *User) Log(action, level, t int64, actionID string, content []byte) e
 
 	return nil
 }
+
+// HashPlainPasswords hashes the passwords saved before the schemes, they are the plain passwords or the md5 hashes of
+// them and both are hashed again with the legacy scheme, so a plain password is never compared with the password of a
+// sign in. It returns the count of the passwords hashed.
+func HashPlainPasswords() (int, error) {
+	count := 0
+
+	for _, user := range new(User).All() {
+		if len(user.Id) == 0 || len(user.Password) == 0 || len(user.PasswordScheme) > 0 {
+			continue
+		}
+
+		hash, err := utils.HashPassword(user.Password, passwordIterations())
+		if err != nil {
+			return count, err
+		}
+
+		//The hash and the scheme are saved together, so a password is never hashed twice
+		if err := LedisDB.HMset([]byte(user.Id), ledis.FVPair{Field: []byte("Password"), Value: []byte(hash)}, ledis.FVPair{Field: []byte("PasswordScheme"), Value: []byte(PASSWORD_SCHEME_LEGACY)}); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+func passwordIterations() int {
+	return beego.AppConfig.DefaultInt("password::Iterations", utils.PASSWORD_HASH_ITERATIONS)
+}
+
+// checkPasswordPolicy requires "password::MinLength" characters at least with letters and digits, and not the username.
+func checkPasswordPolicy(username, password string) error {
+	length := beego.AppConfig.DefaultInt("password::MinLength", 8)
+
+	if len(password) < length {
+		return fmt.Errorf("Password length should be %d at least", length)
+	}
+
+	if len(password) > 128 {
+		return fmt.Errorf("Password length should be 128 at most")
+	}
+
+	if regexp.MustCompile(`[A-Za-z]`).MatchString(password) == false || regexp.MustCompile(`[0-9]`).MatchString(password) == false {
+		return fmt.Errorf("Password should include both letters and digits")
+	}
+
+	if strings.Contains(strings.ToLower(password), strings.ToLower(username)) == true {
+		return fmt.Errorf("Password should not include the username")
+	}
+
+	return nil
+}
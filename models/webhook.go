@@ -0,0 +1,323 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/siddontang/ledisdb/ledis"
+)
+
+const (
+	WEBHOOK_EVENT_PUSH   = "push"
+	WEBHOOK_EVENT_PULL   = "pull"
+	WEBHOOK_EVENT_TAG    = "tag"
+	WEBHOOK_EVENT_DELETE = "delete"
+
+	DELIVERY_STATUS_PENDING   = "pending"
+	DELIVERY_STATUS_SUCCEEDED = "succeeded"
+	DELIVERY_STATUS_FAILED    = "failed"
+
+	//Deliveries kept in the history of a webhook, older ones are removed
+	WEBHOOK_DELIVERIES_HISTORY = 50
+)
+
+var webhookLock sync.Mutex
+
+// Webhook posts the events of a repository, or of all repositories in the namespace when the repository is empty.
+type Webhook struct {
+	Id         string   `json:"id"`         //
+	Namespace  string   `json:"namespace"`  //
+	Repository string   `json:"repository"` // Empty for the webhooks of the organization
+	URL        string   `json:"url"`        //
+	Secret     string   `json:"-"`          // Key of the HMAC signature, not signed when empty
+	Events     []string `json:"events"`     // "push", "pull", "tag" or "delete", all events when empty
+	Active     bool     `json:"active"`     //
+	Deliveries []string `json:"-"`          // Ids of the recent deliveries, the newest is the last
+	Created    int64    `json:"created"`    //
+	Updated    int64    `json:"updated"`    //
+}
+
+// Delivery is a payload posted to a webhook, failed deliveries are retried until the attempts run out.
+type Delivery struct {
+	Id          string `json:"id"`          //
+	Webhook     string `json:"webhook"`     //
+	Event       string `json:"event"`       //
+	Payload     string `json:"payload"`     //
+	Status      string `json:"status"`      // "pending", "succeeded" or "failed"
+	Attempts    int64  `json:"attempts"`    //
+	NextAttempt int64  `json:"nextattempt"` // Milliseconds
+	StatusCode  int64  `json:"statuscode"`  // Response status of the last attempt
+	Response    string `json:"response"`    // Beginning of the response body of the last attempt
+	Error       string `json:"error"`       //
+	Duration    int64  `json:"duration"`    // Milliseconds of the last attempt
+	Created     int64  `json:"created"`     //
+	Updated     int64  `json:"updated"`     //
+}
+
+// Create checks and saves a new webhook of the namespace, or of the repository when it isn't empty.
+func (w *Webhook) Create(namespace, repository, address, secret string, events []string, active bool) error {
+	w.Id = fmt.Sprintf("webhook:%s", uuid.NewV4().String())
+	w.Namespace, w.Repository = namespace, repository
+	w.Created = time.Now().UnixNano() / int64(time.Millisecond)
+
+	return w.Update(address, secret, events, active)
+}
+
+// Update changes the webhook, the secret is kept when it's empty.
+func (w *Webhook) Update(address, secret string, events []string, active bool) error {
+	if u, err := url.Parse(address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("Webhook URL is invalid: %s", address)
+	}
+
+	for _, event := range events {
+		switch event {
+		case WEBHOOK_EVENT_PUSH, WEBHOOK_EVENT_PULL, WEBHOOK_EVENT_TAG, WEBHOOK_EVENT_DELETE:
+		default:
+			return fmt.Errorf("Invalid webhook event: %s", event)
+		}
+	}
+
+	w.URL, w.Events, w.Active = address, events, active
+
+	if len(secret) > 0 {
+		w.Secret = secret
+	}
+
+	if w.Events == nil {
+		w.Events = []string{}
+	}
+
+	if w.Deliveries == nil {
+		w.Deliveries = []string{}
+	}
+
+	w.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+
+	return w.Save()
+}
+
+func (w *Webhook) Save() error {
+	if err := Save(w, []byte(w.Id)); err != nil {
+		return err
+	}
+
+	if _, err := LedisDB.HSet([]byte(GLOBAL_WEBHOOK_INDEX), []byte(w.Id), []byte(w.Scope())); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Get returns the webhook with the id in the namespace and the repository.
+func (w *Webhook) Get(namespace, repository, id string) (bool, error) {
+	scope, err := GetByGobalId("webhook", id)
+	if err != nil || len(scope) == 0 {
+		return false, err
+	}
+
+	if err := Get(w, []byte(id)); err != nil {
+		return false, err
+	}
+
+	return string(scope) == webhookScope(namespace, repository), nil
+}
+
+func (w *Webhook) GetById(id string) error {
+	return Get(w, []byte(id))
+}
+
+func (w *Webhook) Remove() error {
+	if _, err := LedisDB.HDel([]byte(GLOBAL_WEBHOOK_INDEX), []byte(w.Id)); err != nil {
+		return err
+	}
+
+	for _, id := range w.Deliveries {
+		LedisDB.HClear([]byte(id))
+		LedisDB.ZRem([]byte(GLOBAL_WEBHOOK_QUEUE), []byte(id))
+	}
+
+	if _, err := LedisDB.HClear([]byte(w.Id)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (w *Webhook) Scope() string {
+	return webhookScope(w.Namespace, w.Repository)
+}
+
+// All returns the webhooks of the namespace, or of the repository when it isn't empty.
+func (w *Webhook) All(namespace, repository string) []*Webhook {
+	return webhooks(func(scope string) bool {
+		return scope == webhookScope(namespace, repository)
+	})
+}
+
+// Matched returns the active webhooks of the repository and of the namespace which want the event.
+func (w *Webhook) Matched(namespace, repository, event string) []*Webhook {
+	result := []*Webhook{}
+
+	for _, hook := range webhooks(func(scope string) bool {
+		return scope == namespace || scope == webhookScope(namespace, repository)
+	}) {
+		if hook.Active == true && hook.Wants(event) == true {
+			result = append(result, hook)
+		}
+	}
+
+	return result
+}
+
+func (w *Webhook) Wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Enqueue saves a pending delivery of the payload and puts it in the queue, the oldest deliveries out of the
+// history are removed.
+func (w *Webhook) Enqueue(event string, payload []byte) (*Delivery, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	d := &Delivery{
+		Id:          fmt.Sprintf("delivery:%s", uuid.NewV4().String()),
+		Webhook:     w.Id,
+		Event:       event,
+		Payload:     string(payload),
+		Status:      DELIVERY_STATUS_PENDING,
+		NextAttempt: now,
+		Created:     now,
+		Updated:     now,
+	}
+
+	if err := d.Save(); err != nil {
+		return nil, err
+	}
+
+	//Events of the same webhook are enqueued concurrently by requests
+	webhookLock.Lock()
+	defer webhookLock.Unlock()
+
+	if err := Get(w, []byte(w.Id)); err != nil {
+		return nil, err
+	}
+
+	w.Deliveries = append(w.Deliveries, d.Id)
+
+	for len(w.Deliveries) > WEBHOOK_DELIVERIES_HISTORY {
+		LedisDB.HClear([]byte(w.Deliveries[0]))
+		LedisDB.ZRem([]byte(GLOBAL_WEBHOOK_QUEUE), []byte(w.Deliveries[0]))
+
+		w.Deliveries = w.Deliveries[1:]
+	}
+
+	if err := w.Save(); err != nil {
+		return nil, err
+	}
+
+	if err := d.Schedule(now); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// History returns the recent deliveries, the newest is the first.
+func (w *Webhook) History() []*Delivery {
+	result := []*Delivery{}
+
+	for i := len(w.Deliveries) - 1; i >= 0; i-- {
+		d := new(Delivery)
+		if err := Get(d, []byte(w.Deliveries[i])); err != nil || len(d.Id) == 0 {
+			continue
+		}
+
+		result = append(result, d)
+	}
+
+	return result
+}
+
+func (d *Delivery) Get(id string) error {
+	return Get(d, []byte(id))
+}
+
+func (d *Delivery) Save() error {
+	return Save(d, []byte(d.Id))
+}
+
+// Schedule puts the delivery in the queue at the time in milliseconds.
+func (d *Delivery) Schedule(at int64) error {
+	d.NextAttempt = at
+
+	if err := d.Save(); err != nil {
+		return err
+	}
+
+	_, err := LedisDB.ZAdd([]byte(GLOBAL_WEBHOOK_QUEUE), ledis.ScorePair{Score: at, Member: []byte(d.Id)})
+
+	return err
+}
+
+// DueDeliveries returns the ids of the deliveries to attempt before the time in milliseconds.
+func DueDeliveries(now int64, count int) ([]string, error) {
+	pairs, err := LedisDB.ZRangeByScore([]byte(GLOBAL_WEBHOOK_QUEUE), 0, now, 0, count)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, pair := range pairs {
+		ids = append(ids, string(pair.Member))
+	}
+
+	return ids, nil
+}
+
+// ClaimDelivery takes the delivery out of the queue, it's false when another worker claimed it.
+func ClaimDelivery(id string) (bool, error) {
+	n, err := LedisDB.ZRem([]byte(GLOBAL_WEBHOOK_QUEUE), []byte(id))
+
+	return n == 1, err
+}
+
+func webhooks(match func(scope string) bool) []*Webhook {
+	values, _ := LedisDB.HGetAll([]byte(GLOBAL_WEBHOOK_INDEX))
+
+	result := []*Webhook{}
+
+	for _, value := range values {
+		if match(string(value.Value)) == false {
+			continue
+		}
+
+		hook := new(Webhook)
+		if err := Get(hook, value.Field); err != nil {
+			continue
+		}
+
+		result = append(result, hook)
+	}
+
+	return result
+}
+
+func webhookScope(namespace, repository string) string {
+	if len(repository) == 0 {
+		return namespace
+	}
+
+	return fmt.Sprintf("%s/%s", namespace, repository)
+}
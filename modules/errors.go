@@ -13,6 +13,8 @@ const (
 	APIErrorCodeManifestUnverified
 	APIErrorCodeBlobUnknown
 	APIErrorCodeBlobUploadUnknown
+	APIErrorCodePaginationNumberInvalid
+	APIErrorCodeUnsupported
 )
 
 type ErrorDescriptor struct {
@@ -95,4 +97,16 @@ var ErrorDescriptors = []ErrorDescriptor{
 		Message:     "blob upload unknown to registry",
 		Description: `If a blob upload has been cancelled or was never started, this error code may be returned.`,
 	},
+	{
+		Code:        APIErrorCodePaginationNumberInvalid,
+		Value:       "PAGINATION_NUMBER_INVALID",
+		Message:     "invalid number of results requested",
+		Description: `Returned when the "n" parameter (number of results to return) is not an integer, or "n" is negative.`,
+	},
+	{
+		Code:        APIErrorCodeUnsupported,
+		Value:       "UNSUPPORTED",
+		Message:     "The operation is unsupported.",
+		Description: `The operation was unsupported due to a missing implementation or invalid set of parameters, like deleting a blob which is still referenced by manifests.`,
+	},
 }
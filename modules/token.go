@@ -0,0 +1,337 @@
+package modules
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	TOKEN_EXPIRATION = 300
+)
+
+// TokenAccess is an "access" claim of the Docker Registry token, like "repository:library/ubuntu:pull,push".
+type TokenAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+type TokenClaims struct {
+	Issuer     string         `json:"iss"`
+	Subject    string         `json:"sub"`
+	Audience   string         `json:"aud"`
+	Expiration int64          `json:"exp"`
+	NotBefore  int64          `json:"nbf"`
+	IssuedAt   int64          `json:"iat"`
+	Id         string         `json:"jti"`
+	Access     []*TokenAccess `json:"access"`
+}
+
+type tokenHeader struct {
+	Type      string   `json:"typ"`
+	Algorithm string   `json:"alg"`
+	X5c       []string `json:"x5c,omitempty"`
+}
+
+var (
+	tokenKeyOnce sync.Once
+	tokenKey     crypto.Signer
+	tokenChain   []string
+	tokenKeyErr  error
+)
+
+// TokenEnabled returns whether the Registry API V2 uses bearer tokens, it's enabled by "Enabled = true" in the [token]
+// section with a key file. The HTTPS key file alone doesn't switch the clients using basic authentication to tokens.
+func TokenEnabled() bool {
+	enabled, err := beego.AppConfig.Bool("token::Enabled")
+
+	return err == nil && enabled == true && len(tokenKeyFile()) > 0
+}
+
+func TokenRealm() string {
+	return beego.AppConfig.DefaultString("token::Realm", fmt.Sprintf("https://%s/auth/token", beego.AppConfig.String("docker::Endpoints")))
+}
+
+func TokenService() string {
+	return beego.AppConfig.DefaultString("token::Service", beego.AppConfig.String("docker::Endpoints"))
+}
+
+func TokenIssuer() string {
+	return beego.AppConfig.DefaultString("token::Issuer", beego.AppConfig.String("docker::Endpoints"))
+}
+
+// TokenChallenge returns the "WWW-Authenticate" header value which tells clients where to get a token for the scope.
+func TokenChallenge(scope, err string) string {
+	challenge := fmt.Sprintf("Bearer realm=\"%s\",service=\"%s\"", TokenRealm(), TokenService())
+
+	if len(scope) > 0 {
+		challenge += fmt.Sprintf(",scope=\"%s\"", scope)
+	}
+
+	if len(err) > 0 {
+		challenge += fmt.Sprintf(",error=\"%s\"", err)
+	}
+
+	return challenge
+}
+
+// ParseScope parses the scope like "repository:library/ubuntu:pull,push", the name may contain ":".
+func ParseScope(scope string) (*TokenAccess, error) {
+	first, last := strings.Index(scope, ":"), strings.LastIndex(scope, ":")
+
+	if first <= 0 || first == last {
+		return nil, fmt.Errorf("Invalid scope: %s", scope)
+	}
+
+	return &TokenAccess{Type: scope[:first], Name: scope[first+1 : last], Actions: strings.Split(scope[last+1:], ",")}, nil
+}
+
+// Allowed returns whether the token grants the action on the resource.
+func (c *TokenClaims) Allowed(typ, name, action string) bool {
+	for _, access := range c.Access {
+		if access.Type != typ || access.Name != name {
+			continue
+		}
+
+		for _, a := range access.Actions {
+			if a == action || a == "*" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// SignToken issues a JWT for the subject with the key and certificates configured in bucket.conf.
+func SignToken(subject string, access []*TokenAccess) (string, *TokenClaims, error) {
+	key, chain, err := loadTokenKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+
+	claims := &TokenClaims{
+		Issuer:     TokenIssuer(),
+		Subject:    subject,
+		Audience:   TokenService(),
+		Expiration: now.Add(time.Duration(beego.AppConfig.DefaultInt64("token::Expiration", TOKEN_EXPIRATION)) * time.Second).Unix(),
+		NotBefore:  now.Add(-10 * time.Second).Unix(),
+		IssuedAt:   now.Unix(),
+		Id:         uuid.NewV4().String(),
+		Access:     access,
+	}
+
+	header := tokenHeader{Type: "JWT", X5c: chain}
+
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		header.Algorithm = "RS256"
+	case *ecdsa.PrivateKey:
+		header.Algorithm = "ES256"
+	}
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", nil, err
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	signing := tokenBase64(h) + "." + tokenBase64(c)
+	hash := sha256.Sum256([]byte(signing))
+
+	var signature []byte
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:]); err != nil {
+			return "", nil, err
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		if err != nil {
+			return "", nil, err
+		}
+
+		signature = append(tokenPad(r), tokenPad(s)...)
+	}
+
+	return signing + "." + tokenBase64(signature), claims, nil
+}
+
+// ParseToken verifies the signature, the issuer, the audience and the time of the token.
+func ParseToken(token string) (*TokenClaims, error) {
+	key, _, err := loadTokenKey()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Token format is invalid")
+	}
+
+	h, err := tokenDecode(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var header tokenHeader
+	if err := json.Unmarshal(h, &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := tokenDecode(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if header.Algorithm != "RS256" || rsa.VerifyPKCS1v15(&k.PublicKey, crypto.SHA256, hash[:], signature) != nil {
+			return nil, fmt.Errorf("Token signature is invalid")
+		}
+	case *ecdsa.PrivateKey:
+		if header.Algorithm != "ES256" || len(signature) != 64 {
+			return nil, fmt.Errorf("Token signature is invalid")
+		}
+
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if ecdsa.Verify(&k.PublicKey, hash[:], r, s) == false {
+			return nil, fmt.Errorf("Token signature is invalid")
+		}
+	}
+
+	c, err := tokenDecode(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	claims := new(TokenClaims)
+	if err := json.Unmarshal(c, claims); err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != TokenIssuer() || claims.Audience != TokenService() {
+		return nil, fmt.Errorf("Token issuer or audience is invalid")
+	}
+
+	if now := time.Now().Unix(); now >= claims.Expiration || now < claims.NotBefore {
+		return nil, fmt.Errorf("Token is expired")
+	}
+
+	return claims, nil
+}
+
+func tokenKeyFile() string {
+	return beego.AppConfig.DefaultString("token::KeyFile", beego.HttpKeyFile)
+}
+
+func tokenCertFile() string {
+	return beego.AppConfig.DefaultString("token::CertFile", beego.HttpCertFile)
+}
+
+// loadTokenKey reads the RSA or ECDSA P-256 private key and the certificate chain at the first call.
+func loadTokenKey() (crypto.Signer, []string, error) {
+	tokenKeyOnce.Do(func() {
+		data, err := ioutil.ReadFile(tokenKeyFile())
+		if err != nil {
+			tokenKeyErr = err
+			return
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			tokenKeyErr = fmt.Errorf("Token key file is invalid")
+			return
+		}
+
+		var key interface{}
+
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+
+		if err != nil {
+			tokenKeyErr = err
+			return
+		}
+
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			tokenKey = k
+		case *ecdsa.PrivateKey:
+			if k.Curve != elliptic.P256() {
+				tokenKeyErr = fmt.Errorf("Only ECDSA P-256 token key is supported")
+				return
+			}
+
+			tokenKey = k
+		default:
+			tokenKeyErr = fmt.Errorf("Only RSA and ECDSA token key are supported")
+			return
+		}
+
+		//The certificate chain is in the "x5c" header for the clients verify tokens
+		if data, err := ioutil.ReadFile(tokenCertFile()); err == nil {
+			for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+				if block.Type == "CERTIFICATE" {
+					tokenChain = append(tokenChain, base64.StdEncoding.EncodeToString(block.Bytes))
+				}
+			}
+		}
+	})
+
+	return tokenKey, tokenChain, tokenKeyErr
+}
+
+func tokenBase64(data []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+}
+
+func tokenDecode(data string) ([]byte, error) {
+	if mod := len(data) % 4; mod != 0 {
+		data += strings.Repeat("=", 4-mod)
+	}
+
+	return base64.URLEncoding.DecodeString(data)
+}
+
+func tokenPad(value *big.Int) []byte {
+	data := value.Bytes()
+
+	if len(data) >= 32 {
+		return data
+	}
+
+	return append(make([]byte, 32-len(data)), data...)
+}
@@ -0,0 +1,266 @@
+package notifications
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/satori/go.uuid"
+
+	"github.com/containerops/wharf/models"
+)
+
+const (
+	EVENTS_MEDIATYPE = "application/vnd.docker.distribution.events.v1+json"
+
+	DEFAULT_ATTEMPTS    = 8
+	DEFAULT_BACKOFF     = 10   // Seconds before the first retry, doubled after each attempt
+	DEFAULT_MAX_BACKOFF = 3600 // Seconds
+	DEFAULT_TIMEOUT     = 10   // Seconds
+
+	RESPONSE_LIMIT = 1024
+	DISPATCH_BATCH = 100
+)
+
+// Envelope is the body posted to webhooks, the same as the notifications of Docker Registry.
+type Envelope struct {
+	Events []Event `json:"events"`
+}
+
+type Event struct {
+	Id        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	Target    Target    `json:"target"`
+	Request   Request   `json:"request"`
+	Actor     Actor     `json:"actor"`
+	Source    Source    `json:"source"`
+}
+
+type Target struct {
+	MediaType  string `json:"mediaType,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	Length     int64  `json:"length,omitempty"`
+	Repository string `json:"repository"`
+	URL        string `json:"url,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+}
+
+type Request struct {
+	Id        string `json:"id"`
+	Addr      string `json:"addr"`
+	Host      string `json:"host"`
+	Method    string `json:"method"`
+	UserAgent string `json:"useragent"`
+}
+
+type Actor struct {
+	Name string `json:"name,omitempty"`
+}
+
+type Source struct {
+	Addr       string `json:"addr"`
+	InstanceID string `json:"instanceID"`
+}
+
+var (
+	Client     = &http.Client{Timeout: DEFAULT_TIMEOUT * time.Second}
+	Attempts   = int64(DEFAULT_ATTEMPTS)
+	Backoff    = DEFAULT_BACKOFF * time.Second
+	MaxBackoff = DEFAULT_MAX_BACKOFF * time.Second
+
+	instance = uuid.NewV4().String()
+	once     sync.Once
+)
+
+// InitNotifications reads the [webhook] section of bucket.conf: Attempts, Backoff, MaxBackoff and Timeout (seconds),
+// then starts delivering the queue in the background.
+func InitNotifications() {
+	if value, err := beego.AppConfig.Int64("webhook::Attempts"); err == nil && value > 0 {
+		Attempts = value
+	}
+
+	if value, err := beego.AppConfig.Int("webhook::Backoff"); err == nil && value > 0 {
+		Backoff = time.Duration(value) * time.Second
+	}
+
+	if value, err := beego.AppConfig.Int("webhook::MaxBackoff"); err == nil && value > 0 {
+		MaxBackoff = time.Duration(value) * time.Second
+	}
+
+	if value, err := beego.AppConfig.Int("webhook::Timeout"); err == nil && value > 0 {
+		Client.Timeout = time.Duration(value) * time.Second
+	}
+
+	once.Do(func() {
+		go Run(time.Second)
+	})
+}
+
+// Notify enqueues the event to the webhooks of the repository and of its namespace which want the action.
+func Notify(namespace, repository string, event Event) error {
+	hooks := new(models.Webhook).Matched(namespace, repository, event.Action)
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	if len(event.Id) == 0 {
+		event.Id = uuid.NewV4().String()
+	}
+
+	if event.Timestamp.IsZero() == true {
+		event.Timestamp = time.Now().UTC()
+	}
+
+	event.Target.Repository = fmt.Sprintf("%s/%s", namespace, repository)
+	event.Source = Source{Addr: beego.AppConfig.String("docker::Endpoints"), InstanceID: instance}
+
+	payload, err := json.Marshal(Envelope{Events: []Event{event}})
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		if _, err := hook.Enqueue(event.Action, payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run delivers the queue at the interval, the deliveries pending before a restart are sent too.
+func Run(interval time.Duration) {
+	for {
+		Dispatch()
+		time.Sleep(interval)
+	}
+}
+
+// Dispatch attempts the due deliveries and returns how many were attempted.
+func Dispatch() int {
+	ids, err := models.DueDeliveries(time.Now().UnixNano()/int64(time.Millisecond), DISPATCH_BATCH)
+	if err != nil {
+		beego.Error(fmt.Sprintf("[webhook] read queue error: %s", err.Error()))
+		return 0
+	}
+
+	count := 0
+
+	for _, id := range ids {
+		if claimed, err := models.ClaimDelivery(id); err != nil || claimed == false {
+			continue
+		}
+
+		d := new(models.Delivery)
+		if err := d.Get(id); err != nil || len(d.Id) == 0 {
+			continue
+		}
+
+		//The deliveries of removed webhooks are dropped
+		hook := new(models.Webhook)
+		if err := hook.GetById(d.Webhook); err != nil || len(hook.Id) == 0 {
+			continue
+		}
+
+		Deliver(hook, d)
+		count++
+	}
+
+	return count
+}
+
+// Deliver posts the payload once, and schedules the retry with exponential backoff when it fails.
+func Deliver(hook *models.Webhook, d *models.Delivery) error {
+	start := time.Now()
+
+	d.Attempts++
+	d.StatusCode, d.Response, d.Error = 0, "", ""
+
+	err := post(hook, d)
+
+	now := time.Now()
+	d.Duration = int64(now.Sub(start) / time.Millisecond)
+	d.Updated = now.UnixNano() / int64(time.Millisecond)
+
+	if err == nil {
+		d.Status = models.DELIVERY_STATUS_SUCCEEDED
+		return d.Save()
+	}
+
+	d.Error = err.Error()
+
+	if d.Attempts >= Attempts {
+		d.Status = models.DELIVERY_STATUS_FAILED
+		return d.Save()
+	}
+
+	return d.Schedule(d.Updated + int64(RetryAfter(d.Attempts)/time.Millisecond))
+}
+
+// RetryAfter returns the backoff after the attempts, it's doubled after each attempt up to MaxBackoff.
+func RetryAfter(attempts int64) time.Duration {
+	backoff := Backoff
+
+	for i := int64(1); i < attempts && backoff < MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > MaxBackoff {
+		backoff = MaxBackoff
+	}
+
+	return backoff
+}
+
+// Sign returns the HMAC-SHA256 signature of the body like "sha256=<hex>", receivers compare it with the
+// "X-Wharf-Signature" header.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
+
+func post(hook *models.Webhook, d *models.Delivery) error {
+	body := []byte(d.Payload)
+
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", EVENTS_MEDIATYPE)
+	req.Header.Set("User-Agent", "Wharf-Webhook")
+	req.Header.Set("X-Wharf-Event", d.Event)
+	req.Header.Set("X-Wharf-Delivery", d.Id)
+
+	if len(hook.Secret) > 0 {
+		req.Header.Set("X-Wharf-Signature", Sign(hook.Secret, body))
+	}
+
+	resp, err := Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	response, _ := ioutil.ReadAll(io.LimitReader(resp.Body, RESPONSE_LIMIT))
+	d.StatusCode, d.Response = int64(resp.StatusCode), string(response)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook response status: %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/astaxie/beego"
+
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/registry"
+)
+
+const (
+	DEFAULT_TAG_TTL = 300 // Seconds a cached tag is served before it's fetched again
+	DEFAULT_V1_TAGS = 10  // Tags of a repository cached for the pulls with Docker Registry API V1
+)
+
+// Upstream is the registry pulled through in proxy mode, it's nil when the [proxy] section isn't configured.
+var Upstream *Registry
+
+// Registry is the upstream registry, cached tags are fetched again after the TagTTL.
+type Registry struct {
+	*registry.Client
+
+	TagTTL time.Duration
+	V1Tags int
+}
+
+// NewRegistry reads the [proxy] section of bucket.conf: URL, Username, Password, TagTTL and Timeout (seconds) and V1Tags.
+func NewRegistry(parameters map[string]string) (*Registry, error) {
+	timeout, _ := strconv.Atoi(parameters["timeout"])
+
+	client, err := registry.NewClient(parameters["url"], parameters["username"], parameters["password"], timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	client.UserAgent = "Wharf-Proxy"
+
+	r := &Registry{Client: client, TagTTL: DEFAULT_TAG_TTL * time.Second, V1Tags: DEFAULT_V1_TAGS}
+
+	if value, err := strconv.Atoi(parameters["tagttl"]); err == nil && value >= 0 {
+		r.TagTTL = time.Duration(value) * time.Second
+	}
+
+	if value, err := strconv.Atoi(parameters["v1tags"]); err == nil && value > 0 {
+		r.V1Tags = value
+	}
+
+	return r, nil
+}
+
+// InitProxy enables the proxy mode when the [proxy] section of bucket.conf has the URL.
+func InitProxy() {
+	if parameters, err := beego.AppConfig.GetSection("proxy"); err == nil && len(parameters["url"]) > 0 {
+		if Upstream, err = NewRegistry(parameters); err != nil {
+			println(err.Error())
+			panic(err)
+		}
+	}
+}
+
+// Proxied returns whether the repositories of the namespace are pulled through the upstream registry, the namespaces
+// of local users and organizations are never proxied.
+func Proxied(namespace string) bool {
+	if Upstream == nil {
+		return false
+	}
+
+	if has, _, err := new(models.User).Has(namespace); err != nil || has == true {
+		return false
+	}
+
+	if has, _, err := new(models.Organization).Has(namespace); err != nil || has == true {
+		return false
+	}
+
+	return true
+}
+
+// Expired returns whether the tag fetched at the time in milliseconds should be fetched again.
+func (r *Registry) Expired(fetched int64) bool {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	return fetched == 0 || now-fetched >= int64(r.TagTTL/time.Millisecond)
+}
@@ -0,0 +1,444 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/utils"
+)
+
+const (
+	DEFAULT_TIMEOUT       = 30 // Seconds waiting for the response headers of the registry
+	DEFAULT_TOKEN_EXPIRES = 60 // Seconds of the tokens without "expires_in"
+
+	MANIFEST_LIMIT = 4 * 1024 * 1024
+
+	SCOPE_PULL = "pull"
+	SCOPE_PUSH = "pull,push"
+)
+
+// Media types of the manifests fetched from the registry.
+var accepts = []string{
+	models.MEDIATYPE_MANIFEST_LIST,
+	models.MEDIATYPE_OCI_INDEX,
+	models.MEDIATYPE_MANIFEST_V2,
+	models.MEDIATYPE_OCI_MANIFEST,
+	models.MEDIATYPE_MANIFEST_V1_SIGNED,
+	models.MEDIATYPE_MANIFEST_V1,
+}
+
+// Client is the client of another Docker Registry API V2, like Docker Hub or another Wharf. It signs in with the
+// bearer token from the realm of the challenge, or with the basic authorization when the registry doesn't use tokens.
+type Client struct {
+	URL       string
+	Username  string
+	Password  string
+	UserAgent string
+	Client    *http.Client
+
+	lock   sync.Mutex
+	tokens map[string]clientToken
+}
+
+type clientToken struct {
+	Authorization string
+	Expires       time.Time
+}
+
+// Body opens the request body again when the request is sent again after the authorization, the size is -1 when
+// it's unknown.
+type Body func() (io.ReadCloser, int64, error)
+
+// NewClient returns the client of the registry at the URL like "https://registry-1.docker.io", the timeout is the
+// seconds waiting for the response headers.
+func NewClient(address, username, password string, timeout int) (*Client, error) {
+	c := &Client{
+		URL:       strings.TrimRight(address, "/"),
+		Username:  username,
+		Password:  password,
+		UserAgent: "Wharf",
+		tokens:    map[string]clientToken{},
+	}
+
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("Registry URL is invalid: %s", address)
+	}
+
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+
+	//Blobs are streamed for long, only the response headers have a timeout
+	c.Client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, ResponseHeaderTimeout: time.Duration(timeout) * time.Second}}
+
+	return c, nil
+}
+
+// Manifest returns the manifest of the tag or the digest and the media type of the response.
+func (c *Client) Manifest(namespace, repository, reference string) ([]byte, string, error) {
+	header := http.Header{}
+	header.Set("Accept", strings.Join(accepts, ", "))
+
+	resp, err := c.Do("GET", fmt.Sprintf("/v2/%s/%s/manifests/%s", namespace, repository, reference), c.scope(namespace, repository, SCOPE_PULL), header, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("Registry manifest %s/%s:%s response status: %d", namespace, repository, reference, resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MANIFEST_LIMIT))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0]), nil
+}
+
+// ManifestDigest returns the digest of the manifest with HEAD, registries don't count it as a pull. The digest is
+// empty when the manifest doesn't exist.
+func (c *Client) ManifestDigest(namespace, repository, reference string) (string, error) {
+	header := http.Header{}
+	header.Set("Accept", strings.Join(accepts, ", "))
+
+	resp, err := c.Do("HEAD", fmt.Sprintf("/v2/%s/%s/manifests/%s", namespace, repository, reference), c.scope(namespace, repository, SCOPE_PULL), header, nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get("Docker-Content-Digest"), nil
+	case http.StatusNotFound:
+		return "", nil
+	}
+
+	return "", fmt.Errorf("Registry manifest %s/%s:%s response status: %d", namespace, repository, reference, resp.StatusCode)
+}
+
+// PutManifest pushes the manifest with the tag or the digest, the blobs and the manifests it references must be
+// pushed before.
+func (c *Client) PutManifest(namespace, repository, reference, mediaType string, data []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", mediaType)
+
+	body := func() (io.ReadCloser, int64, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+	}
+
+	resp, err := c.Do("PUT", fmt.Sprintf("/v2/%s/%s/manifests/%s", namespace, repository, reference), c.scope(namespace, repository, SCOPE_PUSH), header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Registry put manifest %s/%s:%s response status: %d", namespace, repository, reference, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Blob returns the reader of the blob and the size, the size is -1 when it's unknown. The reader must be closed.
+func (c *Client) Blob(namespace, repository, digest string) (io.ReadCloser, int64, error) {
+	resp, err := c.Do("GET", fmt.Sprintf("/v2/%s/%s/blobs/%s", namespace, repository, digest), c.scope(namespace, repository, SCOPE_PULL), nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("Registry blob %s response status: %d", digest, resp.StatusCode)
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// StatBlob returns the size of the blob, the size is -1 when it's unknown.
+func (c *Client) StatBlob(namespace, repository, digest string) (int64, error) {
+	resp, err := c.Do("HEAD", fmt.Sprintf("/v2/%s/%s/blobs/%s", namespace, repository, digest), c.scope(namespace, repository, SCOPE_PULL), nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Registry blob %s response status: %d", digest, resp.StatusCode)
+	}
+
+	return resp.ContentLength, nil
+}
+
+// PutBlob uploads the blob in one request, check the registry doesn't have it with StatBlob before.
+func (c *Client) PutBlob(namespace, repository, digest string, body Body) error {
+	scope := c.scope(namespace, repository, SCOPE_PUSH)
+
+	resp, err := c.Do("POST", fmt.Sprintf("/v2/%s/%s/blobs/uploads/", namespace, repository), scope, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("Registry start upload %s response status: %d", digest, resp.StatusCode)
+	}
+
+	//The upload location is used with the URL of the client, registries behind proxies may not know their address
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || len(location.Path) == 0 {
+		return fmt.Errorf("Registry upload location is invalid: %s", resp.Header.Get("Location"))
+	}
+
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+
+	resp, err = c.Do("PUT", location.RequestURI(), scope, header, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("Registry upload %s response status: %d", digest, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Tags returns all tags of the repository, the pages in the "Link" header are followed.
+func (c *Client) Tags(namespace, repository string) ([]string, error) {
+	tags := []string{}
+	path := fmt.Sprintf("/v2/%s/%s/tags/list", namespace, repository)
+
+	for len(path) > 0 {
+		resp, err := c.Do("GET", path, c.scope(namespace, repository, SCOPE_PULL), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Registry tags %s/%s response status: %d", namespace, repository, resp.StatusCode)
+		}
+
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, list.Tags...)
+		path = nextLink(resp.Header.Get("Link"))
+	}
+
+	return tags, nil
+}
+
+// Do sends the request with the authorization of the scope, the authorization is got again from the challenge when
+// the registry rejects it. The body may be nil.
+func (c *Client) Do(method, path, scope string, header http.Header, body Body) (*http.Response, error) {
+	resp, err := c.request(method, path, header, body, c.authorization(scope))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	authorization, err := c.authorize(challenge, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.request(method, path, header, body, authorization)
+}
+
+func (c *Client) scope(namespace, repository, actions string) string {
+	return fmt.Sprintf("repository:%s/%s:%s", namespace, repository, actions)
+}
+
+func (c *Client) request(method, path string, header http.Header, body Body, authorization string) (*http.Response, error) {
+	//Paths of the "Link" header may be absolute URLs
+	address := path
+	if strings.HasPrefix(path, "/") == true {
+		address = c.URL + path
+	}
+
+	req, err := http.NewRequest(method, address, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		reader, size, err := body()
+		if err != nil {
+			return nil, err
+		}
+
+		if size == 0 {
+			reader.Close()
+		} else {
+			req.Body, req.ContentLength = reader, size
+		}
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	if len(authorization) > 0 {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	return c.Client.Do(req)
+}
+
+// authorization returns the cached authorization of the scope, or the basic authorization of the credentials which
+// registries without tokens accept.
+func (c *Client) authorization(scope string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if token, exist := c.tokens[scope]; exist == true && time.Now().Before(token.Expires) == true {
+		return token.Authorization
+	}
+
+	if len(c.Username) > 0 {
+		return fmt.Sprintf("Basic %s", utils.EncodeBasicAuth(c.Username, c.Password))
+	}
+
+	return ""
+}
+
+// authorize gets the authorization from the "WWW-Authenticate" challenge and caches it for the scope.
+func (c *Client) authorize(challenge, scope string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if len(c.Username) == 0 {
+			return "", fmt.Errorf("Registry needs the username and password")
+		}
+
+		return fmt.Sprintf("Basic %s", utils.EncodeBasicAuth(c.Username, c.Password)), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("Registry challenge is invalid: %s", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || len(realm.Host) == 0 {
+		return "", fmt.Errorf("Registry token realm is invalid: %s", params["realm"])
+	}
+
+	query := realm.Query()
+	query.Set("scope", scope)
+	if len(params["service"]) > 0 {
+		query.Set("service", params["service"])
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	if len(c.Username) > 0 {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Registry token response status: %d", resp.StatusCode)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	if len(token.Token) == 0 {
+		token.Token = token.AccessToken
+	}
+
+	if len(token.Token) == 0 {
+		return "", fmt.Errorf("Registry token is empty")
+	}
+
+	if token.ExpiresIn <= 0 {
+		token.ExpiresIn = DEFAULT_TOKEN_EXPIRES
+	}
+
+	authorization := fmt.Sprintf("Bearer %s", token.Token)
+
+	//Tokens are renewed a little before they expire
+	c.lock.Lock()
+	c.tokens[scope] = clientToken{Authorization: authorization, Expires: time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - 5*time.Second)}
+	c.lock.Unlock()
+
+	return authorization, nil
+}
+
+// parseChallenge parses the "WWW-Authenticate" header like `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) == 2 {
+		for _, match := range regexp.MustCompile(`(\w+)="([^"]*)"`).FindAllStringSubmatch(parts[1], -1) {
+			params[strings.ToLower(match[1])] = match[2]
+		}
+	}
+
+	return parts[0], params
+}
+
+// nextLink returns the URL of `<url>; rel="next"` in the "Link" header, it's empty on the last page.
+func nextLink(link string) string {
+	if strings.Contains(link, `rel="next"`) == false {
+		return ""
+	}
+
+	start, end := strings.Index(link, "<"), strings.Index(link, ">")
+	if start < 0 || end <= start {
+		return ""
+	}
+
+	return link[start+1 : end]
+}
@@ -0,0 +1,525 @@
+package replication
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+
+	"github.com/containerops/wharf/backend"
+	"github.com/containerops/wharf/models"
+	"github.com/containerops/wharf/registry"
+)
+
+const (
+	DEFAULT_ATTEMPTS      = 5
+	DEFAULT_BACKOFF       = 30   // Seconds before the first retry, doubled after each attempt
+	DEFAULT_MAX_BACKOFF   = 3600 // Seconds
+	DEFAULT_TIMEOUT       = 300  // Seconds of a request to the target registry, blobs are uploaded in one request
+	DEFAULT_SYNC_INTERVAL = 3600 // Seconds between the full syncs of a replication
+
+	DISPATCH_BATCH = 10
+)
+
+var (
+	Attempts     = int64(DEFAULT_ATTEMPTS)
+	Backoff      = DEFAULT_BACKOFF * time.Second
+	MaxBackoff   = DEFAULT_MAX_BACKOFF * time.Second
+	Timeout      = DEFAULT_TIMEOUT
+	SyncInterval = DEFAULT_SYNC_INTERVAL * time.Second
+
+	once    sync.Once
+	lock    sync.Mutex
+	syncing = map[string]bool{}
+)
+
+// InitReplication reads the [replication] section of bucket.conf: Attempts, Backoff, MaxBackoff, Timeout and
+// SyncInterval (seconds, 0 disables the periodic full sync), then starts copying the queue in the background.
+func InitReplication() {
+	if value, err := beego.AppConfig.Int64("replication::Attempts"); err == nil && value > 0 {
+		Attempts = value
+	}
+
+	if value, err := beego.AppConfig.Int("replication::Backoff"); err == nil && value > 0 {
+		Backoff = time.Duration(value) * time.Second
+	}
+
+	if value, err := beego.AppConfig.Int("replication::MaxBackoff"); err == nil && value > 0 {
+		MaxBackoff = time.Duration(value) * time.Second
+	}
+
+	if value, err := beego.AppConfig.Int("replication::Timeout"); err == nil && value > 0 {
+		Timeout = value
+	}
+
+	if value, err := beego.AppConfig.Int("replication::SyncInterval"); err == nil && value >= 0 {
+		SyncInterval = time.Duration(value) * time.Second
+	}
+
+	once.Do(func() {
+		go Run(time.Second)
+		go Reconcile(time.Minute)
+	})
+}
+
+// Replicate enqueues the tag of the repository to the active replications of the namespace which want it.
+func Replicate(namespace, repository, tag string) error {
+	for _, r := range new(models.Replication).Matched(namespace, repository, tag) {
+		if _, err := r.Enqueue(models.REPLICATION_TRIGGER_PUSH, repository, tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReplicateRepository enqueues all tags of the repository, Docker Registry API V1 pushes the tags before the images.
+func ReplicateRepository(namespace, repository string) error {
+	repo := new(models.Repository)
+	if has, _, err := repo.Has(namespace, repository); err != nil || has == false {
+		return err
+	}
+
+	for _, id := range repo.Tags {
+		t := new(models.Tag)
+		if err := t.GetById(id); err != nil || len(t.Name) == 0 {
+			continue
+		}
+
+		if err := Replicate(namespace, repository, t.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run copies the queue at the interval, the jobs pending before a restart are copied too.
+func Run(interval time.Duration) {
+	for {
+		Dispatch()
+		time.Sleep(interval)
+	}
+}
+
+// Dispatch attempts the due jobs and returns how many were attempted.
+func Dispatch() int {
+	ids, err := models.DueReplicationJobs(time.Now().UnixNano()/int64(time.Millisecond), DISPATCH_BATCH)
+	if err != nil {
+		beego.Error(fmt.Sprintf("[replication] read queue error: %s", err.Error()))
+		return 0
+	}
+
+	count := 0
+
+	for _, id := range ids {
+		if claimed, err := models.ClaimReplicationJob(id); err != nil || claimed == false {
+			continue
+		}
+
+		job := new(models.ReplicationJob)
+		if err := job.Get(id); err != nil || len(job.Id) == 0 {
+			continue
+		}
+
+		//The jobs of removed replications are dropped
+		r := new(models.Replication)
+		if err := r.GetById(job.Replication); err != nil || len(r.Id) == 0 {
+			continue
+		}
+
+		Execute(r, job)
+		count++
+	}
+
+	return count
+}
+
+// Execute copies the tag of the job once, and schedules the retry with exponential backoff when it fails.
+func Execute(r *models.Replication, job *models.ReplicationJob) error {
+	start := time.Now()
+
+	job.Attempts++
+	job.Status, job.Blobs, job.Error = models.REPLICATION_STATUS_RUNNING, 0, ""
+	job.Updated = start.UnixNano() / int64(time.Millisecond)
+
+	if err := job.Save(); err != nil {
+		return err
+	}
+
+	client, err := NewClient(r)
+	if err == nil {
+		job.Digest, job.Blobs, err = Copy(client, job.Namespace, job.Repository, job.Tag)
+	}
+
+	now := time.Now()
+	job.Duration = int64(now.Sub(start) / time.Millisecond)
+	job.Updated = now.UnixNano() / int64(time.Millisecond)
+
+	if err == nil {
+		job.Status = models.REPLICATION_STATUS_SUCCEEDED
+		return job.Save()
+	}
+
+	job.Error = err.Error()
+
+	if job.Attempts >= Attempts {
+		job.Status = models.REPLICATION_STATUS_FAILED
+		return job.Save()
+	}
+
+	return job.Schedule(job.Updated + int64(RetryAfter(job.Attempts)/time.Millisecond))
+}
+
+// RetryAfter returns the backoff after the attempts, it's doubled after each attempt up to MaxBackoff.
+func RetryAfter(attempts int64) time.Duration {
+	backoff := Backoff
+
+	for i := int64(1); i < attempts && backoff < MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > MaxBackoff {
+		backoff = MaxBackoff
+	}
+
+	return backoff
+}
+
+// NewClient returns the client of the target registry of the replication.
+func NewClient(r *models.Replication) (*registry.Client, error) {
+	client, err := registry.NewClient(r.Endpoint, r.Username, r.Password, Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	client.UserAgent = "Wharf-Replication"
+
+	return client, nil
+}
+
+// Reconcile starts the full sync of the active replications when the SyncInterval passed since the last one.
+func Reconcile(interval time.Duration) {
+	for {
+		if SyncInterval > 0 {
+			now := time.Now().UnixNano() / int64(time.Millisecond)
+
+			for _, r := range new(models.Replication).All("") {
+				if r.Active == true && now-r.Synced >= int64(SyncInterval/time.Millisecond) {
+					if _, err := Sync(r); err != nil {
+						beego.Error(fmt.Sprintf("[replication] sync %s error: %s", r.Id, err.Error()))
+					}
+				}
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// Sync compares the tags the replication wants with the target registry, and enqueues the tags missed or changed in
+// the target. It returns how many tags were enqueued, and does nothing when the replication is syncing already.
+func Sync(r *models.Replication) (int, error) {
+	lock.Lock()
+	if syncing[r.Id] == true {
+		lock.Unlock()
+		return 0, nil
+	}
+	syncing[r.Id] = true
+	lock.Unlock()
+
+	defer func() {
+		lock.Lock()
+		delete(syncing, r.Id)
+		lock.Unlock()
+	}()
+
+	if err := r.MarkSynced(time.Now().UnixNano() / int64(time.Millisecond)); err != nil {
+		return 0, err
+	}
+
+	client, err := NewClient(r)
+	if err != nil {
+		return 0, err
+	}
+
+	names, err := new(models.Repository).All()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for _, name := range names {
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) != 2 || parts[0] != r.Namespace {
+			continue
+		}
+
+		repo := new(models.Repository)
+		if has, _, err := repo.Has(r.Namespace, parts[1]); err != nil || has == false {
+			continue
+		}
+
+		for _, id := range repo.Tags {
+			t := new(models.Tag)
+			if err := t.GetById(id); err != nil || len(t.Name) == 0 || r.Wants(parts[1], t.Name) == false {
+				continue
+			}
+
+			if r.Pending(parts[1], t.Name) == true {
+				continue
+			}
+
+			//The manifests of the tags pushed with Docker Registry API V1 are built by the job
+			if len(t.Digest) > 0 {
+				if digest, err := client.ManifestDigest(r.Namespace, parts[1], t.Name); err == nil && digest == t.Digest {
+					continue
+				}
+			}
+
+			if _, err := r.Enqueue(models.REPLICATION_TRIGGER_SYNC, parts[1], t.Name); err != nil {
+				return count, err
+			}
+
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// Copy pushes the manifest of the tag with the manifests and the blobs it references to the target registry, blobs the
+// target has already aren't uploaded. It returns the digest of the manifest and how many blobs were uploaded.
+func Copy(client *registry.Client, namespace, repository, tag string) (string, int64, error) {
+	t := new(models.Tag)
+	if has, _, err := t.Has(namespace, repository, tag); err != nil {
+		return "", 0, err
+	} else if has == false {
+		return "", 0, fmt.Errorf("Tag %s/%s:%s not exist", namespace, repository, tag)
+	}
+
+	manifest := new(models.Manifest)
+	paths := map[string]string{}
+
+	switch {
+	case len(t.Digest) > 0:
+		if has, _, err := manifest.Has(namespace, repository, t.Digest); err != nil {
+			return "", 0, err
+		} else if has == false {
+			return "", 0, fmt.Errorf("Manifest %s/%s@%s not exist", namespace, repository, t.Digest)
+		}
+	case len(t.Manifest) > 0:
+		manifest.MediaType, manifest.Data = models.ManifestMediaType([]byte(t.Manifest)), t.Manifest
+	default:
+		data, layers, err := manifestV1(namespace, repository, tag, t.ImageId)
+		if err != nil {
+			return "", 0, err
+		}
+
+		manifest.MediaType, manifest.Data, paths = models.MEDIATYPE_MANIFEST_V1, string(data), layers
+	}
+
+	digest := models.ManifestDigest([]byte(manifest.Data))
+
+	if current, err := client.ManifestDigest(namespace, repository, tag); err == nil && current == digest {
+		return digest, 0, nil
+	}
+
+	blobs, err := push(client, namespace, repository, manifest, paths)
+	if err != nil {
+		return digest, blobs, err
+	}
+
+	if err := client.PutManifest(namespace, repository, tag, manifest.MediaType, []byte(manifest.Data)); err != nil {
+		return digest, blobs, err
+	}
+
+	return digest, blobs, nil
+}
+
+// push uploads the blobs of the manifest and pushes the manifests of a manifest list by digest.
+func push(client *registry.Client, namespace, repository string, manifest *models.Manifest, paths map[string]string) (int64, error) {
+	count := int64(0)
+
+	references, err := manifest.References()
+	if err != nil {
+		return count, err
+	}
+
+	for _, descriptor := range references {
+		child := new(models.Manifest)
+		if has, _, err := child.Has(namespace, repository, descriptor.Digest); err != nil {
+			return count, err
+		} else if has == false {
+			return count, fmt.Errorf("Manifest %s/%s@%s not exist", namespace, repository, descriptor.Digest)
+		}
+
+		n, err := push(client, namespace, repository, child, paths)
+		count += n
+		if err != nil {
+			return count, err
+		}
+
+		if err := client.PutManifest(namespace, repository, child.Digest, child.MediaType, []byte(child.Data)); err != nil {
+			return count, err
+		}
+	}
+
+	blobs, err := manifest.Blobs()
+	if err != nil {
+		return count, err
+	}
+
+	uploaded := map[string]bool{}
+
+	for _, digest := range blobs {
+		if uploaded[digest] == true {
+			continue
+		}
+
+		if _, err := client.StatBlob(namespace, repository, digest); err == nil {
+			continue
+		}
+
+		path, ok := paths[digest]
+		if ok == false {
+			path = blobPath(digest)
+		}
+
+		body := func() (io.ReadCloser, int64, error) {
+			info, err := backend.Storage.Stat(path)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			reader, err := backend.Storage.Reader(path, 0)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			return reader, info.Size, nil
+		}
+
+		if err := client.PutBlob(namespace, repository, digest, body); err != nil {
+			return count, err
+		}
+
+		uploaded[digest] = true
+		count++
+	}
+
+	return count, nil
+}
+
+// blobPath returns the path of the blob in the storage like serving it, layers of the V1 images converted from schema1
+// manifests are found by the tarsum index.
+func blobPath(digest string) string {
+	hex := strings.TrimPrefix(digest, "sha256:")
+
+	image := new(models.Image)
+	if has, _, _ := image.HasTarsum(hex); has == true && len(image.Path) > 0 {
+		return image.Path
+	}
+
+	return fmt.Sprintf("uuid/%v/layer", hex)
+}
+
+// manifestV1 builds an unsigned schema1 manifest of the tag pushed with Docker Registry API V1, the layers are hashed
+// to get the blobSums. It returns the manifest and the paths of the layers by the blobSums.
+func manifestV1(namespace, repository, tag, imageId string) ([]byte, map[string]string, error) {
+	top := new(models.Image)
+	if has, _, err := top.Has(imageId); err != nil {
+		return nil, nil, err
+	} else if has == false {
+		return nil, nil, fmt.Errorf("Image %s not exist", imageId)
+	}
+
+	var ancestry []string
+	if err := json.Unmarshal([]byte(top.Ancestry), &ancestry); err != nil || len(ancestry) == 0 {
+		return nil, nil, fmt.Errorf("Image %s ancestry is invalid", imageId)
+	}
+
+	var config struct {
+		Architecture string `json:"architecture"`
+	}
+
+	json.Unmarshal([]byte(top.JSON), &config)
+
+	if len(config.Architecture) == 0 {
+		config.Architecture = "amd64"
+	}
+
+	type fsLayer struct {
+		BlobSum string `json:"blobSum"`
+	}
+
+	type history struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	}
+
+	manifest := struct {
+		SchemaVersion int       `json:"schemaVersion"`
+		Name          string    `json:"name"`
+		Tag           string    `json:"tag"`
+		Architecture  string    `json:"architecture"`
+		FSLayers      []fsLayer `json:"fsLayers"`
+		History       []history `json:"history"`
+	}{
+		SchemaVersion: 1,
+		Name:          fmt.Sprintf("%s/%s", namespace, repository),
+		Tag:           tag,
+		Architecture:  config.Architecture,
+		FSLayers:      []fsLayer{},
+		History:       []history{},
+	}
+
+	paths := map[string]string{}
+
+	//The ancestry starts with the image itself like the history of schema1
+	for _, id := range ancestry {
+		image := new(models.Image)
+		if has, _, err := image.Has(id); err != nil {
+			return nil, nil, err
+		} else if has == false || len(image.Path) == 0 {
+			return nil, nil, fmt.Errorf("Image %s layer not exist", id)
+		}
+
+		digest, err := layerDigest(image.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		paths[digest] = image.Path
+
+		manifest.FSLayers = append(manifest.FSLayers, fsLayer{BlobSum: digest})
+		manifest.History = append(manifest.History, history{V1Compatibility: image.JSON})
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "   ")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, paths, nil
+}
+
+func layerDigest(path string) (string, error) {
+	reader, err := backend.Storage.Reader(path, 0)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
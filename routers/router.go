@@ -11,6 +11,8 @@ func init() {
 	//Web Interface
 	beego.Router("/", &controllers.WebController{}, "get:GetIndex")
 	beego.Router("/auth", &controllers.WebController{}, "get:GetAuth")
+	beego.Router("/auth/oidc", &controllers.WebController{}, "get:GetOIDC")
+	beego.Router("/auth/oidc/callback", &controllers.WebController{}, "get:GetOIDCCallback")
 	beego.Router("/setting", &controllers.WebController{}, "get:GetSetting")
 	beego.Router("/dashboard", &controllers.WebController{}, "get:GetDashboard")
 	beego.Router("/signout", &controllers.WebController{}, "get:GetSignout")
@@ -18,7 +20,7 @@ func init() {
 	beego.Router("/admin", &controllers.WebController{}, "get:GetAdmin")
 
 	beego.Router("/c/:namespace/:compose", &controllers.WebController{}, "get:GetCompose")
-	beego.Router("/r/:namespace/:repository", &controllers.WebController{}, "get:GetRepository")
+	beego.Router("/r/:namespace/*", &controllers.WebController{}, "get:GetRepository")
 	beego.Router("/o/:org", &controllers.WebController{}, "get:GetOrganization")
 	beego.Router("/u/:username", &controllers.WebController{}, "get:GetUser")
 
@@ -30,6 +32,7 @@ func init() {
 		//user routers
 		beego.NSNamespace("/user",
 			beego.NSRouter("/signin", &controllers.UserWebAPIV1Controller{}, "post:Signin"),
+			beego.NSRouter("/signin/totp", &controllers.UserWebAPIV1Controller{}, "post:SigninTOTP"),
 			beego.NSRouter("/signup", &controllers.UserWebAPIV1Controller{}, "post:Signup"),
 			beego.NSRouter("/users", &controllers.UserWebAPIV1Controller{}, "get:GetUsers"),
 			beego.NSRouter("/:username", &controllers.UserWebAPIV1Controller{}, "get:GetUser"),
@@ -37,17 +40,35 @@ func init() {
 			beego.NSRouter("/:username/gravatar", &controllers.UserWebAPIV1Controller{}, "post:PostGravatar"),
 			beego.NSRouter("/:username/password", &controllers.UserWebAPIV1Controller{}, "put:PutPassword"),
 			beego.NSRouter("/:username/profile", &controllers.UserWebAPIV1Controller{}, "put:PutProfile"),
+			beego.NSRouter("/:username/tokens", &controllers.UserWebAPIV1Controller{}, "get:GetTokens"),
+			beego.NSRouter("/:username/tokens", &controllers.UserWebAPIV1Controller{}, "post:PostToken"),
+			beego.NSRouter("/:username/tokens/:token", &controllers.UserWebAPIV1Controller{}, "delete:DeleteToken"),
+			beego.NSRouter("/:username/totp", &controllers.UserWebAPIV1Controller{}, "get:GetTOTP"),
+			beego.NSRouter("/:username/totp/secret", &controllers.UserWebAPIV1Controller{}, "post:PostTOTP"),
+			beego.NSRouter("/:username/totp", &controllers.UserWebAPIV1Controller{}, "put:PutTOTP"),
+			beego.NSRouter("/:username/totp", &controllers.UserWebAPIV1Controller{}, "delete:DeleteTOTP"),
+			beego.NSRouter("/:username/totp/recovery", &controllers.UserWebAPIV1Controller{}, "post:PostRecoveryCodes"),
 		),
 
-		//repository routers
+		//repository routers, the splat is the repository name which could be nested
 		beego.NSNamespace("/repository",
 			beego.NSRouter("/:namespace/repositories", &controllers.RepoWebAPIV1Controller{}, "get:GetRepositories"),
-			beego.NSRouter("/:namespace/:repository", &controllers.RepoWebAPIV1Controller{}, "post:PostRepository"),
-			beego.NSRouter("/:namespace/:repository", &controllers.RepoWebAPIV1Controller{}, "put:PutRepository"),
-			beego.NSRouter("/:namespace/:repository", &controllers.RepoWebAPIV1Controller{}, "get:GetRepository"),
-			beego.NSRouter("/:namespace/:repository/collaborators", &controllers.RepoWebAPIV1Controller{}, "get:GetCollaborators"),
-			beego.NSRouter("/:namespace/:repository/collaborators/:collaborator", &controllers.RepoWebAPIV1Controller{}, "post:PostCollaborator"),
-			beego.NSRouter("/:namespace/:repository/collaborators/:collaborator", &controllers.RepoWebAPIV1Controller{}, "put:PutCollaborator"),
+			beego.NSRouter("/:namespace/*", &controllers.RepoWebAPIV1Controller{}, "post:PostRepository"),
+			beego.NSRouter("/:namespace/*", &controllers.RepoWebAPIV1Controller{}, "put:PutRepository"),
+			beego.NSRouter("/:namespace/*", &controllers.RepoWebAPIV1Controller{}, "get:GetRepository"),
+			beego.NSRouter("/:namespace/*/collaborators", &controllers.RepoWebAPIV1Controller{}, "get:GetCollaborators"),
+			beego.NSRouter("/:namespace/*/collaborators/:collaborator", &controllers.RepoWebAPIV1Controller{}, "post:PostCollaborator"),
+			beego.NSRouter("/:namespace/*/collaborators/:collaborator", &controllers.RepoWebAPIV1Controller{}, "put:PutCollaborator"),
+			beego.NSRouter("/:namespace/*/builds", &controllers.RepoWebAPIV1Controller{}, "get:GetBuilds"),
+			beego.NSRouter("/:namespace/*/buildrules", &controllers.RepoWebAPIV1Controller{}, "get:GetBuildRules"),
+			beego.NSRouter("/:namespace/*/buildrules", &controllers.RepoWebAPIV1Controller{}, "post:PostBuildRule"),
+			beego.NSRouter("/:namespace/*/buildrules/:buildrule", &controllers.RepoWebAPIV1Controller{}, "put:PutBuildRule"),
+			beego.NSRouter("/:namespace/*/buildrules/:buildrule", &controllers.RepoWebAPIV1Controller{}, "delete:DeleteBuildRule"),
+			beego.NSRouter("/:namespace/*/webhooks", &controllers.RepoWebAPIV1Controller{}, "get:GetWebhooks"),
+			beego.NSRouter("/:namespace/*/webhooks", &controllers.RepoWebAPIV1Controller{}, "post:PostWebhook"),
+			beego.NSRouter("/:namespace/*/webhooks/:webhook", &controllers.RepoWebAPIV1Controller{}, "put:PutWebhook"),
+			beego.NSRouter("/:namespace/*/webhooks/:webhook", &controllers.RepoWebAPIV1Controller{}, "delete:DeleteWebhook"),
+			beego.NSRouter("/:namespace/*/webhooks/:webhook/deliveries", &controllers.RepoWebAPIV1Controller{}, "get:GetDeliveries"),
 		),
 
 		//organization routers
@@ -61,6 +82,14 @@ func init() {
 			beego.NSRouter("/:org", &controllers.OrganizationWebV1Controller{}, "get:GetOrg"),
 			beego.NSRouter("/:org/repos/public", &controllers.OrganizationWebV1Controller{}, "get:GetPublicRepos"),
 			beego.NSRouter("/:org/repos/private", &controllers.OrganizationWebV1Controller{}, "get:GetPrivateRepos"),
+			beego.NSRouter("/:org/robots", &controllers.OrganizationWebV1Controller{}, "get:GetRobots"),
+			beego.NSRouter("/:org/robots", &controllers.OrganizationWebV1Controller{}, "post:PostRobot"),
+			beego.NSRouter("/:org/robots/:robot", &controllers.OrganizationWebV1Controller{}, "delete:DeleteRobot"),
+			beego.NSRouter("/:org/webhooks", &controllers.OrganizationWebV1Controller{}, "get:GetWebhooks"),
+			beego.NSRouter("/:org/webhooks", &controllers.OrganizationWebV1Controller{}, "post:PostWebhook"),
+			beego.NSRouter("/:org/webhooks/:webhook", &controllers.OrganizationWebV1Controller{}, "put:PutWebhook"),
+			beego.NSRouter("/:org/webhooks/:webhook", &controllers.OrganizationWebV1Controller{}, "delete:DeleteWebhook"),
+			beego.NSRouter("/:org/webhooks/:webhook/deliveries", &controllers.OrganizationWebV1Controller{}, "get:GetDeliveries"),
 			beego.NSRouter("/:org/teams", &controllers.TeamWebV1Controller{}, "get:GetOrgTeams"),
 			beego.NSRouter("/:username/:org/team", &controllers.TeamWebV1Controller{}, "post:PostTeam"),
 			beego.NSRouter("/:username/:org/team/:team", &controllers.TeamWebV1Controller{}, "put:PutTeam"),
@@ -68,23 +97,46 @@ func init() {
 			beego.NSRouter("/:username/:org/team/:team/:member", &controllers.TeamWebV1Controller{}, "post:PostMember"),
 			beego.NSRouter("/:username/:org/team/:team/:member", &controllers.TeamWebV1Controller{}, "put:PutMember"),
 		),
+
+		//compose routers, composes are managed by the user or the owner of the organization
+		beego.NSNamespace("/compose",
+			beego.NSRouter("/:namespace", &controllers.ComposeWebV1Controller{}, "get:GetComposes"),
+			beego.NSRouter("/:namespace", &controllers.ComposeWebV1Controller{}, "post:PostCompose"),
+			beego.NSRouter("/:namespace/:compose", &controllers.ComposeWebV1Controller{}, "get:GetCompose"),
+			beego.NSRouter("/:namespace/:compose", &controllers.ComposeWebV1Controller{}, "put:PutCompose"),
+			beego.NSRouter("/:namespace/:compose", &controllers.ComposeWebV1Controller{}, "delete:DeleteCompose"),
+			beego.NSRouter("/:namespace/:compose/tags/:tag", &controllers.ComposeWebV1Controller{}, "get:GetTag"),
+			beego.NSRouter("/:namespace/:compose/tags/:tag", &controllers.ComposeWebV1Controller{}, "put:PutTag"),
+		),
+
+		//replication routers, the namespace is the user or an organization the user owns
+		beego.NSNamespace("/replication",
+			beego.NSRouter("/:namespace", &controllers.ReplicationWebV1Controller{}, "get:GetReplications"),
+			beego.NSRouter("/:namespace", &controllers.ReplicationWebV1Controller{}, "post:PostReplication"),
+			beego.NSRouter("/:namespace/:replication", &controllers.ReplicationWebV1Controller{}, "put:PutReplication"),
+			beego.NSRouter("/:namespace/:replication", &controllers.ReplicationWebV1Controller{}, "delete:DeleteReplication"),
+			beego.NSRouter("/:namespace/:replication/jobs", &controllers.ReplicationWebV1Controller{}, "get:GetJobs"),
+			beego.NSRouter("/:namespace/:replication/sync", &controllers.ReplicationWebV1Controller{}, "post:PostSync"),
+		),
 	)
 
 	//Docker Registry API V1 remain
 	beego.Router("/_ping", &controllers.PingAPIV1Controller{}, "get:GetPing")
 
-	//Docker Registry API V1
+	//Docker Registry API V1, the splat is the repository name which could be nested
 	apiv1 := beego.NewNamespace("/v1",
 		beego.NSRouter("/_ping", &controllers.PingAPIV1Controller{}, "get:GetPing"),
 		beego.NSRouter("/users", &controllers.UserAPIV1Controller{}, "get:GetUsers"),
 		beego.NSRouter("/users", &controllers.UserAPIV1Controller{}, "post:PostUsers"),
 
 		beego.NSNamespace("/repositories",
-			beego.NSRouter("/:namespace/:repo_name/tags/:tag", &controllers.RepoAPIV1Controller{}, "put:PutTag"),
-			beego.NSRouter("/:namespace/:repo_name/images", &controllers.RepoAPIV1Controller{}, "put:PutRepositoryImages"),
-			beego.NSRouter("/:namespace/:repo_name/images", &controllers.RepoAPIV1Controller{}, "get:GetRepositoryImages"),
-			beego.NSRouter("/:namespace/:repo_name/tags", &controllers.RepoAPIV1Controller{}, "get:GetRepositoryTags"),
-			beego.NSRouter("/:namespace/:repo_name", &controllers.RepoAPIV1Controller{}, "put:PutRepository"),
+			beego.NSRouter("/:namespace/*/tags/:tag", &controllers.RepoAPIV1Controller{}, "put:PutTag"),
+			beego.NSRouter("/:namespace/*/images", &controllers.RepoAPIV1Controller{}, "put:PutRepositoryImages"),
+			beego.NSRouter("/:namespace/*/images", &controllers.RepoAPIV1Controller{}, "get:GetRepositoryImages"),
+			beego.NSRouter("/:namespace/*/tags", &controllers.RepoAPIV1Controller{}, "get:GetRepositoryTags"),
+			beego.NSRouter("/:namespace/*", &controllers.RepoAPIV1Controller{}, "put:PutRepository"),
+			beego.NSRouter("/:namespace/*/tags/:tag", &controllers.RepoAPIV1Controller{}, "delete:DeleteTag"),
+			beego.NSRouter("/:namespace/*", &controllers.RepoAPIV1Controller{}, "delete:DeleteRepository"),
 		),
 
 		beego.NSNamespace("/images",
@@ -97,24 +149,37 @@ func init() {
 		),
 	)
 
-	//Docker Registry API V2
+	//Docker Registry API V2 token service
+	beego.Router("/auth/token", &controllers.TokenAPIV2Controller{}, "get:GetToken")
+
+	//Docker Registry API V2, the splat is the repository name under the namespace which could be nested like "team/service"
 	apiv2 := beego.NewNamespace("/v2",
 		beego.NSRouter("/", &controllers.PingAPIV2Controller{}, "get:GetPing"),
+		beego.NSRouter("/_catalog", &controllers.CatalogAPIV2Controller{}, "get:GetCatalog"),
 		//Push
-		beego.NSRouter("/:namespace/:repo_name/blobs/:digest", &controllers.BlobAPIV2Controller{}, "head:HeadDigest"),
-		beego.NSRouter("/:namespace/:repo_name/blobs/uploads", &controllers.BlobAPIV2Controller{}, "post:PostBlobs"),
-		beego.NSRouter("/:namespace/:repo_name/blobs/uploads/:uuid", &controllers.BlobAPIV2Controller{}, "put:PutBlobs"),
-		beego.NSRouter("/:namespace/:repo_name/manifests/:tag", &controllers.ManifestsAPIV2Controller{}, "put:PutManifests"),
+		beego.NSRouter("/:namespace/*/blobs/:digest", &controllers.BlobAPIV2Controller{}, "head:HeadDigest"),
+		beego.NSRouter("/:namespace/*/blobs/uploads", &controllers.BlobAPIV2Controller{}, "post:PostBlobs"),
+		beego.NSRouter("/:namespace/*/blobs/uploads/:uuid", &controllers.BlobAPIV2Controller{}, "patch:PatchBlobs"),
+		beego.NSRouter("/:namespace/*/blobs/uploads/:uuid", &controllers.BlobAPIV2Controller{}, "get:GetUploadStatus"),
+		beego.NSRouter("/:namespace/*/blobs/uploads/:uuid", &controllers.BlobAPIV2Controller{}, "delete:DeleteUpload"),
+		beego.NSRouter("/:namespace/*/blobs/uploads/:uuid", &controllers.BlobAPIV2Controller{}, "put:PutBlobs"),
+		beego.NSRouter("/:namespace/*/manifests/:tag", &controllers.ManifestsAPIV2Controller{}, "put:PutManifests"),
 		//Pull
-		beego.NSRouter("/:namespace/:repo_name/tags/list", &controllers.ManifestsAPIV2Controller{}, "get:GetTags"),
-		beego.NSRouter("/:namespace/:repo_name/manifests/:tag", &controllers.ManifestsAPIV2Controller{}, "get:GetManifests"),
-		beego.NSRouter("/:namespace/:repo_name/blobs/:digest", &controllers.BlobAPIV2Controller{}, "get:GetBlobs"),
+		beego.NSRouter("/:namespace/*/tags/list", &controllers.ManifestsAPIV2Controller{}, "get:GetTags"),
+		beego.NSRouter("/:namespace/*/manifests/:tag", &controllers.ManifestsAPIV2Controller{}, "get:GetManifests"),
+		beego.NSRouter("/:namespace/*/manifests/:tag", &controllers.ManifestsAPIV2Controller{}, "head:GetManifests"),
+		beego.NSRouter("/:namespace/*/blobs/:digest", &controllers.BlobAPIV2Controller{}, "get:GetBlobs"),
+		beego.NSRouter("/:namespace/*/referrers/:digest", &controllers.ManifestsAPIV2Controller{}, "get:GetReferrers"),
+		//Delete
+		beego.NSRouter("/:namespace/*/manifests/:tag", &controllers.ManifestsAPIV2Controller{}, "delete:DeleteManifests"),
+		beego.NSRouter("/:namespace/*/blobs/:digest", &controllers.BlobAPIV2Controller{}, "delete:DeleteBlobs"),
 	)
 
 	//Dockerfile Build API V1
 	buildv1 := beego.NewNamespace("/b1",
 		beego.NSRouter("/build", &controllers.BuilderAPIV1Controller{}, "post:PostBuild"),
 		beego.NSRouter("/status", &controllers.BuilderAPIV1Controller{}, "get:GetStatus"),
+		beego.NSRouter("/hooks/:provider", &controllers.BuilderAPIV1Controller{}, "post:PostHook"),
 	)
 
 	//Auth Fiters
@@ -125,7 +190,9 @@ func init() {
 
 	beego.InsertFilter("/v1/repositories/*", beego.BeforeRouter, filters.FilterAuth)
 	beego.InsertFilter("/v1/images/*", beego.BeforeRouter, filters.FilterAuth)
+	beego.InsertFilter("/v2/*", beego.BeforeRouter, filters.FilterName)
 	beego.InsertFilter("/v2/*", beego.BeforeRouter, filters.FilterAuth)
+	beego.InsertFilter("/w1/repository/*", beego.BeforeRouter, filters.FilterRepository)
 
 	beego.AddNamespace(web)
 	beego.AddNamespace(apiv1)
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	PASSWORD_HASH_ALGORITHM  = "pbkdf2_sha256"
+	PASSWORD_HASH_ITERATIONS = 100000
+	PASSWORD_SALT_LENGTH     = 16
+)
+
+// Hash the password with PBKDF2-HMAC-SHA256 and a random salt, like "pbkdf2_sha256$<iterations>$<salt>$<hash>".
+// The iterations saved in the hash make it adaptive, hashes with less iterations are upgraded on next sign in.
+func HashPassword(password string, iterations int) (string, error) {
+	if iterations <= 0 {
+		iterations = PASSWORD_HASH_ITERATIONS
+	}
+
+	salt := make([]byte, PASSWORD_SALT_LENGTH)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash := pbkdf2SHA256([]byte(password), salt, iterations, sha256.Size)
+
+	return fmt.Sprintf("%s$%d$%s$%s", PASSWORD_HASH_ALGORITHM, iterations, base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(hash)), nil
+}
+
+// Verify the password with the saved hash, the hash itself is never a valid password. It returns whether the hash
+// should be upgraded to the iterations.
+func VerifyPassword(password, hash string, iterations int) (bool, bool) {
+	if strings.HasPrefix(hash, PASSWORD_HASH_ALGORITHM+"$") == false {
+		return false, false
+	}
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 {
+		return false, false
+	}
+
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n <= 0 {
+		return false, false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, false
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false, false
+	}
+
+	if subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(password), salt, n, len(expected)), expected) != 1 {
+		return false, false
+	}
+
+	return true, n < iterations
+}
+
+// PBKDF2 of RFC 2898 with HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+
+	result := []byte{}
+	block := make([]byte, 4)
+
+	for i := uint32(1); len(result) < length; i++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(block, i)
+		prf.Write(block)
+
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		result = append(result, t...)
+	}
+
+	return result[:length]
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	//Known answers of RFC 7914 section 11 and the RFC 6070 inputs with HMAC-SHA256
+	tests := []struct {
+		password, salt string
+		iterations     int
+		expected       string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"pass\x00word", "sa\x00lt", 4096, "89b69d0516f829893c696226650a8687"},
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+
+	for _, test := range tests {
+		result := hex.EncodeToString(pbkdf2SHA256([]byte(test.password), []byte(test.salt), test.iterations, len(test.expected)/2))
+
+		if result != test.expected {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", test.password, test.salt, test.iterations, result, test.expected)
+		}
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	hash, err := HashPassword("Passw0rd", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, password, hash string
+		iterations           int
+		valid, upgrade       bool
+	}{
+		{"hash", "Passw0rd", hash, 1000, true, false},
+		{"weaker hash", "Passw0rd", hash, 2000, true, true},
+		{"wrong password", "passw0rd", hash, 1000, false, false},
+		{"hash as password", hash, hash, 1000, false, false},
+		{"plain password", "Passw0rd", "Passw0rd", 1000, false, false},
+		{"md5 password", "Passw0rd", EncodePassword("tester", "Passw0rd"), 1000, false, false},
+		{"malformed hash", "Passw0rd", "pbkdf2_sha256$1000$salt", 1000, false, false},
+		{"invalid iterations", "Passw0rd", "pbkdf2_sha256$0$c2FsdA==$aGFzaA==", 1000, false, false},
+	}
+
+	for _, test := range tests {
+		valid, upgrade := VerifyPassword(test.password, test.hash, test.iterations)
+
+		if valid != test.valid || upgrade != test.upgrade {
+			t.Errorf("%s: VerifyPassword = %v, %v, want %v, %v", test.name, valid, upgrade, test.valid, test.upgrade)
+		}
+	}
+}
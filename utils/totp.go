@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	TOTP_SECRET_LENGTH = 20
+	TOTP_DIGITS        = 6
+	TOTP_PERIOD        = 30
+	TOTP_SKEW          = 1
+)
+
+// Generate a random base32 secret of the RFC 6238 authenticator without the padding.
+func TOTPSecret() (string, error) {
+	random := make([]byte, TOTP_SECRET_LENGTH)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(random), "="), nil
+}
+
+// The otpauth URI of the secret, authenticator apps scan it from the QR code.
+func TOTPURI(issuer, account, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	query.Set("period", fmt.Sprint(TOTP_PERIOD))
+
+	label := url.QueryEscape(issuer + ":" + account)
+
+	return fmt.Sprintf("otpauth://totp/%s?%s", strings.Replace(label, "+", "%20", -1), query.Encode())
+}
+
+// The code of the secret at the time step counter.
+func TOTPCode(secret string, counter int64) (string, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	if mod := len(secret) % 8; mod != 0 {
+		secret += strings.Repeat("=", 8-mod)
+	}
+
+	key, err := base32.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%1000000), nil
+}
+
+// Verify the code in the time steps around now, it returns the counter of the matched step for the replay check.
+func VerifyTOTP(secret, code string, now time.Time) (bool, int64) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != TOTP_DIGITS {
+		return false, 0
+	}
+
+	current := now.Unix() / TOTP_PERIOD
+
+	for counter := current - TOTP_SKEW; counter <= current+TOTP_SKEW; counter++ {
+		expected, err := TOTPCode(secret, counter)
+		if err != nil {
+			return false, 0
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return true, counter
+		}
+	}
+
+	return false, 0
+}
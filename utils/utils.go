@@ -6,8 +6,10 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -140,6 +142,69 @@ func DecodeBasicAuth(authorization string) (username string, password string, er
 	return username, password, nil
 }
 
+//Only sha256 digest is supported, like "sha256:<64 hex characters>".
+func IsDigest(digest string) bool {
+	valid := regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+	return valid.MatchString(digest)
+}
+
+//Tag grammar of the distribution and OCI spec, like "latest" or "v1.0_rc-1".
+func IsTag(tag string) bool {
+	valid := regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+	return valid.MatchString(tag)
+}
+
+//Repository name grammar of the distribution and OCI spec, path components like "library/ubuntu" in 255 characters.
+func IsRepositoryName(name string) bool {
+	valid := regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*)*$`)
+
+	return len(name) <= 255 && valid.MatchString(name)
+}
+
+//Git URL cloned by the builder, only "http", "https", "ssh" and "git" URLs, and the host or the user can't be an
+//option of git or ssh like "-oProxyCommand=...".
+func IsGitURL(git string) bool {
+	if strings.HasPrefix(git, "-") == true {
+		return false
+	}
+
+	u, err := url.Parse(git)
+	if err != nil || len(u.Host) == 0 || strings.HasPrefix(u.Host, "-") == true {
+		return false
+	}
+
+	if u.User != nil && strings.HasPrefix(u.User.Username(), "-") == true {
+		return false
+	}
+
+	switch u.Scheme {
+	case "http", "https", "ssh", "git":
+		return true
+	}
+
+	return false
+}
+
+//Split the path of Registry API V2 like "library/ubuntu/manifests/latest" to the name and the resource,
+//the name is empty when the path isn't a repository resource.
+func SplitRepositoryPath(path string) (string, string) {
+	index := -1
+
+	for _, resource := range []string{"/blobs/", "/manifests/", "/tags/", "/referrers/"} {
+		if i := strings.LastIndex(path, resource); i > index {
+			index = i
+		}
+	}
+
+	if index <= 0 {
+		return "", path
+	}
+
+	return path[:index], path[index+1:]
+}
+
 func IsDirExists(path string) bool {
 	fi, err := os.Stat(path)
 
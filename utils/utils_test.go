@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestIsGitURL(t *testing.T) {
+	tests := []struct {
+		git   string
+		valid bool
+	}{
+		{"https://github.com/containerops/wharf.git", true},
+		{"http://git.example.com/wharf", true},
+		{"ssh://git@github.com/containerops/wharf.git", true},
+		{"git://github.com/containerops/wharf.git", true},
+		{"file:///etc", false},
+		{"ext::sh -c touch% /tmp/pwned", false},
+		{"/var/lib/wharf", false},
+		{"--upload-pack=touch /tmp/pwned", false},
+		{"-u", false},
+		{"ssh://-oProxyCommand=touch%20pwned/wharf", false},
+		{"ssh://-oProxyCommand=touch@github.com/wharf", false},
+		{"https:///wharf", false},
+	}
+
+	for _, test := range tests {
+		if valid := IsGitURL(test.git); valid != test.valid {
+			t.Errorf("IsGitURL(%q) = %v, want %v", test.git, valid, test.valid)
+		}
+	}
+}
@@ -0,0 +1,592 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseYAML parses the YAML document used by Docker Compose files, mappings are map[string]interface{}, sequences
+// are []interface{}, scalars are strings and nulls are nil. Block and one-line flow collections, quoted and block
+// scalars, anchors, aliases and "<<" merge keys are supported, tags and multiple documents aren't. Aliases share the
+// value of the anchor.
+func ParseYAML(data []byte) (interface{}, error) {
+	p := &yamlParser{lines: strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n"), anchors: map[string]interface{}{}}
+
+	//The document markers are skipped, another document after the marker isn't supported
+	if indent, text, ok := p.peek(); ok == true && indent == 0 && text == "---" {
+		p.i++
+	}
+
+	indent, _, ok := p.peek()
+	if ok == false {
+		return nil, nil
+	}
+
+	value, err := p.parseBlock(indent)
+	if err != nil {
+		return nil, err
+	} else if p.err != nil {
+		return nil, p.err
+	}
+
+	if _, text, ok := p.peek(); ok == true && text != "..." {
+		return nil, p.errorf("unexpected content %q", text)
+	}
+
+	return value, nil
+}
+
+type yamlParser struct {
+	lines   []string
+	i       int
+	err     error
+	anchors map[string]interface{} // Values of the anchors before the current line
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	return p.errorAt(p.i, format, args...)
+}
+
+func (p *yamlParser) errorAt(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("YAML line %d: %s", line+1, fmt.Sprintf(format, args...))
+}
+
+// peek returns the indent and the text without the comment of the next line which isn't blank or a comment, the
+// parsing stops at the tabs of the indentation.
+func (p *yamlParser) peek() (int, string, bool) {
+	for ; p.i < len(p.lines) && p.err == nil; p.i++ {
+		line := p.lines[p.i]
+
+		text := strings.TrimLeft(line, " ")
+		if strings.HasPrefix(text, "\t") == true && len(strings.TrimSpace(text)) > 0 {
+			p.err = p.errorf("tabs aren't allowed in indentation")
+			return 0, "", false
+		}
+
+		if text = stripYAMLComment(text); len(text) > 0 {
+			return len(line) - len(strings.TrimLeft(line, " ")), text, true
+		}
+	}
+
+	return 0, "", false
+}
+
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	n, text, ok := p.peek()
+	if ok == false {
+		return nil, nil
+	}
+
+	if n < indent {
+		return nil, nil
+	}
+
+	if text == "-" || strings.HasPrefix(text, "- ") == true {
+		return p.parseSequence(n)
+	}
+
+	if _, _, ok := yamlMappingKey(text); ok == true {
+		return p.parseMapping(n)
+	}
+
+	return p.parseValue(text, n-1)
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	result := []interface{}{}
+
+	for {
+		n, text, ok := p.peek()
+		if ok == false || n < indent {
+			return result, nil
+		}
+
+		if n > indent {
+			return nil, p.errorf("bad indentation of a sequence entry")
+		}
+
+		if text != "-" && strings.HasPrefix(text, "- ") == false {
+			//The sequence of a mapping value could be at the indent of the key
+			if _, _, ok := yamlMappingKey(text); ok == true {
+				return result, nil
+			}
+
+			return nil, p.errorf("expected a sequence entry")
+		}
+
+		rest := strings.TrimLeft(strings.TrimPrefix(text, "-"), " ")
+
+		anchor := ""
+		if strings.HasPrefix(rest, "&") == true {
+			anchor, rest = yamlAnchor(rest)
+		}
+
+		var value interface{}
+		var err error
+
+		if len(rest) == 0 {
+			p.i++
+
+			if next, _, ok := p.peek(); ok == true && next > indent {
+				value, err = p.parseBlock(next)
+			}
+		} else if _, _, ok := yamlMappingKey(rest); ok == true || rest == "-" || strings.HasPrefix(rest, "- ") == true {
+			//The entry is a nested block, the dash is replaced with spaces
+			inner := len(p.lines[p.i]) - len(strings.TrimLeft(p.lines[p.i], " ")) + len(text) - len(rest)
+			p.lines[p.i] = strings.Repeat(" ", inner) + rest
+
+			value, err = p.parseBlock(inner)
+		} else {
+			value, err = p.parseValue(rest, indent)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(anchor) > 0 {
+			p.anchors[anchor] = value
+		}
+
+		result = append(result, value)
+	}
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	result, merges := map[string]interface{}{}, []map[string]interface{}{}
+
+	for {
+		n, text, ok := p.peek()
+		if ok == false || n < indent {
+			return mergeYAML(result, merges), nil
+		}
+
+		if n > indent {
+			return nil, p.errorf("bad indentation of a mapping entry")
+		}
+
+		key, rest, ok := yamlMappingKey(text)
+		if ok == false {
+			//The sequence of a mapping value ends at the next key, a sequence entry ends the mapping of the entry
+			if text == "-" || strings.HasPrefix(text, "- ") == true {
+				return mergeYAML(result, merges), nil
+			}
+
+			return nil, p.errorf("expected a mapping entry")
+		}
+
+		if _, exist := result[key]; exist == true {
+			return nil, p.errorf("duplicated mapping key %q", key)
+		}
+
+		line, merge := p.i, key == "<<" && text[0] != '"' && text[0] != '\''
+
+		anchor := ""
+		if strings.HasPrefix(rest, "&") == true {
+			anchor, rest = yamlAnchor(rest)
+		}
+
+		var value interface{}
+		var err error
+
+		if len(rest) == 0 {
+			p.i++
+
+			if next, text, ok := p.peek(); ok == true && next > indent {
+				value, err = p.parseBlock(next)
+			} else if ok == true && next == indent && (text == "-" || strings.HasPrefix(text, "- ") == true) {
+				value, err = p.parseSequence(next)
+			}
+		} else {
+			value, err = p.parseValue(rest, indent)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(anchor) > 0 {
+			p.anchors[anchor] = value
+		}
+
+		if merge == false {
+			result[key] = value
+			continue
+		}
+
+		//The value of the merge key is a mapping or a sequence of mappings, the keys of the mapping are added
+		sources, ok := value.([]interface{})
+		if ok == false {
+			sources = []interface{}{value}
+		}
+
+		for _, source := range sources {
+			m, ok := source.(map[string]interface{})
+			if ok == false {
+				return nil, p.errorAt(line, "merge key value must be a mapping or a sequence of mappings")
+			}
+
+			merges = append(merges, m)
+		}
+	}
+}
+
+// mergeYAML adds the keys of the merged mappings missing in the mapping, the keys of the mapping have the precedence
+// and then the mappings merged first.
+func mergeYAML(result map[string]interface{}, merges []map[string]interface{}) map[string]interface{} {
+	for _, m := range merges {
+		for key, value := range m {
+			if _, exist := result[key]; exist == false {
+				result[key] = value
+			}
+		}
+	}
+
+	return result
+}
+
+// parseValue parses the value of the current line after a mapping key or a sequence entry, block scalars are in the
+// next lines indented more than the indent.
+func (p *yamlParser) parseValue(text string, indent int) (interface{}, error) {
+	switch text[0] {
+	case '|', '>':
+		return p.parseBlockScalar(text, indent)
+	case '[', '{':
+		value, rest, err := p.parseFlow(text)
+		if err != nil {
+			return nil, p.errorf("%s", err.Error())
+		}
+
+		if len(strings.TrimSpace(rest)) > 0 {
+			return nil, p.errorf("unexpected content %q", rest)
+		}
+
+		p.i++
+
+		return value, nil
+	}
+
+	value, err := p.parseScalar(text)
+	if err != nil {
+		return nil, err
+	}
+
+	p.i++
+
+	return value, nil
+}
+
+func (p *yamlParser) parseScalar(text string) (interface{}, error) {
+	switch text[0] {
+	case '*':
+		value, err := p.alias(text)
+		if err != nil {
+			return nil, p.errorf("%s", err.Error())
+		}
+
+		return value, nil
+	case '&':
+		return nil, p.errorf("anchors are only supported before mapping values and sequence entries")
+	case '!':
+		return nil, p.errorf("tags aren't supported")
+	case '"', '\'':
+		value, rest, err := parseYAMLQuoted(text)
+		if err != nil {
+			return nil, p.errorf("%s", err.Error())
+		}
+
+		if len(strings.TrimSpace(rest)) > 0 {
+			return nil, p.errorf("unexpected content %q", rest)
+		}
+
+		return value, nil
+	}
+
+	if text == "~" || text == "null" || text == "Null" || text == "NULL" {
+		return nil, nil
+	}
+
+	return text, nil
+}
+
+func (p *yamlParser) parseBlockScalar(header string, indent int) (interface{}, error) {
+	folded, chomp := header[0] == '>', ""
+
+	for _, c := range header[1:] {
+		switch {
+		case c == '-' || c == '+':
+			chomp = string(c)
+		case c >= '1' && c <= '9':
+		default:
+			return nil, p.errorf("invalid block scalar header %q", header)
+		}
+	}
+
+	lines, content := []string{}, -1
+
+	for p.i++; p.i < len(p.lines); p.i++ {
+		line := strings.TrimRight(p.lines[p.i], " ")
+		n := len(line) - len(strings.TrimLeft(line, " "))
+
+		if len(line) == 0 {
+			lines = append(lines, "")
+			continue
+		}
+
+		if n <= indent {
+			break
+		}
+
+		if content == -1 {
+			content = n
+		}
+
+		if n < content {
+			return nil, p.errorf("bad indentation of a block scalar")
+		}
+
+		lines = append(lines, line[content:])
+	}
+
+	//Trailing blank lines are kept only with the "+" chomping
+	trailing := 0
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines, trailing = lines[:len(lines)-1], trailing+1
+	}
+
+	value := strings.Join(lines, "\n")
+
+	if folded == true {
+		value = strings.Replace(strings.Replace(value, "\n\n", "\x00", -1), "\n", " ", -1)
+		value = strings.Replace(value, "\x00", "\n", -1)
+	}
+
+	switch {
+	case len(lines) == 0 || chomp == "-":
+	case chomp == "+":
+		value += strings.Repeat("\n", trailing+1)
+	default:
+		value += "\n"
+	}
+
+	return value, nil
+}
+
+// alias returns the value of the anchor named by the alias "*name".
+func (p *yamlParser) alias(text string) (interface{}, error) {
+	name := text[1:]
+	if len(name) == 0 || strings.ContainsAny(name, " ,[]{}") == true {
+		return nil, fmt.Errorf("invalid alias %q", text)
+	}
+
+	value, exist := p.anchors[name]
+	if exist == false {
+		return nil, fmt.Errorf("unknown alias %q", text)
+	}
+
+	return value, nil
+}
+
+// yamlAnchor splits the anchor "&name" at the beginning of the text to the name and the rest of the text.
+func yamlAnchor(text string) (string, string) {
+	i := strings.IndexByte(text, ' ')
+	if i == -1 {
+		return text[1:], ""
+	}
+
+	return text[1:i], strings.TrimLeft(text[i:], " ")
+}
+
+// yamlMappingKey splits the mapping entry in the line to the key and the value, it's false when the line isn't a
+// mapping entry.
+func yamlMappingKey(text string) (string, string, bool) {
+	if text[0] == '"' || text[0] == '\'' {
+		key, rest, err := parseYAMLQuoted(text)
+		if err != nil || (rest != ":" && strings.HasPrefix(rest, ": ") == false) {
+			return "", "", false
+		}
+
+		return key, strings.TrimSpace(rest[1:]), true
+	}
+
+	if text[0] == '[' || text[0] == '{' || text[0] == '-' && (len(text) == 1 || text[1] == ' ') {
+		return "", "", false
+	}
+
+	i := strings.Index(text, ": ")
+	if i == -1 {
+		if strings.HasSuffix(text, ":") == false {
+			return "", "", false
+		}
+
+		i = len(text) - 1
+	}
+
+	return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+}
+
+// parseYAMLQuoted returns the value of the single or double quoted scalar and the rest of the text.
+func parseYAMLQuoted(text string) (string, string, error) {
+	if text[0] == '\'' {
+		for i := 1; i < len(text); i++ {
+			if text[i] != '\'' {
+				continue
+			}
+
+			if i+1 < len(text) && text[i+1] == '\'' {
+				i++
+				continue
+			}
+
+			return strings.Replace(text[1:i], "''", "'", -1), text[i+1:], nil
+		}
+
+		return "", "", fmt.Errorf("unterminated quoted scalar")
+	}
+
+	for i := 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := strconv.Unquote(text[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("invalid quoted scalar %s", text[:i+1])
+			}
+
+			return value, text[i+1:], nil
+		}
+	}
+
+	return "", "", fmt.Errorf("unterminated quoted scalar")
+}
+
+// parseFlow parses the flow sequence or mapping at the beginning of the text, and returns the rest of the text.
+func (p *yamlParser) parseFlow(text string) (interface{}, string, error) {
+	text = strings.TrimLeft(text, " ")
+
+	if len(text) == 0 {
+		return nil, "", fmt.Errorf("unterminated flow collection")
+	}
+
+	switch text[0] {
+	case '[':
+		result := []interface{}{}
+
+		text = strings.TrimLeft(text[1:], " ")
+		for {
+			if len(text) == 0 {
+				return nil, "", fmt.Errorf("flow collection must be in one line")
+			}
+
+			if text[0] == ']' {
+				return result, text[1:], nil
+			}
+
+			value, rest, err := p.parseFlow(text)
+			if err != nil {
+				return nil, "", err
+			}
+
+			result = append(result, value)
+
+			if text = strings.TrimLeft(rest, " "); strings.HasPrefix(text, ",") == true {
+				text = strings.TrimLeft(text[1:], " ")
+			} else if strings.HasPrefix(text, "]") == false {
+				return nil, "", fmt.Errorf("expected ',' or ']' in flow sequence")
+			}
+		}
+	case '{':
+		result := map[string]interface{}{}
+
+		text = strings.TrimLeft(text[1:], " ")
+		for {
+			if len(text) == 0 {
+				return nil, "", fmt.Errorf("flow collection must be in one line")
+			}
+
+			if text[0] == '}' {
+				return result, text[1:], nil
+			}
+
+			key, rest, err := p.parseFlow(text)
+			if err != nil {
+				return nil, "", err
+			}
+
+			name, ok := key.(string)
+			if ok == false || strings.HasPrefix(strings.TrimLeft(rest, " "), ":") == false {
+				return nil, "", fmt.Errorf("expected a key in flow mapping")
+			}
+
+			value, rest, err := p.parseFlow(strings.TrimLeft(rest, " ")[1:])
+			if err != nil {
+				return nil, "", err
+			}
+
+			result[name] = value
+
+			if text = strings.TrimLeft(rest, " "); strings.HasPrefix(text, ",") == true {
+				text = strings.TrimLeft(text[1:], " ")
+			} else if strings.HasPrefix(text, "}") == false {
+				return nil, "", fmt.Errorf("expected ',' or '}' in flow mapping")
+			}
+		}
+	case '"', '\'':
+		return parseYAMLQuoted(text)
+	}
+
+	//Plain scalars in flow collections end at the indicators
+	end := strings.IndexAny(text, ",]}")
+	if i := strings.Index(text, ": "); i >= 0 && (end == -1 || i < end) {
+		end = i
+	} else if end == -1 && strings.HasSuffix(text, ":") == true {
+		end = len(text) - 1
+	}
+
+	if end == -1 {
+		end = len(text)
+	}
+
+	value := strings.TrimSpace(text[:end])
+	if value == "~" || value == "null" || len(value) == 0 {
+		return nil, text[end:], nil
+	}
+
+	switch value[0] {
+	case '*':
+		alias, err := p.alias(value)
+		return alias, text[end:], err
+	case '&', '!':
+		return nil, "", fmt.Errorf("anchors and tags aren't supported in flow collections")
+	}
+
+	return value, text[end:], nil
+}
+
+// stripYAMLComment removes the comment at the end of the line, "#" in quoted scalars or in plain scalars isn't a
+// comment.
+func stripYAMLComment(text string) string {
+	quote := byte(0)
+
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			//Quotes start a quoted scalar only at the beginning of a value
+			if i == 0 || strings.IndexByte(" [{,:", text[i-1]) >= 0 {
+				quote = c
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' '):
+			return strings.TrimRight(text[:i], " ")
+		}
+	}
+
+	return strings.TrimRight(text, " ")
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAMLAnchors(t *testing.T) {
+	document := `
+x-common: &common
+  restart: always
+  environment: &env
+    LEVEL: info
+    MODE: prod
+x-logging: &logging
+  logging: json
+  restart: never
+services:
+  web:
+    <<: *common
+    image: web
+    environment:
+      <<: *env
+      LEVEL: debug
+  worker:
+    <<: [*common, *logging]
+    image: &image worker
+    command: [run, *image]
+  cron:
+    image: *image
+    environment: *env
+    ports:
+      - &port "80"
+      - *port
+    volumes:
+      - &data
+        source: data
+        target: /data
+      - *data
+`
+
+	value, err := ParseYAML([]byte(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]interface{}{"LEVEL": "info", "MODE": "prod"}
+	data := map[string]interface{}{"source": "data", "target": "/data"}
+
+	want := map[string]interface{}{
+		"web": map[string]interface{}{
+			"restart":     "always",
+			"image":       "web",
+			"environment": map[string]interface{}{"LEVEL": "debug", "MODE": "prod"},
+		},
+		"worker": map[string]interface{}{
+			"restart":     "always",
+			"environment": env,
+			"logging":     "json",
+			"image":       "worker",
+			"command":     []interface{}{"run", "worker"},
+		},
+		"cron": map[string]interface{}{
+			"image":       "worker",
+			"environment": env,
+			"ports":       []interface{}{"80", "80"},
+			"volumes":     []interface{}{data, data},
+		},
+	}
+
+	services := value.(map[string]interface{})["services"]
+	if reflect.DeepEqual(services, want) == false {
+		t.Errorf("services are %#v, want %#v", services, want)
+	}
+
+	//The anchored mapping isn't changed by the merge
+	if reflect.DeepEqual(value.(map[string]interface{})["x-common"].(map[string]interface{})["environment"], env) == false {
+		t.Errorf("anchor is changed: %#v", value.(map[string]interface{})["x-common"])
+	}
+}
+
+func TestParseYAMLAnchorErrors(t *testing.T) {
+	tests := []struct {
+		document, message string
+	}{
+		{"image: *unknown", "line 1: unknown alias"},
+		{"a: 1\nb:\n  <<: *x", "line 3: unknown alias"},
+		{"a: &x 1\nb:\n  <<: *x", "line 3: merge key value must be a mapping"},
+		{"a: &x [1]\nb:\n  <<: *x", "line 3: merge key value must be a mapping"},
+		{"image: !!str web", "tags aren't supported"},
+		{"ports: [&p 80]", "anchors and tags aren't supported in flow collections"},
+		{"- *", "invalid alias"},
+	}
+
+	for _, test := range tests {
+		if _, err := ParseYAML([]byte(test.document)); err == nil || strings.Contains(err.Error(), test.message) == false {
+			t.Errorf("error of %q is %v, want %q", test.document, err, test.message)
+		}
+	}
+
+	//A quoted "<<" is a plain key
+	value, err := ParseYAML([]byte("a: &x {b: 1}\nc:\n  \"<<\": *x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := value.(map[string]interface{})["c"].(map[string]interface{}); len(c) != 1 || c["<<"] == nil {
+		t.Errorf("quoted merge key is %#v", c)
+	}
+}